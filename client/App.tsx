@@ -89,7 +89,12 @@ export const App = () => {
     url: SOCKET_URL,
     onMatch: handleMatch,
     onDownloadStatus: handleDownloadStatus,
-    onTotalSongs: (count) => setTotalSongs(count)
+    onTotalSongs: (count) => setTotalSongs(count),
+    onRecognitionError: (error) => {
+      setIsProcessing(false);
+      setStatus(error.code === 'database_unavailable' ? 'Service unavailable' : `Error: ${error.message}`);
+      setTimeout(() => setStatus('Tap to identify'), 3000);
+    }
   });
 
   const { isListening, startListening, cancelRecording, mediaStream } = useAudioRecorder({
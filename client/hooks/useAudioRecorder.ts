@@ -2,6 +2,9 @@
 import { useState, useRef, useEffect } from 'react';
 import { floatTo16BitPCM, arrayBufferToBase64 } from '../utils/audioHelpers';
 
+// MIME types of recordings the server accepts as they are.
+const UPLOAD_TYPES = ['audio/webm', 'audio/ogg', 'audio/mp4', 'audio/aac'];
+
 interface UseAudioRecorderProps {
   onRecordingComplete: (payload: string) => void;
   onError: (msg: string) => void;
@@ -121,6 +124,18 @@ export const useAudioRecorder = ({ onRecordingComplete, onError }: UseAudioRecor
   const processRecording = async (blob: Blob) => {
     try {
       const arrayBuffer = await blob.arrayBuffer();
+
+      // the server decodes what MediaRecorder produces, which is far
+      // smaller than PCM; anything else is decoded here and sent as PCM
+      const baseType = blob.type.split(';')[0].trim().toLowerCase();
+      if (UPLOAD_TYPES.includes(baseType)) {
+        onRecordingComplete(JSON.stringify({
+          audio: arrayBufferToBase64(arrayBuffer),
+          mimeType: blob.type,
+        }));
+        return;
+      }
+
       const audioCtx = new (window.AudioContext || (window as any).webkitAudioContext)({
         sampleRate: 44100,
       });
@@ -1,15 +1,19 @@
 import { useEffect, useRef, useState } from 'react';
 import { getSocket } from './socket';
 import { MatchResult, DownloadStatus } from '../types';
+import { MatchesEvent, RecognitionErrorEvent, TotalSongsEvent } from '../protocol';
 
 interface UseSocketProps {
   url: string;
   onMatch: (matches: MatchResult[]) => void;
   onDownloadStatus: (data: DownloadStatus) => void;
   onTotalSongs: (count: number) => void;
+  onRecognitionError?: (error: RecognitionErrorEvent) => void;
 }
 
-export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseSocketProps) => {
+const parsePayload = <T>(data: any): T => (typeof data === 'string' ? JSON.parse(data) : data);
+
+export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs, onRecognitionError }: UseSocketProps) => {
   const [isConnected, setIsConnected] = useState(false);
   // Use ReturnType to match whatever hooks/socket.ts exports (likely Socket)
   const socketRef = useRef<ReturnType<typeof getSocket> | null>(null);
@@ -17,12 +21,14 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
   const onMatchRef = useRef(onMatch);
   const onDownloadStatusRef = useRef(onDownloadStatus);
   const onTotalSongsRef = useRef(onTotalSongs);
+  const onRecognitionErrorRef = useRef(onRecognitionError);
 
   useEffect(() => {
     onMatchRef.current = onMatch;
     onDownloadStatusRef.current = onDownloadStatus;
     onTotalSongsRef.current = onTotalSongs;
-  }, [onMatch, onDownloadStatus, onTotalSongs]);
+    onRecognitionErrorRef.current = onRecognitionError;
+  }, [onMatch, onDownloadStatus, onTotalSongs, onRecognitionError]);
 
   useEffect(() => {
     const socket = getSocket(url);
@@ -42,13 +48,16 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
     };
 
     const handleMatches = (data: any) => {
-      // Backend sends a JSON string, need to parse it
+      // Older servers sent a bare array; current ones send a MatchesEvent
       let parsed: MatchResult[] = [];
       try {
-        if (typeof data === 'string') {
-          parsed = JSON.parse(data);
+        const payload = parsePayload<MatchesEvent | MatchResult[]>(data);
+        if (Array.isArray(payload)) {
+          parsed = payload;
+        } else if (!payload.final) {
+          return; // provisional stream result
         } else {
-          parsed = data;
+          parsed = payload.matches;
         }
       } catch (err) {
         console.error('Error parsing matches:', err);
@@ -56,6 +65,14 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
       onMatchRef.current?.(parsed);
     };
 
+    const handleRecognitionError = (data: any) => {
+      try {
+        onRecognitionErrorRef.current?.(parsePayload<RecognitionErrorEvent>(data));
+      } catch (err) {
+        console.error('Error parsing recognition error:', err);
+      }
+    };
+
     const handleDownloadStatus = (data: any) => {
       // Backend sends a JSON string
       let parsed: DownloadStatus;
@@ -73,6 +90,15 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
     };
 
     const handleTotalSongs = (data: any) => {
+      if (typeof data === 'object' && data !== null) {
+        const event = data as TotalSongsEvent;
+        if (event.error) {
+          console.error('Failed to get total songs:', event.error.message);
+          return;
+        }
+        onTotalSongsRef.current?.(event.total);
+        return;
+      }
       const count = typeof data === 'number' ? data : parseInt(data, 10);
       if (!isNaN(count)) {
         onTotalSongsRef.current?.(count);
@@ -84,6 +110,7 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
     socket.on('matches', handleMatches);
     socket.on('downloadStatus', handleDownloadStatus);
     socket.on('totalSongs', handleTotalSongs);
+    socket.on('recognitionError', handleRecognitionError);
 
     // Initial check
     if (socket.connected) {
@@ -106,6 +133,7 @@ export const useSocket = ({ url, onMatch, onDownloadStatus, onTotalSongs }: UseS
       socket.off('matches', handleMatches);
       socket.off('downloadStatus', handleDownloadStatus);
       socket.off('totalSongs', handleTotalSongs);
+      socket.off('recognitionError', handleRecognitionError);
     };
   }, [url]);
 
@@ -0,0 +1,151 @@
+// Code generated by `go run . protocol-types`; DO NOT EDIT.
+// Source: shazoom/protocol/events.go
+
+export type ErrorCode = 'database_unavailable' | 'invalid_payload' | 'decode_failed' | 'fingerprint_failed' | 'match_failed' | 'no_active_stream' | 'fingerprint_config_mismatch' | 'rate_limited' | 'internal';
+
+export type Stage = 'received' | 'decoding' | 'fingerprinting' | 'matching' | 'done';
+
+export type StatusType = 'info' | 'success' | 'error';
+
+export type TrackStatus = 'queued' | 'searching' | 'downloading' | 'fingerprinting' | 'done' | 'skipped' | 'failed';
+
+export interface TotalSongsRequest {
+  requestId?: string;
+}
+
+export interface NewDownloadRequest {
+  requestId?: string;
+  url: string;
+}
+
+export interface NewRecordingRequest {
+  requestId?: string;
+  audio: string;
+  mimeType?: string;
+  sampleRate?: number;
+  channels?: number;
+  sampleSize?: number;
+}
+
+export interface StartStreamRequest {
+  requestId?: string;
+  sampleRate: number;
+  channels: number;
+}
+
+export interface StreamChunkRequest {
+  requestId?: string;
+  audio: string;
+}
+
+export interface StopStreamRequest {
+  requestId?: string;
+}
+
+export interface SubmitFingerprintsRequest {
+  requestId?: string;
+  config: FingerprintConfig;
+  hashes: FingerprintHash[];
+}
+
+export interface FingerprintConfig {
+  version: number;
+  sampleRate: number;
+  windowSize: number;
+  hopSize: number;
+  targetZoneSize: number;
+}
+
+export interface FingerprintHash {
+  address: number;
+  anchorTime: number;
+}
+
+export interface MatchesEvent {
+  requestId?: string;
+  matches: Match[];
+  final: boolean;
+}
+
+export interface Match {
+  SongId: number;
+  SongTitle: string;
+  SongArtist: string;
+  YouTubeID: string;
+  Timestamp: number;
+  Score: number;
+}
+
+export interface TotalSongsEvent {
+  requestId?: string;
+  total: number;
+  error?: ErrorBody;
+}
+
+export interface ErrorBody {
+  code: ErrorCode;
+  message: string;
+}
+
+export interface DownloadStatusEvent {
+  requestId?: string;
+  jobId?: string;
+  type: StatusType;
+  message: string;
+  track?: DownloadTrack;
+  report?: DownloadReport;
+  error?: ErrorBody;
+}
+
+export interface DownloadTrack {
+  index: number;
+  title: string;
+  artist: string;
+  status: TrackStatus;
+  code?: string;
+  reason?: string;
+}
+
+export interface DownloadReport {
+  saved: number;
+  skipped: number;
+  failed: number;
+  tracks: DownloadTrack[];
+}
+
+export interface StreamEndedEvent {
+  requestId?: string;
+  reason: string;
+  confident: boolean;
+  durationMs: number;
+}
+
+export interface RecognitionProgressEvent {
+  requestId?: string;
+  stage: Stage;
+}
+
+export interface RecognitionErrorEvent {
+  requestId?: string;
+  code: ErrorCode;
+  message: string;
+}
+
+export interface ClientEvents {
+  totalSongs: TotalSongsRequest;
+  newDownload: NewDownloadRequest;
+  newRecording: NewRecordingRequest;
+  startStream: StartStreamRequest;
+  streamChunk: StreamChunkRequest;
+  stopStream: StopStreamRequest;
+  submitFingerprints: SubmitFingerprintsRequest;
+}
+
+export interface ServerEvents {
+  matches: MatchesEvent;
+  totalSongs: TotalSongsEvent;
+  downloadStatus: DownloadStatusEvent;
+  streamEnded: StreamEndedEvent;
+  recognitionProgress: RecognitionProgressEvent;
+  recognitionError: RecognitionErrorEvent;
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"shazoom/core"
+	"shazoom/db"
+	"shazoom/jobs"
+	"shazoom/monitor"
+	"shazoom/spotify"
+	"shazoom/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRecognizeUpload = 50 << 20
+	maxIngestUpload    = 200 << 20
+	defaultSongsLimit  = 50
+	maxSongsLimit      = 500
+)
+
+// API error codes, returned in the "code" field of every error body.
+const (
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeUnsupportedMedia    = "unsupported_media"
+	errCodePayloadTooLarge     = "payload_too_large"
+	errCodeNotFound            = "not_found"
+	errCodeConflict            = "conflict"
+	errCodeDatabaseUnavailable = "database_unavailable"
+	errCodeProcessingFailed    = "processing_failed"
+	errCodeInternal            = "internal"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiSong struct {
+	ID        uint32 `json:"id"`
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	YouTubeID string `json:"youtubeId,omitempty"`
+	Source    string `json:"source,omitempty"`
+	SourceID  string `json:"sourceId,omitempty"`
+}
+
+type apiMatch struct {
+	SongID      uint32  `json:"songId"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	YouTubeID   string  `json:"youtubeId,omitempty"`
+	TimestampMs uint32  `json:"timestampMs"`
+	Score       float64 `json:"score"`
+}
+
+type apiRecognizeResponse struct {
+	Matches  []apiMatch `json:"matches"`
+	SearchMs int64      `json:"searchMs"`
+}
+
+type apiSongsResponse struct {
+	Songs []apiSong `json:"songs"`
+	Total int       `json:"total"`
+	Limit int       `json:"limit"`
+	// NextAfter is the after parameter of the next page, absent on the last.
+	NextAfter *uint32 `json:"nextAfter,omitempty"`
+}
+
+type apiIngestRequest struct {
+	URL string `json:"url"`
+}
+
+type apiIngestResponse struct {
+	Processed int      `json:"processed"`
+	Song      *apiSong `json:"song,omitempty"`
+	// Job is the download queued for a URL, to be followed on /api/jobs.
+	Job *jobs.Job `json:"job,omitempty"`
+}
+
+func toAPISong(song db.Song) apiSong {
+	return apiSong{
+		ID:        song.ID,
+		Title:     song.Title,
+		Artist:    song.Artist,
+		YouTubeID: song.YouTubeID,
+		Source:    song.Source,
+		SourceID:  song.SourceID,
+	}
+}
+
+func toAPIMatches(matches []core.Match) []apiMatch {
+	out := make([]apiMatch, 0, len(matches))
+	for _, m := range matches {
+		out = append(out, apiMatch{
+			SongID:      m.SongId,
+			Title:       m.SongTitle,
+			Artist:      m.SongArtist,
+			YouTubeID:   m.YoutubeID,
+			TimestampMs: m.Timestamp,
+			Score:       m.Score,
+		})
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorBody{Error: apiError{Code: code, Message: message}})
+}
+
+// registerAPI mounts the JSON endpoints next to the Socket.IO handler.
+// downloads queues the URLs given to /api/ingest, and is nil when download
+// jobs are disabled.
+func registerAPI(mux *http.ServeMux, dbClient db.DBClient, downloads *jobs.Manager) {
+	mux.HandleFunc("POST /api/recognize", withDB(dbClient, handleRecognize))
+	mux.HandleFunc("GET /api/songs", withDB(dbClient, handleListSongs))
+	mux.HandleFunc("GET /api/songs/{id}", withDB(dbClient, handleGetSong))
+	mux.HandleFunc("POST /api/ingest", withDB(dbClient, func(w http.ResponseWriter, r *http.Request, dbClient db.DBClient) {
+		handleIngest(w, r, dbClient, downloads)
+	}))
+}
+
+// withDB answers 503 instead of calling h when the server runs without a database.
+func withDB(dbClient db.DBClient, h func(http.ResponseWriter, *http.Request, db.DBClient)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dbClient == nil {
+			writeError(w, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, "the server is running without a database connection")
+			return
+		}
+		h(w, r, dbClient)
+	}
+}
+
+func handleRecognize(w http.ResponseWriter, r *http.Request, dbClient db.DBClient) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRecognizeUpload)
+
+	tmpDir, err := os.MkdirTemp("", "shazoom-recognize-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to stage upload")
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	audioPath, _, ok := saveUpload(w, r, tmpDir)
+	if !ok {
+		return
+	}
+
+	matches, searchDuration, err := recognizeFile(r.Context(), audioPath, dbClient)
+	if err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "recognition failed", slog.Any("error", err))
+		writeError(w, http.StatusUnprocessableEntity, errCodeProcessingFailed, err.Error())
+		return
+	}
+
+	if len(matches) > 10 {
+		matches = matches[:10]
+	}
+
+	writeJSON(w, http.StatusOK, apiRecognizeResponse{
+		Matches:  toAPIMatches(matches),
+		SearchMs: searchDuration.Milliseconds(),
+	})
+}
+
+// saveUpload writes the request audio into dir. It accepts multipart forms
+// (the "audio" file field, plus any other form values) or a raw body. On
+// failure it has already written the error response.
+func saveUpload(w http.ResponseWriter, r *http.Request, dir string) (string, map[string]string, bool) {
+	fields := map[string]string{}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var src io.Reader
+	name := "upload"
+
+	switch {
+	case mediaType == "multipart/form-data":
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeUploadError(w, err)
+			return "", nil, false
+		}
+		for key, values := range r.MultipartForm.Value {
+			if len(values) > 0 {
+				fields[key] = values[0]
+			}
+		}
+
+		file, header, err := r.FormFile("audio")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "multipart body needs an \"audio\" file field")
+			return "", nil, false
+		}
+		defer file.Close()
+		src = file
+		name += filepath.Ext(header.Filename)
+
+	case strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"),
+		mediaType == "application/octet-stream", mediaType == "":
+		src = r.Body
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia,
+			fmt.Sprintf("unsupported content type %q", mediaType))
+		return "", nil, false
+	}
+
+	path := filepath.Join(dir, name)
+	dst, err := os.Create(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to stage upload")
+		return "", nil, false
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		writeUploadError(w, err)
+		return "", nil, false
+	}
+	if n == 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "empty audio upload")
+		return "", nil, false
+	}
+
+	return path, fields, true
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge,
+			fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+}
+
+func handleListSongs(w http.ResponseWriter, r *http.Request, dbClient db.DBClient) {
+	var after uint64
+	if val := r.URL.Query().Get("after"); val != "" {
+		var err error
+		if after, err = strconv.ParseUint(val, 10, 32); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "after must be a song id")
+			return
+		}
+	}
+	limit, err := queryInt(r, "limit", defaultSongsLimit)
+	if err != nil || limit < 1 || limit > maxSongsLimit {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxSongsLimit))
+		return
+	}
+
+	// one extra song tells whether there is a next page
+	songs, err := dbClient.ListSongs(uint32(after), limit+1)
+	if err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "failed to list songs", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list songs")
+		return
+	}
+	total, err := dbClient.TotalSongs()
+	if err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "failed to count songs", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list songs")
+		return
+	}
+
+	resp := apiSongsResponse{Songs: []apiSong{}, Total: total, Limit: limit}
+	if len(songs) > limit {
+		songs = songs[:limit]
+		next := songs[limit-1].ID
+		resp.NextAfter = &next
+	}
+	for _, song := range songs {
+		resp.Songs = append(resp.Songs, toAPISong(song))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	val := r.URL.Query().Get(key)
+	if val == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(val)
+}
+
+func handleGetSong(w http.ResponseWriter, r *http.Request, dbClient db.DBClient) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "song id must be an unsigned 32-bit integer")
+		return
+	}
+
+	song, exists, err := dbClient.GetSongByID(uint32(id))
+	if err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "failed to get song", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to get song")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("song %d not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toAPISong(song))
+}
+
+// handleIngest accepts either a JSON {"url": "<spotify url>"} body, or a
+// multipart upload with an "audio" file plus "title" and "artist" fields.
+// An upload is saved right away. A URL, which can stand for a whole album or
+// playlist, is queued as a download job instead and answered with 202 and the
+// job, as POST /api/jobs does.
+func handleIngest(w http.ResponseWriter, r *http.Request, dbClient db.DBClient, downloads *jobs.Manager) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "application/json" {
+		var req apiIngestRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || req.URL == "" {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "body must be {\"url\": \"<spotify url>\"}")
+			return
+		}
+		if downloads == nil {
+			writeError(w, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, "download jobs are disabled")
+			return
+		}
+
+		job, err := downloads.Enqueue(req.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, apiIngestResponse{Job: &job})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIngestUpload)
+
+	tmpDir, err := os.MkdirTemp("", "shazoom-ingest-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to stage upload")
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	audioPath, fields, ok := saveUpload(w, r, tmpDir)
+	if !ok {
+		return
+	}
+
+	title, artist := fields["title"], fields["artist"]
+	if title == "" || artist == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "uploads need \"title\" and \"artist\" fields")
+		return
+	}
+
+	key := utils.GenerateSongKey(title, artist)
+	if _, exists, err := dbClient.GetSongByKey(key); err == nil && exists {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("'%s' by '%s' already exists", title, artist))
+		return
+	}
+
+	source, sourceID := db.SourceUpload, ""
+	if ytID := fields["youtubeId"]; ytID != "" {
+		source, sourceID = db.SourceYouTube, ytID
+	}
+	if err := spotify.ProcessAndSaveSongFromSource(audioPath, title, artist, source, sourceID, dbClient); err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "ingest upload failed", slog.Any("error", err))
+		writeError(w, http.StatusUnprocessableEntity, errCodeProcessingFailed, err.Error())
+		return
+	}
+
+	resp := apiIngestResponse{Processed: 1}
+	if song, exists, err := dbClient.GetSongByKey(key); err == nil && exists {
+		s := toAPISong(song)
+		resp.Song = &s
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+type apiJobsResponse struct {
+	Jobs []jobs.Job `json:"jobs"`
+}
+
+// registerJobsAPI mounts the download job endpoints. downloads is nil when the
+// server runs without a database.
+func registerJobsAPI(mux *http.ServeMux, downloads *jobs.Manager) {
+	withJobs := func(h func(http.ResponseWriter, *http.Request, *jobs.Manager)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if downloads == nil {
+				writeError(w, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, "download jobs need a database connection")
+				return
+			}
+			h(w, r, downloads)
+		}
+	}
+
+	mux.HandleFunc("GET /api/jobs", withJobs(handleListJobs))
+	mux.HandleFunc("POST /api/jobs", withJobs(handleCreateJob))
+	mux.HandleFunc("GET /api/jobs/{id}", withJobs(handleGetJob))
+	mux.HandleFunc("POST /api/jobs/{id}/cancel", withJobs(handleCancelJob))
+	mux.HandleFunc("POST /api/jobs/{id}/retry", withJobs(handleRetryJob))
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request, downloads *jobs.Manager) {
+	writeJSON(w, http.StatusOK, apiJobsResponse{Jobs: downloads.List()})
+}
+
+func handleCreateJob(w http.ResponseWriter, r *http.Request, downloads *jobs.Manager) {
+	var req apiIngestRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || req.URL == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "body must be {\"url\": \"<spotify url>\"}")
+		return
+	}
+
+	job, err := downloads.Enqueue(req.URL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request, downloads *jobs.Manager) {
+	job, err := downloads.Get(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request, downloads *jobs.Manager) {
+	job, err := downloads.Cancel(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func handleRetryJob(w http.ResponseWriter, r *http.Request, downloads *jobs.Manager) {
+	job, err := downloads.Retry(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+	case errors.Is(err, jobs.ErrFinished), errors.Is(err, jobs.ErrNotRetryable):
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+	}
+}
+
+type apiPlay struct {
+	ID         int64     `json:"id"`
+	Source     string    `json:"source"`
+	SongID     uint32    `json:"songId"`
+	Title      string    `json:"title"`
+	Artist     string    `json:"artist"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	Score      float64   `json:"score"`
+	Detections int       `json:"detections"`
+}
+
+type apiPlaysResponse struct {
+	Plays []apiPlay `json:"plays"`
+}
+
+type apiMonitorSource struct {
+	Source     string   `json:"source"`
+	Connected  bool     `json:"connected"`
+	ListenedMs int64    `json:"listenedMs"`
+	NowPlaying *apiPlay `json:"nowPlaying,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type apiMonitorResponse struct {
+	Sources []apiMonitorSource `json:"sources"`
+}
+
+func toAPIPlay(play db.Play) apiPlay {
+	return apiPlay{
+		ID:         play.ID,
+		Source:     play.Source,
+		SongID:     play.SongID,
+		Title:      play.Title,
+		Artist:     play.Artist,
+		StartedAt:  play.StartedAt,
+		EndedAt:    play.EndedAt,
+		Score:      play.Score,
+		Detections: play.Detections,
+	}
+}
+
+// registerMonitorAPI mounts the play log endpoints. plays is nil when the
+// play log could not be opened, and mon when the server monitors no sources.
+func registerMonitorAPI(mux *http.ServeMux, plays db.PlayLog, mon *monitor.Monitor) {
+	mux.HandleFunc("GET /api/plays", func(w http.ResponseWriter, r *http.Request) {
+		if plays == nil {
+			writeError(w, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, "the play log is unavailable")
+			return
+		}
+		handleListPlays(w, r, plays)
+	})
+	mux.HandleFunc("GET /api/monitor", func(w http.ResponseWriter, r *http.Request) {
+		handleMonitorStatus(w, r, mon)
+	})
+}
+
+func handleListPlays(w http.ResponseWriter, r *http.Request, plays db.PlayLog) {
+	limit, err := queryInt(r, "limit", defaultSongsLimit)
+	if err != nil || limit < 1 || limit > maxSongsLimit {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxSongsLimit))
+		return
+	}
+	filter := db.PlayFilter{Source: r.URL.Query().Get("source"), Limit: limit}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "since must be an RFC 3339 time")
+			return
+		}
+	}
+
+	listed, err := plays.ListPlays(filter)
+	if err != nil {
+		utils.GetLogger().ErrorContext(r.Context(), "failed to list plays", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list plays")
+		return
+	}
+
+	resp := apiPlaysResponse{Plays: make([]apiPlay, 0, len(listed))}
+	for _, play := range listed {
+		resp.Plays = append(resp.Plays, toAPIPlay(play))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleMonitorStatus lists no sources when the server monitors none.
+func handleMonitorStatus(w http.ResponseWriter, r *http.Request, mon *monitor.Monitor) {
+	resp := apiMonitorResponse{Sources: []apiMonitorSource{}}
+	if mon == nil {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	for _, status := range mon.Status() {
+		source := apiMonitorSource{
+			Source:     status.Source,
+			Connected:  status.Connected,
+			ListenedMs: status.Listened.Milliseconds(),
+			Error:      status.Error,
+		}
+		if status.NowPlaying != nil {
+			play := toAPIPlay(*status.NowPlaying)
+			source.NowPlaying = &play
+		}
+		resp.Sources = append(resp.Sources, source)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/jobs"
+	"shazoom/spotify"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCatalogue serves the song lookups of the REST API from a slice; the
+// embedded nil DBClient panics on anything else.
+type fakeCatalogue struct {
+	db.DBClient
+	songs []db.Song
+	err   error
+}
+
+func (f *fakeCatalogue) ListSongs(afterID uint32, limit int) ([]db.Song, error) {
+	var songs []db.Song
+	for _, song := range f.songs {
+		if song.ID > afterID && len(songs) < limit {
+			songs = append(songs, song)
+		}
+	}
+	return songs, f.err
+}
+
+func (f *fakeCatalogue) TotalSongs() (int, error) { return len(f.songs), f.err }
+
+func (f *fakeCatalogue) GetSongByID(id uint32) (db.Song, bool, error) {
+	for _, song := range f.songs {
+		if song.ID == id {
+			return song, true, f.err
+		}
+	}
+	return db.Song{}, false, f.err
+}
+
+func newCatalogue(n int) *fakeCatalogue {
+	c := &fakeCatalogue{}
+	for i := 1; i <= n; i++ {
+		c.songs = append(c.songs, db.Song{ID: uint32(i * 10), Title: fmt.Sprintf("Song %d", i), Artist: "Band"})
+	}
+	return c
+}
+
+func apiServer(dbClient db.DBClient) *http.ServeMux {
+	mux := http.NewServeMux()
+	registerAPI(mux, dbClient, nil)
+	return mux
+}
+
+// call sends req to mux and decodes the JSON response into body.
+func call(t *testing.T, mux http.Handler, req *http.Request, wantStatus int, body any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != wantStatus {
+		t.Fatalf("%s %s: status %d, want %d (%s)", req.Method, req.URL, rec.Code, wantStatus, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s: content type %q", req.Method, req.URL, ct)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(body); err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+}
+
+func expectError(t *testing.T, mux http.Handler, req *http.Request, wantStatus int, wantCode string) {
+	t.Helper()
+	var body apiErrorBody
+	call(t, mux, req, wantStatus, &body)
+	if body.Error.Code != wantCode || body.Error.Message == "" {
+		t.Fatalf("%s %s: error %+v, want code %q", req.Method, req.URL, body.Error, wantCode)
+	}
+}
+
+func TestListSongsPages(t *testing.T) {
+	mux := apiServer(newCatalogue(5))
+
+	var titles []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging did not end")
+		}
+		var page apiSongsResponse
+		call(t, mux, httptest.NewRequest("GET", "/api/songs?limit=2"+after, nil), http.StatusOK, &page)
+		if page.Total != 5 || page.Limit != 2 || len(page.Songs) > 2 {
+			t.Fatalf("page %+v", page)
+		}
+		for _, song := range page.Songs {
+			titles = append(titles, song.Title)
+		}
+		if page.NextAfter == nil {
+			break
+		}
+		after = fmt.Sprintf("&after=%d", *page.NextAfter)
+	}
+
+	if strings.Join(titles, ",") != "Song 1,Song 2,Song 3,Song 4,Song 5" {
+		t.Fatalf("listed %v", titles)
+	}
+
+	var empty apiSongsResponse
+	call(t, apiServer(newCatalogue(0)), httptest.NewRequest("GET", "/api/songs", nil), http.StatusOK, &empty)
+	if empty.Songs == nil || len(empty.Songs) != 0 || empty.NextAfter != nil || empty.Limit != defaultSongsLimit {
+		t.Fatalf("empty catalogue %+v", empty)
+	}
+}
+
+func TestListSongsErrors(t *testing.T) {
+	mux := apiServer(newCatalogue(3))
+	for _, query := range []string{"limit=0", "limit=501", "limit=ten", "after=-1", "after=song"} {
+		expectError(t, mux, httptest.NewRequest("GET", "/api/songs?"+query, nil), http.StatusBadRequest, errCodeInvalidRequest)
+	}
+
+	failing := &fakeCatalogue{err: errors.New("connection reset")}
+	expectError(t, apiServer(failing), httptest.NewRequest("GET", "/api/songs", nil), http.StatusInternalServerError, errCodeInternal)
+
+	expectError(t, apiServer(nil), httptest.NewRequest("GET", "/api/songs", nil), http.StatusServiceUnavailable, errCodeDatabaseUnavailable)
+}
+
+func TestGetSong(t *testing.T) {
+	mux := apiServer(newCatalogue(3))
+
+	var song apiSong
+	call(t, mux, httptest.NewRequest("GET", "/api/songs/20", nil), http.StatusOK, &song)
+	if song.ID != 20 || song.Title != "Song 2" {
+		t.Fatalf("song %+v", song)
+	}
+
+	expectError(t, mux, httptest.NewRequest("GET", "/api/songs/21", nil), http.StatusNotFound, errCodeNotFound)
+	expectError(t, mux, httptest.NewRequest("GET", "/api/songs/x", nil), http.StatusBadRequest, errCodeInvalidRequest)
+	expectError(t, mux, httptest.NewRequest("GET", "/api/songs/4294967296", nil), http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestRecognizeRejectsBadUploads(t *testing.T) {
+	mux := apiServer(newCatalogue(1))
+
+	req := httptest.NewRequest("POST", "/api/recognize", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	expectError(t, mux, req, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia)
+
+	req = httptest.NewRequest("POST", "/api/recognize", strings.NewReader(""))
+	req.Header.Set("Content-Type", "audio/wav")
+	expectError(t, mux, req, http.StatusBadRequest, errCodeInvalidRequest)
+
+	req = httptest.NewRequest("POST", "/api/recognize", strings.NewReader("--x--\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	expectError(t, mux, req, http.StatusBadRequest, errCodeInvalidRequest)
+
+	req = httptest.NewRequest("POST", "/api/ingest", strings.NewReader(`{"url": ""}`))
+	req.Header.Set("Content-Type", "application/json")
+	expectError(t, mux, req, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestListPlaysWithoutMonitor(t *testing.T) {
+	plays, err := db.OpenFilePlayLog(filepath.Join(t.TempDir(), "plays.ndjson"), db.FilePlayLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	for i, source := range []string{"radio1", "radio2", "radio1"} {
+		play := db.Play{
+			Source:    source,
+			Title:     fmt.Sprintf("Song %d", i+1),
+			StartedAt: start.Add(time.Duration(i) * time.Hour),
+			EndedAt:   start.Add(time.Duration(i)*time.Hour + 3*time.Minute),
+		}
+		if err := plays.RecordPlay(&play); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	registerMonitorAPI(mux, plays, nil)
+
+	var resp apiPlaysResponse
+	call(t, mux, httptest.NewRequest("GET", "/api/plays", nil), http.StatusOK, &resp)
+	if len(resp.Plays) != 3 || resp.Plays[0].Title != "Song 3" || resp.Plays[2].Title != "Song 1" {
+		t.Fatalf("plays %+v", resp.Plays)
+	}
+
+	resp = apiPlaysResponse{}
+	call(t, mux, httptest.NewRequest("GET", "/api/plays?source=radio1&limit=1", nil), http.StatusOK, &resp)
+	if len(resp.Plays) != 1 || resp.Plays[0].Title != "Song 3" {
+		t.Fatalf("filtered plays %+v", resp.Plays)
+	}
+
+	resp = apiPlaysResponse{}
+	call(t, mux, httptest.NewRequest("GET", "/api/plays?since=2026-01-02T11:30:00Z", nil), http.StatusOK, &resp)
+	if len(resp.Plays) != 1 || resp.Plays[0].Title != "Song 3" {
+		t.Fatalf("plays since %+v", resp.Plays)
+	}
+
+	expectError(t, mux, httptest.NewRequest("GET", "/api/plays?limit=0", nil), http.StatusBadRequest, errCodeInvalidRequest)
+	expectError(t, mux, httptest.NewRequest("GET", "/api/plays?since=yesterday", nil), http.StatusBadRequest, errCodeInvalidRequest)
+
+	// no monitored sources is not an error
+	var status apiMonitorResponse
+	call(t, mux, httptest.NewRequest("GET", "/api/monitor", nil), http.StatusOK, &status)
+	if status.Sources == nil || len(status.Sources) != 0 {
+		t.Fatalf("status %+v", status)
+	}
+
+	unavailable := http.NewServeMux()
+	registerMonitorAPI(unavailable, nil, nil)
+	expectError(t, unavailable, httptest.NewRequest("GET", "/api/plays", nil), http.StatusServiceUnavailable, errCodeDatabaseUnavailable)
+}
+
+// idleDownloader is never run: queued jobs stay queued.
+type idleDownloader struct{}
+
+func (idleDownloader) Resolve(context.Context, string) ([]spotify.Track, error) { return nil, nil }
+
+func (idleDownloader) Download(context.Context, []spotify.Track, func(spotify.TrackUpdate)) (*spotify.DownloadReport, error) {
+	return &spotify.DownloadReport{}, nil
+}
+
+func TestIngestURLQueuesJob(t *testing.T) {
+	downloads, err := jobs.NewManager(jobs.NewFileStore(filepath.Join(t.TempDir(), "jobs.json")), idleDownloader{}, jobs.ManagerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerAPI(mux, newCatalogue(1), downloads)
+
+	url := "https://open.spotify.com/album/abc"
+	req := httptest.NewRequest("POST", "/api/ingest", strings.NewReader(`{"url": "`+url+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	var resp apiIngestResponse
+	call(t, mux, req, http.StatusAccepted, &resp)
+	if resp.Job == nil || resp.Job.URL != url || resp.Job.Status != jobs.StatusQueued {
+		t.Fatalf("response %+v", resp)
+	}
+	if job, err := downloads.Get(resp.Job.ID); err != nil || job.URL != url {
+		t.Fatalf("job %+v, %v", job, err)
+	}
+
+	// without download jobs a URL cannot be taken
+	req = httptest.NewRequest("POST", "/api/ingest", strings.NewReader(`{"url": "`+url+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	expectError(t, apiServer(newCatalogue(1)), req, http.StatusServiceUnavailable, errCodeDatabaseUnavailable)
+}
@@ -0,0 +1,91 @@
+// Package capture records live audio for recognition. A device is either an
+// input of the sound card, read through portaudio, or a file replayed in real
+// time as a stand-in for one:
+//
+//	default         the default input device
+//	<name>          the first input device whose name contains <name>
+//	file:<path>     the audio of <path>, paced like a live recording
+//
+// Sound card input needs a build with the portaudio tag, which links the
+// portaudio C library:
+//
+//	go build -tags portaudio
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"shazoom/core"
+	"strings"
+	"time"
+)
+
+// Source is mono audio in [-1, 1] arriving at its sample rate.
+type Source interface {
+	SampleRate() int
+	// Read fills dst with the next samples as they are recorded, and
+	// returns io.EOF once the source has ended.
+	Read(dst []float64) (int, error)
+	Close() error
+}
+
+// ErrNoPortAudio is returned for sound card devices by builds without the
+// portaudio tag.
+var ErrNoPortAudio = errors.New("built without portaudio; rebuild with -tags portaudio or use file:<path>")
+
+const filePrefix = "file:"
+
+// Open opens the device named as described in the package documentation.
+func Open(device string) (Source, error) {
+	if path, ok := strings.CutPrefix(device, filePrefix); ok {
+		return OpenFile(path, 1)
+	}
+	if device == "" {
+		device = "default"
+	}
+	return openDevice(device)
+}
+
+// chunkDuration is how much audio Listen reads at a time.
+const chunkDuration = 250 * time.Millisecond
+
+// Listen feeds src into rec until rec is done, src ends or ctx is cancelled,
+// calling progress after every rescore. The last of those results is
+// returned; when src ends or ctx is cancelled first, the audio so far is
+// scored once more by rec.Finish.
+func Listen(ctx context.Context, src Source, rec *core.StreamRecognizer, progress func(core.StreamResult)) (core.StreamResult, error) {
+	buf := make([]float64, max(1, src.SampleRate()*int(chunkDuration/time.Millisecond)/1000))
+	for ctx.Err() == nil {
+		n, err := src.Read(buf)
+		if n > 0 {
+			result, feedErr := rec.Feed(buf[:n])
+			if feedErr != nil {
+				return core.StreamResult{}, feedErr
+			}
+			if result != nil {
+				if progress != nil {
+					progress(*result)
+				}
+				if result.Done {
+					return *result, nil
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return core.StreamResult{}, err
+		}
+	}
+
+	result, err := rec.Finish()
+	if err != nil {
+		return core.StreamResult{}, err
+	}
+	if progress != nil {
+		progress(result)
+	}
+	return result, nil
+}
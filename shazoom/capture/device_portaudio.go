@@ -0,0 +1,116 @@
+//go:build portaudio
+
+package capture
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// framesPerBuffer is how much audio one blocking portaudio read returns.
+const framesPerBuffer = 1024
+
+// deviceSource reads mono float32 samples from a sound card input.
+type deviceSource struct {
+	stream     *portaudio.Stream
+	sampleRate int
+	buf        []float32
+	pos        int
+}
+
+func openDevice(name string) (Source, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("cannot initialize portaudio: %w", err)
+	}
+
+	device, err := findDevice(name)
+	if err != nil {
+		portaudio.Terminate()
+		return nil, err
+	}
+
+	src := &deviceSource{
+		sampleRate: int(device.DefaultSampleRate),
+		buf:        make([]float32, framesPerBuffer),
+	}
+	src.pos = len(src.buf)
+
+	params := portaudio.HighLatencyParameters(device, nil)
+	params.Input.Channels = 1
+	params.FramesPerBuffer = framesPerBuffer
+	src.stream, err = portaudio.OpenStream(params, src.buf)
+	if err != nil {
+		portaudio.Terminate()
+		return nil, fmt.Errorf("cannot open %s: %w", device.Name, err)
+	}
+	if err := src.stream.Start(); err != nil {
+		src.stream.Close()
+		portaudio.Terminate()
+		return nil, fmt.Errorf("cannot start %s: %w", device.Name, err)
+	}
+	return src, nil
+}
+
+// findDevice returns the default input for "default", and otherwise the
+// first input whose name contains name, ignoring case.
+func findDevice(name string) (*portaudio.DeviceInfo, error) {
+	if name == "default" {
+		device, err := portaudio.DefaultInputDevice()
+		if err != nil {
+			return nil, fmt.Errorf("no default input device: %w", err)
+		}
+		return device, nil
+	}
+
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var inputs []string
+	for _, device := range devices {
+		if device.MaxInputChannels < 1 {
+			continue
+		}
+		if strings.Contains(strings.ToLower(device.Name), strings.ToLower(name)) {
+			return device, nil
+		}
+		inputs = append(inputs, device.Name)
+	}
+	return nil, fmt.Errorf("no input device matches %q; inputs are: %s", name, strings.Join(inputs, ", "))
+}
+
+func (d *deviceSource) SampleRate() int { return d.sampleRate }
+
+func (d *deviceSource) Read(dst []float64) (int, error) {
+	if d.pos == len(d.buf) {
+		// an overflow only means samples were dropped, which recognition
+		// tolerates
+		if err := d.stream.Read(); err != nil && err != portaudio.InputOverflowed {
+			return 0, err
+		}
+		d.pos = 0
+	}
+
+	n := copy64(dst, d.buf[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+func copy64(dst []float64, src []float32) int {
+	n := min(len(dst), len(src))
+	for i := range n {
+		dst[i] = float64(src[i])
+	}
+	return n
+}
+
+func (d *deviceSource) Close() error {
+	err := d.stream.Stop()
+	if closeErr := d.stream.Close(); err == nil {
+		err = closeErr
+	}
+	portaudio.Terminate()
+	return err
+}
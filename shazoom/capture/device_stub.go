@@ -0,0 +1,9 @@
+//go:build !portaudio
+
+package capture
+
+import "fmt"
+
+func openDevice(name string) (Source, error) {
+	return nil, fmt.Errorf("device %q: %w", name, ErrNoPortAudio)
+}
@@ -0,0 +1,51 @@
+package capture
+
+import (
+	"context"
+	"shazoom/fileformat"
+	"time"
+)
+
+// fileSource replays decoded audio no faster than speed times real time.
+type fileSource struct {
+	stream *fileformat.PCMStream
+	cancel context.CancelFunc
+	speed  float64
+	start  time.Time
+	read   int64
+}
+
+// OpenFile replays the audio of the file at path as a device would record
+// it, downmixed to mono at 44100 Hz. speed scales the pace, 1 being real
+// time; 0 replays as fast as the file decodes.
+func OpenFile(path string, speed float64) (Source, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := fileformat.DecodeFile(ctx, path, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &fileSource{stream: stream, cancel: cancel, speed: speed}, nil
+}
+
+func (f *fileSource) SampleRate() int { return f.stream.SampleRate }
+
+// Read waits until the samples it returns would have been recorded.
+func (f *fileSource) Read(dst []float64) (int, error) {
+	if f.start.IsZero() {
+		f.start = time.Now()
+	}
+	n, err := f.stream.ReadFrames(dst)
+	f.read += int64(n)
+
+	if f.speed > 0 {
+		due := time.Duration(float64(f.read) / float64(f.stream.SampleRate) / f.speed * float64(time.Second))
+		time.Sleep(time.Until(f.start.Add(due)))
+	}
+	return n, err
+}
+
+func (f *fileSource) Close() error {
+	defer f.cancel()
+	return f.stream.Close()
+}
@@ -1,8 +1,8 @@
 package core
 
 import (
+    "context"
     "fmt"
-    wav "shazoom/fileformat"
     "shazoom/models"
     "shazoom/utils"
 )
@@ -13,6 +13,11 @@ const (
     targetZoneSize = 5
 )
 
+// FingerprintConfigVersion identifies the spectrogram and hashing parameters.
+// Bump it whenever a change makes newly generated addresses incompatible with
+// fingerprints that are already stored.
+const FingerprintConfigVersion = 1
+
 func Fingerprint(peaks []Peak, songID uint32) map[int64]models.Couple {
     fingerprints := map[int64]models.Couple{}
     for i, anchor := range peaks {
@@ -68,36 +73,13 @@ func GenerateFingerprintsFromSamples(samples []float64, sampleRate int, songID u
     return fingerprints, nil
 }
 
+// GenerateFingerprints decodes the song at songFilePath through an ffmpeg
+// pipe and fingerprints it; no intermediate file is written.
 func GenerateFingerprints(songFilePath string, songID uint32) (map[int64]models.Couple, error) {
-    wavFilePath, err := wav.ConvertToWAV(songFilePath) 
+    fingerprints, err := FingerprintFile(context.Background(), songFilePath, songID)
     if err != nil {
-        return nil, fmt.Errorf("error converting input file to WAV: %w", err)
-    }
-
-    wavInfo, err := wav.ReadWavInfo(wavFilePath)
-    if err != nil {
-        return nil, fmt.Errorf("error reading WAV info: %w", err)
-    }
-
-    fingerprints := make(map[int64]models.Couple)
-
-    spectro, err := Spectrogram(wavInfo.LeftChannelSamples, wavInfo.SampleRate)
-    if err != nil {
-        return nil, fmt.Errorf("error creating spectrogram: %w", err)
-    }
-
-    peaks := ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate)
-    utils.ExtendMap(fingerprints, Fingerprint(peaks, songID))
-
-    if wavInfo.Channels == 2 {
-        spectro, err = Spectrogram(wavInfo.RightChannelSamples, wavInfo.SampleRate)
-        if err != nil {
-            return nil, fmt.Errorf("error creating spectrogram for right channel: %w", err)
-        }
-
-        peaks = ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate)
-        utils.ExtendMap(fingerprints, Fingerprint(peaks, songID))
+        return nil, fmt.Errorf("error fingerprinting %s: %w", songFilePath, err)
     }
 
     return fingerprints, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	wav "shazoom/fileformat"
+	"shazoom/models"
+	"shazoom/utils"
+)
+
+// FingerprintPipeline fingerprints one channel of a song as its samples are
+// pushed: low-pass, downsample, window, FFT, peak picking and hashing run on
+// a sliding window of windowSize downsampled samples, so memory does not
+// grow with the length of the song.
+//
+// The result is identical to GenerateFingerprintsFromSamples over the same
+// samples when the total sample count is known up front: peak times there are
+// spread over the whole duration. When it is not, frames are timed by the hop
+// size as in StreamFingerprinter, so that peaks can still be hashed as soon as
+// they are found; anchor times then drift from a batch run by a fraction of a
+// percent.
+type FingerprintPipeline struct {
+	songID         uint32
+	sampleRate     int
+	total          int64
+	pushed         int64
+	ratio          int
+	alpha          float64
+	freqResolution float64
+	window         []float64
+
+	prevOutput float64
+	groupSum   float64
+	groupCount int
+	buf        []float64
+	frameIdx   int
+
+	frameDuration float64
+	recent        []Peak
+	fingerprints  map[int64]models.Couple
+}
+
+// NewFingerprintPipeline starts a pipeline for samples at sampleRate.
+// totalSamples is the number of samples that will be pushed, or -1 if
+// unknown.
+func NewFingerprintPipeline(sampleRate int, totalSamples int64, songID uint32) (*FingerprintPipeline, error) {
+	targetRate := sampleRate / dspRatio
+	if sampleRate <= 0 || targetRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+
+	// the same expressions as LowPassFilter and ExtractPeaks, so that the
+	// floating point results match bit for bit
+	rc := 1.0 / (2 * math.Pi * maxFreq)
+	dt := 1.0 / float64(sampleRate)
+	effectiveSampleRate := float64(sampleRate) / float64(dspRatio)
+
+	p := &FingerprintPipeline{
+		songID:         songID,
+		sampleRate:     sampleRate,
+		total:          totalSamples,
+		ratio:          sampleRate / targetRate,
+		alpha:          dt / (rc + dt),
+		freqResolution: effectiveSampleRate / float64(windowSize),
+		window:         analysisWindow(),
+		buf:            make([]float64, 0, 2*windowSize),
+		fingerprints:   make(map[int64]models.Couple),
+	}
+	if totalSamples >= 0 {
+		p.frameDuration = p.durationPerFrame(totalSamples)
+	} else {
+		p.frameDuration = float64(hopSize*p.ratio) / float64(sampleRate)
+	}
+	return p, nil
+}
+
+// durationPerFrame is the frame duration ExtractPeaks derives for a song of
+// n samples.
+func (p *FingerprintPipeline) durationPerFrame(n int64) float64 {
+	downsampled := (n + int64(p.ratio) - 1) / int64(p.ratio)
+	if downsampled < windowSize {
+		return 0
+	}
+	frames := (downsampled-windowSize)/hopSize + 1
+	audioDuration := float64(n) / float64(p.sampleRate)
+	return audioDuration / float64(frames)
+}
+
+// Push feeds the next samples of the channel.
+func (p *FingerprintPipeline) Push(samples []float64) {
+	for _, x := range samples {
+		if p.pushed == 0 {
+			p.prevOutput = x * p.alpha
+		} else {
+			p.prevOutput = p.alpha*x + (1-p.alpha)*p.prevOutput
+		}
+		p.pushed++
+
+		p.groupSum += p.prevOutput
+		p.groupCount++
+		if p.groupCount == p.ratio {
+			p.emitDownsampled()
+		}
+	}
+}
+
+func (p *FingerprintPipeline) emitDownsampled() {
+	p.buf = append(p.buf, p.groupSum/float64(p.groupCount))
+	p.groupSum, p.groupCount = 0, 0
+
+	if len(p.buf) < windowSize {
+		return
+	}
+
+	frame := frameMagnitudes(p.buf[:windowSize], p.window)
+	for _, bin := range framePeakBins(frame) {
+		p.addPeak(p.peak(p.frameIdx, bin))
+	}
+	p.frameIdx++
+
+	p.buf = append(p.buf[:0], p.buf[hopSize:]...)
+}
+
+func (p *FingerprintPipeline) peak(frameIdx, bin int) Peak {
+	return Peak{
+		Time: float64(frameIdx) * p.frameDuration,
+		Freq: float64(bin) * p.freqResolution,
+	}
+}
+
+// addPeak pairs target with the targetZoneSize peaks before it. Fingerprint
+// keeps the pair with the latest anchor when addresses collide; anchor times
+// never decrease, so keeping the larger time gives the same map.
+func (p *FingerprintPipeline) addPeak(target Peak) {
+	for _, anchor := range p.recent {
+		address := createAddress(anchor, target)
+		anchorTimeMs := uint32(anchor.Time * 1000)
+		if existing, ok := p.fingerprints[address]; !ok || anchorTimeMs >= existing.AnchorTime {
+			p.fingerprints[address] = models.Couple{AnchorTime: anchorTimeMs, SongId: p.songID}
+		}
+	}
+
+	p.recent = append(p.recent, target)
+	if len(p.recent) > targetZoneSize {
+		p.recent = p.recent[1:]
+	}
+}
+
+// Finish flushes the last, partial downsampling group and returns the
+// fingerprints of the channel.
+func (p *FingerprintPipeline) Finish() (map[int64]models.Couple, error) {
+	if p.total >= 0 && p.pushed != p.total {
+		return nil, fmt.Errorf("expected %d samples, got %d", p.total, p.pushed)
+	}
+	if p.groupCount > 0 {
+		p.emitDownsampled()
+	}
+	return p.fingerprints, nil
+}
+
+// FingerprintWav streams a WAV file through one pipeline per channel and
+// returns the same fingerprints as GenerateFingerprintsFromSamples would for
+// its samples: both channels of a stereo file, or the mono downmix of any
+// other. A file whose header does not give its data size, as written to a
+// pipe, is timed by the hop size instead (see FingerprintPipeline).
+func FingerprintWav(r io.Reader, songID uint32) (map[int64]models.Couple, error) {
+	wr, err := wav.NewWavReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if wr.Channels == 2 {
+		return fingerprintFrames(wr.ReadFrames, 2, wr.SampleRate, wr.Frames(), songID)
+	}
+	return fingerprintFrames(wr.ReadMono, 1, wr.SampleRate, wr.Frames(), songID)
+}
+
+// FingerprintPCM fingerprints a mono or stereo PCM stream as it is decoded.
+// When the decoder knows the length of the stream, the result is the same as
+// GenerateFingerprintsFromSamples over its samples; otherwise, as for
+// anything ffmpeg decodes, frames are timed by the hop size.
+func FingerprintPCM(s *wav.PCMStream, songID uint32) (map[int64]models.Couple, error) {
+	if s.Channels != 1 && s.Channels != 2 {
+		return nil, fmt.Errorf("cannot fingerprint %d channels", s.Channels)
+	}
+	return fingerprintFrames(s.ReadFrames, s.Channels, s.SampleRate, s.Frames, songID)
+}
+
+// FingerprintFile decodes the file at path, in-process or through an ffmpeg
+// pipe, and fingerprints it without writing anything to disk.
+func FingerprintFile(ctx context.Context, path string, songID uint32) (map[int64]models.Couple, error) {
+	stream, err := wav.DecodeFile(ctx, path, wav.DecodeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	return FingerprintPCM(stream, songID)
+}
+
+// fingerprintFrames runs the frames read by read, interleaved over channels,
+// through one pipeline per channel and combines their fingerprints left
+// channel first.
+func fingerprintFrames(read func(dst []float64) (int, error), channels, sampleRate int, totalFrames int64, songID uint32) (map[int64]models.Couple, error) {
+	pipelines := make([]*FingerprintPipeline, channels)
+	for i := range pipelines {
+		var err error
+		pipelines[i], err = NewFingerprintPipeline(sampleRate, totalFrames, songID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	const chunkFrames = 16384
+	buf := make([]float64, chunkFrames*channels)
+	left := make([]float64, chunkFrames)
+	right := make([]float64, chunkFrames)
+	for {
+		n, err := read(buf)
+		if channels == 2 {
+			for i := 0; i < n; i++ {
+				left[i], right[i] = buf[2*i], buf[2*i+1]
+			}
+			pipelines[0].Push(left[:n])
+			pipelines[1].Push(right[:n])
+		} else {
+			pipelines[0].Push(buf[:n])
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read samples: %w", err)
+		}
+	}
+
+	fingerprints := make(map[int64]models.Couple)
+	for _, p := range pipelines {
+		channel, err := p.Finish()
+		if err != nil {
+			// peaks were timed for the length in the header
+			return nil, fmt.Errorf("audio data does not match its header: %w", err)
+		}
+		utils.ExtendMap(fingerprints, channel)
+	}
+	return fingerprints, nil
+}
@@ -3,11 +3,16 @@ package core
 import (
 	"fmt"
 	"shazoom/db"
+	"shazoom/models"
 	"shazoom/utils"
 	"sort"
 	"time"
 )
 
+// MaxResolvedCandidates caps how many of the best-scoring songs get their
+// metadata looked up; lower-ranked candidates are dropped from the result.
+const MaxResolvedCandidates = 20
+
 type Match struct {
 	SongId     uint32
 	SongTitle  string
@@ -38,7 +43,13 @@ func FindMatches(audioSample []float64, audioDuration float64, sampleRate int) (
 
 	fmt.Printf("Generated %d fingerprints from the recorded sample.\n", len(sampleFingerprint))
 
-	matches, _, err := FindMatchesUsingFingerPrints(sampleFingerprintMap)
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, time.Since(startTime), err
+	}
+	defer dbClient.Close()
+
+	matches, _, err := FindMatchesUsingFingerPrints(sampleFingerprintMap, dbClient)
 	if err != nil {
 		return nil, time.Since(startTime), err
 	}
@@ -46,73 +57,99 @@ func FindMatches(audioSample []float64, audioDuration float64, sampleRate int) (
 	return matches, time.Since(startTime), nil
 }
 
-func FindMatchesUsingFingerPrints(sample map[int64]uint32) ([]Match, time.Duration, error) {
+func FindMatchesUsingFingerPrints(sample map[int64]uint32, dbClient db.DBClient) ([]Match, time.Duration, error) {
 	startTime := time.Now()
-	logger := utils.GetLogger()
 
 	addresses := make([]int64, 0, len(sample))
 	for address := range sample {
 		addresses = append(addresses, address)
 	}
 
-	dbClient, err := db.NewDBClient()
+	m, err := dbClient.GetCouples(addresses)
 	if err != nil {
 		return nil, time.Since(startTime), err
 	}
-	defer dbClient.Close()
 
-	m, err := dbClient.GetCouples(addresses)
+	acc := newMatchAccumulator()
+	acc.add(sample, m)
+
+	selectedCandidates, err := resolveMatches(analyzeRelativeTiming(acc.matches), acc.timestamps, dbClient)
 	if err != nil {
 		return nil, time.Since(startTime), err
 	}
 
-	timestamps := map[uint32]uint32{}
-	targetZones := map[uint32]map[uint32]int{}
-	matches := map[uint32][][2]uint32{}
+	return selectedCandidates, time.Since(startTime), nil
+}
+
+// matchAccumulator collects (sampleTime, songTime) pairs per candidate song
+// across one or more posting-list lookups.
+type matchAccumulator struct {
+	timestamps map[uint32]uint32
+	matches    map[uint32][][2]uint32
+}
+
+func newMatchAccumulator() *matchAccumulator {
+	return &matchAccumulator{
+		timestamps: map[uint32]uint32{},
+		matches:    map[uint32][][2]uint32{},
+	}
+}
 
-	for address, couples := range m {
-		for _, couple := range couples {
-			matches[couple.SongId] = append(
-				matches[couple.SongId],
+func (a *matchAccumulator) add(sample map[int64]uint32, couples map[int64][]models.Couple) {
+	for address, postings := range couples {
+		for _, couple := range postings {
+			a.matches[couple.SongId] = append(
+				a.matches[couple.SongId],
 				[2]uint32{sample[address], couple.AnchorTime},
 			)
 
-			if existingTime, ok := timestamps[couple.SongId]; !ok || couple.AnchorTime < existingTime {
-				timestamps[couple.SongId] = couple.AnchorTime
+			if existingTime, ok := a.timestamps[couple.SongId]; !ok || couple.AnchorTime < existingTime {
+				a.timestamps[couple.SongId] = couple.AnchorTime
 			}
+		}
+	}
+}
 
-			if _, ok := targetZones[couple.SongId]; !ok {
-				targetZones[couple.SongId] = make(map[uint32]int)
-			}
+// resolveMatches ranks the scored songs and looks up metadata for the best
+// MaxResolvedCandidates of them, returning matches ordered by score.
+func resolveMatches(scores map[uint32]float64, timestamps map[uint32]uint32, dbClient db.DBClient) ([]Match, error) {
+	logger := utils.GetLogger()
 
-			targetZones[couple.SongId][couple.AnchorTime]++
+	// rank before touching the songs table so a noisy sample with hundreds of
+	// weak candidates costs one metadata query instead of one per candidate
+	ranked := make([]uint32, 0, len(scores))
+	for songId := range scores {
+		ranked = append(ranked, songId)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
 		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > MaxResolvedCandidates {
+		ranked = ranked[:MaxResolvedCandidates]
 	}
 
-	scores := analyzeRelativeTiming(matches)
+	songs, err := dbClient.GetSongsByIDs(ranked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch candidate songs: %w", err)
+	}
 
 	var selectedCandidates []Match
 
-	for songId, points := range scores {
-		song, songExists, err := dbClient.GetSongByID(songId)
+	for _, songId := range ranked {
+		song, songExists := songs[songId]
 		if !songExists {
 			logger.Info(fmt.Sprintf("song provided (%v) doesn't exist in our DB :(", songId))
 			continue
 		}
 
-		if err != nil {
-			logger.Info(fmt.Sprintf("failed to fetch the song by ID (%v): %v", songId, err))
-		}
-
-		match := Match{songId, song.Title, song.Artist, song.YouTubeID, timestamps[songId], points}
+		match := Match{songId, song.Title, song.Artist, song.YouTubeID, timestamps[songId], scores[songId]}
 		selectedCandidates = append(selectedCandidates, match)
 	}
 
-	sort.Slice(selectedCandidates, func(i, j int) bool {
-		return selectedCandidates[i].Score > selectedCandidates[j].Score
-	})
-
-	return selectedCandidates, time.Since(startTime), nil
+	return selectedCandidates, nil
 }
 
 /*
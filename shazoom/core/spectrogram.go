@@ -23,6 +23,19 @@ func Spectrogram(sample []float64, sampleRate int) ([][]float64, error) {
         return nil, fmt.Errorf("couldn't downsample audio sample: %v", err)
     }
 
+    window := analysisWindow()
+
+    spectrogram := make([][]float64, 0)
+
+    for start := 0; start+windowSize <= len(downsampledSample); start += hopSize {
+        end := start + windowSize
+        spectrogram = append(spectrogram, frameMagnitudes(downsampledSample[start:end], window))
+    }
+
+    return spectrogram, nil
+}
+
+func analysisWindow() []float64 {
     window := make([]float64, windowSize)
     for i := range window {
         theta := 2 * math.Pi * float64(i) / float64(windowSize-1)
@@ -33,30 +46,27 @@ func Spectrogram(sample []float64, sampleRate int) ([][]float64, error) {
             window[i] = 0.5 - 0.5*math.Cos(theta)
         }
     }
+    return window
+}
 
-    spectrogram := make([][]float64, 0)
-
-    for start := 0; start+windowSize <= len(downsampledSample); start += hopSize {
-        end := start + windowSize
-
-        frame := make([]float64, windowSize)
-        copy(frame, downsampledSample[start:end])
-
-        for j := range window {
-            frame[j] *= window[j]
-        }
+// frameMagnitudes windows one frame of downsampled audio and returns the
+// magnitudes of the lower half of its FFT.
+func frameMagnitudes(samples []float64, window []float64) []float64 {
+    frame := make([]float64, windowSize)
+    copy(frame, samples)
 
-        fftResult := FFT(frame)
+    for j := range window {
+        frame[j] *= window[j]
+    }
 
-        magnitude := make([]float64, len(fftResult)/2)
-        for j := range magnitude {
-            magnitude[j] = cmplx.Abs(fftResult[j])
-        }
+    fftResult := FFT(frame)
 
-        spectrogram = append(spectrogram, magnitude)
+    magnitude := make([]float64, len(fftResult)/2)
+    for j := range magnitude {
+        magnitude[j] = cmplx.Abs(fftResult[j])
     }
 
-    return spectrogram, nil
+    return magnitude
 }
 
 func LowPassFilter(cutoffFrequency, sampleRate float64, input []float64) []float64 {
@@ -120,6 +130,25 @@ func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int
         return []Peak{}
     }
 
+    var peaks []Peak
+    frameDuration := audioDuration / float64(len(spectrogram))
+
+    effectiveSampleRate := float64(sampleRate) / float64(dspRatio)
+    freqResolution := effectiveSampleRate / float64(windowSize)
+
+    for frameIdx, frame := range spectrogram {
+        peakTime := float64(frameIdx) * frameDuration
+        for _, freqIdx := range framePeakBins(frame) {
+            peaks = append(peaks, Peak{Time: peakTime, Freq: float64(freqIdx) * freqResolution})
+        }
+    }
+
+    return peaks
+}
+
+// framePeakBins returns the frequency bins of one spectrogram frame whose
+// band maximum is louder than the average band maximum.
+func framePeakBins(frame []float64) []int {
     type maxies struct {
         maxMag  float64
         freqIdx int
@@ -129,50 +158,40 @@ func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int
         {0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512},
     }
 
-    var peaks []Peak
-    frameDuration := audioDuration / float64(len(spectrogram))
-
-    effectiveSampleRate := float64(sampleRate) / float64(dspRatio)
-    freqResolution := effectiveSampleRate / float64(windowSize)
-
-    for frameIdx, frame := range spectrogram {
-        var maxMags []float64
-        var freqIndices []int
-
-        binBandMaxies := []maxies{}
-        for _, band := range bands {
-            var maxx maxies
-            var maxMag float64
-            for idx, mag := range frame[band.min:band.max] {
-                if mag > maxMag {
-                    maxMag = mag
-                    freqIdx := band.min + idx
-                    maxx = maxies{mag, freqIdx}
-                }
+    var maxMags []float64
+    var freqIndices []int
+
+    binBandMaxies := []maxies{}
+    for _, band := range bands {
+        var maxx maxies
+        var maxMag float64
+        for idx, mag := range frame[band.min:band.max] {
+            if mag > maxMag {
+                maxMag = mag
+                freqIdx := band.min + idx
+                maxx = maxies{mag, freqIdx}
             }
-            binBandMaxies = append(binBandMaxies, maxx)
-        }
-
-        for _, value := range binBandMaxies {
-            maxMags = append(maxMags, value.maxMag)
-            freqIndices = append(freqIndices, value.freqIdx)
         }
+        binBandMaxies = append(binBandMaxies, maxx)
+    }
 
-        var maxMagsSum float64
-        for _, max := range maxMags {
-            maxMagsSum += max
-        }
-        avg := maxMagsSum / float64(len(maxMags))
+    for _, value := range binBandMaxies {
+        maxMags = append(maxMags, value.maxMag)
+        freqIndices = append(freqIndices, value.freqIdx)
+    }
 
-        for i, value := range maxMags {
-            if value > avg {
-                peakTime := float64(frameIdx) * frameDuration
-                peakFreq := float64(freqIndices[i]) * freqResolution
+    var maxMagsSum float64
+    for _, max := range maxMags {
+        maxMagsSum += max
+    }
+    avg := maxMagsSum / float64(len(maxMags))
 
-                peaks = append(peaks, Peak{Time: peakTime, Freq: peakFreq})
-            }
+    var bins []int
+    for i, value := range maxMags {
+        if value > avg {
+            bins = append(bins, freqIndices[i])
         }
     }
 
-    return peaks
-}
\ No newline at end of file
+    return bins
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"shazoom/db"
+	"time"
+)
+
+// StreamFingerprinter turns audio into fingerprints as it arrives. It runs the
+// same low-pass, downsample, FFT and peak-pairing steps as the batch path, but
+// keeps just enough state between writes to only process new frames.
+//
+// Frame times come from the hop size rather than from the total duration, which
+// is unknown while streaming, so anchor times can drift from a batch run of the
+// same audio by a fraction of a percent.
+type StreamFingerprinter struct {
+	ratio          int
+	alpha          float64
+	frameDuration  float64
+	freqResolution float64
+	window         []float64
+
+	prevOutput  float64
+	groupSum    float64
+	groupCount  int
+	downsampled []float64
+	frameIdx    int
+	recent      []Peak
+}
+
+func NewStreamFingerprinter(sampleRate int) (*StreamFingerprinter, error) {
+	targetRate := sampleRate / dspRatio
+	if sampleRate <= 0 || targetRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+	ratio := sampleRate / targetRate
+
+	rc := 1.0 / (2 * math.Pi * maxFreq)
+	dt := 1.0 / float64(sampleRate)
+
+	return &StreamFingerprinter{
+		ratio:          ratio,
+		alpha:          dt / (rc + dt),
+		frameDuration:  float64(hopSize*ratio) / float64(sampleRate),
+		freqResolution: float64(sampleRate) / float64(dspRatio) / float64(windowSize),
+		window:         analysisWindow(),
+	}, nil
+}
+
+// Write consumes mono samples and adds the fingerprints of every frame they
+// complete to out, keyed by address with the anchor time in ms. As in
+// Fingerprint, a repeated address keeps the latest anchor.
+func (f *StreamFingerprinter) Write(samples []float64, out map[int64]uint32) {
+	for _, x := range samples {
+		f.prevOutput = f.alpha*x + (1-f.alpha)*f.prevOutput
+
+		f.groupSum += f.prevOutput
+		f.groupCount++
+		if f.groupCount == f.ratio {
+			f.downsampled = append(f.downsampled, f.groupSum/float64(f.ratio))
+			f.groupSum, f.groupCount = 0, 0
+		}
+	}
+
+	consumed := 0
+	for consumed+windowSize <= len(f.downsampled) {
+		frame := frameMagnitudes(f.downsampled[consumed:consumed+windowSize], f.window)
+		peakTime := float64(f.frameIdx) * f.frameDuration
+
+		for _, freqIdx := range framePeakBins(frame) {
+			f.addPeak(Peak{Time: peakTime, Freq: float64(freqIdx) * f.freqResolution}, out)
+		}
+
+		f.frameIdx++
+		consumed += hopSize
+	}
+	f.downsampled = append(f.downsampled[:0], f.downsampled[consumed:]...)
+}
+
+// addPeak pairs target with the targetZoneSize peaks before it, which yields
+// the same pairs as Fingerprint does over the full peak list.
+func (f *StreamFingerprinter) addPeak(target Peak, out map[int64]uint32) {
+	for _, anchor := range f.recent {
+		address := createAddress(anchor, target)
+		anchorTimeMs := uint32(anchor.Time * 1000)
+		if existing, ok := out[address]; !ok || anchorTimeMs >= existing {
+			out[address] = anchorTimeMs
+		}
+	}
+
+	f.recent = append(f.recent, target)
+	if len(f.recent) > targetZoneSize {
+		f.recent = f.recent[1:]
+	}
+}
+
+// StreamOptions decides when a streaming recognition is confident enough to
+// stop listening.
+type StreamOptions struct {
+	// MinScore is the score the best match needs before it can be reported
+	// as confident.
+	MinScore float64
+	// MinMargin is how many times the runner-up's score the best match needs.
+	MinMargin float64
+	// RescoreEvery is how much new audio triggers another lookup.
+	RescoreEvery time.Duration
+	// MaxDuration ends the session even when no match is confident.
+	MaxDuration time.Duration
+}
+
+var DefaultStreamOptions = StreamOptions{
+	MinScore:     20,
+	MinMargin:    2,
+	RescoreEvery: time.Second,
+	MaxDuration:  20 * time.Second,
+}
+
+// StreamResult is the state of a streaming recognition after a rescore.
+type StreamResult struct {
+	Matches   []Match
+	Confident bool
+	// Done is set once the session will not accept more audio, because it
+	// became confident, reached MaxDuration or was finished by the caller.
+	Done  bool
+	Audio time.Duration
+}
+
+var ErrStreamDone = errors.New("stream recognition already finished")
+
+// StreamRecognizer matches audio against dbClient while it is still being
+// recorded. Each rescore only looks up addresses that were not seen before,
+// and scores accumulate across rescores.
+type StreamRecognizer struct {
+	dbClient   db.DBClient
+	opts       StreamOptions
+	sampleRate int
+
+	fp      *StreamFingerprinter
+	sample  map[int64]uint32
+	pending map[int64]uint32
+	acc     *matchAccumulator
+
+	samples     int
+	lastRescore int
+	done        bool
+	last        StreamResult
+}
+
+func NewStreamRecognizer(sampleRate int, dbClient db.DBClient, opts StreamOptions) (*StreamRecognizer, error) {
+	fp, err := NewStreamFingerprinter(sampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RescoreEvery <= 0 {
+		opts.RescoreEvery = DefaultStreamOptions.RescoreEvery
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = DefaultStreamOptions.MaxDuration
+	}
+
+	return &StreamRecognizer{
+		dbClient:   dbClient,
+		opts:       opts,
+		sampleRate: sampleRate,
+		fp:         fp,
+		sample:     make(map[int64]uint32),
+		pending:    make(map[int64]uint32),
+		acc:        newMatchAccumulator(),
+	}, nil
+}
+
+// Feed adds mono samples to the session. It returns a result whenever enough
+// new audio arrived to rescore, and nil otherwise.
+func (s *StreamRecognizer) Feed(samples []float64) (*StreamResult, error) {
+	if s.done {
+		return nil, ErrStreamDone
+	}
+
+	fresh := make(map[int64]uint32)
+	s.fp.Write(samples, fresh)
+	s.samples += len(samples)
+
+	for address, anchor := range fresh {
+		// addresses that were already looked up keep the anchor they were
+		// scored with; re-scoring them would count their postings twice
+		if _, seen := s.sample[address]; !seen {
+			s.pending[address] = anchor
+		}
+		s.sample[address] = anchor
+	}
+
+	audio := s.duration(s.samples)
+	if audio >= s.opts.MaxDuration {
+		return s.rescore(true)
+	}
+	if audio-s.duration(s.lastRescore) < s.opts.RescoreEvery {
+		return nil, nil
+	}
+	return s.rescore(false)
+}
+
+// Finish scores whatever audio was not scored yet and closes the session.
+func (s *StreamRecognizer) Finish() (StreamResult, error) {
+	if s.done {
+		return s.last, nil
+	}
+	result, err := s.rescore(true)
+	if err != nil {
+		return StreamResult{}, err
+	}
+	return *result, nil
+}
+
+func (s *StreamRecognizer) duration(samples int) time.Duration {
+	return time.Duration(samples) * time.Second / time.Duration(s.sampleRate)
+}
+
+func (s *StreamRecognizer) rescore(final bool) (*StreamResult, error) {
+	s.lastRescore = s.samples
+
+	if len(s.pending) > 0 {
+		addresses := make([]int64, 0, len(s.pending))
+		for address := range s.pending {
+			addresses = append(addresses, address)
+		}
+
+		couples, err := s.dbClient.GetCouples(addresses)
+		if err != nil {
+			return nil, err
+		}
+		s.acc.add(s.pending, couples)
+		s.pending = make(map[int64]uint32)
+	}
+
+	matches, err := resolveMatches(analyzeRelativeTiming(s.acc.matches), s.acc.timestamps, s.dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	result := StreamResult{
+		Matches:   matches,
+		Confident: s.opts.Confident(matches),
+		Audio:     s.duration(s.samples),
+	}
+	result.Done = final || result.Confident
+
+	s.done = result.Done
+	s.last = result
+	return &result, nil
+}
+
+// Confident reports whether the best of matches, ordered by score, clears
+// MinScore and leads the runner-up by MinMargin.
+func (o StreamOptions) Confident(matches []Match) bool {
+	if len(matches) == 0 || matches[0].Score < o.MinScore {
+		return false
+	}
+	if len(matches) == 1 {
+		return true
+	}
+	return matches[0].Score >= o.MinMargin*matches[1].Score
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	wav "shazoom/fileformat"
+	"sort"
+	"time"
+)
+
+// Limits on fingerprints computed by a client and submitted for matching.
+const (
+	// MaxSubmittedHashes is far more than a MaxSubmittedDuration recording
+	// produces.
+	MaxSubmittedHashes = 50000
+	// MaxSubmittedDuration bounds the anchor times of submitted hashes.
+	MaxSubmittedDuration = 60 * time.Second
+)
+
+var (
+	// ErrConfigMismatch is returned for hashes computed with a fingerprint
+	// configuration other than the server's.
+	ErrConfigMismatch = errors.New("fingerprint configuration does not match the server's")
+	// ErrInvalidHashes is returned for submitted hashes that cannot have come
+	// from Fingerprint.
+	ErrInvalidHashes = errors.New("invalid fingerprint hashes")
+)
+
+// FingerprintConfig describes how fingerprints are computed. Hashes are only
+// comparable between clients and the catalogue when the configs are equal.
+type FingerprintConfig struct {
+	Version        int
+	SampleRate     int
+	WindowSize     int
+	HopSize        int
+	TargetZoneSize int
+}
+
+// CurrentFingerprintConfig is the configuration this build fingerprints with.
+func CurrentFingerprintConfig() FingerprintConfig {
+	return FingerprintConfig{
+		Version:        FingerprintConfigVersion,
+		SampleRate:     44100,
+		WindowSize:     windowSize,
+		HopSize:        hopSize,
+		TargetZoneSize: targetZoneSize,
+	}
+}
+
+// Hash is one fingerprint of a recording: the address of an anchor and
+// target peak pair, and the anchor time in ms.
+type Hash struct {
+	Address    int64
+	AnchorTime uint32
+}
+
+// Submission is a recording fingerprinted by the client instead of uploaded.
+type Submission struct {
+	Config FingerprintConfig
+	Hashes []Hash
+}
+
+// FingerprintSubmission fingerprints a mono recording of samples in [-1, 1]
+// at sampleRate. The samples are quantised to 16 bits as the web client does
+// before uploading PCM, and resampled to the configured rate, so the hashes
+// are the ones the server computes for the same recording sent with
+// newRecording.
+func FingerprintSubmission(samples []float64, sampleRate int) (Submission, error) {
+	config := CurrentFingerprintConfig()
+
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		s = max(-1, min(1, s))
+		if s < 0 {
+			s *= 0x8000
+		} else {
+			s *= 0x7FFF
+		}
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(s)))
+	}
+
+	stream, err := wav.DecodeRecording(context.Background(), pcm, sampleRate, 1, 16,
+		wav.DecodeOptions{SampleRate: config.SampleRate, Channels: 1})
+	if err != nil {
+		return Submission{}, err
+	}
+	defer stream.Close()
+
+	fingerprints, err := FingerprintPCM(stream, 0)
+	if err != nil {
+		return Submission{}, err
+	}
+
+	hashes := make([]Hash, 0, len(fingerprints))
+	for address, couple := range fingerprints {
+		hashes = append(hashes, Hash{Address: address, AnchorTime: couple.AnchorTime})
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if hashes[i].AnchorTime != hashes[j].AnchorTime {
+			return hashes[i].AnchorTime < hashes[j].AnchorTime
+		}
+		return hashes[i].Address < hashes[j].Address
+	})
+	return Submission{Config: config, Hashes: hashes}, nil
+}
+
+// Sample checks the submission against the current configuration and limits
+// and returns its hashes in the form FindMatchesUsingFingerPrints takes. As
+// in Fingerprint, a repeated address keeps the latest anchor.
+func (s Submission) Sample() (map[int64]uint32, error) {
+	if current := CurrentFingerprintConfig(); s.Config != current {
+		return nil, fmt.Errorf("%w: got %+v, want %+v", ErrConfigMismatch, s.Config, current)
+	}
+	if len(s.Hashes) == 0 {
+		return nil, fmt.Errorf("%w: no hashes", ErrInvalidHashes)
+	}
+	if len(s.Hashes) > MaxSubmittedHashes {
+		return nil, fmt.Errorf("%w: %d hashes, at most %d allowed", ErrInvalidHashes, len(s.Hashes), MaxSubmittedHashes)
+	}
+
+	maxAnchor := uint32(MaxSubmittedDuration.Milliseconds())
+	sample := make(map[int64]uint32, len(s.Hashes))
+	for _, h := range s.Hashes {
+		// createAddress packs two frequency bins and a delta into 32 bits
+		if h.Address < 0 || h.Address >= 1<<(2*maxFreqBits+maxDeltaBits) {
+			return nil, fmt.Errorf("%w: address %d out of range", ErrInvalidHashes, h.Address)
+		}
+		if h.AnchorTime > maxAnchor {
+			return nil, fmt.Errorf("%w: anchor time %d ms is past %v", ErrInvalidHashes, h.AnchorTime, MaxSubmittedDuration)
+		}
+		if prev, ok := sample[h.Address]; !ok || h.AnchorTime >= prev {
+			sample[h.Address] = h.AnchorTime
+		}
+	}
+	return sample, nil
+}
@@ -0,0 +1,417 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"shazoom/models"
+	"shazoom/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A catalogue archive is gzip-compressed newline-delimited JSON. Every line is
+an object with a single key naming the record type:
+
+	{"header": {...}}                      always first
+	{"song": {"id": 1, "title": ...}}      every song, ordered by ID
+	{"fp": {"a": 123, "c": [[1, 5000]]}}   one per address, couples as [songID, anchorTimeMs]
+	{"end": {"songs": 1, "fingerprints": 1}}
+
+Song IDs inside an archive are the exporter's IDs; import maps them to the
+IDs the destination assigns. A missing "end" record means the archive was
+truncated.
+*/
+
+const (
+	archiveFormat  = "shazoom-archive"
+	archiveVersion = 1
+)
+
+type archiveHeader struct {
+	Format             string    `json:"format"`
+	Version            int       `json:"version"`
+	FingerprintVersion int       `json:"fingerprintVersion"`
+	ExportID           string    `json:"exportID"`
+	CreatedAt          time.Time `json:"createdAt"`
+}
+
+type archiveSong struct {
+	ID        uint32 `json:"id"`
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	YouTubeID string `json:"ytID"`
+	Source    string `json:"source,omitempty"`
+	SourceID  string `json:"sourceID,omitempty"`
+}
+
+type archiveFingerprint struct {
+	Address int64       `json:"a"`
+	Couples [][2]uint32 `json:"c"`
+}
+
+// ArchiveStats counts what an archive holds; it doubles as the end record.
+type ArchiveStats struct {
+	Songs        int `json:"songs"`
+	Fingerprints int `json:"fingerprints"`
+}
+
+type archiveRecord struct {
+	Header      *archiveHeader      `json:"header,omitempty"`
+	Song        *archiveSong        `json:"song,omitempty"`
+	Fingerprint *archiveFingerprint `json:"fp,omitempty"`
+	End         *ArchiveStats       `json:"end,omitempty"`
+}
+
+// ExportArchive streams every song and fingerprint of src into w.
+// fingerprintVersion is recorded in the header so imports can refuse
+// fingerprints generated with different parameters.
+func ExportArchive(w io.Writer, src DBClient, fingerprintVersion int) (ArchiveStats, error) {
+	var stats ArchiveStats
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	header := &archiveHeader{
+		Format:             archiveFormat,
+		Version:            archiveVersion,
+		FingerprintVersion: fingerprintVersion,
+		ExportID:           strconv.FormatInt(time.Now().UnixNano(), 36),
+		CreatedAt:          time.Now().UTC(),
+	}
+	if err := enc.Encode(archiveRecord{Header: header}); err != nil {
+		return stats, err
+	}
+
+	err := src.IterateSongs(func(song Song) error {
+		stats.Songs++
+		return enc.Encode(archiveRecord{Song: &archiveSong{
+			ID:        song.ID,
+			Title:     song.Title,
+			Artist:    song.Artist,
+			YouTubeID: song.YouTubeID,
+			Source:    song.Source,
+			SourceID:  song.SourceID,
+		}})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to export songs: %w", err)
+	}
+
+	var current *archiveFingerprint
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		stats.Fingerprints += len(current.Couples)
+		return enc.Encode(archiveRecord{Fingerprint: current})
+	}
+
+	err = src.IterateFingerprints(func(address int64, couple models.Couple) error {
+		if current == nil || current.Address != address {
+			if err := flush(); err != nil {
+				return err
+			}
+			current = &archiveFingerprint{Address: address}
+		}
+		current.Couples = append(current.Couples, [2]uint32{couple.SongId, couple.AnchorTime})
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to export fingerprints: %w", err)
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	if err := enc.Encode(archiveRecord{End: &stats}); err != nil {
+		return stats, err
+	}
+
+	return stats, gz.Close()
+}
+
+type ArchiveImportOptions struct {
+	// FingerprintVersion must match the archive header.
+	FingerprintVersion int
+	// ProgressPath is an append-only log that lets an interrupted import
+	// resume. It is removed once the import completes.
+	ProgressPath string
+	// BatchSize is the number of fingerprints stored per StoreFingerprints call.
+	BatchSize int
+}
+
+type ArchiveImportStats struct {
+	SongsImported int
+	SongsSkipped  int
+	Fingerprints  int
+	Resumed       bool
+}
+
+// ImportArchive loads an archive written by ExportArchive into dst. Songs
+// whose key already exists in dst are skipped along with their fingerprints.
+// Progress is checkpointed after every stored batch, so running the import
+// again after a failure continues where the last run stopped.
+func ImportArchive(r io.Reader, dst DBClient, opts ArchiveImportOptions) (ArchiveImportStats, error) {
+	var stats ArchiveImportStats
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 20000
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	var first archiveRecord
+	if err := dec.Decode(&first); err != nil || first.Header == nil {
+		return stats, errors.New("archive is missing its header")
+	}
+	header := first.Header
+	if header.Format != archiveFormat || header.Version != archiveVersion {
+		return stats, fmt.Errorf("unsupported archive %s v%d", header.Format, header.Version)
+	}
+	if header.FingerprintVersion != opts.FingerprintVersion {
+		return stats, fmt.Errorf(
+			"archive fingerprints use config version %d, this build uses %d",
+			header.FingerprintVersion, opts.FingerprintVersion,
+		)
+	}
+
+	progress, err := openImportProgress(opts.ProgressPath, header.ExportID)
+	if err != nil {
+		return stats, err
+	}
+	defer progress.Close()
+	stats.Resumed = progress.resumed
+
+	pending := make(map[uint32]map[int64]models.Couple)
+	pendingCount := 0
+	records := 0
+
+	// flush stores the pending batch and checkpoints the number of
+	// fingerprint records that are now fully stored.
+	flush := func(done int) error {
+		for _, fingerprints := range pending {
+			if err := dst.StoreFingerprints(fingerprints); err != nil {
+				return fmt.Errorf("failed to store fingerprints: %w", err)
+			}
+		}
+		stats.Fingerprints += pendingCount
+		pending = make(map[uint32]map[int64]models.Couple)
+		pendingCount = 0
+		return progress.recordFingerprints(done)
+	}
+
+	for {
+		var rec archiveRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return stats, errors.New("archive is truncated (no end record)")
+			}
+			return stats, fmt.Errorf("corrupt archive record: %w", err)
+		}
+
+		switch {
+		case rec.Song != nil:
+			if _, ok := progress.songs[rec.Song.ID]; ok {
+				continue
+			}
+
+			key := utils.GenerateSongKey(rec.Song.Title, rec.Song.Artist)
+			existing, exists, err := dst.GetSongByKey(key)
+			if err != nil {
+				return stats, err
+			}
+			if exists && progress.registering[rec.Song.ID] {
+				// registered by the interrupted run, which stopped before
+				// it could record the new ID
+				if err := progress.recordSong(rec.Song.ID, existing.ID); err != nil {
+					return stats, err
+				}
+				stats.SongsImported++
+				continue
+			}
+			if exists {
+				stats.SongsSkipped++
+				continue
+			}
+
+			// archives written before sources were recorded only have ytID
+			song := withLegacySource(Song{YouTubeID: rec.Song.YouTubeID, Source: rec.Song.Source, SourceID: rec.Song.SourceID})
+			if err := progress.recordRegistering(rec.Song.ID); err != nil {
+				return stats, err
+			}
+			newID, err := dst.RegisterSongFromSource(rec.Song.Title, rec.Song.Artist, song.Source, song.SourceID)
+			if err != nil {
+				return stats, fmt.Errorf("failed to register '%s': %w", key, err)
+			}
+			if err := progress.recordSong(rec.Song.ID, newID); err != nil {
+				return stats, err
+			}
+			stats.SongsImported++
+
+		case rec.Fingerprint != nil:
+			records++
+			if records <= progress.fingerprintRecords {
+				continue
+			}
+
+			for _, c := range rec.Fingerprint.Couples {
+				newID, ok := progress.songs[c[0]]
+				if !ok {
+					continue
+				}
+
+				song := pending[newID]
+				if song == nil {
+					song = make(map[int64]models.Couple)
+					pending[newID] = song
+				}
+				if _, dup := song[rec.Fingerprint.Address]; dup {
+					// StoreFingerprints holds one couple per address; the
+					// batch up to here has to go first.
+					if err := flush(records - 1); err != nil {
+						return stats, err
+					}
+					song = map[int64]models.Couple{}
+					pending[newID] = song
+				}
+
+				song[rec.Fingerprint.Address] = models.Couple{AnchorTime: c[1], SongId: newID}
+				pendingCount++
+			}
+
+			if pendingCount >= opts.BatchSize {
+				if err := flush(records); err != nil {
+					return stats, err
+				}
+			}
+
+		case rec.End != nil:
+			if err := flush(records); err != nil {
+				return stats, err
+			}
+			return stats, progress.finish()
+		}
+	}
+}
+
+// importProgress is the resume log kept next to an archive during import.
+type importProgress struct {
+	path    string
+	file    *os.File
+	resumed bool
+	songs   map[uint32]uint32
+	// registering holds the songs whose registration was started, so that a
+	// song registered just before a crash is adopted rather than skipped
+	registering        map[uint32]bool
+	fingerprintRecords int
+}
+
+func openImportProgress(path, exportID string) (*importProgress, error) {
+	p := &importProgress{path: path, songs: make(map[uint32]uint32), registering: make(map[uint32]bool)}
+	if path == "" {
+		return p, nil
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) == 0 || lines[0] != "archive "+exportID {
+			return nil, fmt.Errorf("progress file %s belongs to a different archive", path)
+		}
+		p.resumed = true
+
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 3 && fields[0] == "song":
+				oldID, err1 := strconv.ParseUint(fields[1], 10, 32)
+				newID, err2 := strconv.ParseUint(fields[2], 10, 32)
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("corrupt progress line %q", line)
+				}
+				p.songs[uint32(oldID)] = uint32(newID)
+			case len(fields) == 2 && fields[0] == "register":
+				oldID, err := strconv.ParseUint(fields[1], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("corrupt progress line %q", line)
+				}
+				p.registering[uint32(oldID)] = true
+			case len(fields) == 2 && fields[0] == "records":
+				n, err := strconv.Atoi(fields[1])
+				if err != nil {
+					return nil, fmt.Errorf("corrupt progress line %q", line)
+				}
+				p.fingerprintRecords = n
+			}
+			// anything else is a torn final write and can be ignored
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open progress file: %w", err)
+	}
+	p.file = f
+
+	if !p.resumed {
+		if err := p.append("archive " + exportID); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *importProgress) append(line string) error {
+	if p.file == nil {
+		return nil
+	}
+	if _, err := p.file.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("failed to write progress: %w", err)
+	}
+	return p.file.Sync()
+}
+
+func (p *importProgress) recordRegistering(oldID uint32) error {
+	p.registering[oldID] = true
+	return p.append(fmt.Sprintf("register %d", oldID))
+}
+
+func (p *importProgress) recordSong(oldID, newID uint32) error {
+	p.songs[oldID] = newID
+	return p.append(fmt.Sprintf("song %d %d", oldID, newID))
+}
+
+func (p *importProgress) recordFingerprints(records int) error {
+	p.fingerprintRecords = records
+	return p.append(fmt.Sprintf("records %d", records))
+}
+
+func (p *importProgress) finish() error {
+	if p.file == nil {
+		return nil
+	}
+	_ = p.file.Close()
+	p.file = nil
+	return os.Remove(p.path)
+}
+
+func (p *importProgress) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
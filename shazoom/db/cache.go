@@ -0,0 +1,223 @@
+package db
+
+import (
+	"container/list"
+	"shazoom/models"
+	"sync"
+	"time"
+)
+
+// CacheOptions bounds the posting-list cache of a CachedClient.
+type CacheOptions struct {
+	// MaxBytes is the approximate memory budget for cached posting lists.
+	MaxBytes int64
+	// TTL expires entries so that writes made by other processes show up
+	// eventually. Zero keeps entries until they are evicted or invalidated.
+	TTL time.Duration
+}
+
+// CacheStats is a snapshot of cache activity since the client was created.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// rough per-entry bookkeeping cost: list element, map slot and slice header
+const (
+	cacheEntryOverhead = 96
+	coupleSize         = 8
+)
+
+type cacheEntry struct {
+	address int64
+	couples []models.Couple
+	expires time.Time
+	size    int64
+}
+
+// CachedClient wraps any DBClient with an LRU cache of posting lists keyed by
+// address. Addresses with no postings are cached too, since most addresses in
+// a noisy sample miss. Every other method passes straight through to the
+// wrapped client.
+//
+// Slices returned by GetCouples may be shared with the cache and must not be
+// modified by callers.
+type CachedClient struct {
+	DBClient
+	opts CacheOptions
+
+	mu         sync.Mutex
+	entries    map[int64]*list.Element
+	lru        *list.List
+	bytes      int64
+	generation uint64
+	stats      CacheStats
+}
+
+func NewCachedClient(backend DBClient, opts CacheOptions) *CachedClient {
+	return &CachedClient{
+		DBClient: backend,
+		opts:     opts,
+		entries:  make(map[int64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *CachedClient) GetCouples(addresses []int64) (map[int64][]models.Couple, error) {
+	couples := make(map[int64][]models.Couple)
+	var missing []int64
+	now := time.Now()
+
+	c.mu.Lock()
+	for _, address := range addresses {
+		elem, ok := c.entries[address]
+		if ok {
+			entry := elem.Value.(*cacheEntry)
+			if c.opts.TTL > 0 && now.After(entry.expires) {
+				c.remove(elem)
+				ok = false
+			} else {
+				c.lru.MoveToFront(elem)
+				if len(entry.couples) > 0 {
+					couples[address] = entry.couples
+				}
+			}
+		}
+
+		if ok {
+			c.stats.Hits++
+		} else {
+			c.stats.Misses++
+			missing = append(missing, address)
+		}
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		return couples, nil
+	}
+
+	fetched, err := c.DBClient.GetCouples(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	// an invalidation while we were fetching means fetched may be stale
+	if generation == c.generation {
+		for _, address := range missing {
+			c.put(address, fetched[address], now)
+		}
+	}
+	c.mu.Unlock()
+
+	for address, postings := range fetched {
+		couples[address] = postings
+	}
+	return couples, nil
+}
+
+func (c *CachedClient) put(address int64, couples []models.Couple, now time.Time) {
+	if elem, ok := c.entries[address]; ok {
+		c.remove(elem)
+	}
+
+	entry := &cacheEntry{
+		address: address,
+		couples: couples,
+		expires: now.Add(c.opts.TTL),
+		size:    cacheEntryOverhead + int64(len(couples))*coupleSize,
+	}
+	if entry.size > c.opts.MaxBytes {
+		return
+	}
+
+	c.entries[address] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+
+	for c.bytes > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachedClient) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.address)
+	c.bytes -= entry.size
+}
+
+func (c *CachedClient) StoreFingerprints(fingerprints map[int64]models.Couple) error {
+	err := c.DBClient.StoreFingerprints(fingerprints)
+
+	// invalidate even on error: part of the batch may have been written
+	c.mu.Lock()
+	c.generation++
+	for address := range fingerprints {
+		if elem, ok := c.entries[address]; ok {
+			c.remove(elem)
+		}
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *CachedClient) DeleteSongByID(songID uint32) error {
+	err := c.DBClient.DeleteSongByID(songID)
+
+	c.mu.Lock()
+	c.generation++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		for _, couple := range elem.Value.(*cacheEntry).couples {
+			if couple.SongId == songID {
+				c.remove(elem)
+				break
+			}
+		}
+		elem = next
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *CachedClient) DeleteCollection(collectionName string) error {
+	err := c.DBClient.DeleteCollection(collectionName)
+	c.Purge()
+	return err
+}
+
+// Purge drops every cached entry.
+func (c *CachedClient) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[int64]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (c *CachedClient) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"shazoom/models"
 	"shazoom/utils"
+	"strconv"
 )
 
 type DBClient interface {
@@ -13,18 +14,65 @@ type DBClient interface {
 
 	TotalSongs() (int, error)
 	RegisterSong(songTitle, songArtist, ytID string) (uint32, error)
+	// RegisterSongFromSource registers a song whose audio came from source
+	// (see the Source constants) under sourceID. RegisterSong is the same
+	// with SourceYouTube, or no source when ytID is empty.
+	RegisterSongFromSource(songTitle, songArtist, source, sourceID string) (uint32, error)
 	GetSong(filterKey string, value interface{}) (Song, bool, error)
 	GetSongByID(songID uint32) (Song, bool, error)
+	// GetSongsByIDs resolves many songs in one round trip. IDs that do not
+	// exist are absent from the returned map.
+	GetSongsByIDs(songIDs []uint32) (map[uint32]Song, error)
 	GetSongByYTID(ytID string) (Song, bool, error)
+	GetSongBySource(source, sourceID string) (Song, bool, error)
 	GetSongByKey(key string) (Song, bool, error)
+	// DeleteSongByID deletes a song together with its fingerprints.
 	DeleteSongByID(songID uint32) error
 	DeleteCollection(collectionName string) error
+
+	// ListSongs returns up to limit songs with IDs above afterID, ordered by
+	// ID, so that pages are fetched by passing the last ID of the previous one.
+	ListSongs(afterID uint32, limit int) ([]Song, error)
+	// IterateSongs calls fn for every registered song, ordered by ID.
+	IterateSongs(fn func(song Song) error) error
+	// IterateFingerprints calls fn for every stored fingerprint in ascending
+	// address order. Couples sharing an address may come in any order.
+	IterateFingerprints(fn func(address int64, couple models.Couple) error) error
 }
 
 type Song struct {
+	ID        uint32
 	Title     string
 	Artist    string
 	YouTubeID string
+	// Source and SourceID say where the indexed audio came from, e.g.
+	// "youtube" and the video ID, or "local" and a path in the library.
+	Source   string
+	SourceID string
+}
+
+const (
+	SourceYouTube = "youtube"
+	SourceLocal   = "local"
+	SourceHTTP    = "http"
+	SourceUpload  = "upload"
+)
+
+// youTubeSource is the source RegisterSong records for ytID.
+func youTubeSource(ytID string) (string, string) {
+	if ytID == "" {
+		return "", ""
+	}
+	return SourceYouTube, ytID
+}
+
+// withLegacySource fills in the source of songs stored before sources were
+// recorded, which all came from YouTube.
+func withLegacySource(song Song) Song {
+	if song.Source == "" && song.YouTubeID != "" {
+		song.Source, song.SourceID = SourceYouTube, song.YouTubeID
+	}
+	return song
 }
 
 func setupTestEnv() {
@@ -48,6 +96,10 @@ func setupTestEnv() {
 }
 
 func NewDBClient() (DBClient, error) {
+    if indexPath := utils.GetEnv("DB_INDEX_FILE"); indexPath != "" {
+        return OpenIndexClient(indexPath)
+    }
+
     setupTestEnv()
     var (
         dbUser = utils.GetEnv("DB_USER")
@@ -62,5 +114,31 @@ func NewDBClient() (DBClient, error) {
     dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
         dbHost, dbUser, dbPass, dbName, dbPort)
 
-    return NewPostgresClient(dsn)
+    opts, err := postgresOptionsFromEnv()
+    if err != nil {
+        return nil, err
+    }
+
+    return NewPostgresClientWithOptions(dsn, opts)
+}
+
+// postgresOptionsFromEnv reads DB_FINGERPRINT_PARTITIONS and DB_LOOKUP_CONCURRENCY.
+// Both default to 0, which keeps the unpartitioned table.
+func postgresOptionsFromEnv() (PostgresOptions, error) {
+    var opts PostgresOptions
+
+    vars := map[string]*int{
+        "DB_FINGERPRINT_PARTITIONS": &opts.Partitions,
+        "DB_LOOKUP_CONCURRENCY":     &opts.LookupConcurrency,
+    }
+    for key, dst := range vars {
+        val := utils.GetEnv(key, "0")
+        n, err := strconv.Atoi(val)
+        if err != nil {
+            return opts, fmt.Errorf("failed to convert env variable (%s) to int: %v", key, err)
+        }
+        *dst = n
+    }
+
+    return opts, nil
 }
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shazoom/models"
+	"sort"
+)
+
+/*
+Index file layout (all integers little-endian, "uv" = unsigned varint):
+
+	header      fixed 64 bytes, see indexHeader
+	songs       per song: uv id, then title, artist, ytID, source and
+	            sourceID as uv length + bytes (version 1 files stop at ytID)
+	postings    one entry per address, sorted by address:
+	              uv address delta (from the previous entry in the same block)
+	              uv couple count
+	              uv byte length of the couples that follow
+	              couples sorted by (songID, anchorTime):
+	                uv songID delta from the previous couple
+	                uv anchorTime, as a delta when the songID repeats
+	directory   one 16-byte entry (first address, file offset) per block of
+	            indexBlockSize addresses, so lookups binary-search the
+	            directory and then decode at most one block
+
+The file is written once by WriteIndexFile and never modified afterwards.
+*/
+
+const (
+	indexMagic     = "SHZIDX\x00\x00"
+	indexVersion   = 2
+	indexBlockSize = 64
+)
+
+type indexHeader struct {
+	Magic           [8]byte
+	Version         uint32
+	BlockSize       uint32
+	SongCount       uint64
+	AddressCount    uint64
+	SongsOffset     uint64
+	PostingsOffset  uint64
+	DirectoryOffset uint64
+	DirectoryCount  uint64
+}
+
+const indexHeaderSize = 64
+
+type indexDirEntry struct {
+	FirstAddress int64
+	Offset       uint64
+}
+
+const indexDirEntrySize = 16
+
+// countingWriter tracks the absolute file offset while writing through a buffer.
+type countingWriter struct {
+	w      *bufio.Writer
+	offset uint64
+	varint [binary.MaxVarintLen64]byte
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.offset += uint64(n)
+	return n, err
+}
+
+func (cw *countingWriter) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(cw.varint[:], v)
+	_, err := cw.Write(cw.varint[:n])
+	return err
+}
+
+func (cw *countingWriter) writeString(s string) error {
+	if err := cw.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(cw, s)
+	return err
+}
+
+// WriteIndexFile exports every song and fingerprint of src into an immutable
+// index file at path. The file is written next to path and renamed into place
+// once complete, so readers never observe a partial index.
+func WriteIndexFile(path string, src DBClient) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	header, err := writeIndex(tmp, src)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(tmp, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("cannot write index header: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeIndex(f *os.File, src DBClient) (indexHeader, error) {
+	header := indexHeader{Version: indexVersion, BlockSize: indexBlockSize}
+	copy(header.Magic[:], indexMagic)
+
+	cw := &countingWriter{w: bufio.NewWriterSize(f, 1<<20)}
+
+	// placeholder, patched once all offsets are known
+	if _, err := cw.Write(make([]byte, indexHeaderSize)); err != nil {
+		return header, err
+	}
+
+	header.SongsOffset = cw.offset
+	err := src.IterateSongs(func(song Song) error {
+		header.SongCount++
+		if err := cw.writeUvarint(uint64(song.ID)); err != nil {
+			return err
+		}
+		for _, s := range []string{song.Title, song.Artist, song.YouTubeID, song.Source, song.SourceID} {
+			if err := cw.writeString(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return header, fmt.Errorf("failed to export songs: %w", err)
+	}
+
+	header.PostingsOffset = cw.offset
+
+	var (
+		directory   []indexDirEntry
+		current     int64
+		couples     []models.Couple
+		started     bool
+		prevAddress int64
+		postingBuf  []byte
+	)
+
+	flush := func() error {
+		if !started {
+			return nil
+		}
+
+		if header.AddressCount%indexBlockSize == 0 {
+			directory = append(directory, indexDirEntry{FirstAddress: current, Offset: cw.offset})
+			prevAddress = current
+		}
+		header.AddressCount++
+
+		sort.Slice(couples, func(i, j int) bool {
+			if couples[i].SongId != couples[j].SongId {
+				return couples[i].SongId < couples[j].SongId
+			}
+			return couples[i].AnchorTime < couples[j].AnchorTime
+		})
+
+		postingBuf = postingBuf[:0]
+		var prev models.Couple
+		for i, c := range couples {
+			postingBuf = binary.AppendUvarint(postingBuf, uint64(c.SongId-prev.SongId))
+			if i > 0 && c.SongId == prev.SongId {
+				postingBuf = binary.AppendUvarint(postingBuf, uint64(c.AnchorTime-prev.AnchorTime))
+			} else {
+				postingBuf = binary.AppendUvarint(postingBuf, uint64(c.AnchorTime))
+			}
+			prev = c
+		}
+
+		for _, v := range []uint64{uint64(current - prevAddress), uint64(len(couples)), uint64(len(postingBuf))} {
+			if err := cw.writeUvarint(v); err != nil {
+				return err
+			}
+		}
+		if _, err := cw.Write(postingBuf); err != nil {
+			return err
+		}
+
+		prevAddress = current
+		couples = couples[:0]
+		return nil
+	}
+
+	err = src.IterateFingerprints(func(address int64, couple models.Couple) error {
+		if started && address < current {
+			return errors.New("fingerprints are not sorted by address")
+		}
+		if !started || address != current {
+			if err := flush(); err != nil {
+				return err
+			}
+			current = address
+			started = true
+		}
+		couples = append(couples, couple)
+		return nil
+	})
+	if err != nil {
+		return header, fmt.Errorf("failed to export fingerprints: %w", err)
+	}
+	if err := flush(); err != nil {
+		return header, err
+	}
+
+	header.DirectoryOffset = cw.offset
+	header.DirectoryCount = uint64(len(directory))
+	if err := binary.Write(cw, binary.LittleEndian, directory); err != nil {
+		return header, fmt.Errorf("cannot write index directory: %w", err)
+	}
+
+	return header, cw.w.Flush()
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"shazoom/models"
+	"shazoom/utils"
+	"sort"
+)
+
+var ErrReadOnly = errors.New("index file backend is read-only")
+
+// IndexClient serves lookups from a memory-mapped index file written by
+// WriteIndexFile. Song metadata is loaded into memory on open; posting lists
+// stay on disk and are decoded on demand.
+type IndexClient struct {
+	data      []byte
+	unmap     func() error
+	header    indexHeader
+	directory []byte
+
+	songs    map[uint32]Song
+	ids      []uint32 // sorted keys of songs
+	byKey    map[string]uint32
+	byYTID   map[string]uint32
+	bySource map[sourceKey]uint32
+}
+
+type sourceKey struct {
+	source, id string
+}
+
+func OpenIndexClient(path string) (*IndexClient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening index file: %w", err)
+	}
+	defer f.Close()
+
+	data, unmap, err := mmapFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping index file: %w", err)
+	}
+
+	c := &IndexClient{data: data, unmap: unmap}
+	if err := c.load(); err != nil {
+		_ = unmap()
+		return nil, fmt.Errorf("invalid index file %s: %w", path, err)
+	}
+
+	utils.GetLogger().Info("opened index file", slog.String("path", path),
+		slog.Uint64("songs", c.header.SongCount), slog.Uint64("addresses", c.header.AddressCount))
+	return c, nil
+}
+
+func (c *IndexClient) load() error {
+	if len(c.data) < indexHeaderSize {
+		return errors.New("file too small")
+	}
+
+	if err := binary.Read(bytes.NewReader(c.data[:indexHeaderSize]), binary.LittleEndian, &c.header); err != nil {
+		return err
+	}
+	if string(c.header.Magic[:]) != indexMagic {
+		return errors.New("bad magic")
+	}
+	if c.header.Version != 1 && c.header.Version != indexVersion {
+		return fmt.Errorf("unsupported version %d", c.header.Version)
+	}
+
+	if c.header.SongsOffset < indexHeaderSize ||
+		c.header.SongsOffset > c.header.PostingsOffset ||
+		c.header.PostingsOffset > c.header.DirectoryOffset ||
+		c.header.DirectoryOffset > uint64(len(c.data)) ||
+		c.header.DirectoryCount > (uint64(len(c.data))-c.header.DirectoryOffset)/indexDirEntrySize {
+		return errors.New("section offsets out of range")
+	}
+	dirEnd := c.header.DirectoryOffset + c.header.DirectoryCount*indexDirEntrySize
+	c.directory = c.data[c.header.DirectoryOffset:dirEnd]
+	if err := c.checkDirectory(); err != nil {
+		return err
+	}
+
+	c.songs = make(map[uint32]Song, c.header.SongCount)
+	c.byKey = make(map[string]uint32, c.header.SongCount)
+	c.byYTID = make(map[string]uint32, c.header.SongCount)
+	c.bySource = make(map[sourceKey]uint32, c.header.SongCount)
+
+	r := &indexReader{buf: c.data[c.header.SongsOffset:c.header.PostingsOffset]}
+	for i := uint64(0); i < c.header.SongCount; i++ {
+		var song Song
+		song.ID = uint32(r.uvarint())
+		song.Title = r.string()
+		song.Artist = r.string()
+		song.YouTubeID = r.string()
+		if c.header.Version >= 2 {
+			song.Source = r.string()
+			song.SourceID = r.string()
+		}
+		song = withLegacySource(song)
+		if r.err != nil {
+			return fmt.Errorf("corrupt song table: %w", r.err)
+		}
+
+		c.songs[song.ID] = song
+		c.byKey[utils.GenerateSongKey(song.Title, song.Artist)] = song.ID
+		if song.YouTubeID != "" {
+			c.byYTID[song.YouTubeID] = song.ID
+		}
+		if song.Source != "" {
+			c.bySource[sourceKey{song.Source, song.SourceID}] = song.ID
+		}
+	}
+
+	c.ids = make([]uint32, 0, len(c.songs))
+	for id := range c.songs {
+		c.ids = append(c.ids, id)
+	}
+	sort.Slice(c.ids, func(i, j int) bool { return c.ids[i] < c.ids[j] })
+
+	return nil
+}
+
+// checkDirectory makes sure every block lies within the postings section and
+// the blocks follow each other in address order, so that lookups can slice
+// the file without checking again.
+func (c *IndexClient) checkDirectory() error {
+	prev := indexDirEntry{Offset: c.header.PostingsOffset}
+	for i := 0; i < int(c.header.DirectoryCount); i++ {
+		entry := c.dirEntry(i)
+		if entry.Offset < prev.Offset || entry.Offset > c.header.DirectoryOffset {
+			return fmt.Errorf("directory entry %d: offset %d out of range", i, entry.Offset)
+		}
+		if i > 0 && entry.FirstAddress <= prev.FirstAddress {
+			return fmt.Errorf("directory entry %d: addresses out of order", i)
+		}
+		prev = entry
+	}
+	return nil
+}
+
+func (c *IndexClient) Close() error {
+	if c.unmap == nil {
+		return nil
+	}
+	err := c.unmap()
+	c.unmap = nil
+	c.data = nil
+	return err
+}
+
+func (c *IndexClient) dirEntry(i int) indexDirEntry {
+	b := c.directory[i*indexDirEntrySize:]
+	return indexDirEntry{
+		FirstAddress: int64(binary.LittleEndian.Uint64(b)),
+		Offset:       binary.LittleEndian.Uint64(b[8:]),
+	}
+}
+
+func (c *IndexClient) GetCouples(addresses []int64) (map[int64][]models.Couple, error) {
+	couples := make(map[int64][]models.Couple)
+
+	for _, address := range addresses {
+		postings, err := c.lookup(address)
+		if err != nil {
+			return nil, err
+		}
+		if len(postings) > 0 {
+			couples[address] = postings
+		}
+	}
+
+	return couples, nil
+}
+
+// lookup finds the block that may hold address and scans it.
+func (c *IndexClient) lookup(address int64) ([]models.Couple, error) {
+	count := int(c.header.DirectoryCount)
+	block := sort.Search(count, func(i int) bool {
+		return c.dirEntry(i).FirstAddress > address
+	}) - 1
+	if block < 0 {
+		return nil, nil
+	}
+
+	entry := c.dirEntry(block)
+	end := c.header.DirectoryOffset
+	if block+1 < count {
+		end = c.dirEntry(block + 1).Offset
+	}
+
+	r := &indexReader{buf: c.data[entry.Offset:end]}
+	current := entry.FirstAddress
+	for len(r.buf) > 0 {
+		current += int64(r.uvarint())
+		n := r.uvarint()
+		size := r.uvarint()
+		if r.err != nil {
+			return nil, fmt.Errorf("corrupt posting entry: %w", r.err)
+		}
+		if size > uint64(len(r.buf)) {
+			return nil, errors.New("corrupt posting entry: length out of range")
+		}
+
+		switch {
+		case current == address:
+			return decodePostings(r.buf[:size], n)
+		case current > address:
+			return nil, nil
+		}
+		r.buf = r.buf[size:]
+	}
+
+	return nil, nil
+}
+
+func decodePostings(buf []byte, n uint64) ([]models.Couple, error) {
+	// every posting takes at least two bytes, which bounds what a corrupt
+	// count can make us allocate
+	if n > uint64(len(buf))/2 {
+		return nil, errors.New("corrupt posting list: count out of range")
+	}
+
+	r := &indexReader{buf: buf}
+	couples := make([]models.Couple, 0, n)
+
+	var prev models.Couple
+	for i := uint64(0); i < n; i++ {
+		var c models.Couple
+		songDelta := uint32(r.uvarint())
+		anchor := uint32(r.uvarint())
+
+		c.SongId = prev.SongId + songDelta
+		if i > 0 && songDelta == 0 {
+			c.AnchorTime = prev.AnchorTime + anchor
+		} else {
+			c.AnchorTime = anchor
+		}
+
+		couples = append(couples, c)
+		prev = c
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("corrupt posting list: %w", r.err)
+	}
+	return couples, nil
+}
+
+func (c *IndexClient) TotalSongs() (int, error) {
+	return len(c.songs), nil
+}
+
+func (c *IndexClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	var id uint32
+	var ok bool
+
+	switch filterKey {
+	case "id":
+		switch v := value.(type) {
+		case uint32:
+			id, ok = v, true
+		case int64:
+			id, ok = uint32(v), true
+		default:
+			return Song{}, false, fmt.Errorf("invalid id type %T", value)
+		}
+	case "ytID":
+		s, _ := value.(string)
+		id, ok = c.byYTID[s]
+	case "key":
+		s, _ := value.(string)
+		id, ok = c.byKey[s]
+	default:
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	if !ok {
+		return Song{}, false, nil
+	}
+	song, exists := c.songs[id]
+	return song, exists, nil
+}
+
+func (c *IndexClient) GetSongByID(id uint32) (Song, bool, error) {
+	return c.GetSong("id", id)
+}
+
+func (c *IndexClient) GetSongsByIDs(ids []uint32) (map[uint32]Song, error) {
+	songs := make(map[uint32]Song, len(ids))
+	for _, id := range ids {
+		if song, ok := c.songs[id]; ok {
+			songs[id] = song
+		}
+	}
+	return songs, nil
+}
+
+func (c *IndexClient) GetSongByYTID(id string) (Song, bool, error) {
+	return c.GetSong("ytID", id)
+}
+
+func (c *IndexClient) GetSongBySource(source, sourceID string) (Song, bool, error) {
+	id, ok := c.bySource[sourceKey{source, sourceID}]
+	if !ok {
+		return Song{}, false, nil
+	}
+	return c.songs[id], true, nil
+}
+
+func (c *IndexClient) GetSongByKey(k string) (Song, bool, error) {
+	return c.GetSong("key", k)
+}
+
+func (c *IndexClient) ListSongs(afterID uint32, limit int) ([]Song, error) {
+	start := sort.Search(len(c.ids), func(i int) bool { return c.ids[i] > afterID })
+	end := min(len(c.ids), start+max(limit, 0))
+
+	songs := make([]Song, 0, end-start)
+	for _, id := range c.ids[start:end] {
+		songs = append(songs, c.songs[id])
+	}
+	return songs, nil
+}
+
+func (c *IndexClient) IterateSongs(fn func(song Song) error) error {
+	for _, id := range c.ids {
+		if err := fn(c.songs[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *IndexClient) IterateFingerprints(fn func(address int64, couple models.Couple) error) error {
+	for block := 0; block < int(c.header.DirectoryCount); block++ {
+		entry := c.dirEntry(block)
+		end := c.header.DirectoryOffset
+		if block+1 < int(c.header.DirectoryCount) {
+			end = c.dirEntry(block + 1).Offset
+		}
+
+		r := &indexReader{buf: c.data[entry.Offset:end]}
+		current := entry.FirstAddress
+		for len(r.buf) > 0 {
+			current += int64(r.uvarint())
+			n := r.uvarint()
+			size := r.uvarint()
+			if r.err != nil || size > uint64(len(r.buf)) {
+				return errors.New("corrupt posting entry")
+			}
+
+			couples, err := decodePostings(r.buf[:size], n)
+			if err != nil {
+				return err
+			}
+			for _, couple := range couples {
+				if err := fn(current, couple); err != nil {
+					return err
+				}
+			}
+			r.buf = r.buf[size:]
+		}
+	}
+	return nil
+}
+
+func (c *IndexClient) StoreFingerprints(map[int64]models.Couple) error {
+	return ErrReadOnly
+}
+
+func (c *IndexClient) RegisterSongFromSource(string, string, string, string) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *IndexClient) RegisterSong(string, string, string) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (c *IndexClient) DeleteSongByID(uint32) error {
+	return ErrReadOnly
+}
+
+func (c *IndexClient) DeleteCollection(string) error {
+	return ErrReadOnly
+}
+
+// indexReader decodes varints from a byte slice, remembering the first error.
+type indexReader struct {
+	buf []byte
+	err error
+}
+
+func (r *indexReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("truncated varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *indexReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errors.New("truncated string")
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
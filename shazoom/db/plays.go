@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Play is one song heard on a monitored source, from the first window it was
+// detected in to the last.
+type Play struct {
+	ID        int64
+	Source    string
+	SongID    uint32
+	Title     string
+	Artist    string
+	StartedAt time.Time
+	EndedAt   time.Time
+	// Score is the best score of the song over its detections.
+	Score      float64
+	Detections int
+}
+
+// PlayFilter selects plays; zero fields match everything.
+type PlayFilter struct {
+	Source string
+	// Since keeps plays that ended at or after it.
+	Since time.Time
+	Limit int
+}
+
+func (f PlayFilter) match(play Play) bool {
+	return (f.Source == "" || play.Source == f.Source) && !play.EndedAt.Before(f.Since)
+}
+
+// PlayLog persists the plays detected by monitors.
+type PlayLog interface {
+	// RecordPlay stores a new play and sets its ID.
+	RecordPlay(play *Play) error
+	// UpdatePlay saves the end, score and detections of a recorded play.
+	UpdatePlay(play Play) error
+	// ListPlays returns the plays matching filter, latest start first.
+	ListPlays(filter PlayFilter) ([]Play, error)
+}
+
+// OpenPlayLog returns backend itself when it can store plays, as postgres
+// does, and otherwise a FilePlayLog at path with the default options.
+func OpenPlayLog(backend DBClient, path string) (PlayLog, error) {
+	if log, ok := backend.(PlayLog); ok {
+		return log, nil
+	}
+	return OpenFilePlayLog(path, FilePlayLogOptions{})
+}
+
+// FilePlayLogOptions tunes a FilePlayLog. Zero values take the defaults.
+type FilePlayLogOptions struct {
+	// MaxPlays is how many of the latest recorded plays are kept; 10000 by
+	// default. Once the file holds twice as many lines it is rewritten with
+	// one line for each of them, so that neither the file nor the plays
+	// held in memory grow without bound.
+	MaxPlays int
+}
+
+// FilePlayLog keeps plays in a file of JSON lines, one for every record or
+// update, so that writes only ever append. The latest line of each play wins
+// when the file is read back.
+type FilePlayLog struct {
+	path     string
+	maxPlays int
+
+	mu     sync.Mutex
+	plays  map[int64]Play
+	nextID int64
+	// lines is the number of lines in the file.
+	lines int
+}
+
+func OpenFilePlayLog(path string, opts FilePlayLogOptions) (*FilePlayLog, error) {
+	if opts.MaxPlays <= 0 {
+		opts.MaxPlays = 10000
+	}
+	l := &FilePlayLog{path: path, maxPlays: opts.MaxPlays, plays: map[int64]Play{}, nextID: 1}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read play log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var play Play
+		if err := json.Unmarshal(scanner.Bytes(), &play); err != nil {
+			return nil, fmt.Errorf("corrupt play log %s, line %d: %w", path, line, err)
+		}
+		l.plays[play.ID] = play
+		l.nextID = max(l.nextID, play.ID+1)
+		l.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read play log: %w", err)
+	}
+	if l.lines >= 2*l.maxPlays {
+		if err := l.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *FilePlayLog) RecordPlay(play *Play) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	play.ID = l.nextID
+	if err := l.append(*play); err != nil {
+		play.ID = 0
+		return err
+	}
+	l.nextID++
+	return nil
+}
+
+func (l *FilePlayLog) UpdatePlay(play Play) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.plays[play.ID]; !ok {
+		return fmt.Errorf("play %d was never recorded", play.ID)
+	}
+	return l.append(play)
+}
+
+func (l *FilePlayLog) append(play Play) error {
+	line, err := json.Marshal(play)
+	if err != nil {
+		return err
+	}
+	if l.lines >= 2*l.maxPlays {
+		if err := l.compact(); err != nil {
+			return err
+		}
+	}
+
+	if dir := filepath.Dir(l.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create play log directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write play log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write play log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write play log: %w", err)
+	}
+
+	l.plays[play.ID] = play
+	l.lines++
+	return nil
+}
+
+// compact rewrites the file with one line for each of the maxPlays plays
+// recorded last, dropping the others. The file is written next to path and
+// renamed into place, so a failure leaves it as it was.
+func (l *FilePlayLog) compact() error {
+	ids := make([]int64, 0, len(l.plays))
+	for id := range l.plays {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	ids = ids[max(0, len(ids)-l.maxPlays):]
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to compact play log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	kept := make(map[int64]Play, len(ids))
+	for _, id := range ids {
+		line, err := json.Marshal(l.plays[id])
+		if err != nil {
+			return err
+		}
+		w.Write(append(line, '\n'))
+		kept[id] = l.plays[id]
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to compact play log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact play log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("failed to compact play log: %w", err)
+	}
+
+	l.plays, l.lines = kept, len(kept)
+	return nil
+}
+
+func (l *FilePlayLog) ListPlays(filter PlayFilter) ([]Play, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var plays []Play
+	for _, play := range l.plays {
+		if filter.match(play) {
+			plays = append(plays, play)
+		}
+	}
+	sort.Slice(plays, func(i, j int) bool {
+		if !plays[i].StartedAt.Equal(plays[j].StartedAt) {
+			return plays[i].StartedAt.After(plays[j].StartedAt)
+		}
+		return plays[i].ID > plays[j].ID
+	})
+	if filter.Limit > 0 && len(plays) > filter.Limit {
+		plays = plays[:filter.Limit]
+	}
+	return plays, nil
+}
@@ -3,18 +3,40 @@ package db
 import (
     "database/sql"
     "fmt"
+    "log/slog"
+    "runtime"
     "shazoom/models"
     "shazoom/utils"
     "strings"
+    "sync"
 
     _ "github.com/jackc/pgx/v5/stdlib"
 )
 
 type PostgresClient struct {
-    db *sql.DB
+    db                *sql.DB
+    partitions        int
+    lookupConcurrency int
+}
+
+// PostgresOptions controls how the fingerprints table is laid out and queried.
+// The zero value keeps the single unpartitioned table.
+type PostgresOptions struct {
+    // Partitions hash-partitions fingerprints by address into this many tables (0 disables).
+    Partitions int
+    // LookupConcurrency caps how many partitions GetCouples queries at once (0 means one per CPU).
+    LookupConcurrency int
 }
 
 func NewPostgresClient(dsn string) (*PostgresClient, error) {
+    return NewPostgresClientWithOptions(dsn, PostgresOptions{})
+}
+
+func NewPostgresClientWithOptions(dsn string, opts PostgresOptions) (*PostgresClient, error) {
+    if opts.Partitions < 0 || opts.LookupConcurrency < 0 {
+        return nil, fmt.Errorf("partitions and lookup concurrency must not be negative")
+    }
+
     db, err := sql.Open("pgx", dsn)
     if err != nil {
         return nil, fmt.Errorf("error opening postgres connection: %w", err)
@@ -28,8 +50,22 @@ func NewPostgresClient(dsn string) (*PostgresClient, error) {
         return nil, fmt.Errorf("error creating tables: %w", err)
     }
 
+    partitions, err := createFingerprintsTable(db, opts.Partitions)
+    if err != nil {
+        return nil, fmt.Errorf("error creating tables: %w", err)
+    }
+
+    concurrency := opts.LookupConcurrency
+    if concurrency == 0 {
+        concurrency = runtime.NumCPU()
+    }
+
     fmt.Printf("successfully created postgreSQL client and created tables\n")
-    return &PostgresClient{db: db}, nil
+    return &PostgresClient{
+        db:                db,
+        partitions:        partitions,
+        lookupConcurrency: concurrency,
+    }, nil
 }
 
 func (c *PostgresClient) Close() error {
@@ -46,25 +82,115 @@ func createPostgresTables(db *sql.DB) error {
         key TEXT NOT NULL UNIQUE
     );`
 
+    if _, err := db.Exec(createSongsTable); err != nil {
+        return fmt.Errorf("creating songs table: %w", err)
+    }
+
+    // songs tables created before sources were recorded get the columns
+    // added, and their YouTube songs marked as such
+    migrateSongSources := `
+    ALTER TABLE songs ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+    ALTER TABLE songs ADD COLUMN IF NOT EXISTS "sourceID" TEXT NOT NULL DEFAULT '';
+    UPDATE songs SET source = 'youtube', "sourceID" = "ytID"
+        WHERE source = '' AND "ytID" IS NOT NULL AND "ytID" <> '';
+    CREATE INDEX IF NOT EXISTS songs_source_idx ON songs (source, "sourceID");`
+
+    if _, err := db.Exec(migrateSongSources); err != nil {
+        return fmt.Errorf("adding song source columns: %w", err)
+    }
+
+    // plays keep the title and artist, so the log outlives deleted songs
+    createPlaysTable := `
+    CREATE TABLE IF NOT EXISTS plays (
+        id BIGSERIAL PRIMARY KEY,
+        source TEXT NOT NULL,
+        "songID" BIGINT NOT NULL,
+        title TEXT NOT NULL,
+        artist TEXT NOT NULL,
+        "startedAt" TIMESTAMPTZ NOT NULL,
+        "endedAt" TIMESTAMPTZ NOT NULL,
+        score DOUBLE PRECISION NOT NULL,
+        detections INTEGER NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS plays_source_started_idx ON plays (source, "startedAt");`
+
+    if _, err := db.Exec(createPlaysTable); err != nil {
+        return fmt.Errorf("creating plays table: %w", err)
+    }
+
+    return nil
+}
+
+// createFingerprintsTable creates the fingerprints table, hash-partitioned by
+// address when partitions > 0, and returns the partition count in effect.
+// An existing table keeps its layout: changing the partition count requires
+// erasing the database first.
+func createFingerprintsTable(db *sql.DB, partitions int) (int, error) {
+    var relkind string
+    var existing int
+    err := db.QueryRow(`
+        SELECT c.relkind, (SELECT COUNT(*) FROM pg_inherits i WHERE i.inhparent = c.oid)
+        FROM pg_class c
+        WHERE c.oid = to_regclass('fingerprints')
+    `).Scan(&relkind, &existing)
+
+    switch {
+    case err == sql.ErrNoRows:
+    case err != nil:
+        return 0, fmt.Errorf("inspecting fingerprints table: %w", err)
+    case relkind == "p":
+        if partitions != existing {
+            utils.GetLogger().Warn("fingerprints table already partitioned, ignoring the requested partition count",
+                slog.Int("partitions", existing), slog.Int("requested", partitions))
+        }
+        return existing, nil
+    default:
+        if partitions > 0 {
+            utils.GetLogger().Warn("fingerprints table already exists unpartitioned, erase the database to enable partitioning")
+        }
+        return 0, nil
+    }
+
     createFingerprintsTable := `
     CREATE TABLE IF NOT EXISTS fingerprints (
         address BIGINT NOT NULL,
         "anchorTimeMs" INTEGER NOT NULL,
         "songID" BIGINT NOT NULL,
         PRIMARY KEY (address, "anchorTimeMs", "songID")
-    );
-    
-    CREATE INDEX IF NOT EXISTS idx_fingerprints_address ON fingerprints (address);
-    `
+    )`
+    if partitions > 0 {
+        createFingerprintsTable += ` PARTITION BY HASH (address)`
+    }
 
-    if _, err := db.Exec(createSongsTable); err != nil {
-        return fmt.Errorf("creating songs table: %w", err)
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
     }
-    if _, err := db.Exec(createFingerprintsTable); err != nil {
-        return fmt.Errorf("creating fingerprints table: %w", err)
+    defer tx.Rollback()
+
+    if _, err := tx.Exec(createFingerprintsTable); err != nil {
+        return 0, fmt.Errorf("creating fingerprints table: %w", err)
     }
 
-    return nil
+    for remainder := 0; remainder < partitions; remainder++ {
+        createPartition := fmt.Sprintf(
+            `CREATE TABLE IF NOT EXISTS %s PARTITION OF fingerprints FOR VALUES WITH (MODULUS %d, REMAINDER %d)`,
+            partitionName(remainder), partitions, remainder,
+        )
+        if _, err := tx.Exec(createPartition); err != nil {
+            return 0, fmt.Errorf("creating fingerprints partition %d: %w", remainder, err)
+        }
+    }
+
+    if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_fingerprints_address ON fingerprints (address)`); err != nil {
+        return 0, fmt.Errorf("creating fingerprints index: %w", err)
+    }
+
+    return partitions, tx.Commit()
+}
+
+func partitionName(remainder int) string {
+    return fmt.Sprintf("fingerprints_p%d", remainder)
 }
 
 func (c *PostgresClient) StoreFingerprints(fingerprints map[int64]models.Couple) error {
@@ -118,15 +244,63 @@ func (c *PostgresClient) StoreFingerprints(fingerprints map[int64]models.Couple)
 }
 
 func (c *PostgresClient) GetCouples(addresses []int64) (map[int64][]models.Couple, error) {
-    couples := make(map[int64][]models.Couple)
-
     if len(addresses) == 0 {
-        return couples, nil
+        return make(map[int64][]models.Couple), nil
     }
 
-    query := `SELECT "anchorTimeMs", "songID", address FROM fingerprints WHERE address = ANY($1)`
-    
-    rows, err := c.db.Query(query, addresses)
+    if c.partitions == 0 {
+        query := `SELECT "anchorTimeMs", "songID", address FROM fingerprints WHERE address = ANY($1)`
+        return c.queryCouples(query, addresses)
+    }
+
+    return c.getCouplesPartitioned(addresses)
+}
+
+// getCouplesPartitioned queries every partition in parallel, bounded by
+// lookupConcurrency. Each query only probes the addresses that hash into its
+// own partition, so the per-partition index scans stay small.
+func (c *PostgresClient) getCouplesPartitioned(addresses []int64) (map[int64][]models.Couple, error) {
+    results := make([]map[int64][]models.Couple, c.partitions)
+    errs := make([]error, c.partitions)
+
+    var wg sync.WaitGroup
+    semaphore := make(chan struct{}, c.lookupConcurrency)
+
+    for remainder := 0; remainder < c.partitions; remainder++ {
+        wg.Add(1)
+        go func(remainder int) {
+            defer wg.Done()
+            semaphore <- struct{}{}
+            defer func() { <-semaphore }()
+
+            query := fmt.Sprintf(`
+                SELECT "anchorTimeMs", "songID", address FROM %s
+                WHERE address = ANY(ARRAY(
+                    SELECT a FROM unnest($1::bigint[]) AS a
+                    WHERE satisfies_hash_partition('fingerprints'::regclass, $2, $3, a)
+                ))
+            `, partitionName(remainder))
+
+            results[remainder], errs[remainder] = c.queryCouples(query, addresses, c.partitions, remainder)
+        }(remainder)
+    }
+    wg.Wait()
+
+    couples := make(map[int64][]models.Couple)
+    for remainder, partial := range results {
+        if errs[remainder] != nil {
+            return nil, fmt.Errorf("querying partition %d: %w", remainder, errs[remainder])
+        }
+        utils.ExtendMap(couples, partial)
+    }
+
+    return couples, nil
+}
+
+func (c *PostgresClient) queryCouples(query string, args ...any) (map[int64][]models.Couple, error) {
+    couples := make(map[int64][]models.Couple)
+
+    rows, err := c.db.Query(query, args...)
     if err != nil {
         return nil, err
     }
@@ -146,7 +320,7 @@ func (c *PostgresClient) GetCouples(addresses []int64) (map[int64][]models.Coupl
         couples[dbAddress] = append(couples[dbAddress], couple)
     }
 
-    return couples, nil
+    return couples, rows.Err()
 }
 
 func (c *PostgresClient) TotalSongs() (int, error) {
@@ -156,6 +330,11 @@ func (c *PostgresClient) TotalSongs() (int, error) {
 }
 
 func (c *PostgresClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+    source, sourceID := youTubeSource(ytID)
+    return c.RegisterSongFromSource(songTitle, songArtist, source, sourceID)
+}
+
+func (c *PostgresClient) RegisterSongFromSource(songTitle, songArtist, source, sourceID string) (uint32, error) {
     tx, err := c.db.Begin()
     if err != nil {
         return 0, err
@@ -165,9 +344,14 @@ func (c *PostgresClient) RegisterSong(songTitle, songArtist, ytID string) (uint3
     songID := utils.GenerateUniqueID()
     songKey := utils.GenerateSongKey(songTitle, songArtist)
 
-    query := `INSERT INTO songs (id, title, artist, "ytID", key) VALUES ($1, $2, $3, $4, $5)`
+    ytID := ""
+    if source == SourceYouTube {
+        ytID = sourceID
+    }
+
+    query := `INSERT INTO songs (id, title, artist, "ytID", key, source, "sourceID") VALUES ($1, $2, $3, $4, $5, $6, $7)`
     
-    _, err = tx.Exec(query, int64(songID), songTitle, songArtist, ytID, songKey)
+    _, err = tx.Exec(query, int64(songID), songTitle, songArtist, ytID, songKey, source, sourceID)
     if err != nil {
         if strings.Contains(err.Error(), "duplicate key") {
             return 0, fmt.Errorf("song already exists: %w", err)
@@ -181,6 +365,19 @@ func (c *PostgresClient) RegisterSong(songTitle, songArtist, ytID string) (uint3
     return songID, nil
 }
 
+const songColumns = `id, title, artist, COALESCE("ytID", ''), source, "sourceID"`
+
+// scanSong reads a row selected with songColumns.
+func scanSong(row interface{ Scan(dest ...any) error }) (Song, error) {
+    var song Song
+    var dbSongID int64
+    if err := row.Scan(&dbSongID, &song.Title, &song.Artist, &song.YouTubeID, &song.Source, &song.SourceID); err != nil {
+        return Song{}, err
+    }
+    song.ID = uint32(dbSongID)
+    return song, nil
+}
+
 func (c *PostgresClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
     validKeys := map[string]bool{"id": true, "ytID": true, "key": true}
     if !validKeys[filterKey] {
@@ -191,10 +388,9 @@ func (c *PostgresClient) GetSong(filterKey string, value interface{}) (Song, boo
         filterKey = `"ytID"`
     }
 
-    query := fmt.Sprintf(`SELECT title, artist, "ytID" FROM songs WHERE %s = $1`, filterKey)
+    query := fmt.Sprintf(`SELECT %s FROM songs WHERE %s = $1`, songColumns, filterKey)
     
-    var song Song
-    err := c.db.QueryRow(query, value).Scan(&song.Title, &song.Artist, &song.YouTubeID)
+    song, err := scanSong(c.db.QueryRow(query, value))
     if err != nil {
         if err == sql.ErrNoRows {
             return Song{}, false, nil
@@ -209,6 +405,34 @@ func (c *PostgresClient) GetSongByID(id uint32) (Song, bool, error) {
     return c.GetSong("id", int64(id)) 
 }
 
+func (c *PostgresClient) GetSongsByIDs(ids []uint32) (map[uint32]Song, error) {
+    songs := make(map[uint32]Song, len(ids))
+    if len(ids) == 0 {
+        return songs, nil
+    }
+
+    dbIDs := make([]int64, len(ids))
+    for i, id := range ids {
+        dbIDs[i] = int64(id)
+    }
+
+    rows, err := c.db.Query(`SELECT `+songColumns+` FROM songs WHERE id = ANY($1)`, dbIDs)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        song, err := scanSong(rows)
+        if err != nil {
+            return nil, err
+        }
+        songs[song.ID] = song
+    }
+
+    return songs, rows.Err()
+}
+
 func (c *PostgresClient) GetSongByYTID(id string) (Song, bool, error) { 
     return c.GetSong("ytID", id) 
 }
@@ -217,9 +441,37 @@ func (c *PostgresClient) GetSongByKey(k string) (Song, bool, error) {
     return c.GetSong("key", k) 
 }
 
+func (c *PostgresClient) GetSongBySource(source, sourceID string) (Song, bool, error) {
+    query := `SELECT ` + songColumns + ` FROM songs WHERE source = $1 AND "sourceID" = $2`
+
+    song, err := scanSong(c.db.QueryRow(query, source, sourceID))
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return Song{}, false, nil
+        }
+        return Song{}, false, err
+    }
+
+    return song, true, nil
+}
+
+// DeleteSongByID deletes a song and its fingerprints together, so that no
+// orphaned postings are left to be matched. fingerprints has no index on
+// "songID", so this scans the table; it is meant for the occasional removal.
 func (c *PostgresClient) DeleteSongByID(id uint32) error {
-    _, err := c.db.Exec(`DELETE FROM songs WHERE id = $1`, int64(id))
-    return err
+    tx, err := c.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec(`DELETE FROM fingerprints WHERE "songID" = $1`, int64(id)); err != nil {
+        return fmt.Errorf("failed to delete fingerprints: %w", err)
+    }
+    if _, err := tx.Exec(`DELETE FROM songs WHERE id = $1`, int64(id)); err != nil {
+        return fmt.Errorf("failed to delete song: %w", err)
+    }
+    return tx.Commit()
 }
 
 func (c *PostgresClient) DeleteCollection(table string) error {
@@ -228,4 +480,70 @@ func (c *PostgresClient) DeleteCollection(table string) error {
     }
     _, err := c.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
     return err
-}
\ No newline at end of file
+}
+
+func (c *PostgresClient) ListSongs(afterID uint32, limit int) ([]Song, error) {
+    rows, err := c.db.Query(`SELECT `+songColumns+` FROM songs WHERE id > $1 ORDER BY id LIMIT $2`, int64(afterID), limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list songs: %w", err)
+    }
+    defer rows.Close()
+
+    var songs []Song
+    for rows.Next() {
+        song, err := scanSong(rows)
+        if err != nil {
+            return nil, err
+        }
+        songs = append(songs, song)
+    }
+
+    return songs, rows.Err()
+}
+
+func (c *PostgresClient) IterateSongs(fn func(song Song) error) error {
+    rows, err := c.db.Query(`SELECT ` + songColumns + ` FROM songs ORDER BY id`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        song, err := scanSong(rows)
+        if err != nil {
+            return err
+        }
+
+        if err := fn(song); err != nil {
+            return err
+        }
+    }
+
+    return rows.Err()
+}
+
+func (c *PostgresClient) IterateFingerprints(fn func(address int64, couple models.Couple) error) error {
+    // Ordering by the full primary key lets postgres walk the index instead of sorting.
+    rows, err := c.db.Query(`SELECT address, "anchorTimeMs", "songID" FROM fingerprints ORDER BY address, "anchorTimeMs", "songID"`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var couple models.Couple
+        var dbSongID int64
+        var dbAddress int64
+
+        if err := rows.Scan(&dbAddress, &couple.AnchorTime, &dbSongID); err != nil {
+            return err
+        }
+
+        couple.SongId = uint32(dbSongID)
+        if err := fn(dbAddress, couple); err != nil {
+            return err
+        }
+    }
+
+    return rows.Err()
+}
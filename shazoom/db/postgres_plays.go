@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (c *PostgresClient) RecordPlay(play *Play) error {
+	err := c.db.QueryRow(
+		`INSERT INTO plays (source, "songID", title, artist, "startedAt", "endedAt", score, detections)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		play.Source, int64(play.SongID), play.Title, play.Artist, play.StartedAt, play.EndedAt, play.Score, play.Detections,
+	).Scan(&play.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record play: %w", err)
+	}
+	return nil
+}
+
+func (c *PostgresClient) UpdatePlay(play Play) error {
+	res, err := c.db.Exec(
+		`UPDATE plays SET "endedAt" = $2, score = $3, detections = $4 WHERE id = $1`,
+		play.ID, play.EndedAt, play.Score, play.Detections,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update play: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("play %d was never recorded", play.ID)
+	}
+	return nil
+}
+
+func (c *PostgresClient) ListPlays(filter PlayFilter) ([]Play, error) {
+	var where []string
+	var args []any
+	if filter.Source != "" {
+		args = append(args, filter.Source)
+		where = append(where, fmt.Sprintf("source = $%d", len(args)))
+	}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since)
+		where = append(where, fmt.Sprintf(`"endedAt" >= $%d`, len(args)))
+	}
+
+	query := `SELECT id, source, "songID", title, artist, "startedAt", "endedAt", score, detections FROM plays`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY "startedAt" DESC, id DESC`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plays: %w", err)
+	}
+	defer rows.Close()
+
+	var plays []Play
+	for rows.Next() {
+		var play Play
+		var songID int64
+		if err := rows.Scan(&play.ID, &play.Source, &songID, &play.Title, &play.Artist,
+			&play.StartedAt, &play.EndedAt, &play.Score, &play.Detections); err != nil {
+			return nil, err
+		}
+		play.SongID = uint32(songID)
+		plays = append(plays, play)
+	}
+	return plays, rows.Err()
+}
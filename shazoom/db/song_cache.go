@@ -0,0 +1,98 @@
+package db
+
+import "sync"
+
+// SongCache wraps any DBClient with an in-process cache of song metadata by
+// ID, so repeated recognitions of the same songs skip the songs table. Only
+// songs that exist are cached.
+type SongCache struct {
+	DBClient
+	maxEntries int
+
+	mu    sync.RWMutex
+	songs map[uint32]Song
+}
+
+func NewSongCache(backend DBClient, maxEntries int) *SongCache {
+	return &SongCache{
+		DBClient:   backend,
+		maxEntries: maxEntries,
+		songs:      make(map[uint32]Song),
+	}
+}
+
+func (c *SongCache) GetSongByID(songID uint32) (Song, bool, error) {
+	c.mu.RLock()
+	song, ok := c.songs[songID]
+	c.mu.RUnlock()
+	if ok {
+		return song, true, nil
+	}
+
+	song, exists, err := c.DBClient.GetSongByID(songID)
+	if err == nil && exists {
+		c.store(song)
+	}
+	return song, exists, err
+}
+
+func (c *SongCache) GetSongsByIDs(songIDs []uint32) (map[uint32]Song, error) {
+	songs := make(map[uint32]Song, len(songIDs))
+	var missing []uint32
+
+	c.mu.RLock()
+	for _, id := range songIDs {
+		if song, ok := c.songs[id]; ok {
+			songs[id] = song
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return songs, nil
+	}
+
+	fetched, err := c.DBClient.GetSongsByIDs(missing)
+	if err != nil {
+		return nil, err
+	}
+	for id, song := range fetched {
+		songs[id] = song
+		c.store(song)
+	}
+	return songs, nil
+}
+
+func (c *SongCache) store(song Song) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.songs) >= c.maxEntries {
+		// metadata is cheap to refetch, so evicting an arbitrary entry is enough
+		for id := range c.songs {
+			delete(c.songs, id)
+			break
+		}
+	}
+	c.songs[song.ID] = song
+}
+
+func (c *SongCache) DeleteSongByID(songID uint32) error {
+	c.mu.Lock()
+	delete(c.songs, songID)
+	c.mu.Unlock()
+
+	return c.DBClient.DeleteSongByID(songID)
+}
+
+func (c *SongCache) DeleteCollection(collectionName string) error {
+	if collectionName == "songs" {
+		c.mu.Lock()
+		c.songs = make(map[uint32]Song)
+		c.mu.Unlock()
+	}
+
+	return c.DBClient.DeleteCollection(collectionName)
+}
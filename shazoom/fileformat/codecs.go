@@ -0,0 +1,229 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// ErrNoCodec is returned when no registered codec recognises a stream.
+var ErrNoCodec = errors.New("no in-process decoder for this audio format")
+
+// FrameDecoder is an audio stream being decoded in-process.
+type FrameDecoder interface {
+	Format() (sampleRate, channels int)
+	// ReadFrames decodes up to len(dst)/channels frames into dst,
+	// interleaved and normalised to [-1, 1], and returns the number of frames
+	// read. It returns io.EOF after the last frame.
+	ReadFrames(dst []float64) (int, error)
+}
+
+// A FrameDecoder that knows the length of its stream up front reports it
+// with a Frames method, -1 when the header does not say.
+type frameCounter interface {
+	Frames() int64
+}
+
+// Codec decodes one audio format without ffmpeg.
+type Codec struct {
+	Name string
+	// Sniff reports whether header, the first bytes of a stream after any
+	// ID3v2 tag, are in this format.
+	Sniff func(header []byte) bool
+	Open  func(r io.Reader) (FrameDecoder, error)
+}
+
+// sniffLen is how many bytes codecs get to recognise a stream by.
+const sniffLen = 64
+
+var codecs []Codec
+
+// RegisterCodec adds a codec. Codecs are tried in the order they were
+// registered, and formats no codec recognises are left to ffmpeg.
+//
+// WAV, FLAC, Ogg Vorbis and MPEG layer III (MP3) are registered.
+func RegisterCodec(c Codec) {
+	codecs = append(codecs, c)
+}
+
+func init() {
+	RegisterCodec(Codec{
+		Name: "wav",
+		Sniff: func(h []byte) bool {
+			return len(h) >= 12 && (bytes.HasPrefix(h, []byte("RIFF")) || bytes.HasPrefix(h, []byte("RF64")) ||
+				bytes.HasPrefix(h, []byte("BW64"))) && string(h[8:12]) == "WAVE"
+		},
+		Open: func(r io.Reader) (FrameDecoder, error) {
+			w, err := NewWavReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return wavDecoder{w}, nil
+		},
+	})
+
+	RegisterCodec(Codec{
+		Name:  "flac",
+		Sniff: func(h []byte) bool { return bytes.HasPrefix(h, []byte("fLaC")) },
+		Open: func(r io.Reader) (FrameDecoder, error) {
+			f, err := NewFlacReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return flacDecoder{f}, nil
+		},
+	})
+
+	RegisterCodec(Codec{
+		Name: "vorbis",
+		// the first packet of an Ogg Vorbis stream is its identification
+		// header; Ogg also carries Opus and FLAC, which are left to ffmpeg
+		Sniff: func(h []byte) bool {
+			return bytes.HasPrefix(h, []byte("OggS")) && bytes.Contains(h, []byte("\x01vorbis"))
+		},
+		Open: func(r io.Reader) (FrameDecoder, error) {
+			v, err := oggvorbis.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return &vorbisDecoder{r: v}, nil
+		},
+	})
+
+	RegisterCodec(Codec{
+		Name: "mp3",
+		// a frame header, the ID3v2 tag in front of it having been skipped;
+		// layers I and II are left to ffmpeg
+		Sniff: func(h []byte) bool {
+			header, ok := parseMPEGHeader(h)
+			return ok && header.layer == 3
+		},
+		Open: func(r io.Reader) (FrameDecoder, error) {
+			d, err := mp3.NewDecoder(r)
+			if err != nil {
+				return nil, err
+			}
+			return &mp3Decoder{d: d}, nil
+		},
+	})
+}
+
+// openCodec finds the codec for br and opens it. An ID3v2 tag in front of
+// the stream is skipped; otherwise nothing is consumed unless a codec
+// recognises the stream.
+func openCodec(br *bufio.Reader) (FrameDecoder, string, error) {
+	if err := skipID3v2(br); err != nil {
+		return nil, "", err
+	}
+
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+	for _, c := range codecs {
+		if c.Sniff(header) {
+			d, err := c.Open(br)
+			return d, c.Name, err
+		}
+	}
+	return nil, "", ErrNoCodec
+}
+
+// skipID3v2 discards an ID3v2 tag at the start of br, as found in front of
+// MP3 and some FLAC files.
+func skipID3v2(br *bufio.Reader) error {
+	h, err := br.Peek(10)
+	if err != nil || string(h[:3]) != "ID3" {
+		return nil
+	}
+	size := int(h[6]&0x7F)<<21 | int(h[7]&0x7F)<<14 | int(h[8]&0x7F)<<7 | int(h[9]&0x7F)
+	size += 10
+	if h[5]&0x10 != 0 {
+		// footer
+		size += 10
+	}
+	_, err = br.Discard(size)
+	return err
+}
+
+type wavDecoder struct{ *WavReader }
+
+func (d wavDecoder) Format() (int, int) { return d.SampleRate, d.Channels }
+
+type flacDecoder struct{ *FlacReader }
+
+func (d flacDecoder) Format() (int, int) { return d.SampleRate, d.Channels }
+
+func (d flacDecoder) Frames() int64 { return d.TotalFrames }
+
+type vorbisDecoder struct {
+	r   *oggvorbis.Reader
+	buf []float32
+}
+
+func (d *vorbisDecoder) Format() (int, int) { return d.r.SampleRate(), d.r.Channels() }
+
+// Frames is only known for seekable input, which a bufio.Reader is not.
+func (d *vorbisDecoder) Frames() int64 {
+	if n := d.r.Length(); n > 0 {
+		return n
+	}
+	return -1
+}
+
+func (d *vorbisDecoder) ReadFrames(dst []float64) (int, error) {
+	channels := d.r.Channels()
+	want := len(dst) / channels * channels
+	if want == 0 {
+		return 0, nil
+	}
+	if cap(d.buf) < want {
+		d.buf = make([]float32, want)
+	}
+
+	n, err := d.r.Read(d.buf[:want])
+	for i, s := range d.buf[:n] {
+		dst[i] = float64(s)
+	}
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n / channels, err
+}
+
+// mp3Decoder reads the 16-bit stereo go-mp3 always produces, mono files
+// included.
+type mp3Decoder struct {
+	d   *mp3.Decoder
+	buf []byte
+}
+
+func (d *mp3Decoder) Format() (int, int) { return d.d.SampleRate(), 2 }
+
+func (d *mp3Decoder) ReadFrames(dst []float64) (int, error) {
+	frames := len(dst) / 2
+	if frames == 0 {
+		return 0, nil
+	}
+	if cap(d.buf) < frames*4 {
+		d.buf = make([]byte, frames*4)
+	}
+
+	n, err := io.ReadFull(d.d, d.buf[:frames*4])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	frames = n / 4
+	if frames == 0 && err == nil {
+		err = io.EOF
+	}
+	for i := 0; i < frames*2; i++ {
+		dst[i] = float64(int16(binary.LittleEndian.Uint16(d.buf[2*i:]))) / (1 << 15)
+	}
+	return frames, err
+}
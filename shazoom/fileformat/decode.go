@@ -0,0 +1,335 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"shazoom/utils"
+	"strconv"
+	"strings"
+)
+
+// ErrDecodeFailed is returned when ffmpeg cannot decode its input.
+var ErrDecodeFailed = errors.New("ffmpeg could not decode the audio")
+
+// DecodeOptions describes the PCM ffmpeg should produce. Zero values take
+// the defaults.
+type DecodeOptions struct {
+	// SampleRate defaults to 44100 Hz.
+	SampleRate int
+	// Channels is 1 or 2; it defaults to 2 when FINGERPRINT_STEREO is set and
+	// to 1 otherwise.
+	Channels int
+}
+
+func (o DecodeOptions) withDefaults() (DecodeOptions, error) {
+	if o.SampleRate <= 0 {
+		o.SampleRate = 44100
+	}
+	if o.Channels <= 0 {
+		channels, err := FingerprintChannels()
+		if err != nil {
+			return o, err
+		}
+		o.Channels = channels
+	}
+	if o.Channels > 2 {
+		o.Channels = 1
+	}
+	return o, nil
+}
+
+// FingerprintChannels is the number of channels songs are fingerprinted in:
+// 2 when FINGERPRINT_STEREO is set, 1 otherwise.
+func FingerprintChannels() (int, error) {
+	stereo, err := strconv.ParseBool(utils.GetEnv("FINGERPRINT_STEREO", "false"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert env variable (%s) to bool: %v", "FINGERPRINT_STEREO", err)
+	}
+	if stereo {
+		return 2, nil
+	}
+	return 1, nil
+}
+
+// PCMStream is decoded audio at the rate and channel count asked for,
+// normalised to [-1, 1]. It comes from a registered codec when one
+// recognises the input, and from an ffmpeg process writing s16le otherwise.
+type PCMStream struct {
+	SampleRate int
+	Channels   int
+	// Decoder is the name of the codec that decoded the audio, or "ffmpeg".
+	Decoder string
+	// Frames is the number of frames the stream will deliver, or -1 when it
+	// is not known up front, as for anything ffmpeg decodes.
+	Frames int64
+
+	src    interface{ ReadFrames([]float64) (int, error) }
+	ctx    context.Context
+	closer io.Closer
+
+	// set when the stream is read from an ffmpeg process
+	cancel context.CancelFunc
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+// NewPCMReader reads raw s16le audio from r.
+func NewPCMReader(r io.Reader, sampleRate, channels int) *PCMStream {
+	return &PCMStream{
+		SampleRate: sampleRate,
+		Channels:   channels,
+		Frames:     -1,
+		src: &s16leReader{
+			r:          bufio.NewReaderSize(r, 64<<10),
+			sampleRate: sampleRate,
+			channels:   channels,
+		},
+	}
+}
+
+// DecodeFile streams the audio of the file at path as PCM. Formats with a
+// registered codec are decoded in-process; anything else, or a file a codec
+// fails to open, goes through ffmpeg. Nothing is written to disk. The stream
+// must be closed; cancelling ctx stops decoding.
+func DecodeFile(ctx context.Context, path string, opts DecodeOptions) (*PCMStream, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("input file does not exists!: %w", err)
+	}
+
+	s, err := decodeNative(ctx, bufio.NewReaderSize(f, 64<<10), opts)
+	if err == nil {
+		s.closer = f
+		return s, nil
+	}
+	f.Close()
+
+	if !errors.Is(err, ErrNoCodec) {
+		utils.GetLogger().Warn("in-process decoding failed, falling back to ffmpeg",
+			slog.String("file", path), slog.Any("error", err))
+	}
+	return startFFmpeg(ctx, path, nil, opts)
+}
+
+// DecodeReader is DecodeFile for a stream. Since a stream cannot be read
+// twice, ffmpeg only gets it when no codec recognises it.
+func DecodeReader(ctx context.Context, r io.Reader, opts DecodeOptions) (*PCMStream, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	// the codec search only peeks, apart from skipping an ID3v2 tag that
+	// ffmpeg does not need either
+	br := bufio.NewReaderSize(r, 64<<10)
+	s, err := decodeNative(ctx, br, opts)
+	if !errors.Is(err, ErrNoCodec) {
+		return s, err
+	}
+	return startFFmpeg(ctx, "pipe:0", br, opts)
+}
+
+// DecodeRecording decodes raw little-endian PCM as captured by a client.
+// Data that is not whole frames is rejected with ErrInvalidPCM.
+func DecodeRecording(ctx context.Context, data []byte, sampleRate, channels, bitsPerSample int, opts DecodeOptions) (*PCMStream, error) {
+	format, err := checkPCM(data, sampleRate, channels, bitsPerSample)
+	if err != nil {
+		return nil, err
+	}
+	header := format.header(uint32(len(data)))
+	return DecodeReader(ctx, io.MultiReader(bytes.NewReader(header), bytes.NewReader(data)), opts)
+}
+
+// decodeNative opens r with the codec that recognises it.
+func decodeNative(ctx context.Context, r *bufio.Reader, opts DecodeOptions) (*PCMStream, error) {
+	d, name, err := openCodec(r)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := newConverter(d, opts.SampleRate, opts.Channels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &PCMStream{
+		SampleRate: opts.SampleRate,
+		Channels:   opts.Channels,
+		Decoder:    name,
+		Frames:     conv.frames(),
+		src:        conv,
+		ctx:        ctx,
+	}, nil
+}
+
+func startFFmpeg(ctx context.Context, input string, stdin io.Reader, opts DecodeOptions) (*PCMStream, error) {
+	args := []string{"-v", "error"}
+	if stdin == nil {
+		// keep ffmpeg from waiting for commands on the terminal
+		args = append(args, "-nostdin")
+	}
+	args = append(args,
+		"-i", input,
+		"-vn",
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"-ar", fmt.Sprint(opts.SampleRate),
+		"-ac", fmt.Sprint(opts.Channels),
+		"-",
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = stdin
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := NewPCMReader(stdout, opts.SampleRate, opts.Channels)
+	s.Decoder = "ffmpeg"
+	s.ctx, s.cancel, s.cmd = ctx, cancel, cmd
+	cmd.Stderr = &s.stderr
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%w, and ffmpeg is not installed: %w", ErrNoCodec, err)
+		}
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	return s, nil
+}
+
+// ReadFrames decodes up to len(dst)/Channels frames into dst, interleaved,
+// and returns the number of frames read. It returns io.EOF after the last
+// frame, or why decoding failed.
+func (s *PCMStream) ReadFrames(dst []float64) (int, error) {
+	if s.cmd == nil && s.ctx != nil {
+		if err := s.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.src.ReadFrames(dst)
+	if err == io.EOF && s.cmd != nil {
+		return n, s.finish()
+	}
+	return n, err
+}
+
+// ReadAll decodes the rest of the stream into one slice of interleaved
+// samples.
+func (s *PCMStream) ReadAll() ([]float64, error) {
+	var samples []float64
+	buf := make([]float64, 16384*s.Channels)
+	for {
+		n, err := s.ReadFrames(buf)
+		samples = append(samples, buf[:n*s.Channels]...)
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return samples, err
+		}
+	}
+}
+
+// finish reaps ffmpeg once its output is exhausted and returns io.EOF, or
+// why it failed.
+func (s *PCMStream) finish() error {
+	if s.cmd == nil {
+		return io.EOF
+	}
+	if !s.waited {
+		s.waited = true
+		s.err = s.cmd.Wait()
+		if s.err != nil {
+			if ctxErr := s.ctx.Err(); ctxErr != nil {
+				s.err = ctxErr
+			} else {
+				s.err = fmt.Errorf("%w: %v: %s", ErrDecodeFailed, s.err, strings.TrimSpace(s.stderr.String()))
+			}
+		}
+		s.cancel()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	return io.EOF
+}
+
+// Close stops ffmpeg if it is still running and waits for it to exit, or
+// closes the file a codec was reading.
+func (s *PCMStream) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	if s.cmd == nil || s.waited {
+		return nil
+	}
+	s.waited = true
+	s.cancel()
+	// killed on purpose, so its exit status means nothing
+	_ = s.cmd.Wait()
+	return nil
+}
+
+// s16leReader decodes interleaved signed 16-bit little-endian samples.
+type s16leReader struct {
+	r          io.Reader
+	sampleRate int
+	channels   int
+	buf        []byte
+	eof        bool
+}
+
+func (p *s16leReader) Format() (int, int) { return p.sampleRate, p.channels }
+
+func (p *s16leReader) ReadFrames(dst []float64) (int, error) {
+	frames := len(dst) / p.channels
+	if frames == 0 {
+		return 0, nil
+	}
+	if p.eof {
+		return 0, io.EOF
+	}
+
+	want := frames * p.channels * 2
+	if cap(p.buf) < want {
+		p.buf = make([]byte, want)
+	}
+	buf := p.buf[:want]
+
+	n, err := io.ReadFull(p.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+		p.eof = true
+	} else if err != nil {
+		return 0, err
+	}
+
+	frames = n / (p.channels * 2)
+	if frames == 0 {
+		return 0, io.EOF
+	}
+	for i := 0; i < frames*p.channels; i++ {
+		dst[i] = float64(int16(binary.LittleEndian.Uint16(buf[2*i:]))) / (1 << 15)
+	}
+	return frames, nil
+}
@@ -0,0 +1,585 @@
+package fileformat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// FlacReader decodes a native FLAC stream: the STREAMINFO block is read up
+// front, every other metadata block is skipped, and frames are decoded as
+// samples are read. Frame CRCs are checked.
+type FlacReader struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	// TotalFrames is the length from STREAMINFO, or -1 when unknown.
+	TotalFrames int64
+
+	br    *flacBits
+	block [][]int64 // the decoded channels of the current frame
+	pos   int       // next sample of block to return
+	eof   bool
+}
+
+// NewFlacReader reads the metadata blocks of a FLAC stream up to its first
+// frame.
+func NewFlacReader(r io.Reader) (*FlacReader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, 64<<10)
+	}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil || string(magic[:]) != "fLaC" {
+		return nil, errors.New("not a FLAC stream")
+	}
+
+	f := &FlacReader{br: &flacBits{r: br}}
+	haveInfo := false
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, fmt.Errorf("truncated FLAC metadata: %w", err)
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if blockType != 0 {
+			if _, err := io.CopyN(io.Discard, br, size); err != nil {
+				return nil, fmt.Errorf("cannot skip FLAC metadata block %d: %w", blockType, err)
+			}
+			continue
+		}
+
+		info, err := readChunk(br, size)
+		if err != nil || len(info) < 34 {
+			return nil, errors.New("invalid FLAC STREAMINFO block")
+		}
+		packed := binary.BigEndian.Uint64(info[10:18])
+		f.SampleRate = int(packed >> 44)
+		f.Channels = int(packed>>41&0x7) + 1
+		f.BitsPerSample = int(packed>>36&0x1F) + 1
+		f.TotalFrames = int64(packed & (1<<36 - 1))
+		if f.TotalFrames == 0 {
+			f.TotalFrames = -1
+		}
+		haveInfo = true
+	}
+
+	if !haveInfo || f.SampleRate == 0 {
+		return nil, errors.New("FLAC stream has no STREAMINFO")
+	}
+	return f, nil
+}
+
+// ReadFrames decodes up to len(dst)/Channels frames into dst, interleaved
+// and normalised to [-1, 1], and returns the number of frames read. It
+// returns io.EOF after the last frame.
+func (f *FlacReader) ReadFrames(dst []float64) (int, error) {
+	frames := len(dst) / f.Channels
+	scale := float64(int64(1) << (f.BitsPerSample - 1))
+
+	n := 0
+	for n < frames {
+		if len(f.block) == 0 || f.pos == len(f.block[0]) {
+			if f.eof {
+				break
+			}
+			if err := f.readFrame(); err == io.EOF {
+				f.eof = true
+				break
+			} else if err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		count := min(frames-n, len(f.block[0])-f.pos)
+		for i := 0; i < count; i++ {
+			for c, samples := range f.block {
+				dst[(n+i)*f.Channels+c] = float64(samples[f.pos+i]) / scale
+			}
+		}
+		n += count
+		f.pos += count
+	}
+
+	if n == 0 && frames > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+var flacSampleSizes = [...]int{0, 8, 12, 0, 16, 20, 24, 32}
+
+const (
+	flacIndependent = iota
+	flacLeftSide
+	flacRightSide
+	flacMidSide
+)
+
+// readFrame decodes the next frame into f.block.
+func (f *FlacReader) readFrame() error {
+	b := f.br
+	if err := b.sync(); err != nil {
+		return err
+	}
+
+	// the two sync bytes are part of both CRCs
+	b.crc8, b.crc16 = 0, 0
+	b.update(0xFF)
+	b.update(b.syncByte)
+
+	h, err := b.bits(16)
+	if err != nil {
+		return noEOF(err)
+	}
+	blockSizeCode := int(h >> 12)
+	rateCode := int(h >> 8 & 0xF)
+	assignment := int(h >> 4 & 0xF)
+	sizeCode := int(h >> 1 & 0x7)
+
+	// frame or sample number, UTF-8 coded
+	first, err := b.bits(8)
+	if err != nil {
+		return noEOF(err)
+	}
+	for extra := bits.LeadingZeros8(^uint8(first)) - 1; extra > 0; extra-- {
+		if _, err := b.bits(8); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		v, err := b.bits(8)
+		if err != nil {
+			return noEOF(err)
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode == 7:
+		v, err := b.bits(16)
+		if err != nil {
+			return noEOF(err)
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return errors.New("invalid FLAC block size")
+	}
+
+	switch rateCode {
+	case 12:
+		_, err = b.bits(8)
+	case 13, 14:
+		_, err = b.bits(16)
+	case 15:
+		return errors.New("invalid FLAC sample rate")
+	}
+	if err != nil {
+		return noEOF(err)
+	}
+
+	bps := f.BitsPerSample
+	if sizeCode != 0 {
+		bps = flacSampleSizes[sizeCode]
+		if bps == 0 {
+			return errors.New("invalid FLAC sample size")
+		}
+	}
+	if bps != f.BitsPerSample {
+		return fmt.Errorf("FLAC frame of %d bits in a %d-bit stream", bps, f.BitsPerSample)
+	}
+
+	channels, mode := assignment+1, flacIndependent
+	switch {
+	case assignment >= 8 && assignment <= 10:
+		channels, mode = 2, assignment-7
+	case assignment > 10:
+		return errors.New("invalid FLAC channel assignment")
+	}
+	if channels != f.Channels {
+		return fmt.Errorf("FLAC frame with %d channels in a %d-channel stream", channels, f.Channels)
+	}
+
+	crc8 := b.crc8
+	v, err := b.bits(8)
+	if err != nil {
+		return noEOF(err)
+	}
+	if uint8(v) != crc8 {
+		return errors.New("FLAC frame header CRC mismatch")
+	}
+
+	if len(f.block) != channels || cap(f.block[0]) < blockSize {
+		f.block = make([][]int64, channels)
+		for c := range f.block {
+			f.block[c] = make([]int64, blockSize)
+		}
+	}
+	for c := range f.block {
+		f.block[c] = f.block[c][:blockSize]
+		// the side channel is one bit wider, 33 bits for 32-bit audio
+		subBPS := bps
+		if (mode == flacLeftSide || mode == flacMidSide) && c == 1 || mode == flacRightSide && c == 0 {
+			subBPS++
+		}
+		if err := b.subframe(f.block[c], subBPS); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	b.align()
+	crc16 := b.crc16
+	v, err = b.bits(16)
+	if err != nil {
+		return noEOF(err)
+	}
+	if uint16(v) != crc16 {
+		return errors.New("FLAC frame CRC mismatch")
+	}
+
+	left, right := f.block[0], f.block[len(f.block)-1]
+	for i := 0; i < blockSize; i++ {
+		switch mode {
+		case flacLeftSide:
+			right[i] = left[i] - right[i]
+		case flacRightSide:
+			left[i] += right[i]
+		case flacMidSide:
+			mid := left[i]<<1 | right[i]&1
+			side := right[i]
+			left[i], right[i] = (mid+side)>>1, (mid-side)>>1
+		}
+	}
+	f.pos = 0
+	return nil
+}
+
+// subframe decodes one channel of a frame into out.
+func (b *flacBits) subframe(out []int64, bps int) error {
+	h, err := b.bits(8)
+	if err != nil {
+		return err
+	}
+	if h&0x80 != 0 {
+		return errors.New("invalid FLAC subframe padding")
+	}
+	kind := int(h >> 1 & 0x3F)
+
+	wasted := 0
+	if h&1 != 0 {
+		k, err := b.unary()
+		if err != nil {
+			return err
+		}
+		wasted = int(k) + 1
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0:
+		v, err := b.signed(bps)
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = v
+		}
+
+	case kind == 1:
+		for i := range out {
+			if out[i], err = b.signed(bps); err != nil {
+				return err
+			}
+		}
+
+	case kind >= 8 && kind <= 12:
+		order := kind - 8
+		if order > len(out) {
+			return errors.New("FLAC predictor order exceeds the block size")
+		}
+		for i := 0; i < order; i++ {
+			if out[i], err = b.signed(bps); err != nil {
+				return err
+			}
+		}
+		if err := b.residual(out, order); err != nil {
+			return err
+		}
+		for i := order; i < len(out); i++ {
+			switch order {
+			case 1:
+				out[i] += out[i-1]
+			case 2:
+				out[i] += 2*out[i-1] - out[i-2]
+			case 3:
+				out[i] += 3*out[i-1] - 3*out[i-2] + out[i-3]
+			case 4:
+				out[i] += 4*out[i-1] - 6*out[i-2] + 4*out[i-3] - out[i-4]
+			}
+		}
+
+	case kind >= 32:
+		order := kind - 31
+		if order > len(out) {
+			return errors.New("FLAC predictor order exceeds the block size")
+		}
+		for i := 0; i < order; i++ {
+			if out[i], err = b.signed(bps); err != nil {
+				return err
+			}
+		}
+		p, err := b.bits(4)
+		if err != nil {
+			return err
+		}
+		if p == 0xF {
+			return errors.New("invalid FLAC coefficient precision")
+		}
+		shift, err := b.signed(5)
+		if err != nil {
+			return err
+		}
+		if shift < 0 {
+			return errors.New("negative FLAC predictor shift")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			if coefs[i], err = b.signed(int(p) + 1); err != nil {
+				return err
+			}
+		}
+		if err := b.residual(out, order); err != nil {
+			return err
+		}
+		for i := order; i < len(out); i++ {
+			var sum int64
+			for j, c := range coefs {
+				sum += c * out[i-1-j]
+			}
+			out[i] += sum >> shift
+		}
+
+	default:
+		return fmt.Errorf("reserved FLAC subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// residual reads the Rice-coded residual of a predicted subframe into
+// out[order:].
+func (b *flacBits) residual(out []int64, order int) error {
+	method, err := b.bits(2)
+	if err != nil {
+		return err
+	}
+	paramBits, escape := uint(4), uint64(0xF)
+	switch method {
+	case 0:
+	case 1:
+		paramBits, escape = 5, 0x1F
+	default:
+		return errors.New("reserved FLAC residual coding method")
+	}
+
+	partitionOrder, err := b.bits(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	if len(out)%partitions != 0 || len(out)/partitions < order {
+		return errors.New("invalid FLAC residual partition order")
+	}
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * len(out) / partitions
+		param, err := b.bits(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if param == escape {
+			n, err := b.bits(5)
+			if err != nil {
+				return err
+			}
+			for ; i < end; i++ {
+				if n == 0 {
+					out[i] = 0
+				} else if out[i], err = b.signed(int(n)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for ; i < end; i++ {
+			q, err := b.unary()
+			if err != nil {
+				return err
+			}
+			low, err := b.bits(uint(param))
+			if err != nil {
+				return err
+			}
+			u := q<<param | low
+			out[i] = int64(u>>1) ^ -int64(u&1)
+		}
+	}
+	return nil
+}
+
+// flacBits reads a FLAC stream bit by bit, most significant bit first, and
+// keeps the CRCs of the bytes read since they were last reset.
+type flacBits struct {
+	r        *bufio.Reader
+	cur      uint64
+	n        uint // bits of cur not yet consumed, always < 8 between reads
+	crc8     uint8
+	crc16    uint16
+	syncByte byte
+}
+
+func (b *flacBits) update(c byte) {
+	b.crc8 = crc8Table[b.crc8^c]
+	b.crc16 = b.crc16<<8 ^ crc16Table[byte(b.crc16>>8)^c]
+}
+
+func (b *flacBits) fill() error {
+	c, err := b.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	b.update(c)
+	b.cur = b.cur<<8 | uint64(c)
+	b.n += 8
+	return nil
+}
+
+// bits reads an n-bit unsigned value, n <= 56.
+func (b *flacBits) bits(n uint) (uint64, error) {
+	for b.n < n {
+		if err := b.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b.n -= n
+	return b.cur >> b.n & (1<<n - 1), nil
+}
+
+// signed reads an n-bit two's complement value.
+func (b *flacBits) signed(n int) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := b.bits(uint(n))
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// unary counts the zero bits before the next one bit.
+func (b *flacBits) unary() (uint64, error) {
+	var zeros uint64
+	for {
+		if b.n == 0 {
+			if err := b.fill(); err != nil {
+				return 0, err
+			}
+		}
+		rest := b.cur & (1<<b.n - 1)
+		if rest == 0 {
+			zeros += uint64(b.n)
+			b.n = 0
+			continue
+		}
+		lead := b.n - uint(bits.Len64(rest))
+		zeros += uint64(lead)
+		b.n -= lead + 1
+		return zeros, nil
+	}
+}
+
+// align skips to the next byte boundary.
+func (b *flacBits) align() {
+	b.n = 0
+}
+
+// sync skips to the next frame sync code, so junk between frames (or an
+// ID3v1 tag at the end) is passed over. It returns io.EOF at the end of the
+// stream.
+func (b *flacBits) sync() error {
+	b.align()
+	for {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			return io.EOF
+		}
+		if c != 0xFF {
+			continue
+		}
+		next, err := b.r.Peek(1)
+		if err != nil {
+			return io.EOF
+		}
+		if next[0]&0xFE == 0xF8 {
+			b.syncByte, _ = b.r.ReadByte()
+			return nil
+		}
+	}
+}
+
+// noEOF turns the end of the stream inside a frame into an error.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var (
+	crc8Table  [256]uint8
+	crc16Table [256]uint16
+)
+
+func init() {
+	for i := range 256 {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for range 8 {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		crc8Table[i] = c8
+		crc16Table[i] = c16
+	}
+}
@@ -0,0 +1,103 @@
+package fileformat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+)
+
+// ErrUnsupportedMedia is returned for recordings whose MIME type is not
+// accepted, or whose data is not of the type they declare.
+var ErrUnsupportedMedia = errors.New("unsupported recording media type")
+
+// mediaType is a compressed format clients may upload recordings in.
+type mediaType struct {
+	ext   string
+	sniff func(header []byte) bool
+}
+
+func isEBML(h []byte) bool { return bytes.HasPrefix(h, []byte{0x1A, 0x45, 0xDF, 0xA3}) }
+func isOgg(h []byte) bool  { return bytes.HasPrefix(h, []byte("OggS")) }
+func isMP4(h []byte) bool  { return len(h) >= 8 && string(h[4:8]) == "ftyp" }
+func isWAV(h []byte) bool  { return sniffTagFormat(h) == tagFormatWAV }
+
+// isADTS matches an AAC ADTS frame header, possibly behind an ID3v2 tag.
+func isADTS(h []byte) bool {
+	return bytes.HasPrefix(h, []byte("ID3")) || (len(h) >= 2 && h[0] == 0xFF && h[1]&0xF6 == 0xF0)
+}
+
+// mediaTypes are the recording formats accepted besides raw PCM: what
+// MediaRecorder produces in browsers (WebM or Ogg with Opus, MP4 with AAC)
+// and WAV.
+var mediaTypes = map[string]mediaType{
+	"audio/webm":  {".webm", isEBML},
+	"video/webm":  {".webm", isEBML},
+	"audio/ogg":   {".ogg", isOgg},
+	"audio/opus":  {".opus", isOgg},
+	"audio/mp4":   {".m4a", isMP4},
+	"audio/m4a":   {".m4a", isMP4},
+	"audio/x-m4a": {".m4a", isMP4},
+	"audio/aac":   {".aac", isADTS},
+	"audio/x-aac": {".aac", isADTS},
+	"audio/wav":   {".wav", isWAV},
+	"audio/wave":  {".wav", isWAV},
+	"audio/x-wav": {".wav", isWAV},
+}
+
+// IsPCMMediaType reports whether mimeType is raw little-endian PCM, which
+// comes without a header and is decoded with DecodeRecording. An empty type
+// is PCM, as sent by clients older than MIME typed recordings.
+func IsPCMMediaType(mimeType string) bool {
+	if strings.TrimSpace(mimeType) == "" {
+		return true
+	}
+	base, _, err := mime.ParseMediaType(mimeType)
+	return err == nil && (base == "audio/pcm" || base == "audio/l16")
+}
+
+func lookupMediaType(mimeType string) (mediaType, error) {
+	base, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mediaType{}, fmt.Errorf("%w: %q", ErrUnsupportedMedia, mimeType)
+	}
+	t, ok := mediaTypes[base]
+	if !ok {
+		return mediaType{}, fmt.Errorf("%w: %s", ErrUnsupportedMedia, base)
+	}
+	return t, nil
+}
+
+// DecodeMedia decodes a compressed recording of the given MIME type, such as
+// "audio/webm;codecs=opus". Formats with an in-process codec are decoded
+// natively and the rest, Opus and AAC among them, through ffmpeg.
+func DecodeMedia(ctx context.Context, data []byte, mimeType string, opts DecodeOptions) (*PCMStream, error) {
+	t, err := lookupMediaType(mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if !t.sniff(data[:min(len(data), sniffLen)]) {
+		return nil, fmt.Errorf("%w: data is not %s", ErrUnsupportedMedia, mimeType)
+	}
+	return DecodeReader(ctx, bytes.NewReader(data), opts)
+}
+
+// ArchiveMedia keeps a compressed recording as it was uploaded, as
+// recordings/<unix nanos>.<ext>, and returns its path.
+func ArchiveMedia(data []byte, mimeType string) (string, error) {
+	t, err := lookupMediaType(mimeType)
+	if err != nil {
+		return "", err
+	}
+	filePath, err := archivePath(t.ext)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
@@ -0,0 +1,225 @@
+package fileformat
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// converter maps the channels of a decoder onto 1 or 2 and resamples it to
+// a target rate, doing in-process what `ffmpeg -ac -ar` does for the pipe.
+type converter struct {
+	src      FrameDecoder
+	srcRate  int
+	srcCh    int
+	channels int
+	in       []float64
+	mapped   []float64
+	rs       *resampler
+}
+
+// Limits on what a converter takes from a decoder. The format comes from the
+// stream's header, so it sizes buffers only once it is known to be sane: the
+// resampler's kernel grows with the ratio of the rates.
+const (
+	maxSampleRate = 768000
+	// maxDownsampling is the largest ratio of source to target rate.
+	maxDownsampling = 32
+	// convertChunkFrames is the most frames a converter reads from its
+	// decoder at once.
+	convertChunkFrames = 4096
+)
+
+func newConverter(src FrameDecoder, sampleRate, channels int) (*converter, error) {
+	srcRate, srcCh := src.Format()
+	if srcCh < 1 || srcCh > MaxChannels {
+		return nil, fmt.Errorf("%w: %d channels", ErrUnsupportedFormat, srcCh)
+	}
+	if srcRate < 1 || srcRate > maxSampleRate || sampleRate < 1 || sampleRate > maxSampleRate {
+		return nil, fmt.Errorf("%w: cannot resample %d Hz to %d Hz", ErrUnsupportedFormat, srcRate, sampleRate)
+	}
+	if srcRate > sampleRate*maxDownsampling {
+		return nil, fmt.Errorf("%w: cannot resample %d Hz down to %d Hz", ErrUnsupportedFormat, srcRate, sampleRate)
+	}
+
+	c := &converter{src: src, srcRate: srcRate, srcCh: srcCh, channels: channels}
+	if srcRate != sampleRate {
+		c.rs = newResampler(srcRate, sampleRate, channels)
+	}
+	return c, nil
+}
+
+// readMapped reads up to len(dst)/channels source frames, at most
+// convertChunkFrames, with their channels mapped: mono sources are copied to
+// both sides, stereo ones averaged for mono, and of any wider layout the
+// first two channels (the front pair) are kept.
+func (c *converter) readMapped(dst []float64) (int, error) {
+	frames := min(len(dst)/c.channels, convertChunkFrames)
+	if cap(c.in) < frames*c.srcCh {
+		c.in = make([]float64, frames*c.srcCh)
+	}
+	n, err := c.src.ReadFrames(c.in[:frames*c.srcCh])
+	for i := 0; i < n; i++ {
+		frame := c.in[i*c.srcCh : (i+1)*c.srcCh]
+		switch {
+		case c.channels == c.srcCh:
+			copy(dst[i*c.channels:], frame)
+		case c.channels == 1:
+			var sum float64
+			for _, s := range frame {
+				sum += s
+			}
+			dst[i] = sum / float64(c.srcCh)
+		case c.srcCh == 1:
+			dst[2*i], dst[2*i+1] = frame[0], frame[0]
+		default:
+			dst[2*i], dst[2*i+1] = frame[0], frame[1]
+		}
+	}
+	return n, err
+}
+
+// frames is the number of frames the converter will produce, or -1 when its
+// decoder does not know its length.
+func (c *converter) frames() int64 {
+	counter, ok := c.src.(frameCounter)
+	if !ok {
+		return -1
+	}
+	n := counter.Frames()
+	if n < 0 || c.rs == nil {
+		return n
+	}
+	// as many as the resampler's read produces once it reaches the end
+	return int64(math.Ceil(float64(n) / c.rs.step))
+}
+
+func (c *converter) ReadFrames(dst []float64) (int, error) {
+	if c.rs == nil {
+		return c.readMapped(dst)
+	}
+
+	for {
+		if n := c.rs.read(dst); n > 0 {
+			return n, nil
+		}
+		if c.rs.eof {
+			return 0, io.EOF
+		}
+
+		if cap(c.mapped) < convertChunkFrames*c.channels {
+			c.mapped = make([]float64, convertChunkFrames*c.channels)
+		}
+		n, err := c.readMapped(c.mapped[:convertChunkFrames*c.channels])
+		c.rs.write(c.mapped[:n*c.channels])
+		if err == io.EOF {
+			c.rs.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// resamplerTaps is the half width of the interpolation kernel in samples of
+// the lower of the two rates, and kernelPhases its resolution per sample.
+const (
+	resamplerTaps = 16
+	kernelPhases  = 256
+)
+
+// resampler converts interleaved frames between sample rates with a
+// Blackman-windowed sinc, low-passed at the lower of the two Nyquist rates.
+type resampler struct {
+	channels int
+	step     float64 // input frames per output frame
+	cutoff   float64
+	half     int       // kernel half width in input frames
+	kernel   []float64 // kernel at kernelPhases points per input frame
+
+	buf  []float64 // interleaved input frames from frame base on
+	base int64
+	out  int64 // output frames produced
+	eof  bool
+}
+
+func newResampler(from, to, channels int) *resampler {
+	r := &resampler{
+		channels: channels,
+		step:     float64(from) / float64(to),
+		cutoff:   min(1, float64(to)/float64(from)),
+	}
+	r.half = int(math.Ceil(resamplerTaps / r.cutoff))
+	r.kernel = make([]float64, r.half*kernelPhases+2)
+	for i := range r.kernel {
+		d := float64(i) / kernelPhases
+		x := d / float64(r.half)
+		if x > 1 {
+			continue
+		}
+		window := 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+		r.kernel[i] = r.cutoff * sinc(r.cutoff*d) * window
+	}
+	return r
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+func (r *resampler) write(frames []float64) {
+	r.buf = append(r.buf, frames...)
+}
+
+func (r *resampler) weight(d float64) float64 {
+	pos := math.Abs(d) * kernelPhases
+	i := int(pos)
+	if i+1 >= len(r.kernel) {
+		return 0
+	}
+	frac := pos - float64(i)
+	return r.kernel[i]*(1-frac) + r.kernel[i+1]*frac
+}
+
+// read produces the output frames whose kernels are covered by the input
+// written so far, or by the end of the input once eof is set.
+func (r *resampler) read(dst []float64) int {
+	available := r.base + int64(len(r.buf)/r.channels)
+	total := int64(math.Ceil(float64(available) / r.step))
+
+	n := 0
+	for ; n < len(dst)/r.channels; n++ {
+		t := float64(r.out) * r.step
+		center := int64(math.Floor(t))
+		if r.eof {
+			if r.out >= total {
+				break
+			}
+		} else if center+int64(r.half) >= available {
+			break
+		}
+
+		for c := 0; c < r.channels; c++ {
+			var sum float64
+			for k := center - int64(r.half) + 1; k <= center+int64(r.half); k++ {
+				if k < r.base || k >= available {
+					continue
+				}
+				sum += r.buf[int(k-r.base)*r.channels+c] * r.weight(t-float64(k))
+			}
+			dst[n*r.channels+c] = sum
+		}
+		r.out++
+	}
+
+	// drop the input no later output frame needs
+	keepFrom := int64(math.Floor(float64(r.out)*r.step)) - int64(r.half) + 1
+	if drop := keepFrom - r.base; drop > 0 {
+		drop = min(drop, int64(len(r.buf)/r.channels))
+		r.buf = append(r.buf[:0], r.buf[int(drop)*r.channels:]...)
+		r.base += drop
+	}
+	return n
+}
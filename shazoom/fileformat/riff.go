@@ -0,0 +1,301 @@
+package fileformat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Format codes of the fmt chunk. Extensible files carry the real code in the
+// first two bytes of their sub-format GUID.
+const (
+	WaveFormatPCM        = 0x0001
+	WaveFormatIEEEFloat  = 0x0003
+	WaveFormatExtensible = 0xFFFE
+)
+
+// MaxChannels is the most channels a WAV file or raw recording may have, 7.1
+// surround. Larger counts only come from corrupt or hostile headers, whose
+// frames would be too large to buffer.
+const MaxChannels = 8
+
+// sizeFromDS64 marks a RIFF or data chunk size that is too large for 32 bits
+// and is given by the ds64 chunk of an RF64 file instead.
+const sizeFromDS64 = 0xFFFFFFFF
+
+var (
+	ErrNotWav            = errors.New("not a RIFF/WAVE file")
+	ErrUnsupportedFormat = errors.New("unsupported WAV sample format")
+)
+
+// WavFormat describes the samples of a WAV file.
+type WavFormat struct {
+	// AudioFormat is WaveFormatPCM or WaveFormatIEEEFloat, resolved from the
+	// sub-format of extensible files.
+	AudioFormat   int
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	// BlockAlign is the size of one frame, a sample of every channel, in
+	// bytes.
+	BlockAlign  int
+	ChannelMask uint32
+}
+
+// WavReader walks the chunks of a RIFF/WAVE (or RF64) stream up to its data
+// chunk and then decodes the samples as they are read, normalised to
+// [-1, 1]. Chunks other than fmt, ds64 and data are skipped.
+type WavReader struct {
+	WavFormat
+
+	r         io.Reader
+	remaining int64 // bytes left in the data chunk, -1 until EOF
+	frames    int64
+	buf       []byte
+	decode    func(b []byte) float64
+}
+
+// NewWavReader reads the header of a WAV stream. It returns once it has
+// reached the first sample, so only the header is buffered.
+func NewWavReader(r io.Reader) (*WavReader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, 64<<10)
+	}
+
+	var riff [12]byte
+	if _, err := io.ReadFull(br, riff[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotWav, err)
+	}
+	id := string(riff[0:4])
+	if (id != "RIFF" && id != "RF64" && id != "BW64") || string(riff[8:12]) != "WAVE" {
+		return nil, ErrNotWav
+	}
+	rf64 := id != "RIFF"
+
+	w := &WavReader{r: br}
+	var (
+		haveFormat bool
+		ds64Data   int64 = -1
+	)
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, fmt.Errorf("no data chunk found: %w", err)
+		}
+		chunkID := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch chunkID {
+		case "ds64":
+			chunk, err := readChunk(br, size)
+			if err != nil {
+				return nil, err
+			}
+			if len(chunk) < 24 {
+				return nil, errors.New("ds64 chunk too short")
+			}
+			ds64Data = int64(binary.LittleEndian.Uint64(chunk[8:16]))
+
+		case "fmt ":
+			chunk, err := readChunk(br, size)
+			if err != nil {
+				return nil, err
+			}
+			if err := w.parseFormat(chunk); err != nil {
+				return nil, err
+			}
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return nil, errors.New("data chunk before fmt chunk")
+			}
+			switch {
+			case size == sizeFromDS64 && rf64 && ds64Data >= 0:
+				size = ds64Data
+			case size == sizeFromDS64 || size == 0:
+				// written by a streaming encoder that never went back to
+				// fill in the size: read to the end
+				size = -1
+			}
+			w.remaining = size
+			if size >= 0 {
+				w.frames = size / int64(w.BlockAlign)
+			} else {
+				w.frames = -1
+			}
+			return w, nil
+
+		default:
+			if err := skipChunk(br, size); err != nil {
+				return nil, fmt.Errorf("cannot skip %q chunk: %w", chunkID, err)
+			}
+		}
+	}
+}
+
+func readChunk(r io.Reader, size int64) ([]byte, error) {
+	if size > 1<<20 {
+		return nil, fmt.Errorf("chunk of %d bytes is too large", size)
+	}
+	chunk := make([]byte, size+size%2)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, fmt.Errorf("truncated chunk: %w", err)
+	}
+	return chunk[:size], nil
+}
+
+// skipChunk discards a chunk and its pad byte.
+func skipChunk(r io.Reader, size int64) error {
+	n, err := io.CopyN(io.Discard, r, size+size%2)
+	if err == io.EOF && n >= size {
+		// a missing pad byte at the end of the file
+		return nil
+	}
+	return err
+}
+
+func (w *WavReader) parseFormat(chunk []byte) error {
+	if len(chunk) < 16 {
+		return errors.New("fmt chunk too short")
+	}
+
+	format := int(binary.LittleEndian.Uint16(chunk[0:2]))
+	w.Channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+	w.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+	w.BlockAlign = int(binary.LittleEndian.Uint16(chunk[12:14]))
+	w.BitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:16]))
+
+	if format == WaveFormatExtensible {
+		if len(chunk) < 40 {
+			return errors.New("extensible fmt chunk too short")
+		}
+		w.ChannelMask = binary.LittleEndian.Uint32(chunk[20:24])
+		format = int(binary.LittleEndian.Uint16(chunk[24:26]))
+	}
+	w.AudioFormat = format
+
+	if w.Channels < 1 || w.Channels > MaxChannels || w.SampleRate < 1 {
+		return fmt.Errorf("invalid fmt chunk (channels: %d, sample rate: %d)", w.Channels, w.SampleRate)
+	}
+
+	bytesPerSample := (w.BitsPerSample + 7) / 8
+	if w.BlockAlign < bytesPerSample*w.Channels {
+		w.BlockAlign = bytesPerSample * w.Channels
+	}
+	// extra bytes in a block belong to the container, not the samples
+	bytesPerSample = w.BlockAlign / w.Channels
+
+	switch {
+	case format == WaveFormatPCM && bytesPerSample == 1:
+		w.decode = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == WaveFormatPCM && bytesPerSample == 2:
+		w.decode = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == WaveFormatPCM && bytesPerSample == 3:
+		w.decode = func(b []byte) float64 {
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float64(v) / (1 << 23)
+		}
+	case format == WaveFormatPCM && bytesPerSample == 4:
+		w.decode = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == WaveFormatIEEEFloat && bytesPerSample == 4:
+		w.decode = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case format == WaveFormatIEEEFloat && bytesPerSample == 8:
+		w.decode = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return fmt.Errorf("%w: format 0x%04x with %d bits per sample", ErrUnsupportedFormat, format, w.BitsPerSample)
+	}
+	return nil
+}
+
+// Frames is the number of frames in the data chunk, or -1 when the header
+// does not say.
+func (w *WavReader) Frames() int64 {
+	return w.frames
+}
+
+// Duration is the length of the audio in seconds, or -1 when unknown.
+func (w *WavReader) Duration() float64 {
+	if w.frames < 0 {
+		return -1
+	}
+	return float64(w.frames) / float64(w.SampleRate)
+}
+
+// ReadFrames decodes up to len(dst)/Channels frames into dst, interleaved,
+// and returns the number of frames read. It returns io.EOF after the last
+// frame; a partial frame at the end of a truncated file is dropped.
+func (w *WavReader) ReadFrames(dst []float64) (int, error) {
+	frames := len(dst) / w.Channels
+	if frames == 0 {
+		return 0, nil
+	}
+
+	want := int64(frames * w.BlockAlign)
+	if w.remaining >= 0 && want > w.remaining {
+		want = w.remaining - w.remaining%int64(w.BlockAlign)
+	}
+	if want == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(cap(w.buf)) < want {
+		w.buf = make([]byte, want)
+	}
+	buf := w.buf[:want]
+
+	n, err := io.ReadFull(w.r, buf)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && w.remaining < 0) {
+		err = nil
+		w.remaining = 0
+	} else if err != nil {
+		return 0, err
+	}
+	if w.remaining > 0 {
+		w.remaining -= int64(n)
+	}
+
+	frames = n / w.BlockAlign
+	if frames == 0 {
+		return 0, io.EOF
+	}
+
+	sampleSize := w.BlockAlign / w.Channels
+	for i := 0; i < frames*w.Channels; i++ {
+		dst[i] = w.decode(buf[i*sampleSize:])
+	}
+	return frames, nil
+}
+
+// ReadMono decodes up to len(dst) frames, each the average of its channels.
+func (w *WavReader) ReadMono(dst []float64) (int, error) {
+	if w.Channels == 1 {
+		return w.ReadFrames(dst)
+	}
+
+	frameBuf := make([]float64, min(len(dst), 4096)*w.Channels)
+	total := 0
+	for total < len(dst) {
+		n, err := w.ReadFrames(frameBuf[:min(len(dst)-total, 4096)*w.Channels])
+		for i := 0; i < n; i++ {
+			var sum float64
+			for _, s := range frameBuf[i*w.Channels : (i+1)*w.Channels] {
+				sum += s
+			}
+			dst[total+i] = sum / float64(w.Channels)
+		}
+		total += n
+		if err != nil {
+			if total > 0 && err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,238 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"shazoom/utils"
+	"strings"
+)
+
+var (
+	// ErrTagsUnsupported is returned by WriteTags for formats it cannot tag.
+	ErrTagsUnsupported = errors.New("cannot write tags to this file format")
+	// ErrInvalidTags is returned by ReadTags for a file whose metadata it
+	// cannot parse.
+	ErrInvalidTags = errors.New("invalid tags")
+)
+
+// Tags is the metadata of an audio file that songs are saved under.
+type Tags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	// Duration is in seconds, zero when the container does not say.
+	Duration float64
+}
+
+// fill sets the fields of t that are empty from other.
+func (t *Tags) fill(other Tags) {
+	for _, f := range []struct{ dst, src *string }{
+		{&t.Title, &other.Title},
+		{&t.Artist, &other.Artist},
+		{&t.Album, &other.Album},
+		{&t.AlbumArtist, &other.AlbumArtist},
+	} {
+		if *f.dst == "" {
+			*f.dst = strings.TrimSpace(*f.src)
+		}
+	}
+	if t.Duration == 0 {
+		t.Duration = other.Duration
+	}
+}
+
+type tagFormat int
+
+const (
+	tagFormatUnknown tagFormat = iota
+	tagFormatWAV
+	tagFormatFLAC
+	tagFormatOgg
+	tagFormatMP4
+	tagFormatMPEG // MP3 and other raw streams tagged with ID3
+)
+
+func sniffTagFormat(header []byte) tagFormat {
+	switch {
+	case len(header) >= 12 && (bytes.HasPrefix(header, []byte("RIFF")) || bytes.HasPrefix(header, []byte("RF64"))) &&
+		string(header[8:12]) == "WAVE":
+		return tagFormatWAV
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return tagFormatFLAC
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return tagFormatOgg
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return tagFormatMP4
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return tagFormatMPEG
+	}
+	return tagFormatUnknown
+}
+
+// ReadTags reads the tags of the file at path from ID3v1/v2, FLAC and Ogg
+// Vorbis comments, MP4 atoms or a WAV LIST/INFO chunk, without ffprobe.
+// Files without tags, or in formats it does not know, give empty Tags. The
+// duration of MPEG audio is worked out from its frames, TLEN only being used
+// when no frame is found.
+func ReadTags(path string) (Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Tags{}, err
+	}
+	defer f.Close()
+
+	var tags Tags
+	br := bufio.NewReaderSize(f, 64<<10)
+	prefix, err := readID3v2(br)
+	if err != nil {
+		return Tags{}, fmt.Errorf("cannot read tags of %s: %w: %w", path, ErrInvalidTags, err)
+	}
+
+	header, _ := br.Peek(16)
+	format := sniffTagFormat(header)
+	if format == tagFormatUnknown && (prefix.present || strings.EqualFold(filepath.Ext(path), ".mp3")) {
+		format = tagFormatMPEG
+	}
+
+	offset := int64(prefix.size)
+	switch format {
+	case tagFormatWAV:
+		tags, err = readRIFFTags(br)
+	case tagFormatFLAC:
+		tags, err = readFLACTags(br)
+	case tagFormatOgg:
+		tags, err = readOggTags(f, offset)
+	case tagFormatMP4:
+		tags, err = readMP4Tags(f, offset)
+	}
+	if err != nil {
+		return Tags{}, fmt.Errorf("cannot read tags of %s: %w: %w", path, ErrInvalidTags, err)
+	}
+
+	tags.fill(prefix.tags)
+	if format == tagFormatMPEG {
+		if d := mpegDuration(f, offset); d > 0 {
+			tags.Duration = d
+		}
+		if tags.Title == "" || tags.Artist == "" {
+			if v1, ok := readID3v1(f); ok {
+				tags.fill(v1)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// WriteTags sets the title, artist, album and album artist of the file at
+// path, keeping any other metadata; empty fields are left as they are. The
+// file is rewritten next to itself and renamed into place. WAV files get a
+// LIST/INFO chunk, FLAC and Ogg Vorbis/Opus files Vorbis comments, MP4 files
+// iTunes atoms and anything else that is MPEG audio an ID3v2 tag.
+func WriteTags(path string, tags Tags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, 64<<10)
+	prefix, err := readID3v2(br)
+	if err != nil {
+		return err
+	}
+	header, _ := br.Peek(16)
+	format := sniffTagFormat(header)
+	if format == tagFormatUnknown && (prefix.present || strings.EqualFold(filepath.Ext(path), ".mp3")) {
+		format = tagFormatMPEG
+	}
+
+	var write func(w io.Writer) error
+	switch format {
+	case tagFormatWAV:
+		write = func(w io.Writer) error { return writeRIFFTags(w, f, tags) }
+	case tagFormatFLAC:
+		write = func(w io.Writer) error { return writeFLACTags(w, f, int64(prefix.size), tags) }
+	case tagFormatOgg:
+		write = func(w io.Writer) error { return writeOggTags(w, f, int64(prefix.size), tags) }
+	case tagFormatMP4:
+		write = func(w io.Writer) error { return writeMP4Tags(w, f, tags) }
+	case tagFormatMPEG:
+		write = func(w io.Writer) error { return writeID3v2(w, f, prefix, tags) }
+	default:
+		return fmt.Errorf("%w: %s", ErrTagsUnsupported, path)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := replaceFile(path, write); err != nil {
+		return fmt.Errorf("cannot write tags to %s: %w", path, err)
+	}
+	return nil
+}
+
+// replaceFile writes a new version of path through write and renames it
+// over the original, so a failed write leaves the file as it was.
+func replaceFile(path string, write func(w io.Writer) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tags-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriterSize(tmp, 64<<10)
+	if err := write(bw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// TagsFromFilename reads "Artist - Title.ext"; a name without the
+// separator is taken as the title alone.
+func TagsFromFilename(path string) Tags {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if artist, title, ok := strings.Cut(name, " - "); ok {
+		return Tags{Artist: strings.TrimSpace(artist), Title: strings.TrimSpace(title)}
+	}
+	return Tags{Title: strings.TrimSpace(name)}
+}
+
+// ReadTagsOrFilename is ReadTags with the title and artist taken from the
+// file name when the file has none, or has tags that cannot be read. Only
+// failing to read the file is an error.
+func ReadTagsOrFilename(path string) (Tags, error) {
+	tags, err := ReadTags(path)
+	if errors.Is(err, ErrInvalidTags) {
+		utils.GetLogger().Warn("ignoring unreadable tags", slog.String("file", path), slog.Any("error", err))
+		tags, err = Tags{}, nil
+	}
+	if err != nil {
+		return Tags{}, err
+	}
+	tags.fill(TagsFromFilename(path))
+	return tags, nil
+}
@@ -0,0 +1,307 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3Tag is an ID3v2 tag read from the start of a file.
+type id3Tag struct {
+	present bool
+	// size is the number of bytes the tag takes, header and footer included.
+	size  int
+	major byte
+	// frames are kept for v2.3 and v2.4 tags so rewriting keeps them.
+	frames []id3Frame
+	tags   Tags
+}
+
+type id3Frame struct {
+	id    string
+	flags uint16
+	data  []byte
+}
+
+// id3TextFrames maps the text frames shazoom uses to Tags fields, for v2.3+
+// and v2.2 frame ids.
+var id3TextFrames = map[string]func(*Tags) *string{
+	"TIT2": func(t *Tags) *string { return &t.Title },
+	"TPE1": func(t *Tags) *string { return &t.Artist },
+	"TALB": func(t *Tags) *string { return &t.Album },
+	"TPE2": func(t *Tags) *string { return &t.AlbumArtist },
+	"TT2":  func(t *Tags) *string { return &t.Title },
+	"TP1":  func(t *Tags) *string { return &t.Artist },
+	"TAL":  func(t *Tags) *string { return &t.Album },
+	"TP2":  func(t *Tags) *string { return &t.AlbumArtist },
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+func putSyncsafe(b []byte, v int) {
+	b[0], b[1], b[2], b[3] = byte(v>>21&0x7F), byte(v>>14&0x7F), byte(v>>7&0x7F), byte(v&0x7F)
+}
+
+// removeUnsync undoes ID3 unsynchronisation, which inserts a zero byte after
+// every 0xFF.
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// readID3v2 consumes an ID3v2 tag at the start of br, if there is one.
+func readID3v2(br *bufio.Reader) (id3Tag, error) {
+	h, err := br.Peek(10)
+	if err != nil || string(h[:3]) != "ID3" {
+		return id3Tag{}, nil
+	}
+
+	tag := id3Tag{present: true, major: h[3], size: 10 + syncsafe(h[6:10])}
+	flags := h[5]
+	if tag.major >= 4 && flags&0x10 != 0 {
+		tag.size += 10
+	}
+
+	raw := make([]byte, tag.size)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return id3Tag{}, errors.New("truncated ID3v2 tag")
+	}
+	body := raw[10 : 10+syncsafe(h[6:10])]
+	if tag.major < 2 || tag.major > 4 {
+		// a future version: skip it whole
+		return tag, nil
+	}
+	if flags&0x80 != 0 && tag.major < 4 {
+		body = removeUnsync(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// extended header
+		n := int(binary.BigEndian.Uint32(body))
+		if tag.major == 4 {
+			n = syncsafe(body)
+		} else {
+			n += 4
+		}
+		body = body[min(n, len(body)):]
+	}
+
+	idLen, headerLen := 4, 10
+	if tag.major == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var size int
+		var frameFlags uint16
+		switch tag.major {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		case 4:
+			size = syncsafe(body[4:8])
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		}
+		if size > len(body)-headerLen {
+			break
+		}
+		data := body[headerLen : headerLen+size]
+		body = body[headerLen+size:]
+
+		if tag.major > 2 {
+			tag.frames = append(tag.frames, id3Frame{id: id, flags: frameFlags, data: data})
+		}
+		if text, ok := id3FrameText(tag.major, frameFlags, data); ok {
+			if field, ok := id3TextFrames[id]; ok {
+				*field(&tag.tags) = text
+			} else if id == "TLEN" || id == "TLE" {
+				if ms, err := strconv.ParseFloat(text, 64); err == nil {
+					tag.tags.Duration = ms / 1000
+				}
+			}
+		}
+	}
+	return tag, nil
+}
+
+// id3FrameText decodes the first string of a text frame.
+func id3FrameText(major byte, flags uint16, data []byte) (string, bool) {
+	switch major {
+	case 3:
+		if flags&0x00C0 != 0 {
+			// compressed or encrypted
+			return "", false
+		}
+		if flags&0x0020 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+	case 4:
+		if flags&0x000C != 0 {
+			return "", false
+		}
+		if flags&0x0040 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+		if flags&0x0002 != 0 {
+			data = removeUnsync(data)
+		}
+		if flags&0x0001 != 0 && len(data) >= 4 {
+			data = data[4:]
+		}
+	}
+	if len(data) == 0 {
+		return "", false
+	}
+
+	text := decodeID3String(data[0], data[1:])
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text), true
+}
+
+func decodeID3String(encoding byte, b []byte) string {
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			b, bigEndian = b[2:], false
+		} else if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			b, bigEndian = b[2:], true
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		return string(b)
+	default:
+		return latin1(b)
+	}
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// readID3v1 reads the 128-byte tag at the end of an MPEG file.
+func readID3v1(f *os.File) (Tags, bool) {
+	var b [128]byte
+	info, err := f.Stat()
+	if err != nil || info.Size() < 128 {
+		return Tags{}, false
+	}
+	if _, err := f.ReadAt(b[:], info.Size()-128); err != nil || string(b[:3]) != "TAG" {
+		return Tags{}, false
+	}
+	field := func(s []byte) string {
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(latin1(s))
+	}
+	return Tags{Title: field(b[3:33]), Artist: field(b[33:63]), Album: field(b[63:93])}, true
+}
+
+// writeID3v2 writes f with its ID3v2 tag replaced by one carrying tags. The
+// other frames of a v2.3 or v2.4 tag are kept, in its version; anything else
+// is replaced by a v2.4 tag.
+func writeID3v2(w io.Writer, f io.Reader, old id3Tag, tags Tags) error {
+	major := old.major
+	if major != 3 {
+		major = 4
+	}
+
+	var frames bytes.Buffer
+	addFrame := func(id string, flags uint16, data []byte) {
+		var h [10]byte
+		copy(h[:4], id)
+		if major == 4 {
+			putSyncsafe(h[4:8], len(data))
+		} else {
+			binary.BigEndian.PutUint32(h[4:8], uint32(len(data)))
+		}
+		binary.BigEndian.PutUint16(h[8:10], flags)
+		frames.Write(h[:])
+		frames.Write(data)
+	}
+
+	replaced := map[string]bool{}
+	for _, fr := range []struct{ id, value string }{
+		{"TIT2", tags.Title}, {"TPE1", tags.Artist}, {"TALB", tags.Album}, {"TPE2", tags.AlbumArtist},
+	} {
+		if fr.value != "" {
+			addFrame(fr.id, 0, encodeID3Text(major, fr.value))
+			replaced[fr.id] = true
+		}
+	}
+	if old.major == major {
+		for _, fr := range old.frames {
+			if !replaced[fr.id] {
+				addFrame(fr.id, fr.flags, fr.data)
+			}
+		}
+	} else {
+		// a v2.2 tag cannot be carried over frame by frame; keep what it
+		// said about the fields shazoom knows
+		for _, fr := range []struct{ id, value string }{
+			{"TIT2", old.tags.Title}, {"TPE1", old.tags.Artist}, {"TALB", old.tags.Album}, {"TPE2", old.tags.AlbumArtist},
+		} {
+			if fr.value != "" && !replaced[fr.id] {
+				addFrame(fr.id, 0, encodeID3Text(major, fr.value))
+			}
+		}
+	}
+
+	header := []byte{'I', 'D', '3', major, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(header[6:10], frames.Len())
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(frames.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(io.Discard, f, int64(old.size)); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, f)
+	return err
+}
+
+// encodeID3Text encodes a text frame: UTF-8 for v2.4, and UTF-16 for v2.3,
+// which has no UTF-8.
+func encodeID3Text(major byte, s string) []byte {
+	if major == 4 {
+		return append([]byte{3}, s...)
+	}
+	b := []byte{1, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
@@ -0,0 +1,376 @@
+package fileformat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// mp4Box is a box (atom) of an MP4 file.
+type mp4Box struct {
+	typ    string
+	offset int64 // of the box header
+	header int   // 8, or 16 for 64-bit sizes
+	size   int64 // header included
+}
+
+// mp4Items maps iTunes metadata items to Tags fields.
+var mp4Items = []struct {
+	typ   string
+	field func(*Tags) *string
+}{
+	{"\xa9nam", func(t *Tags) *string { return &t.Title }},
+	{"\xa9ART", func(t *Tags) *string { return &t.Artist }},
+	{"\xa9alb", func(t *Tags) *string { return &t.Album }},
+	{"aART", func(t *Tags) *string { return &t.AlbumArtist }},
+}
+
+// readMP4Boxes lists the top-level boxes of f from offset on.
+func readMP4Boxes(f *os.File, offset int64) ([]mp4Box, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var boxes []mp4Box
+	for offset+8 <= info.Size() {
+		var h [16]byte
+		if _, err := f.ReadAt(h[:8], offset); err != nil {
+			return nil, err
+		}
+		b := mp4Box{typ: string(h[4:8]), offset: offset, header: 8, size: int64(binary.BigEndian.Uint32(h[:4]))}
+		switch b.size {
+		case 0:
+			b.size = info.Size() - offset
+		case 1:
+			if _, err := f.ReadAt(h[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			b.header, b.size = 16, int64(binary.BigEndian.Uint64(h[8:16]))
+		}
+		if b.size < int64(b.header) || offset+b.size > info.Size() {
+			return nil, errors.New("truncated " + b.typ + " box")
+		}
+		boxes = append(boxes, b)
+		offset += b.size
+	}
+	return boxes, nil
+}
+
+// mp4Children splits the payload of a container box into its boxes, each
+// header included.
+func mp4Children(payload []byte) ([][]byte, error) {
+	var children [][]byte
+	for len(payload) >= 8 {
+		size := int(binary.BigEndian.Uint32(payload))
+		if size < 8 || size > len(payload) {
+			return nil, errors.New("malformed MP4 box")
+		}
+		children = append(children, payload[:size])
+		payload = payload[size:]
+	}
+	return children, nil
+}
+
+func mp4Type(box []byte) string { return string(box[4:8]) }
+
+func mp4Encode(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// mp4MetaChildren returns the box header fields and children of a meta box,
+// which is a full box except in some QuickTime files.
+func mp4MetaChildren(meta []byte) ([]byte, [][]byte, error) {
+	payload := meta[8:]
+	var full []byte
+	if len(payload) >= 8 && string(payload[4:8]) != "hdlr" {
+		full, payload = payload[:4], payload[4:]
+	}
+	children, err := mp4Children(payload)
+	return full, children, err
+}
+
+func mp4Find(children [][]byte, typ string) []byte {
+	for _, c := range children {
+		if mp4Type(c) == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+func readMP4Tags(f *os.File, offset int64) (Tags, error) {
+	boxes, err := readMP4Boxes(f, offset)
+	if err != nil {
+		return Tags{}, err
+	}
+	moov, _, err := readMoov(f, boxes)
+	if err != nil || moov == nil {
+		return Tags{}, err
+	}
+
+	var tags Tags
+	children, err := mp4Children(moov[8:])
+	if err != nil {
+		return Tags{}, err
+	}
+	if mvhd := mp4Find(children, "mvhd"); len(mvhd) >= 32 {
+		var timescale uint32
+		var duration uint64
+		if mvhd[8] == 1 && len(mvhd) >= 44 {
+			timescale, duration = binary.BigEndian.Uint32(mvhd[28:32]), binary.BigEndian.Uint64(mvhd[32:40])
+		} else {
+			timescale, duration = binary.BigEndian.Uint32(mvhd[20:24]), uint64(binary.BigEndian.Uint32(mvhd[24:28]))
+		}
+		if timescale > 0 {
+			tags.Duration = float64(duration) / float64(timescale)
+		}
+	}
+
+	udta := mp4Find(children, "udta")
+	if udta == nil {
+		return tags, nil
+	}
+	udtaChildren, err := mp4Children(udta[8:])
+	if err != nil {
+		return Tags{}, err
+	}
+	meta := mp4Find(udtaChildren, "meta")
+	if meta == nil {
+		return tags, nil
+	}
+	_, metaChildren, err := mp4MetaChildren(meta)
+	if err != nil {
+		return Tags{}, err
+	}
+	ilst := mp4Find(metaChildren, "ilst")
+	if ilst == nil {
+		return tags, nil
+	}
+	items, err := mp4Children(ilst[8:])
+	if err != nil {
+		return Tags{}, err
+	}
+	for _, item := range items {
+		for _, m := range mp4Items {
+			if mp4Type(item) == m.typ {
+				*m.field(&tags) = mp4ItemText(item)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// readMoov reads the moov box into memory.
+func readMoov(f *os.File, boxes []mp4Box) ([]byte, int, error) {
+	for i, b := range boxes {
+		if b.typ != "moov" {
+			continue
+		}
+		if b.size > maxTagChunk {
+			return nil, 0, errors.New("moov box too large")
+		}
+		moov := make([]byte, b.size)
+		if _, err := f.ReadAt(moov, b.offset); err != nil {
+			return nil, 0, err
+		}
+		if b.header == 16 {
+			// normalise to a 32-bit header
+			moov = mp4Encode("moov", moov[16:])
+		}
+		return moov, i, nil
+	}
+	return nil, -1, nil
+}
+
+// mp4ItemText returns the UTF-8 value of the data box of a metadata item.
+func mp4ItemText(item []byte) string {
+	children, err := mp4Children(item[8:])
+	if err != nil {
+		return ""
+	}
+	data := mp4Find(children, "data")
+	if len(data) < 16 || binary.BigEndian.Uint32(data[8:12])&0xFFFFFF != 1 {
+		return ""
+	}
+	return strings.TrimSpace(string(data[16:]))
+}
+
+// writeMP4Tags writes f with the iTunes metadata items for tags set in its
+// moov box, creating udta, meta and ilst as needed. When moov grows or
+// shrinks, the chunk offsets of media data after it are moved with it.
+func writeMP4Tags(w io.Writer, f *os.File, tags Tags) error {
+	boxes, err := readMP4Boxes(f, 0)
+	if err != nil {
+		return err
+	}
+	moov, index, err := readMoov(f, boxes)
+	if err != nil {
+		return err
+	}
+	if moov == nil {
+		return fmt.Errorf("%w: MP4 without a moov box", ErrTagsUnsupported)
+	}
+	for _, b := range boxes {
+		if b.typ == "moof" {
+			return fmt.Errorf("%w: fragmented MP4", ErrTagsUnsupported)
+		}
+	}
+
+	newMoov, err := setMP4Tags(moov, tags)
+	if err != nil {
+		return err
+	}
+	old := boxes[index]
+	if err := shiftChunkOffsets(newMoov, old.offset+old.size, int64(len(newMoov))-old.size); err != nil {
+		return err
+	}
+
+	for i, b := range boxes {
+		if i == index {
+			if _, err := w.Write(newMoov); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, b.offset, b.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMP4Tags returns moov with the items for the fields tags sets replaced.
+func setMP4Tags(moov []byte, tags Tags) ([]byte, error) {
+	children, err := mp4Children(moov[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	udtaIndex := -1
+	var udtaChildren [][]byte
+	for i, c := range children {
+		if mp4Type(c) == "udta" {
+			udtaIndex = i
+			if udtaChildren, err = mp4Children(c[8:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	metaIndex := -1
+	full := []byte{0, 0, 0, 0}
+	metaChildren := [][]byte{
+		mp4Encode("hdlr", []byte{0, 0, 0, 0, 0, 0, 0, 0}, []byte("mdirappl"), make([]byte, 9)),
+	}
+	for i, c := range udtaChildren {
+		if mp4Type(c) == "meta" {
+			metaIndex = i
+			if full, metaChildren, err = mp4MetaChildren(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ilstIndex := -1
+	var items [][]byte
+	for i, c := range metaChildren {
+		if mp4Type(c) == "ilst" {
+			ilstIndex = i
+			if items, err = mp4Children(c[8:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var newItems [][]byte
+	replaced := map[string]bool{}
+	for _, m := range mp4Items {
+		if v := *m.field(&tags); v != "" {
+			data := mp4Encode("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(v))
+			newItems = append(newItems, mp4Encode(m.typ, data))
+			replaced[m.typ] = true
+		}
+	}
+	for _, item := range items {
+		if !replaced[mp4Type(item)] {
+			newItems = append(newItems, item)
+		}
+	}
+
+	ilst := mp4Encode("ilst", newItems...)
+	metaChildren = replaceOrAppend(metaChildren, ilstIndex, ilst)
+	meta := mp4Encode("meta", append([][]byte{full}, metaChildren...)...)
+	udta := mp4Encode("udta", replaceOrAppend(udtaChildren, metaIndex, meta)...)
+	return mp4Encode("moov", replaceOrAppend(children, udtaIndex, udta)...), nil
+}
+
+func replaceOrAppend(boxes [][]byte, i int, box []byte) [][]byte {
+	if i < 0 {
+		return append(boxes, box)
+	}
+	boxes[i] = box
+	return boxes
+}
+
+// shiftChunkOffsets adds delta to the stco and co64 entries of moov that
+// point at or after from.
+func shiftChunkOffsets(moov []byte, from, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	var walk func(payload []byte) error
+	walk = func(payload []byte) error {
+		children, err := mp4Children(payload)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			switch mp4Type(c) {
+			case "trak", "mdia", "minf", "stbl":
+				if err := walk(c[8:]); err != nil {
+					return err
+				}
+			case "stco":
+				if len(c) < 16 {
+					return errors.New("malformed stco box")
+				}
+				entries := c[16:]
+				for i := 0; i+4 <= len(entries) && i/4 < int(binary.BigEndian.Uint32(c[12:16])); i += 4 {
+					v := int64(binary.BigEndian.Uint32(entries[i:]))
+					if v < from {
+						continue
+					}
+					if v+delta > 0xFFFFFFFF {
+						return fmt.Errorf("%w: chunk offsets overflow stco", ErrTagsUnsupported)
+					}
+					binary.BigEndian.PutUint32(entries[i:], uint32(v+delta))
+				}
+			case "co64":
+				if len(c) < 16 {
+					return errors.New("malformed co64 box")
+				}
+				entries := c[16:]
+				for i := 0; i+8 <= len(entries) && i/8 < int(binary.BigEndian.Uint32(c[12:16])); i += 8 {
+					if v := int64(binary.BigEndian.Uint64(entries[i:])); v >= from {
+						binary.BigEndian.PutUint64(entries[i:], uint64(v+delta))
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return walk(moov[8:])
+}
@@ -0,0 +1,166 @@
+package fileformat
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// mpegScanLimit is how far past the ID3v2 tag the first frame is looked for.
+const mpegScanLimit = 64 << 10
+
+// mpegHeader is the header of an MPEG audio frame.
+type mpegHeader struct {
+	mpeg1      bool
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	padding    bool
+	mono       bool
+}
+
+var mpegBitrates = [...][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // MPEG-1 layer I
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // MPEG-1 layer II
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // MPEG-1 layer III
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},    // MPEG-2/2.5 layer I
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},         // MPEG-2/2.5 layers II and III
+}
+
+// parseMPEGHeader reads the 4-byte frame header at the start of b. Free
+// format streams, which do not say their bitrate, are not accepted.
+func parseMPEGHeader(b []byte) (mpegHeader, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mpegHeader{}, false
+	}
+	version := b[1] >> 3 & 3
+	layer := 4 - int(b[1]>>1&3)
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int(b[2] >> 2 & 3)
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mpegHeader{}, false
+	}
+
+	h := mpegHeader{
+		mpeg1:      version == 3,
+		layer:      layer,
+		sampleRate: [3]int{44100, 48000, 32000}[rateIndex],
+		padding:    b[2]&2 != 0,
+		mono:       b[3]>>6 == 3,
+	}
+	table := layer - 1
+	if !h.mpeg1 {
+		table = 3 + min(layer-1, 1)
+		h.sampleRate /= 2
+		if version == 0 {
+			// MPEG 2.5
+			h.sampleRate /= 2
+		}
+	}
+	h.bitrate = mpegBitrates[table][bitrateIndex] * 1000
+	return h, true
+}
+
+// samples is the number of samples per channel in a frame.
+func (h mpegHeader) samples() int {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && !h.mpeg1:
+		return 576
+	}
+	return 1152
+}
+
+// size is the length of the frame in bytes, header included.
+func (h mpegHeader) size() int {
+	pad := 0
+	if h.padding {
+		pad = 1
+	}
+	if h.layer == 1 {
+		return (12*h.bitrate/h.sampleRate + pad) * 4
+	}
+	return h.samples()/8*h.bitrate/h.sampleRate + pad
+}
+
+// sideInfo is the length of the layer III side information after the header,
+// where a Xing header starts.
+func (h mpegHeader) sideInfo() int {
+	switch {
+	case h.mpeg1 && h.mono:
+		return 17
+	case h.mpeg1:
+		return 32
+	case h.mono:
+		return 9
+	}
+	return 17
+}
+
+// mpegDuration works out the duration in seconds of the MPEG audio that
+// starts at offset in f: from the frame count of a Xing, Info or VBRI header
+// when the first frame has one, otherwise from the bitrate of the first frame
+// and the size of the stream, which is exact for constant bitrate files. It
+// gives 0 when no frame is found.
+func mpegDuration(f *os.File, offset int64) float64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	end := info.Size()
+	if _, ok := readID3v1(f); ok {
+		end -= 128
+	}
+	if end <= offset {
+		return 0
+	}
+
+	buf := make([]byte, min(end-offset, mpegScanLimit+4096))
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return 0
+	}
+	buf = buf[:n]
+
+	for i := 0; i < len(buf) && i < mpegScanLimit; i++ {
+		h, ok := parseMPEGHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		frame := buf[i:]
+		if frames := mpegFrameCount(h, frame); frames > 0 {
+			return float64(frames) * float64(h.samples()) / float64(h.sampleRate)
+		}
+
+		// a sync pattern in other data is only taken for a frame when
+		// another frame of the same stream follows it
+		next, ok := parseMPEGHeader(frame[min(h.size(), len(frame)):])
+		if !ok || next.mpeg1 != h.mpeg1 || next.layer != h.layer || next.sampleRate != h.sampleRate {
+			continue
+		}
+		audio := end - offset - int64(i)
+		return float64(audio) * 8 / float64(h.bitrate)
+	}
+	return 0
+}
+
+// mpegFrameCount reads the number of frames from a Xing/Info or VBRI header
+// in frame, the first frame of a stream; 0 when it has neither.
+func mpegFrameCount(h mpegHeader, frame []byte) int {
+	if h.layer != 3 {
+		return 0
+	}
+	if x := 4 + h.sideInfo(); len(frame) >= x+12 {
+		tag := string(frame[x : x+4])
+		flags := binary.BigEndian.Uint32(frame[x+4:])
+		if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+			return int(binary.BigEndian.Uint32(frame[x+8:]))
+		}
+	}
+	// VBRI sits at a fixed offset, after 32 bytes whatever the mode
+	if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		return int(binary.BigEndian.Uint32(frame[36+14:]))
+	}
+	return 0
+}
@@ -0,0 +1,237 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxTagChunk bounds the metadata chunks read into memory.
+const maxTagChunk = 64 << 20
+
+// riffInfoFields maps the LIST/INFO subchunks shazoom uses to Tags fields.
+var riffInfoFields = []struct {
+	id    string
+	field func(*Tags) *string
+}{
+	{"INAM", func(t *Tags) *string { return &t.Title }},
+	{"IART", func(t *Tags) *string { return &t.Artist }},
+	{"IPRD", func(t *Tags) *string { return &t.Album }},
+}
+
+// readRIFFTags reads the LIST/INFO chunk, or an "id3 " chunk, of a WAV
+// file, and its duration from the fmt and data chunks.
+func readRIFFTags(br *bufio.Reader) (Tags, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return Tags{}, err
+	}
+
+	var tags, id3 Tags
+	var byteRate uint32
+	var dataSize uint64
+chunks:
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(br, ch[:]); err != nil {
+			// a truncated or final chunk ends the walk
+			break
+		}
+		id, size := string(ch[:4]), binary.LittleEndian.Uint32(ch[4:])
+		skip := uint64(size) + uint64(size%2)
+
+		switch id {
+		case "fmt ", "ds64", "LIST", "id3 ", "ID3 ":
+			if size > maxTagChunk {
+				break
+			}
+			body := make([]byte, skip)
+			if _, err := io.ReadFull(br, body); err != nil && (err != io.ErrUnexpectedEOF || size%2 == 0) {
+				break chunks
+			}
+			skip = 0
+			switch id {
+			case "fmt ":
+				if size >= 12 {
+					byteRate = binary.LittleEndian.Uint32(body[8:12])
+				}
+			case "ds64":
+				if size >= 16 {
+					dataSize = binary.LittleEndian.Uint64(body[8:16])
+				}
+			case "LIST":
+				if size >= 4 && string(body[:4]) == "INFO" {
+					parseRIFFInfo(body[4:size], &tags)
+				}
+			default:
+				if t, err := readID3v2(bufio.NewReader(bytes.NewReader(body))); err == nil {
+					id3 = t.tags
+				}
+			}
+		case "data":
+			if size != 0xFFFFFFFF || dataSize == 0 {
+				dataSize = uint64(size)
+			}
+			skip = dataSize + dataSize%2
+		}
+		if _, err := br.Discard(int(min(skip, 1<<62))); err != nil {
+			break
+		}
+	}
+
+	tags.fill(id3)
+	if byteRate > 0 {
+		tags.Duration = float64(dataSize) / float64(byteRate)
+	}
+	return tags, nil
+}
+
+// parseRIFFInfo reads the subchunks of a LIST/INFO chunk into tags.
+func parseRIFFInfo(b []byte, tags *Tags) {
+	for len(b) >= 8 {
+		id, size := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		if size > len(b)-8 {
+			return
+		}
+		value := strings.TrimSpace(strings.TrimRight(string(b[8:8+size]), "\x00"))
+		for _, f := range riffInfoFields {
+			if f.id == id {
+				*f.field(tags) = value
+			}
+		}
+		b = b[8+size+size%2:]
+	}
+}
+
+type riffChunk struct {
+	id     string
+	offset int64 // of the chunk header
+	size   uint32
+}
+
+// writeRIFFTags writes the WAV file f with a LIST/INFO chunk carrying tags in
+// front of its data chunk. Other INFO fields and chunks are kept. RF64
+// files, and ones written while streaming that never got their data size,
+// are not rewritten.
+func writeRIFFTags(w io.Writer, f *os.File, tags Tags) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var header [12]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if string(header[:4]) != "RIFF" {
+		return fmt.Errorf("%w: %s files", ErrTagsUnsupported, header[:4])
+	}
+
+	var chunks []riffChunk
+	var infoList []byte
+	for offset := int64(12); offset+8 <= info.Size(); {
+		var ch [8]byte
+		if _, err := f.ReadAt(ch[:], offset); err != nil {
+			return err
+		}
+		c := riffChunk{id: string(ch[:4]), offset: offset, size: binary.LittleEndian.Uint32(ch[4:])}
+		if c.id == "data" && (c.size == 0 || c.size == 0xFFFFFFFF) {
+			return fmt.Errorf("%w: WAV without a data size", ErrTagsUnsupported)
+		}
+		end := offset + 8 + int64(c.size) + int64(c.size%2)
+		if end > info.Size() {
+			return errors.New("truncated " + strings.TrimSpace(c.id) + " chunk")
+		}
+
+		if c.id == "LIST" && c.size >= 4 {
+			body := make([]byte, c.size)
+			if _, err := f.ReadAt(body, offset+8); err != nil {
+				return err
+			}
+			if string(body[:4]) == "INFO" {
+				if infoList == nil {
+					infoList = body[4:]
+				}
+				offset = end
+				continue
+			}
+		}
+		chunks = append(chunks, c)
+		offset = end
+	}
+
+	list := buildRIFFInfo(infoList, tags)
+	size := int64(4 + len(list))
+	for _, c := range chunks {
+		size += 8 + int64(c.size) + int64(c.size%2)
+	}
+	if size > 0xFFFFFFFF {
+		return fmt.Errorf("%w: WAV over 4 GiB", ErrTagsUnsupported)
+	}
+
+	binary.LittleEndian.PutUint32(header[4:8], uint32(size))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	written := false
+	for _, c := range chunks {
+		if c.id == "data" && !written {
+			if _, err := w.Write(list); err != nil {
+				return err
+			}
+			written = true
+		}
+		n := 8 + int64(c.size) + int64(c.size%2)
+		if _, err := io.Copy(w, io.NewSectionReader(f, c.offset, n)); err != nil {
+			return err
+		}
+	}
+	if !written {
+		_, err = w.Write(list)
+	}
+	return err
+}
+
+// buildRIFFInfo returns a LIST chunk with the INFO subchunks of old, the
+// fields of tags replacing the ones they set.
+func buildRIFFInfo(old []byte, tags Tags) []byte {
+	var body bytes.Buffer
+	body.WriteString("INFO")
+	addField := func(id string, value []byte) {
+		var h [8]byte
+		copy(h[:4], id)
+		binary.LittleEndian.PutUint32(h[4:], uint32(len(value)))
+		body.Write(h[:])
+		body.Write(value)
+		if len(value)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	replaced := map[string]bool{}
+	for _, f := range riffInfoFields {
+		if v := *f.field(&tags); v != "" {
+			addField(f.id, append([]byte(v), 0))
+			replaced[f.id] = true
+		}
+	}
+	for len(old) >= 8 {
+		id, size := string(old[:4]), int(binary.LittleEndian.Uint32(old[4:8]))
+		if size > len(old)-8 {
+			break
+		}
+		if !replaced[id] {
+			addField(id, old[8:8+size])
+		}
+		old = old[min(8+size+size%2, len(old)):]
+	}
+
+	chunk := make([]byte, 8, 8+body.Len())
+	copy(chunk, "LIST")
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(body.Len()))
+	return append(chunk, body.Bytes()...)
+}
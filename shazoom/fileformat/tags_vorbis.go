@@ -0,0 +1,548 @@
+package fileformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// vorbisComments is a Vorbis comment block, the tag format of FLAC, Ogg
+// Vorbis and Opus.
+type vorbisComments struct {
+	vendor   string
+	comments []string // "KEY=value"
+}
+
+// vorbisFields maps comment keys to Tags fields; the first key of a field is
+// the one written.
+var vorbisFields = []struct {
+	keys  []string
+	field func(*Tags) *string
+}{
+	{[]string{"TITLE"}, func(t *Tags) *string { return &t.Title }},
+	{[]string{"ARTIST"}, func(t *Tags) *string { return &t.Artist }},
+	{[]string{"ALBUM"}, func(t *Tags) *string { return &t.Album }},
+	{[]string{"ALBUMARTIST", "ALBUM ARTIST"}, func(t *Tags) *string { return &t.AlbumArtist }},
+}
+
+func parseVorbisComments(b []byte) (vorbisComments, error) {
+	var c vorbisComments
+	errTruncated := errors.New("truncated Vorbis comment block")
+
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+
+	vendor, ok := next()
+	if !ok || len(b) < 4 {
+		return c, errTruncated
+	}
+	c.vendor = vendor
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		s, ok := next()
+		if !ok {
+			return c, errTruncated
+		}
+		c.comments = append(c.comments, s)
+	}
+	return c, nil
+}
+
+func (c vorbisComments) tags() Tags {
+	var tags Tags
+	for _, comment := range c.comments {
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+		for _, f := range vorbisFields {
+			for _, k := range f.keys {
+				// the first of repeated keys wins, as with ffprobe
+				if strings.EqualFold(key, k) && *f.field(&tags) == "" {
+					*f.field(&tags) = strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+	return tags
+}
+
+// set replaces the comments for the fields tags sets.
+func (c *vorbisComments) set(tags Tags) {
+	var kept []string
+	for _, comment := range c.comments {
+		key, _, _ := strings.Cut(comment, "=")
+		replaced := false
+		for _, f := range vorbisFields {
+			for _, k := range f.keys {
+				if strings.EqualFold(key, k) && *f.field(&tags) != "" {
+					replaced = true
+				}
+			}
+		}
+		if !replaced {
+			kept = append(kept, comment)
+		}
+	}
+
+	var added []string
+	for _, f := range vorbisFields {
+		if v := *f.field(&tags); v != "" {
+			added = append(added, f.keys[0]+"="+v)
+		}
+	}
+	c.comments = append(added, kept...)
+}
+
+func (c vorbisComments) bytes() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(c.vendor)))
+	b = append(b, c.vendor...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(c.comments)))
+	for _, comment := range c.comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(comment)))
+		b = append(b, comment...)
+	}
+	return b
+}
+
+// FLAC metadata block types.
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+)
+
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// readFLACMetadata reads the "fLaC" marker and the metadata blocks after it.
+// With keep unset only the blocks tags come from are kept in memory.
+func readFLACMetadata(r io.Reader, keep bool) ([]flacBlock, error) {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || string(marker[:]) != "fLaC" {
+		return nil, errors.New("missing fLaC marker")
+	}
+
+	var blocks []flacBlock
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return nil, errors.New("truncated FLAC metadata")
+		}
+		typ, last := h[0]&0x7F, h[0]&0x80 != 0
+		size := int64(h[1])<<16 | int64(h[2])<<8 | int64(h[3])
+
+		if keep || typ == flacStreamInfo || typ == flacVorbisComment {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errors.New("truncated FLAC metadata")
+			}
+			blocks = append(blocks, flacBlock{typ: typ, data: data})
+		} else if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return nil, errors.New("truncated FLAC metadata")
+		}
+		if last {
+			return blocks, nil
+		}
+	}
+}
+
+func readFLACTags(br *bufio.Reader) (Tags, error) {
+	blocks, err := readFLACMetadata(br, false)
+	if err != nil {
+		return Tags{}, err
+	}
+
+	var tags Tags
+	for _, b := range blocks {
+		switch {
+		case b.typ == flacVorbisComment:
+			c, err := parseVorbisComments(b.data)
+			if err != nil {
+				return Tags{}, err
+			}
+			duration := tags.Duration
+			tags = c.tags()
+			tags.Duration = duration
+		case b.typ == flacStreamInfo && len(b.data) >= 18:
+			rate := uint64(b.data[10])<<12 | uint64(b.data[11])<<4 | uint64(b.data[12])>>4
+			total := uint64(b.data[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(b.data[14:18]))
+			if rate > 0 {
+				tags.Duration = float64(total) / float64(rate)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// writeFLACTags writes f with its Vorbis comment block replaced, or added
+// after STREAMINFO. An ID3v2 tag of prefixSize bytes in front is kept.
+func writeFLACTags(w io.Writer, f io.Reader, prefixSize int64, tags Tags) error {
+	if _, err := io.CopyN(w, f, prefixSize); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(f, 64<<10)
+	blocks, err := readFLACMetadata(br, true)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range blocks {
+		if blocks[i].typ == flacVorbisComment {
+			c, err := parseVorbisComments(blocks[i].data)
+			if err != nil {
+				return err
+			}
+			c.set(tags)
+			blocks[i].data = c.bytes()
+			found = true
+			break
+		}
+	}
+	if !found {
+		c := vorbisComments{vendor: "shazoom"}
+		c.set(tags)
+		blocks = append(blocks[:1], append([]flacBlock{{typ: flacVorbisComment, data: c.bytes()}}, blocks[1:]...)...)
+	}
+
+	if _, err := w.Write([]byte("fLaC")); err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		if len(b.data) >= 1<<24 {
+			return errors.New("FLAC metadata block too large")
+		}
+		h := []byte{b.typ, byte(len(b.data) >> 16), byte(len(b.data) >> 8), byte(len(b.data))}
+		if i == len(blocks)-1 {
+			h[0] |= 0x80
+		}
+		if _, err := w.Write(h); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.data); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// oggPage is one page of an Ogg stream.
+type oggPage struct {
+	header []byte // 27 bytes and the lacing values
+	body   []byte
+}
+
+func readOggPage(r io.Reader) (oggPage, error) {
+	h := make([]byte, 27, 27+255)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return oggPage{}, err
+	}
+	if string(h[:4]) != "OggS" {
+		return oggPage{}, errors.New("lost Ogg page sync")
+	}
+	h = h[:27+int(h[26])]
+	if _, err := io.ReadFull(r, h[27:]); err != nil {
+		return oggPage{}, io.ErrUnexpectedEOF
+	}
+	size := 0
+	for _, l := range h[27:] {
+		size += int(l)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return oggPage{}, io.ErrUnexpectedEOF
+	}
+	return oggPage{header: h, body: body}, nil
+}
+
+func (p oggPage) serial() uint32  { return binary.LittleEndian.Uint32(p.header[14:18]) }
+func (p oggPage) granule() uint64 { return binary.LittleEndian.Uint64(p.header[6:14]) }
+
+// setSequence renumbers the page and updates its checksum.
+func (p oggPage) setSequence(n uint32) {
+	binary.LittleEndian.PutUint32(p.header[18:22], n)
+	binary.LittleEndian.PutUint32(p.header[22:26], 0)
+	crc := oggCRC(oggCRC(0, p.header), p.body)
+	binary.LittleEndian.PutUint32(p.header[22:26], crc)
+}
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for range 8 {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(crc uint32, b []byte) uint32 {
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// oggHeaders is the start of a logical Ogg stream up to its first audio
+// page.
+type oggHeaders struct {
+	pages   []oggPage
+	packets [][]byte
+	codec   string // "vorbis" or "opus"
+}
+
+// readOggHeaders reads the pages of the first logical stream in r until its
+// header packets, three for Vorbis and two for Opus, are complete.
+func readOggHeaders(r io.Reader) (oggHeaders, error) {
+	var h oggHeaders
+	var packet []byte
+	for want := 2; len(h.packets) < want; {
+		p, err := readOggPage(r)
+		if err != nil {
+			return h, fmt.Errorf("reading Ogg headers: %w", err)
+		}
+		if len(h.pages) > 0 && p.serial() != h.pages[0].serial() {
+			return h, fmt.Errorf("%w: multiplexed Ogg streams", ErrTagsUnsupported)
+		}
+		h.pages = append(h.pages, p)
+
+		body := p.body
+		for _, l := range p.header[27:] {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				h.packets = append(h.packets, packet)
+				packet = nil
+			}
+		}
+
+		if len(h.packets) > 0 && h.codec == "" {
+			switch first := h.packets[0]; {
+			case bytes.HasPrefix(first, []byte("\x01vorbis")):
+				h.codec, want = "vorbis", 3
+			case bytes.HasPrefix(first, []byte("OpusHead")):
+				h.codec = "opus"
+			default:
+				return h, fmt.Errorf("%w: Ogg streams other than Vorbis and Opus", ErrTagsUnsupported)
+			}
+		}
+	}
+	if len(packet) > 0 {
+		// the first audio packet starts on a header page
+		return h, fmt.Errorf("%w: Ogg headers not page aligned", ErrTagsUnsupported)
+	}
+	return h, nil
+}
+
+// commentMagic starts the comment header packet.
+func (h oggHeaders) commentMagic() string {
+	if h.codec == "opus" {
+		return "OpusTags"
+	}
+	return "\x03vorbis"
+}
+
+// comments returns the Vorbis comment block of the comment header.
+func (h oggHeaders) comments() (vorbisComments, error) {
+	magic := h.commentMagic()
+	if !bytes.HasPrefix(h.packets[1], []byte(magic)) {
+		return vorbisComments{}, errors.New("missing Ogg comment header")
+	}
+	return parseVorbisComments(h.packets[1][len(magic):])
+}
+
+func readOggTags(f *os.File, offset int64) (Tags, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return Tags{}, err
+	}
+	h, err := readOggHeaders(bufio.NewReader(f))
+	if errors.Is(err, ErrTagsUnsupported) {
+		return Tags{}, nil
+	}
+	if err != nil {
+		return Tags{}, err
+	}
+	c, err := h.comments()
+	if err != nil {
+		return Tags{}, err
+	}
+	tags := c.tags()
+
+	// the granule position of the last page counts the samples
+	var rate, skip uint64
+	if id := h.packets[0]; h.codec == "vorbis" && len(id) >= 16 {
+		rate = uint64(binary.LittleEndian.Uint32(id[12:16]))
+	} else if h.codec == "opus" && len(id) >= 12 {
+		rate, skip = 48000, uint64(binary.LittleEndian.Uint16(id[10:12]))
+	}
+	if granule, ok := lastOggGranule(f, h.pages[0].serial()); ok && rate > 0 && granule > skip {
+		tags.Duration = float64(granule-skip) / float64(rate)
+	}
+	return tags, nil
+}
+
+// lastOggGranule finds the granule position of the last page of a stream by
+// searching the end of the file.
+func lastOggGranule(f *os.File, serial uint32) (uint64, bool) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	start := max(0, info.Size()-64<<10)
+	tail := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(tail, start); err != nil {
+		return 0, false
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		if i+27 > len(tail) {
+			continue
+		}
+		p := oggPage{header: tail[i : i+27]}
+		if p.serial() == serial && p.granule() != ^uint64(0) {
+			return p.granule(), true
+		}
+	}
+	return 0, false
+}
+
+// writeOggTags writes f with the comment header of its first stream
+// replaced. The header pages after the first are repaginated and the later
+// pages of the stream renumbered.
+func writeOggTags(w io.Writer, f io.Reader, prefixSize int64, tags Tags) error {
+	if _, err := io.CopyN(w, f, prefixSize); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(f, 64<<10)
+	h, err := readOggHeaders(br)
+	if err != nil {
+		return err
+	}
+	c, err := h.comments()
+	if err != nil {
+		return err
+	}
+	c.set(tags)
+
+	comment := append([]byte(h.commentMagic()), c.bytes()...)
+	if h.codec == "vorbis" {
+		comment = append(comment, 1) // framing bit
+	}
+
+	serial := h.pages[0].serial()
+	first := h.pages[0]
+	if len(first.header) != 28 {
+		return fmt.Errorf("%w: Ogg identification header not on its own page", ErrTagsUnsupported)
+	}
+	if _, err := w.Write(first.header); err != nil {
+		return err
+	}
+	if _, err := w.Write(first.body); err != nil {
+		return err
+	}
+
+	seq := uint32(1)
+	for _, p := range paginateOgg(serial, &seq, append([][]byte{comment}, h.packets[2:]...)) {
+		if _, err := w.Write(p.header); err != nil {
+			return err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return err
+		}
+	}
+
+	delta := int64(seq) - int64(len(h.pages))
+	for {
+		p, err := readOggPage(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.serial() == serial && delta != 0 {
+			p.setSequence(uint32(int64(binary.LittleEndian.Uint32(p.header[18:22])) + delta))
+		}
+		if _, err := w.Write(p.header); err != nil {
+			return err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return err
+		}
+	}
+}
+
+// paginateOgg lays header packets out on pages, numbering them from *seq.
+func paginateOgg(serial uint32, seq *uint32, packets [][]byte) []oggPage {
+	var lacing []byte
+	var body []byte
+	for _, p := range packets {
+		for n := len(p); ; n -= 255 {
+			if n < 255 {
+				lacing = append(lacing, byte(n))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		body = append(body, p...)
+	}
+
+	var pages []oggPage
+	continued := false
+	for len(lacing) > 0 {
+		n := min(len(lacing), 255)
+		size := 0
+		for _, l := range lacing[:n] {
+			size += int(l)
+		}
+
+		h := make([]byte, 27+n)
+		copy(h, "OggS")
+		if continued {
+			h[5] = 0x01
+		}
+		// header pages are at granule 0, or -1 when no packet ends on them
+		ends := false
+		for _, l := range lacing[:n] {
+			ends = ends || l < 255
+		}
+		if !ends {
+			binary.LittleEndian.PutUint64(h[6:14], ^uint64(0))
+		}
+		binary.LittleEndian.PutUint32(h[14:18], serial)
+		h[26] = byte(n)
+		copy(h[27:], lacing[:n])
+
+		p := oggPage{header: h, body: body[:size]}
+		p.setSequence(*seq)
+		pages = append(pages, p)
+		*seq++
+
+		continued = lacing[n-1] == 255
+		lacing, body = lacing[n:], body[size:]
+	}
+	return pages
+}
@@ -0,0 +1,235 @@
+package fileformat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	// ErrInvalidPCM is returned for raw PCM that is not whole frames of its
+	// format.
+	ErrInvalidPCM = errors.New("PCM data is not a whole number of frames")
+	// ErrWavTooLarge is returned when a WAV file would outgrow its 32-bit
+	// chunk sizes.
+	ErrWavTooLarge = errors.New("audio too large for a WAV file")
+)
+
+// PCMFormat returns the format of interleaved little-endian integer PCM.
+func PCMFormat(sampleRate, channels, bitsPerSample int) WavFormat {
+	return WavFormat{
+		AudioFormat:   WaveFormatPCM,
+		Channels:      channels,
+		SampleRate:    sampleRate,
+		BitsPerSample: bitsPerSample,
+	}
+}
+
+// FloatFormat returns the format of interleaved IEEE float samples of 32 or
+// 64 bits.
+func FloatFormat(sampleRate, channels, bitsPerSample int) WavFormat {
+	f := PCMFormat(sampleRate, channels, bitsPerSample)
+	f.AudioFormat = WaveFormatIEEEFloat
+	return f
+}
+
+// validate checks that f can be written and fills in BlockAlign.
+func (f *WavFormat) validate() error {
+	if f.SampleRate <= 0 || f.Channels <= 0 || f.BitsPerSample <= 0 {
+		return fmt.Errorf(
+			"values must be greater than zero (sampleRate: %d, channels: %d, bitsPerSample: %d)",
+			f.SampleRate, f.Channels, f.BitsPerSample,
+		)
+	}
+	if f.Channels > MaxChannels {
+		return fmt.Errorf("%w: %d channels", ErrUnsupportedFormat, f.Channels)
+	}
+
+	switch {
+	case f.AudioFormat == WaveFormatPCM && (f.BitsPerSample == 8 || f.BitsPerSample == 16 ||
+		f.BitsPerSample == 24 || f.BitsPerSample == 32):
+	case f.AudioFormat == WaveFormatIEEEFloat && (f.BitsPerSample == 32 || f.BitsPerSample == 64):
+	default:
+		return fmt.Errorf("%w: format 0x%04x with %d bits per sample", ErrUnsupportedFormat, f.AudioFormat, f.BitsPerSample)
+	}
+	f.BlockAlign = f.Channels * f.BitsPerSample / 8
+	return nil
+}
+
+// checkPCM validates raw integer PCM before anything is written for it.
+func checkPCM(data []byte, sampleRate, channels, bitsPerSample int) (WavFormat, error) {
+	format := PCMFormat(sampleRate, channels, bitsPerSample)
+	if err := format.validate(); err != nil {
+		return format, err
+	}
+	if len(data)%format.BlockAlign != 0 {
+		return format, fmt.Errorf("%w: %d bytes with %d-byte frames", ErrInvalidPCM, len(data), format.BlockAlign)
+	}
+	if int64(len(data)) > math.MaxUint32-64 {
+		return format, ErrWavTooLarge
+	}
+	return format, nil
+}
+
+// header returns the RIFF header of a file in format f with dataSize bytes
+// of samples, up to the start of the data chunk. Float files get the fact
+// chunk the format requires.
+func (f WavFormat) header(dataSize uint32) []byte {
+	le := binary.LittleEndian
+	fmtSize := 16
+	if f.AudioFormat != WaveFormatPCM {
+		fmtSize = 18
+	}
+
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = append(b, "fmt "...)
+	b = le.AppendUint32(b, uint32(fmtSize))
+	b = le.AppendUint16(b, uint16(f.AudioFormat))
+	b = le.AppendUint16(b, uint16(f.Channels))
+	b = le.AppendUint32(b, uint32(f.SampleRate))
+	b = le.AppendUint32(b, uint32(f.SampleRate*f.BlockAlign)) // byte rate
+	b = le.AppendUint16(b, uint16(f.BlockAlign))
+	b = le.AppendUint16(b, uint16(f.BitsPerSample))
+	if fmtSize == 18 {
+		b = le.AppendUint16(b, 0)
+		b = append(b, "fact"...)
+		b = le.AppendUint32(b, 4)
+		b = le.AppendUint32(b, dataSize/uint32(f.BlockAlign))
+	}
+	b = append(b, "data"...)
+	b = le.AppendUint32(b, dataSize)
+
+	pad := dataSize % 2
+	le.PutUint32(b[4:8], uint32(len(b)-8)+dataSize+pad)
+	return b
+}
+
+// WavWriter streams samples into a WAV file. The header is written up front
+// with empty sizes and patched when the writer is closed, so the samples are
+// never held in memory.
+type WavWriter struct {
+	WavFormat
+
+	w         io.WriteSeeker
+	start     int64 // offset of the RIFF header in w
+	headerLen int
+	dataBytes int64
+	encode    func(b []byte, s float64)
+	buf       []byte
+	closed    bool
+}
+
+// NewWavWriter writes the header of a WAV file in format f at the current
+// position of w. Close must be called to complete the file.
+func NewWavWriter(w io.WriteSeeker, f WavFormat) (*WavWriter, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	header := f.header(0)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("cannot write header to file: %w", err)
+	}
+
+	ww := &WavWriter{WavFormat: f, w: w, start: start, headerLen: len(header)}
+	le := binary.LittleEndian
+	switch {
+	case f.AudioFormat == WaveFormatIEEEFloat && f.BitsPerSample == 32:
+		ww.encode = func(b []byte, s float64) { le.PutUint32(b, math.Float32bits(float32(s))) }
+	case f.AudioFormat == WaveFormatIEEEFloat:
+		ww.encode = func(b []byte, s float64) { le.PutUint64(b, math.Float64bits(s)) }
+	case f.BitsPerSample == 8:
+		ww.encode = func(b []byte, s float64) { b[0] = byte(quantize(s, 8) + 128) }
+	default:
+		ww.encode = func(b []byte, s float64) {
+			v := quantize(s, f.BitsPerSample)
+			for i := range b {
+				b[i] = byte(v >> (8 * i))
+			}
+		}
+	}
+	return ww, nil
+}
+
+// quantize scales a sample in [-1, 1] to a signed integer of bits, clipping
+// what is outside.
+func quantize(s float64, bits int) int64 {
+	full := float64(int64(1) << (bits - 1))
+	v := math.Round(s * full)
+	return int64(max(-full, min(full-1, v)))
+}
+
+// Write appends raw samples already in the writer's format. They need not
+// end on a frame boundary, but the file must by the time it is closed.
+func (w *WavWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed WavWriter")
+	}
+	if int64(w.headerLen)+w.dataBytes+int64(len(p)) > math.MaxUint32-1 {
+		return 0, ErrWavTooLarge
+	}
+	n, err := w.w.Write(p)
+	w.dataBytes += int64(n)
+	return n, err
+}
+
+// WriteFrames encodes interleaved samples in [-1, 1]; integer formats clip
+// what is outside. It returns the number of frames written.
+func (w *WavWriter) WriteFrames(samples []float64) (int, error) {
+	if len(samples)%w.Channels != 0 {
+		return 0, fmt.Errorf("%d samples are not whole frames of %d channels", len(samples), w.Channels)
+	}
+
+	size := w.BitsPerSample / 8
+	if cap(w.buf) < len(samples)*size {
+		w.buf = make([]byte, len(samples)*size)
+	}
+	buf := w.buf[:len(samples)*size]
+	for i, s := range samples {
+		w.encode(buf[i*size:(i+1)*size], s)
+	}
+
+	n, err := w.Write(buf)
+	return n / w.BlockAlign, err
+}
+
+// Frames is the number of whole frames written so far.
+func (w *WavWriter) Frames() int64 {
+	return w.dataBytes / int64(w.BlockAlign)
+}
+
+// Close pads the data chunk and fills in the sizes of the header, leaving w
+// positioned at the end of the file. It does not close w.
+func (w *WavWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.dataBytes%int64(w.BlockAlign) != 0 {
+		return fmt.Errorf("%w: %d bytes with %d-byte frames", ErrInvalidPCM, w.dataBytes, w.BlockAlign)
+	}
+
+	if w.dataBytes%2 == 1 {
+		if _, err := w.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	end, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Seek(w.start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.header(uint32(w.dataBytes))); err != nil {
+		return fmt.Errorf("cannot write header to file: %w", err)
+	}
+	_, err = w.w.Seek(end, io.SeekStart)
+	return err
+}
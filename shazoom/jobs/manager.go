@@ -0,0 +1,550 @@
+// Package jobs runs Spotify downloads in the background. Jobs are persisted
+// through a Store, so a job queued or interrupted before a restart runs again
+// afterwards, and every track's progress can be watched while it runs.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/metadata"
+	"shazoom/spotify"
+	"shazoom/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+func (s Status) Finished() bool {
+	return s == StatusDone || s == StatusFailed || s == StatusCancelled
+}
+
+type Track struct {
+	Title     string              `json:"title"`
+	Artist    string              `json:"artist"`
+	Status    spotify.TrackStatus `json:"status"`
+	Code      spotify.FailureCode `json:"code,omitempty"`
+	Reason    string              `json:"reason,omitempty"`
+	Source    string              `json:"source,omitempty"`
+	SourceID  string              `json:"sourceId,omitempty"`
+	YouTubeID string              `json:"youtubeId,omitempty"`
+}
+
+type Job struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Tracks    []Track   `json:"tracks"`
+	Saved     int       `json:"saved"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (j *Job) clone() Job {
+	c := *j
+	c.Tracks = append([]Track(nil), j.Tracks...)
+	return c
+}
+
+// Event is published whenever a job changes. TrackIndex names the track that
+// changed, or is -1 when the job itself changed state.
+type Event struct {
+	Job        Job
+	TrackIndex int
+}
+
+// Downloader does the actual work of a job.
+type Downloader interface {
+	Resolve(ctx context.Context, url string) ([]spotify.Track, error)
+	Download(ctx context.Context, tracks []spotify.Track, onUpdate func(spotify.TrackUpdate)) (*spotify.DownloadReport, error)
+}
+
+// SpotifyDownloader resolves URLs through Metadata, or metadata.Default when
+// it is nil, and downloads through the spotify package into SavePath, from
+// Sources or spotify.DefaultSources when it is empty.
+type SpotifyDownloader struct {
+	SavePath string
+	DB       db.DBClient
+	Metadata *metadata.Registry
+	Sources  []spotify.AudioSource
+}
+
+func (d SpotifyDownloader) Resolve(ctx context.Context, url string) ([]spotify.Track, error) {
+	registry := d.Metadata
+	if registry == nil {
+		registry = metadata.Default()
+	}
+	tracks, err := registry.Tracks(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.ToSpotify(tracks), nil
+}
+
+func (d SpotifyDownloader) Download(ctx context.Context, tracks []spotify.Track, onUpdate func(spotify.TrackUpdate)) (*spotify.DownloadReport, error) {
+	if len(d.Sources) > 0 {
+		return spotify.DownloadTracksFrom(ctx, d.Sources, tracks, d.SavePath, d.DB, onUpdate)
+	}
+	return spotify.DownloadTracks(ctx, tracks, d.SavePath, d.DB, onUpdate)
+}
+
+var (
+	ErrNotFound     = errors.New("job not found")
+	ErrFinished     = errors.New("job has already finished")
+	ErrNotRetryable = errors.New("only failed or cancelled jobs can be retried")
+)
+
+// ManagerOptions configures optional behaviour of a Manager.
+type ManagerOptions struct {
+	// ReportDir, if set, receives a <job id>.json audit report for every
+	// finished run of a job.
+	ReportDir string
+	// KeepFinished is how many finished jobs are kept; older ones are
+	// forgotten so the store does not grow forever. Zero keeps 200.
+	KeepFinished int
+}
+
+// trackSaveInterval spaces out the saves of per-track progress; changes to
+// the jobs themselves are saved right away.
+const trackSaveInterval = time.Second
+
+type Manager struct {
+	store Store
+	dl    Downloader
+	opts  ManagerOptions
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending []string
+	cancels map[string]context.CancelFunc
+	subs    map[int]*subscriber
+	nextSub int
+	version uint64
+	wake    chan struct{}
+
+	saveMu    sync.Mutex
+	savedVers uint64
+	savedAt   time.Time
+}
+
+type subscriber struct {
+	jobID string
+	ch    chan Event
+}
+
+// NewManager loads the jobs in store. Jobs that were running when the
+// previous process stopped are queued again.
+func NewManager(store Store, dl Downloader, opts ManagerOptions) (*Manager, error) {
+	saved, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		store:   store,
+		dl:      dl,
+		opts:    opts,
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+		subs:    make(map[int]*subscriber),
+		wake:    make(chan struct{}, 1),
+	}
+
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	for i := range saved {
+		job := saved[i]
+		if job.Status == StatusRunning {
+			job.Status = StatusQueued
+			job.Error = "interrupted by a restart"
+		}
+		if job.Status == StatusQueued {
+			m.pending = append(m.pending, job.ID)
+		}
+		m.jobs[job.ID] = &job
+	}
+	m.prune()
+
+	return m, nil
+}
+
+// Run processes queued jobs one at a time until ctx is cancelled. A job that
+// is still running at that point is left queued for the next start.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		id, ok := m.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+				continue
+			}
+		}
+
+		m.run(ctx, id)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (m *Manager) next() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.pending) == 0 {
+		return "", false
+	}
+	id := m.pending[0]
+	m.pending = m.pending[1:]
+	return id, true
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) run(ctx context.Context, id string) {
+	logger := utils.GetLogger()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok || job.Status != StatusQueued {
+		m.mu.Unlock()
+		return
+	}
+	job.Status = StatusRunning
+	job.Error = ""
+	job.Attempts++
+	m.cancels[id] = cancel
+	m.changed(job, -1)
+	url := job.URL
+	m.mu.Unlock()
+	m.save()
+
+	var report *spotify.DownloadReport
+	tracks, err := m.dl.Resolve(jobCtx, url)
+	if err == nil {
+		m.mu.Lock()
+		job.Tracks = make([]Track, len(tracks))
+		for i, t := range tracks {
+			job.Tracks[i] = Track{Title: t.Title, Artist: t.Artist, Status: spotify.TrackQueued}
+		}
+		m.changed(job, -1)
+		m.mu.Unlock()
+		m.save()
+
+		report, err = m.dl.Download(jobCtx, tracks, func(u spotify.TrackUpdate) {
+			m.updateTrack(id, u)
+		})
+	}
+
+	m.mu.Lock()
+	delete(m.cancels, id)
+	if report != nil {
+		job.Saved, job.Skipped, job.Failed = report.Saved, report.Skipped, report.Failed
+	}
+	switch {
+	case ctx.Err() != nil:
+		// shutting down: run it again on the next start
+		job.Status = StatusQueued
+		job.Error = "interrupted by shutdown"
+	case jobCtx.Err() != nil:
+		job.Status = StatusCancelled
+	case err != nil:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = StatusDone
+	}
+	m.changed(job, -1)
+	status := job.Status
+	m.prune()
+	m.mu.Unlock()
+	m.save()
+
+	if report != nil && m.opts.ReportDir != "" {
+		report.Source = url
+		path := filepath.Join(m.opts.ReportDir, id+".json")
+		if err := report.WriteJSON(path); err != nil {
+			logger.Error("failed to write job report", slog.String("job", id), slog.Any("error", err))
+		}
+	}
+
+	logger.Info("download job finished",
+		slog.String("job", id), slog.String("status", string(status)), slog.Int("saved", job.Saved))
+}
+
+func (m *Manager) updateTrack(id string, u spotify.TrackUpdate) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok || u.Index < 0 || u.Index >= len(job.Tracks) {
+		m.mu.Unlock()
+		return
+	}
+
+	track := &job.Tracks[u.Index]
+	track.Status = u.Status
+	track.Code = u.Code
+	track.Reason = u.Reason
+	if u.Source != "" {
+		track.Source, track.SourceID = u.Source, u.SourceID
+	}
+	if u.YouTubeID != "" {
+		track.YouTubeID = u.YouTubeID
+	}
+	m.changed(job, u.Index)
+	m.mu.Unlock()
+
+	m.saveSoon()
+}
+
+// changed stamps job and publishes it; m.mu must be held.
+func (m *Manager) changed(job *Job, trackIndex int) {
+	job.UpdatedAt = time.Now().UTC()
+	m.version++
+
+	event := Event{Job: job.clone(), TrackIndex: trackIndex}
+	for _, sub := range m.subs {
+		if sub.jobID != "" && sub.jobID != job.ID {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			utils.GetLogger().Warn("dropping job event for slow subscriber", slog.String("job", job.ID))
+		}
+	}
+}
+
+// save writes the current job list. Concurrent callers may finish in any
+// order, so a snapshot older than the last one written is discarded.
+func (m *Manager) save() {
+	m.mu.Lock()
+	version := m.version
+	snapshot := m.snapshot()
+	m.mu.Unlock()
+
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	if version <= m.savedVers {
+		return
+	}
+	if err := m.store.Save(snapshot); err != nil {
+		utils.GetLogger().Error("failed to persist jobs", slog.Any("error", err))
+		return
+	}
+	m.savedVers = version
+	m.savedAt = time.Now()
+}
+
+// saveSoon saves unless the jobs were saved less than trackSaveInterval ago.
+// The save at the end of the job writes whatever was skipped.
+func (m *Manager) saveSoon() {
+	m.saveMu.Lock()
+	recent := time.Since(m.savedAt) < trackSaveInterval
+	m.saveMu.Unlock()
+	if !recent {
+		m.save()
+	}
+}
+
+// prune forgets the oldest finished jobs beyond KeepFinished; m.mu must be
+// held.
+func (m *Manager) prune() {
+	keep := m.opts.KeepFinished
+	if keep <= 0 {
+		keep = 200
+	}
+
+	var finished []*Job
+	for _, job := range m.jobs {
+		if job.Status.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= keep {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].UpdatedAt.After(finished[j].UpdatedAt) })
+	for _, job := range finished[keep:] {
+		delete(m.jobs, job.ID)
+	}
+	m.version++
+}
+
+// snapshot returns copies of every job, oldest first; m.mu must be held.
+func (m *Manager) snapshot() []Job {
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job.clone())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+func newJobID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *Manager) Enqueue(url string) (Job, error) {
+	if url == "" {
+		return Job{}, fmt.Errorf("url is required")
+	}
+
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        newJobID(),
+		URL:       url,
+		Status:    StatusQueued,
+		Tracks:    []Track{},
+		CreatedAt: now,
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.pending = append(m.pending, job.ID)
+	m.changed(job, -1)
+	created := job.clone()
+	m.mu.Unlock()
+
+	m.save()
+	m.notify()
+	return created, nil
+}
+
+// List returns every job, newest first.
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	jobs := m.snapshot()
+	m.mu.Unlock()
+
+	for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+		jobs[i], jobs[j] = jobs[j], jobs[i]
+	}
+	return jobs
+}
+
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job.clone(), nil
+}
+
+// Cancel drops a queued job, or stops a running one after the stage each of
+// its tracks is in.
+func (m *Manager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return Job{}, ErrNotFound
+	}
+
+	switch job.Status {
+	case StatusQueued:
+		for i, pendingID := range m.pending {
+			if pendingID == id {
+				m.pending = append(m.pending[:i], m.pending[i+1:]...)
+				break
+			}
+		}
+		job.Status = StatusCancelled
+		m.changed(job, -1)
+	case StatusRunning:
+		if cancel, ok := m.cancels[id]; ok {
+			cancel()
+		}
+	default:
+		m.mu.Unlock()
+		return Job{}, ErrFinished
+	}
+
+	result := job.clone()
+	m.mu.Unlock()
+
+	m.save()
+	return result, nil
+}
+
+// Retry queues a failed or cancelled job again. Tracks that were saved on a
+// previous attempt are skipped as already existing.
+func (m *Manager) Retry(id string) (Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return Job{}, ErrNotFound
+	}
+	if job.Status != StatusFailed && job.Status != StatusCancelled {
+		m.mu.Unlock()
+		return Job{}, ErrNotRetryable
+	}
+
+	job.Status = StatusQueued
+	job.Error = ""
+	m.pending = append(m.pending, id)
+	m.changed(job, -1)
+	result := job.clone()
+	m.mu.Unlock()
+
+	m.save()
+	m.notify()
+	return result, nil
+}
+
+// Subscribe streams events for jobID, or for every job when jobID is empty,
+// until the returned function is called. Events are dropped rather than
+// blocking the download when the channel is full.
+func (m *Manager) Subscribe(jobID string) (<-chan Event, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextSub
+	m.nextSub++
+	sub := &subscriber{jobID: jobID, ch: make(chan Event, 256)}
+	m.subs[id] = sub
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs, id)
+			m.mu.Unlock()
+		})
+	}
+}
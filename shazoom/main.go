@@ -6,7 +6,13 @@ import (
     "fmt"
     "log/slog"
     "os"
+    "os/signal"
+    "strings"
+    "time"
+    "shazoom/core"
     "shazoom/db" 
+    "shazoom/monitor"
+    "shazoom/protocol"
     "shazoom/utils"
 
     "github.com/joho/godotenv"
@@ -20,11 +26,6 @@ func main() {
     logger := utils.GetLogger()
     ctx := context.Background()
 
-    if err := utils.CreateFolder("tmp"); err != nil {
-        err = xerrors.New(err)
-        logger.ErrorContext(ctx, "failed to create tmp directory", slog.Any("error", err))
-    }
-
     if err := utils.CreateFolder(SONGS_DIR); err != nil {
         err = xerrors.New(err)
         logger.ErrorContext(ctx, "failed to create songs directory", slog.Any("error", err))
@@ -44,11 +45,82 @@ func main() {
         client := getDBOrExit(ctx, logger)
         defer client.Close()
         
-        find(os.Args[2])
+        find(os.Args[2], client)
+
+    case "listen":
+        listenCmd := flag.NewFlagSet("listen", flag.ExitOnError)
+        device := listenCmd.String("device", "default", "input device name, or file:<path> to replay a file in real time")
+        every := listenCmd.Duration("every", 3*time.Second, "how much new audio triggers another lookup")
+        maxDuration := listenCmd.Duration("max", 30*time.Second, "give up after this much audio")
+        _ = listenCmd.Parse(os.Args[2:])
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        opts := core.DefaultStreamOptions
+        opts.RescoreEvery = *every
+        opts.MaxDuration = *maxDuration
+
+        listenCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+        defer stop()
+        if err := listen(listenCtx, *device, opts, client); err != nil {
+            fmt.Printf("\nListening failed: %v\n", err)
+            os.Exit(1)
+        }
+
+    case "monitor":
+        monitorCmd := flag.NewFlagSet("monitor", flag.ExitOnError)
+        window := monitorCmd.Duration("window", 10*time.Second, "how much audio each lookup matches")
+        hop := monitorCmd.Duration("hop", 5*time.Second, "how much new audio triggers another lookup")
+        gap := monitorCmd.Duration("gap", 30*time.Second, "how long a song can go undetected before its play ends")
+        speed := monitorCmd.Float64("speed", 1, "pace of file sources relative to real time (0 for as fast as possible)")
+        cacheMB := monitorCmd.Int("cache-mb", 64, "Fingerprint cache budget in MB")
+        _ = monitorCmd.Parse(os.Args[2:])
+
+        if monitorCmd.NArg() < 1 {
+            fmt.Println("Usage: monitor [-window d] [-hop d] [-gap d] [-speed x] <http://stream | file | fifo>...")
+            os.Exit(1)
+        }
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        cache := db.NewCachedClient(client, db.CacheOptions{MaxBytes: int64(*cacheMB) << 20, TTL: 10 * time.Minute})
+        opts := monitor.Options{Window: *window, Hop: *hop, Gap: *gap, Speed: *speed}
+
+        monitorCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+        defer stop()
+        if err := monitorSources(monitorCtx, monitorCmd.Args(), opts, client, cache); err != nil {
+            fmt.Printf("\nMonitoring failed: %v\n", err)
+            os.Exit(1)
+        }
+
+    case "plays":
+        playsCmd := flag.NewFlagSet("plays", flag.ExitOnError)
+        source := playsCmd.String("source", "", "only list plays of this source")
+        since := playsCmd.Duration("since", 0, "only list plays from this long ago on (0 for all)")
+        limit := playsCmd.Int("limit", 50, "list at most this many plays")
+        _ = playsCmd.Parse(os.Args[2:])
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        filter := db.PlayFilter{Source: *source, Limit: *limit}
+        if *since > 0 {
+            filter.Since = time.Now().Add(-*since)
+        }
+        if err := printPlays(filter, client); err != nil {
+            fmt.Printf("\nCould not read the play log: %v\n", err)
+            os.Exit(1)
+        }
 
     case "download":
-        if len(os.Args) < 3 {
-            fmt.Println("Usage: download <spotify_url>")
+        downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
+        reportPath := downloadCmd.String("report", "", "also write the per-track report as JSON to this file")
+        _ = downloadCmd.Parse(os.Args[2:])
+
+        if downloadCmd.NArg() < 1 {
+            fmt.Println("Usage: download [-report file.json] <url>")
             os.Exit(1)
         }
         
@@ -56,14 +128,27 @@ func main() {
         defer client.Close()
 
         fmt.Println("Starting download...")
-        count, err := download(os.Args[2], client)
+        report, err := download(downloadCmd.Arg(0), client)
+
+        if report != nil {
+            fmt.Println()
+            report.PrintTable(os.Stdout)
+
+            if *reportPath != "" {
+                if err := report.WriteJSON(*reportPath); err != nil {
+                    fmt.Printf("\nCould not write report: %v\n", err)
+                } else {
+                    fmt.Printf("Report written to %s\n", *reportPath)
+                }
+            }
+        }
         
         if err != nil {
             fmt.Printf("\nDownload failed: %v\n", err)
             os.Exit(1)
         }
         
-        fmt.Printf("\nSuccessfully processed %d track(s)!\n", count)
+        fmt.Printf("\nSuccessfully processed %d track(s)!\n", report.Saved)
 
     case "serve":
         serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
@@ -74,6 +159,10 @@ func main() {
             defaultPort = "8080"
         }
         port := serveCmd.String("p", defaultPort, "Port to use")
+        cacheMB := serveCmd.Int("cache-mb", 0, "Fingerprint cache budget in MB (0 disables the cache)")
+        cacheTTL := serveCmd.Duration("cache-ttl", 10*time.Minute, "How long cached fingerprints stay valid")
+        songCache := serveCmd.Int("song-cache", 10000, "Number of songs to keep in the metadata cache (0 disables it)")
+        monitored := serveCmd.String("monitor", "", "Comma-separated audio streams to log plays from")
         
         if len(os.Args) > 2 {
             _ = serveCmd.Parse(os.Args[2:])
@@ -83,15 +172,51 @@ func main() {
         // We attempt to connect. If it fails, we LOG it but DO NOT EXIT.
         // This allows the web server to start and pass the Cloud Run health check (TCP handshake).
         // Requests requiring DB will fail, but the container stays alive for debugging.
-        dbClient, err := db.NewDBClient()
+        var dbClient, playBackend db.DBClient
+        var mon *monitor.Monitor
+        var sources []string
+        backend, err := db.NewDBClient()
         if err != nil {
             logger.ErrorContext(ctx, "WARNING: Starting server without Database Connection!", slog.Any("error", err))
             fmt.Println(">>> SERVER STARTING IN DISCONNECTED MODE <<<")
         } else {
-            defer dbClient.Close()
+            defer backend.Close()
+            dbClient, playBackend = backend, backend
+
+            if *cacheMB > 0 {
+                cache := db.NewCachedClient(backend, db.CacheOptions{
+                    MaxBytes: int64(*cacheMB) << 20,
+                    TTL:      *cacheTTL,
+                })
+                go logCacheStats(cache, time.Minute)
+                dbClient = cache
+            }
+
+            if *songCache > 0 {
+                dbClient = db.NewSongCache(dbClient, *songCache)
+            }
+
+        }
+
+        // the play log is served whether or not this server monitors
+        // anything, from a file when there is no database to keep it
+        plays, err := openPlayLog(playBackend)
+        if err != nil {
+            logger.ErrorContext(ctx, "play log disabled", slog.Any("error", err))
+        }
+
+        if *monitored != "" && dbClient != nil && plays != nil {
+            // every window of a monitored stream looks up thousands of
+            // addresses, so the monitor always matches through a cache
+            matcher := dbClient
+            if *cacheMB <= 0 {
+                matcher = db.NewCachedClient(dbClient, db.CacheOptions{MaxBytes: 64 << 20, TTL: *cacheTTL})
+            }
+            mon = monitor.New(matcher, plays, monitor.Options{Speed: 1})
+            sources = strings.Split(*monitored, ",")
         }
         
-        serve(*protocol, *port, dbClient)
+        serve(*protocol, *port, dbClient, plays, mon, sources)
 
     case "erase":
         client := getDBOrExit(ctx, logger)
@@ -125,6 +250,103 @@ func main() {
         }
         save(saveCmd.Arg(0), *force, client)
 
+    case "export-index":
+        if len(os.Args) < 3 {
+            fmt.Println("Usage: export-index <output_file>")
+            os.Exit(1)
+        }
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        if err := db.WriteIndexFile(os.Args[2], client); err != nil {
+            fmt.Printf("\nIndex export failed: %v\n", err)
+            os.Exit(1)
+        }
+
+        fmt.Printf("Index written to %s (serve it with DB_INDEX_FILE=%s)\n", os.Args[2], os.Args[2])
+
+    case "export":
+        if len(os.Args) < 3 {
+            fmt.Println("Usage: export <archive.ndjson.gz>")
+            os.Exit(1)
+        }
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        stats, err := exportArchive(os.Args[2], client)
+        if err != nil {
+            fmt.Printf("\nExport failed: %v\n", err)
+            os.Exit(1)
+        }
+
+        fmt.Printf("Exported %d songs and %d fingerprints to %s\n", stats.Songs, stats.Fingerprints, os.Args[2])
+
+    case "import":
+        importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+        batch := importCmd.Int("batch", 20000, "fingerprints stored per batch")
+        _ = importCmd.Parse(os.Args[2:])
+
+        if importCmd.NArg() < 1 {
+            fmt.Println("Usage: import [-batch n] <archive.ndjson.gz>")
+            os.Exit(1)
+        }
+
+        client := getDBOrExit(ctx, logger)
+        defer client.Close()
+
+        stats, err := importArchive(importCmd.Arg(0), *batch, client)
+        if stats.Resumed {
+            fmt.Println("Resumed a previous import of this archive")
+        }
+        fmt.Printf("Imported %d songs (%d already present) and %d fingerprints\n",
+            stats.SongsImported, stats.SongsSkipped, stats.Fingerprints)
+        if err != nil {
+            fmt.Printf("\nImport failed: %v\nRun the same command again to resume.\n", err)
+            os.Exit(1)
+        }
+
+    case "jobs":
+        jobsCmd := flag.NewFlagSet("jobs", flag.ExitOnError)
+        defaultPort := os.Getenv("PORT")
+        if defaultPort == "" {
+            defaultPort = "8080"
+        }
+        server := jobsCmd.String("server", "http://localhost:"+defaultPort, "URL of the running server")
+        _ = jobsCmd.Parse(os.Args[2:])
+
+        action := "list"
+        if jobsCmd.NArg() > 0 {
+            action = jobsCmd.Arg(0)
+        }
+        if action != "list" && jobsCmd.NArg() < 2 {
+            fmt.Println("Usage: jobs [-server url] [list | add <url> | show <id> | cancel <id> | retry <id>]")
+            os.Exit(1)
+        }
+
+        if err := jobsCommand(*server, action, jobsCmd.Arg(1)); err != nil {
+            fmt.Printf("\n%v\n", err)
+            os.Exit(1)
+        }
+
+    case "protocol-types":
+        out := os.Stdout
+        if len(os.Args) > 2 {
+            f, err := os.Create(os.Args[2])
+            if err != nil {
+                fmt.Printf("Cannot create %s: %v\n", os.Args[2], err)
+                os.Exit(1)
+            }
+            defer f.Close()
+            out = f
+        }
+
+        if err := protocol.WriteTypeScript(out); err != nil {
+            fmt.Printf("Failed to write protocol types: %v\n", err)
+            os.Exit(1)
+        }
+
     default:
         printUsage()
         os.Exit(1)
@@ -148,9 +370,17 @@ func printUsage() {
     fmt.Println("Usage: go run . <command> [arguments]")
     fmt.Println("\nAvailable Commands:")
     fmt.Printf("  %-25s %s\n", "find <file.wav>", "Identify a song from a local WAV file")
-    fmt.Printf("  %-25s %s\n", "download <url>", "Download song/album/playlist from Spotify")
+    fmt.Printf("  %-25s %s\n", "listen [-device d]", "Identify a song playing near the microphone (file:<path> replays a file)")
+    fmt.Printf("  %-25s %s\n", "monitor <stream>...", "Log every song played on HTTP streams, files or FIFOs")
+    fmt.Printf("  %-25s %s\n", "plays [-source s]", "List the songs logged by monitor (or serve -monitor)")
+    fmt.Printf("  %-25s %s\n", "download [-report f] <url>", "Download a song/album/playlist (Spotify, Deezer, MusicBrainz)")
     fmt.Printf("  %-25s %s\n", "save [-force] <path>", "Fingerprint and save a file or directory to DB")
-    fmt.Printf("  %-25s %s\n", "serve [-p port]", "Start the WebSocket server")
+    fmt.Printf("  %-25s %s\n", "serve [-p port]", "Start the WebSocket server (-cache-mb enables the fingerprint cache)")
     fmt.Printf("  %-25s %s\n", "erase [db|all]", "Clear the database and optionally the song files")
+    fmt.Printf("  %-25s %s\n", "export-index <file>", "Build a read-only fingerprint index file from the DB")
+    fmt.Printf("  %-25s %s\n", "export <archive>", "Export songs and fingerprints to a portable archive")
+    fmt.Printf("  %-25s %s\n", "import <archive>", "Import (or resume importing) a portable archive")
+    fmt.Printf("  %-25s %s\n", "jobs [list|add|show|...]", "List, queue, cancel or retry background downloads")
+    fmt.Printf("  %-25s %s\n", "protocol-types [file.ts]", "Generate the client's TypeScript socket event types")
     fmt.Println("")
 }
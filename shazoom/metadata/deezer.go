@@ -0,0 +1,169 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"time"
+)
+
+const deezerAPI = "https://api.deezer.com"
+
+type DeezerOptions struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// Deezer is the provider for deezer.com track, album and playlist links,
+// looked up through the public API, which needs no credentials.
+type Deezer struct {
+	baseURL string
+	api     *apiClient
+}
+
+func NewDeezer(opts DeezerOptions) *Deezer {
+	if opts.BaseURL == "" {
+		opts.BaseURL = deezerAPI
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 15 * time.Second}
+	}
+	// the public API allows 50 requests per 5 seconds
+	return &Deezer{baseURL: opts.BaseURL, api: &apiClient{http: opts.HTTPClient, interval: 100 * time.Millisecond}}
+}
+
+var deezerURLPattern = regexp.MustCompile(`deezer\.com/(?:[a-z]{2}(?:-[a-z]{2})?/)?(track|album|playlist)/(\d+)`)
+
+func (d *Deezer) Name() string {
+	return "deezer"
+}
+
+func (d *Deezer) Parse(url string) (Resource, bool) {
+	matches := deezerURLPattern.FindStringSubmatch(url)
+	if matches == nil {
+		return Resource{}, false
+	}
+	return Resource{Provider: d.Name(), Kind: Kind(matches[1]), ID: matches[2]}, true
+}
+
+// deezerError is sent with status 200 in place of the requested object.
+type deezerError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+type deezerTrack struct {
+	Title    string `json:"title"`
+	Duration int    `json:"duration"`
+	Artist   struct {
+		Name string `json:"name"`
+	} `json:"artist"`
+	Contributors []struct {
+		Name string `json:"name"`
+	} `json:"contributors"`
+	Album struct {
+		Title string `json:"title"`
+	} `json:"album"`
+}
+
+func (t deezerTrack) track(album string) Track {
+	artists := []string{t.Artist.Name}
+	for _, c := range t.Contributors {
+		if c.Name != t.Artist.Name {
+			artists = append(artists, c.Name)
+		}
+	}
+	if t.Album.Title != "" {
+		album = t.Album.Title
+	}
+	return Track{
+		Title:    t.Title,
+		Artist:   t.Artist.Name,
+		Artists:  artists,
+		Album:    album,
+		Duration: t.Duration,
+	}
+}
+
+func (d *Deezer) get(ctx context.Context, path string, out any, apiErr *deezerError) error {
+	if err := d.api.getJSON(ctx, d.Name(), d.baseURL+path, out); err != nil {
+		return err
+	}
+	if apiErr.Message != "" {
+		return fmt.Errorf("deezer: %s (%s)", apiErr.Message, apiErr.Type)
+	}
+	return nil
+}
+
+func (d *Deezer) TrackInfo(ctx context.Context, url string) (*Track, error) {
+	res, ok := d.Parse(url)
+	if !ok || res.Kind != KindTrack {
+		return nil, fmt.Errorf("invalid Deezer track URL: %s", url)
+	}
+
+	var result struct {
+		deezerTrack
+		Error deezerError `json:"error"`
+	}
+	if err := d.get(ctx, "/track/"+res.ID, &result, &result.Error); err != nil {
+		return nil, err
+	}
+
+	track := result.track("")
+	return &track, nil
+}
+
+func (d *Deezer) AlbumInfo(ctx context.Context, url string) ([]Track, error) {
+	res, ok := d.Parse(url)
+	if !ok || res.Kind != KindAlbum {
+		return nil, fmt.Errorf("invalid Deezer album URL: %s", url)
+	}
+
+	var album struct {
+		Title string      `json:"title"`
+		Error deezerError `json:"error"`
+	}
+	if err := d.get(ctx, "/album/"+res.ID, &album, &album.Error); err != nil {
+		return nil, err
+	}
+	return d.pagedTracks(ctx, "/album/"+res.ID+"/tracks", album.Title)
+}
+
+func (d *Deezer) PlaylistInfo(ctx context.Context, url string) ([]Track, error) {
+	res, ok := d.Parse(url)
+	if !ok || res.Kind != KindPlaylist {
+		return nil, fmt.Errorf("invalid Deezer playlist URL: %s", url)
+	}
+	return d.pagedTracks(ctx, "/playlist/"+res.ID+"/tracks", "")
+}
+
+// pagedTracks follows the next links of a paged endpoint. Only their query
+// is used, so the pages come from baseURL too.
+func (d *Deezer) pagedTracks(ctx context.Context, path, album string) ([]Track, error) {
+	var tracks []Track
+
+	next := path + "?index=0&limit=100"
+	for next != "" {
+		var page struct {
+			Data  []deezerTrack `json:"data"`
+			Next  string        `json:"next"`
+			Error deezerError   `json:"error"`
+		}
+		if err := d.get(ctx, next, &page, &page.Error); err != nil {
+			return tracks, err
+		}
+
+		for _, t := range page.Data {
+			tracks = append(tracks, t.track(album))
+		}
+
+		next = ""
+		if u, err := neturl.Parse(page.Next); err == nil && page.Next != "" && len(page.Data) > 0 {
+			next = path + "?" + u.RawQuery
+		}
+	}
+	return tracks, nil
+}
@@ -0,0 +1,175 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	musicBrainzAPI       = "https://musicbrainz.org/ws/2"
+	musicBrainzUserAgent = "shazoom/1.0"
+)
+
+type MusicBrainzOptions struct {
+	BaseURL string
+	// UserAgent should name the application and a contact, as MusicBrainz
+	// asks of API clients.
+	UserAgent string
+	// RequestInterval spaces requests; zero is MusicBrainz's limit of one
+	// request per second.
+	RequestInterval time.Duration
+	HTTPClient      *http.Client
+}
+
+// MusicBrainz is the provider for musicbrainz.org links: a recording is a
+// track and a release is an album. MusicBrainz has no playlists.
+type MusicBrainz struct {
+	baseURL string
+	api     *apiClient
+}
+
+func NewMusicBrainz(opts MusicBrainzOptions) *MusicBrainz {
+	if opts.BaseURL == "" {
+		opts.BaseURL = musicBrainzAPI
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = musicBrainzUserAgent
+	}
+	if opts.RequestInterval <= 0 {
+		opts.RequestInterval = time.Second
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 15 * time.Second}
+	}
+	return &MusicBrainz{
+		baseURL: opts.BaseURL,
+		api:     &apiClient{http: opts.HTTPClient, userAgent: opts.UserAgent, interval: opts.RequestInterval},
+	}
+}
+
+var musicBrainzURLPattern = regexp.MustCompile(`musicbrainz\.org/(recording|release)/([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
+
+func (m *MusicBrainz) Name() string {
+	return "musicbrainz"
+}
+
+func (m *MusicBrainz) Parse(url string) (Resource, bool) {
+	matches := musicBrainzURLPattern.FindStringSubmatch(url)
+	if matches == nil {
+		return Resource{}, false
+	}
+
+	kind := KindTrack
+	if matches[1] == "release" {
+		kind = KindAlbum
+	}
+	return Resource{Provider: m.Name(), Kind: kind, ID: matches[2]}, true
+}
+
+type mbArtistCredit []struct {
+	Name string `json:"name"`
+}
+
+func (c mbArtistCredit) names() []string {
+	names := make([]string, 0, len(c))
+	for _, credit := range c {
+		names = append(names, credit.Name)
+	}
+	return names
+}
+
+type mbRecording struct {
+	Title        string         `json:"title"`
+	Length       int            `json:"length"`
+	ArtistCredit mbArtistCredit `json:"artist-credit"`
+	Releases     []struct {
+		Title string `json:"title"`
+	} `json:"releases"`
+}
+
+func mbTrack(title string, lengthMs int, credit mbArtistCredit, album string) Track {
+	artists := credit.names()
+	artist := ""
+	if len(artists) > 0 {
+		artist = artists[0]
+	}
+	return Track{
+		Title:    title,
+		Artist:   artist,
+		Artists:  artists,
+		Album:    album,
+		Duration: lengthMs / 1000,
+	}
+}
+
+func (m *MusicBrainz) TrackInfo(ctx context.Context, url string) (*Track, error) {
+	res, ok := m.Parse(url)
+	if !ok || res.Kind != KindTrack {
+		return nil, fmt.Errorf("invalid MusicBrainz recording URL: %s", url)
+	}
+
+	var rec mbRecording
+	endpoint := fmt.Sprintf("%s/recording/%s?inc=artist-credits+releases&fmt=json", m.baseURL, res.ID)
+	if err := m.api.getJSON(ctx, m.Name(), endpoint, &rec); err != nil {
+		return nil, err
+	}
+
+	album := ""
+	if len(rec.Releases) > 0 {
+		album = rec.Releases[0].Title
+	}
+	track := mbTrack(rec.Title, rec.Length, rec.ArtistCredit, album)
+	return &track, nil
+}
+
+func (m *MusicBrainz) AlbumInfo(ctx context.Context, url string) ([]Track, error) {
+	res, ok := m.Parse(url)
+	if !ok || res.Kind != KindAlbum {
+		return nil, fmt.Errorf("invalid MusicBrainz release URL: %s", url)
+	}
+
+	var release struct {
+		Title        string         `json:"title"`
+		ArtistCredit mbArtistCredit `json:"artist-credit"`
+		Media        []struct {
+			Tracks []struct {
+				Title     string      `json:"title"`
+				Length    int         `json:"length"`
+				Recording mbRecording `json:"recording"`
+			} `json:"tracks"`
+		} `json:"media"`
+	}
+	endpoint := fmt.Sprintf("%s/release/%s?inc=recordings+artist-credits&fmt=json", m.baseURL, res.ID)
+	if err := m.api.getJSON(ctx, m.Name(), endpoint, &release); err != nil {
+		return nil, err
+	}
+
+	var tracks []Track
+	for _, medium := range release.Media {
+		for _, t := range medium.Tracks {
+			// tracks on compilations carry their own credit
+			credit := t.Recording.ArtistCredit
+			if len(credit) == 0 {
+				credit = release.ArtistCredit
+			}
+			title := strings.TrimSpace(t.Title)
+			if title == "" {
+				title = t.Recording.Title
+			}
+			length := t.Length
+			if length == 0 {
+				length = t.Recording.Length
+			}
+			tracks = append(tracks, mbTrack(title, length, credit, release.Title))
+		}
+	}
+	return tracks, nil
+}
+
+func (m *MusicBrainz) PlaylistInfo(ctx context.Context, url string) ([]Track, error) {
+	return nil, fmt.Errorf("musicbrainz playlists: %w", ErrUnsupportedKind)
+}
@@ -0,0 +1,221 @@
+// Package metadata resolves links from music services into the tracks that
+// the downloader searches for and ingests. Each service is a
+// MetadataProvider; a Registry picks the provider for a URL.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shazoom/spotify"
+	"shazoom/utils"
+	"sync"
+	"time"
+)
+
+// Kind is what a URL points at.
+type Kind string
+
+const (
+	KindTrack    Kind = "track"
+	KindAlbum    Kind = "album"
+	KindPlaylist Kind = "playlist"
+)
+
+// Track is a track as a provider describes it: what the downloader searches
+// its audio sources for. Duration is in seconds, 0 when unknown.
+type Track struct {
+	Title, Artist, Album string
+	Artists              []string
+	Duration             int
+}
+
+// ToSpotify converts tracks to the ones spotify.DownloadTracks takes.
+func ToSpotify(tracks []Track) []spotify.Track {
+	out := make([]spotify.Track, len(tracks))
+	for i, t := range tracks {
+		out[i] = spotify.Track{Title: t.Title, Artist: t.Artist, Album: t.Album, Artists: t.Artists, Duration: t.Duration}
+	}
+	return out
+}
+
+// Resource is a URL that a provider recognised.
+type Resource struct {
+	Provider string
+	Kind     Kind
+	ID       string
+}
+
+// MetadataProvider looks up tracks on one music service. Parse only inspects
+// the URL; the lookups take the same URL and call the service.
+type MetadataProvider interface {
+	Name() string
+	Parse(url string) (Resource, bool)
+	TrackInfo(ctx context.Context, url string) (*Track, error)
+	AlbumInfo(ctx context.Context, url string) ([]Track, error)
+	PlaylistInfo(ctx context.Context, url string) ([]Track, error)
+}
+
+var (
+	ErrUnsupportedURL  = errors.New("unsupported URL")
+	ErrUnsupportedKind = errors.New("not supported by this provider")
+)
+
+// Registry routes URLs to the first registered provider that parses them.
+type Registry struct {
+	mu        sync.RWMutex
+	providers []MetadataProvider
+}
+
+func NewRegistry(providers ...MetadataProvider) *Registry {
+	return &Registry{providers: providers}
+}
+
+func (r *Registry) Register(p MetadataProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = append(r.providers, p)
+}
+
+// Providers returns the registered providers in lookup order.
+func (r *Registry) Providers() []MetadataProvider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]MetadataProvider(nil), r.providers...)
+}
+
+// Lookup finds the provider for url.
+func (r *Registry) Lookup(url string) (MetadataProvider, Resource, error) {
+	for _, p := range r.Providers() {
+		if res, ok := p.Parse(url); ok {
+			return p, res, nil
+		}
+	}
+	return nil, Resource{}, fmt.Errorf("%w: %s", ErrUnsupportedURL, url)
+}
+
+// Tracks resolves url to its tracks, one for a track link and all of them for
+// an album or playlist.
+func (r *Registry) Tracks(ctx context.Context, url string) ([]Track, error) {
+	p, res, err := r.Lookup(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.Kind {
+	case KindTrack:
+		track, err := p.TrackInfo(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return []Track{*track}, nil
+	case KindAlbum:
+		return p.AlbumInfo(ctx, url)
+	case KindPlaylist:
+		return p.PlaylistInfo(ctx, url)
+	default:
+		return nil, fmt.Errorf("%s %s: %w", p.Name(), res.Kind, ErrUnsupportedKind)
+	}
+}
+
+var (
+	defaultRegistry     *Registry
+	defaultRegistryOnce sync.Once
+)
+
+// Default returns the registry of every built-in provider.
+func Default() *Registry {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry = NewRegistry(
+			NewSpotify(spotify.Default()),
+			NewDeezer(DeezerOptions{}),
+			NewMusicBrainz(MusicBrainzOptions{UserAgent: utils.GetEnv("MUSICBRAINZ_USER_AGENT", "")}),
+		)
+	})
+	return defaultRegistry
+}
+
+// Tracks resolves url with the default registry.
+func Tracks(ctx context.Context, url string) ([]Track, error) {
+	return Default().Tracks(ctx, url)
+}
+
+// apiClient is the small JSON-over-HTTP client the public-API providers
+// share. Requests are spaced at least interval apart.
+type apiClient struct {
+	http      *http.Client
+	userAgent string
+	interval  time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// StatusError is returned for a non-200 response from a provider.
+type StatusError struct {
+	Provider   string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.Provider, e.StatusCode)
+}
+
+func (c *apiClient) getJSON(ctx context.Context, provider, endpoint string, out any) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", provider, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return &StatusError{Provider: provider, StatusCode: resp.StatusCode}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid %s response: %w", provider, err)
+	}
+	return nil
+}
+
+func (c *apiClient) wait(ctx context.Context) error {
+	if c.interval <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	at := c.next
+	if at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(c.interval)
+	c.mu.Unlock()
+
+	if delay := time.Until(at); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"context"
+	"shazoom/spotify"
+)
+
+// Spotify is the provider for open.spotify.com links. The lookups are the
+// ones of the wrapped spotify.Client.
+type Spotify struct {
+	client *spotify.Client
+}
+
+func NewSpotify(client *spotify.Client) Spotify {
+	return Spotify{client: client}
+}
+
+func (Spotify) Name() string {
+	return "spotify"
+}
+
+func (Spotify) Parse(url string) (Resource, bool) {
+	kind, id, ok := spotify.ParseURL(url)
+	if !ok {
+		return Resource{}, false
+	}
+	return Resource{Provider: "spotify", Kind: Kind(kind), ID: id}, true
+}
+
+func (s Spotify) TrackInfo(ctx context.Context, url string) (*Track, error) {
+	track, err := s.client.TrackInfo(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	t := fromSpotify(*track)
+	return &t, nil
+}
+
+func (s Spotify) AlbumInfo(ctx context.Context, url string) ([]Track, error) {
+	return fromSpotifyAll(s.client.AlbumInfo(ctx, url))
+}
+
+func (s Spotify) PlaylistInfo(ctx context.Context, url string) ([]Track, error) {
+	return fromSpotifyAll(s.client.PlaylistInfo(ctx, url))
+}
+
+func fromSpotify(t spotify.Track) Track {
+	return Track{Title: t.Title, Artist: t.Artist, Album: t.Album, Artists: t.Artists, Duration: t.Duration}
+}
+
+func fromSpotifyAll(tracks []spotify.Track, err error) ([]Track, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Track, len(tracks))
+	for i, t := range tracks {
+		out[i] = fromSpotify(t)
+	}
+	return out, nil
+}
@@ -0,0 +1,380 @@
+// Package monitor logs the songs played on broadcast streams. Each source
+// runs one long-lived streaming fingerprinter whose hashes are matched in
+// rolling windows; consecutive detections of the same song are folded into
+// a single play in the play log.
+package monitor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"shazoom/core"
+	"shazoom/db"
+	"shazoom/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Options tunes the matching of every source of a Monitor. Zero values take
+// the defaults.
+type Options struct {
+	// Window is how much audio each match looks at; 10s by default.
+	Window time.Duration
+	// Hop is how much new audio triggers the next match; 5s by default.
+	Hop time.Duration
+	// Gap ends a play when its song has not been detected for this long,
+	// so that it is logged again if it comes back; 30s by default.
+	Gap time.Duration
+	// MinScore and MinMargin decide when a window's best match counts as a
+	// detection, as for a streaming recognition. They default to the values
+	// of core.DefaultStreamOptions.
+	MinScore  float64
+	MinMargin float64
+	// Speed paces file sources: 1 is real time, 0 as fast as they decode.
+	Speed float64
+	// RetryDelay is the wait before reconnecting to a dropped HTTP stream;
+	// 5s by default.
+	RetryDelay time.Duration
+	// IdleTimeout drops an HTTP stream that has sent no data for this long,
+	// to be reconnected to; 30s by default.
+	IdleTimeout time.Duration
+	// OnPlay is called whenever a new play starts.
+	OnPlay func(play db.Play)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.Hop <= 0 {
+		o.Hop = 5 * time.Second
+	}
+	if o.Gap <= 0 {
+		o.Gap = 30 * time.Second
+	}
+	if o.MinScore <= 0 {
+		o.MinScore = core.DefaultStreamOptions.MinScore
+	}
+	if o.MinMargin <= 0 {
+		o.MinMargin = core.DefaultStreamOptions.MinMargin
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 5 * time.Second
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// maxSessionAudio restarts the fingerprinter of a source before its anchor
+// times, in ms since it started, can overflow 32 bits.
+const maxSessionAudio = 24 * time.Hour
+
+// Status is the state of one monitored source.
+type Status struct {
+	Source    string
+	Connected bool
+	// Listened is how much audio the source has delivered in total.
+	Listened time.Duration
+	// NowPlaying is the play in progress, if a song is being detected.
+	NowPlaying *db.Play
+	// Error is why the source last failed.
+	Error string
+}
+
+// Monitor matches the audio of its sources against a catalogue and records
+// what it hears in a play log.
+type Monitor struct {
+	dbClient db.DBClient
+	plays    db.PlayLog
+	opts     Options
+
+	mu      sync.Mutex
+	sources map[string]*Status
+}
+
+// New returns a monitor matching against dbClient, which should cache
+// posting lists (see db.NewCachedClient): a station repeats its playlist,
+// and every window looks up thousands of addresses.
+func New(dbClient db.DBClient, plays db.PlayLog, opts Options) *Monitor {
+	return &Monitor{
+		dbClient: dbClient,
+		plays:    plays,
+		opts:     opts.withDefaults(),
+		sources:  map[string]*Status{},
+	}
+}
+
+// Plays lists the play log.
+func (m *Monitor) Plays(filter db.PlayFilter) ([]db.Play, error) {
+	return m.plays.ListPlays(filter)
+}
+
+// Status returns the state of every source run so far, ordered by source.
+func (m *Monitor) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.sources))
+	for _, s := range m.sources {
+		status := *s
+		if s.NowPlaying != nil {
+			play := *s.NowPlaying
+			status.NowPlaying = &play
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Source < statuses[j].Source })
+	return statuses
+}
+
+func (m *Monitor) update(source string, fn func(s *Status)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sources[source]
+	if !ok {
+		s = &Status{Source: source}
+		m.sources[source] = s
+	}
+	fn(s)
+}
+
+// Run monitors source until ctx is cancelled. A file ends the run when it
+// has been played through; an HTTP stream is reconnected to whenever it
+// drops, and Run only returns ctx's error.
+func (m *Monitor) Run(ctx context.Context, source string) error {
+	logger := utils.GetLogger()
+	t := &tracker{m: m, source: source}
+
+	for {
+		err := m.session(ctx, source, t)
+		m.update(source, func(s *Status) {
+			s.Connected = false
+			if err != nil {
+				s.Error = err.Error()
+			}
+		})
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isNetworkSource(source) {
+			return err
+		}
+
+		logger.Warn("monitored stream dropped, reconnecting",
+			slog.String("source", source), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.opts.RetryDelay):
+		}
+	}
+}
+
+// session reads source from one connection until it ends or fails. Times
+// are taken from the audio, counted from when the connection was opened, so
+// that a file replayed faster than real time is logged as if it were live.
+func (m *Monitor) session(ctx context.Context, source string, t *tracker) error {
+	src, err := OpenSource(ctx, source, m.opts)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var listened time.Duration
+	m.update(source, func(s *Status) { s.Connected, s.Error, listened = true, "", s.Listened })
+
+	rate := src.SampleRate()
+	w := &window{}
+	fp, err := core.NewStreamFingerprinter(rate)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	buf := make([]float64, rate/4)
+	fresh := map[int64]uint32{}
+	// samples counts from the last restart of the fingerprinter, read from
+	// the start of the session
+	var samples, lastMatch, read int64
+	audio := func(n int64) time.Duration { return time.Duration(n) * time.Second / time.Duration(rate) }
+
+	for ctx.Err() == nil {
+		n, readErr := src.Read(buf)
+		fp.Write(buf[:n], fresh)
+		w.add(fresh)
+		clear(fresh)
+		samples += int64(n)
+		read += int64(n)
+		m.update(source, func(s *Status) { s.Listened = listened + audio(read) })
+
+		if audio(samples-lastMatch) >= m.opts.Hop {
+			lastMatch = samples
+			end := audio(samples)
+			if err := m.match(w, t, start.Add(end-m.opts.Window), start.Add(end)); err != nil {
+				return err
+			}
+		}
+
+		if audio(samples) >= maxSessionAudio {
+			start = start.Add(audio(samples))
+			samples, lastMatch = 0, 0
+			w = &window{}
+			if fp, err = core.NewStreamFingerprinter(rate); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	return ctx.Err()
+}
+
+// match looks up the hashes of the window ending at end and passes its
+// detection, if any, to the tracker.
+func (m *Monitor) match(w *window, t *tracker, start, end time.Time) error {
+	sample := w.sample(end.Sub(start).Milliseconds())
+	if len(sample) == 0 {
+		return t.observe(nil, start, end)
+	}
+
+	matches, _, err := core.FindMatchesUsingFingerPrints(sample, m.dbClient)
+	if err != nil {
+		return err
+	}
+
+	opts := core.StreamOptions{MinScore: m.opts.MinScore, MinMargin: m.opts.MinMargin}
+	if !opts.Confident(matches) {
+		return t.observe(nil, start, end)
+	}
+	return t.observe(&matches[0], start, end)
+}
+
+// window holds the hashes of the most recent audio, in the order they were
+// fingerprinted.
+type window struct {
+	hashes []core.Hash
+	latest uint32
+}
+
+func (w *window) add(fresh map[int64]uint32) {
+	for address, anchor := range fresh {
+		w.hashes = append(w.hashes, core.Hash{Address: address, AnchorTime: anchor})
+		w.latest = max(w.latest, anchor)
+	}
+}
+
+// sample drops the hashes anchored more than length ms before the latest
+// one and returns the rest. As in Fingerprint, a repeated address keeps the
+// latest anchor.
+func (w *window) sample(length int64) map[int64]uint32 {
+	cutoff := int64(w.latest) - length
+	kept := w.hashes[:0]
+	sample := make(map[int64]uint32)
+	for _, h := range w.hashes {
+		if int64(h.AnchorTime) < cutoff {
+			continue
+		}
+		kept = append(kept, h)
+		if prev, ok := sample[h.Address]; !ok || h.AnchorTime >= prev {
+			sample[h.Address] = h.AnchorTime
+		}
+	}
+	w.hashes = kept
+	return sample
+}
+
+// tracker folds the detections of one source into plays.
+type tracker struct {
+	m       *Monitor
+	source  string
+	current *db.Play
+}
+
+// observe records the outcome of the window from start to end: best is the
+// detected song, or nil when nothing was detected. Detections of the song
+// already playing extend its play unless more than Gap has passed since the
+// last one.
+func (t *tracker) observe(best *core.Match, start, end time.Time) error {
+	defer t.publish()
+
+	if best == nil {
+		if t.current != nil && end.Sub(t.current.EndedAt) > t.m.opts.Gap {
+			t.current = nil
+		}
+		return nil
+	}
+
+	if t.current != nil && t.current.SongID == best.SongId && start.Sub(t.current.EndedAt) <= t.m.opts.Gap {
+		t.current.EndedAt = end
+		t.current.Score = max(t.current.Score, best.Score)
+		t.current.Detections++
+		return t.m.plays.UpdatePlay(*t.current)
+	}
+
+	play := &db.Play{
+		Source:     t.source,
+		SongID:     best.SongId,
+		Title:      best.SongTitle,
+		Artist:     best.SongArtist,
+		StartedAt:  start,
+		EndedAt:    end,
+		Score:      best.Score,
+		Detections: 1,
+	}
+	if err := t.m.plays.RecordPlay(play); err != nil {
+		t.current = nil
+		return err
+	}
+	t.current = play
+	if t.m.opts.OnPlay != nil {
+		t.m.opts.OnPlay(*play)
+	}
+	return nil
+}
+
+func (t *tracker) publish() {
+	t.m.update(t.source, func(s *Status) { s.NowPlaying = t.current })
+}
+
+// ErrNoSources is returned by RunAll when given nothing to monitor.
+var ErrNoSources = errors.New("no sources to monitor")
+
+// RunAll runs every source until ctx is cancelled, or until every file
+// among them has been played through, and returns the first error of a
+// source that stopped for another reason.
+func (m *Monitor) RunAll(ctx context.Context, sources []string) error {
+	if len(sources) == 0 {
+		return ErrNoSources
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(sources))
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.Run(ctx, source)
+			if errs[i] != nil && ctx.Err() == nil {
+				utils.GetLogger().Error("monitor stopped", slog.String("source", source), slog.Any("error", errs[i]))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"shazoom/capture"
+	"shazoom/fileformat"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamIdle is returned by the sources of HTTP streams that stopped
+// sending data for longer than their idle timeout.
+var ErrStreamIdle = errors.New("stream sent no data")
+
+// httpClient opens HTTP streams. It has no overall timeout, since a stream
+// never ends; stalls are caught by the idle timeout of each source instead.
+var httpClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// isNetworkSource reports whether spec is an HTTP stream, which is
+// reconnected to when it drops rather than ending like a file.
+func isNetworkSource(spec string) bool {
+	return strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://")
+}
+
+// OpenSource opens a monitored source:
+//
+//	http(s)://...   an Icecast or Shoutcast stream, or any audio over HTTP
+//	[file:]<path>   a file, replayed at speed times real time (0 for as fast
+//	                as it decodes), or a FIFO, read as it is written
+//
+// Compressed audio without an in-process codec, such as AAC, is decoded
+// through ffmpeg. Only opts.Speed and opts.IdleTimeout are used.
+func OpenSource(ctx context.Context, spec string, opts Options) (capture.Source, error) {
+	opts = opts.withDefaults()
+	if isNetworkSource(spec) {
+		return openHTTP(ctx, spec, opts.IdleTimeout)
+	}
+
+	path := strings.TrimPrefix(spec, "file:")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return capture.OpenFile(path, opts.Speed)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSource(ctx, f)
+}
+
+func openHTTP(ctx context.Context, url string, idle time.Duration) (capture.Source, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "shazoom-monitor")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return decodeSource(ctx, newIdleReader(resp.Body, idle))
+}
+
+// idleReader closes a connection that has sent nothing for timeout, which
+// fails the read waiting on it so that the stream is reconnected to rather
+// than waited on forever.
+type idleReader struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleReader(body io.ReadCloser, timeout time.Duration) *idleReader {
+	r := &idleReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.timedOut.Store(true)
+		body.Close()
+	})
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && r.timedOut.Load() {
+		err = fmt.Errorf("%w for %v", ErrStreamIdle, r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// streamSource decodes audio as it is read from a connection or a pipe.
+type streamSource struct {
+	stream *fileformat.PCMStream
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func decodeSource(ctx context.Context, body io.ReadCloser) (capture.Source, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := fileformat.DecodeReader(ctx, body, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		cancel()
+		body.Close()
+		return nil, err
+	}
+	return &streamSource{stream: stream, body: body, cancel: cancel}, nil
+}
+
+func (s *streamSource) SampleRate() int { return s.stream.SampleRate }
+
+func (s *streamSource) Read(dst []float64) (int, error) {
+	return s.stream.ReadFrames(dst)
+}
+
+func (s *streamSource) Close() error {
+	defer s.cancel()
+	// closing the body first unblocks a decoder waiting for data
+	s.body.Close()
+	return s.stream.Close()
+}
@@ -0,0 +1,274 @@
+// Package protocol describes every Socket.IO event exchanged between the
+// server and the web client. It is the source of truth for client/protocol.ts,
+// which is generated from it with `go run . protocol-types`.
+//
+// Every request may carry a client-chosen requestId; every event sent in
+// response to it echoes the same ID so the client can tell which request an
+// answer, progress update or error belongs to. Requests may also be sent in
+// their legacy form (a bare URL for newDownload, an empty string for
+// totalSongs, bare base64 audio for streamChunk).
+//
+// Instead of uploading audio, a client may fingerprint a recording itself,
+// with the WebAssembly build of the core package, and send only the hashes
+// with submitFingerprints.
+package protocol
+
+// Events sent by the client.
+const (
+	EventTotalSongs   = "totalSongs"
+	EventNewDownload  = "newDownload"
+	EventNewRecording = "newRecording"
+	EventStartStream  = "startStream"
+	EventStreamChunk  = "streamChunk"
+	EventStopStream   = "stopStream"
+
+	EventSubmitFingerprints = "submitFingerprints"
+)
+
+// Events sent by the server.
+const (
+	EventMatches             = "matches"
+	EventDownloadStatus      = "downloadStatus"
+	EventStreamEnded         = "streamEnded"
+	EventRecognitionProgress = "recognitionProgress"
+	EventRecognitionError    = "recognitionError"
+)
+
+// ErrorCode identifies why a request failed.
+type ErrorCode string
+
+const (
+	ErrDatabaseUnavailable ErrorCode = "database_unavailable"
+	ErrInvalidPayload      ErrorCode = "invalid_payload"
+	ErrDecodeFailed        ErrorCode = "decode_failed"
+	ErrFingerprintFailed   ErrorCode = "fingerprint_failed"
+	ErrMatchFailed         ErrorCode = "match_failed"
+	ErrNoActiveStream      ErrorCode = "no_active_stream"
+	ErrConfigMismatch      ErrorCode = "fingerprint_config_mismatch"
+	ErrRateLimited         ErrorCode = "rate_limited"
+	ErrInternal            ErrorCode = "internal"
+)
+
+var ErrorCodes = []ErrorCode{
+	ErrDatabaseUnavailable, ErrInvalidPayload, ErrDecodeFailed,
+	ErrFingerprintFailed, ErrMatchFailed, ErrNoActiveStream,
+	ErrConfigMismatch, ErrRateLimited, ErrInternal,
+}
+
+// Stage is a step of recognising a recording, reported by recognitionProgress.
+type Stage string
+
+const (
+	StageReceived       Stage = "received"
+	StageDecoding       Stage = "decoding"
+	StageFingerprinting Stage = "fingerprinting"
+	StageMatching       Stage = "matching"
+	StageDone           Stage = "done"
+)
+
+var Stages = []Stage{StageReceived, StageDecoding, StageFingerprinting, StageMatching, StageDone}
+
+// StatusType is the severity of a downloadStatus event.
+type StatusType string
+
+const (
+	StatusInfo    StatusType = "info"
+	StatusSuccess StatusType = "success"
+	StatusError   StatusType = "error"
+)
+
+var StatusTypes = []StatusType{StatusInfo, StatusSuccess, StatusError}
+
+// TrackStatus is the stage a track of a download job has reached.
+type TrackStatus string
+
+const (
+	TrackQueued         TrackStatus = "queued"
+	TrackSearching      TrackStatus = "searching"
+	TrackDownloading    TrackStatus = "downloading"
+	TrackFingerprinting TrackStatus = "fingerprinting"
+	TrackDone           TrackStatus = "done"
+	TrackSkipped        TrackStatus = "skipped"
+	TrackFailed         TrackStatus = "failed"
+)
+
+var TrackStatuses = []TrackStatus{
+	TrackQueued, TrackSearching, TrackDownloading, TrackFingerprinting,
+	TrackDone, TrackSkipped, TrackFailed,
+}
+
+// ErrorBody is attached to responses whose request failed.
+type ErrorBody struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+type TotalSongsRequest struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type NewDownloadRequest struct {
+	RequestID string `json:"requestId,omitempty"`
+	URL       string `json:"url"`
+}
+
+// NewRecordingRequest carries a complete recording, base64 encoded. Without
+// a MIME type, or with audio/pcm, it is raw little-endian PCM described by
+// SampleRate, Channels and SampleSize (16 bits when unset). Otherwise it is
+// a compressed recording as produced by MediaRecorder, such as
+// "audio/webm;codecs=opus", "audio/ogg" or "audio/mp4", and the sample
+// fields are ignored.
+type NewRecordingRequest struct {
+	RequestID  string `json:"requestId,omitempty"`
+	Audio      string `json:"audio"`
+	MimeType   string `json:"mimeType,omitempty"`
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	SampleSize int    `json:"sampleSize,omitempty"`
+}
+
+type StartStreamRequest struct {
+	RequestID  string `json:"requestId,omitempty"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+}
+
+// StreamChunkRequest carries the next slice of base64 16-bit PCM. Its
+// requestId, if any, must be the one the stream was started with.
+type StreamChunkRequest struct {
+	RequestID string `json:"requestId,omitempty"`
+	Audio     string `json:"audio"`
+}
+
+type StopStreamRequest struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// FingerprintConfig declares how submitted hashes were computed. It must
+// equal the server's configuration, or the submission is rejected with
+// fingerprint_config_mismatch; Version changes whenever hashes of one
+// version stop being comparable with another.
+type FingerprintConfig struct {
+	Version        int `json:"version"`
+	SampleRate     int `json:"sampleRate"`
+	WindowSize     int `json:"windowSize"`
+	HopSize        int `json:"hopSize"`
+	TargetZoneSize int `json:"targetZoneSize"`
+}
+
+// FingerprintHash is one fingerprint of a recording: a 32-bit peak pair
+// address and the time of its anchor peak in ms.
+type FingerprintHash struct {
+	Address    int64  `json:"address"`
+	AnchorTime uint32 `json:"anchorTime"`
+}
+
+// SubmitFingerprintsRequest asks for the matches of a recording the client
+// fingerprinted itself. It is answered like newRecording, with matches or a
+// recognitionError.
+type SubmitFingerprintsRequest struct {
+	RequestID string            `json:"requestId,omitempty"`
+	Config    FingerprintConfig `json:"config"`
+	Hashes    []FingerprintHash `json:"hashes"`
+}
+
+// Match keeps the field names the client has always received.
+type Match struct {
+	SongID      uint32  `json:"SongId"`
+	SongTitle   string  `json:"SongTitle"`
+	SongArtist  string  `json:"SongArtist"`
+	YouTubeID   string  `json:"YouTubeID"`
+	TimestampMs uint32  `json:"Timestamp"`
+	Score       float64 `json:"Score"`
+}
+
+// MatchesEvent answers newRecording and submitFingerprints, and is sent
+// after every rescore of a stream. Final is false for provisional stream
+// results.
+type MatchesEvent struct {
+	RequestID string  `json:"requestId,omitempty"`
+	Matches   []Match `json:"matches"`
+	Final     bool    `json:"final"`
+}
+
+type TotalSongsEvent struct {
+	RequestID string     `json:"requestId,omitempty"`
+	Total     int        `json:"total"`
+	Error     *ErrorBody `json:"error,omitempty"`
+}
+
+// DownloadStatusEvent reports on a download job. Track is set when the event
+// is about a single track of the job; Report is set once the job finished.
+type DownloadStatusEvent struct {
+	RequestID string          `json:"requestId,omitempty"`
+	JobID     string          `json:"jobId,omitempty"`
+	Type      StatusType      `json:"type"`
+	Message   string          `json:"message"`
+	Track     *DownloadTrack  `json:"track,omitempty"`
+	Report    *DownloadReport `json:"report,omitempty"`
+	Error     *ErrorBody      `json:"error,omitempty"`
+}
+
+// DownloadTrack is one track of a download. Code is a short machine-readable
+// reason for a skipped or failed track, e.g. "already_exists".
+type DownloadTrack struct {
+	Index  int         `json:"index"`
+	Title  string      `json:"title"`
+	Artist string      `json:"artist"`
+	Status TrackStatus `json:"status"`
+	Code   string      `json:"code,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// DownloadReport is the per-track outcome of a finished download job.
+type DownloadReport struct {
+	Saved   int             `json:"saved"`
+	Skipped int             `json:"skipped"`
+	Failed  int             `json:"failed"`
+	Tracks  []DownloadTrack `json:"tracks"`
+}
+
+type StreamEndedEvent struct {
+	RequestID  string `json:"requestId,omitempty"`
+	Reason     string `json:"reason"`
+	Confident  bool   `json:"confident"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type RecognitionProgressEvent struct {
+	RequestID string `json:"requestId,omitempty"`
+	Stage     Stage  `json:"stage"`
+}
+
+// RecognitionErrorEvent ends a newRecording, submitFingerprints or stream
+// request that failed.
+type RecognitionErrorEvent struct {
+	RequestID string    `json:"requestId,omitempty"`
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+}
+
+// EventSpec ties an event name to the payload type sent with it.
+type EventSpec struct {
+	Name    string
+	Payload any
+}
+
+var ClientEvents = []EventSpec{
+	{EventTotalSongs, TotalSongsRequest{}},
+	{EventNewDownload, NewDownloadRequest{}},
+	{EventNewRecording, NewRecordingRequest{}},
+	{EventStartStream, StartStreamRequest{}},
+	{EventStreamChunk, StreamChunkRequest{}},
+	{EventStopStream, StopStreamRequest{}},
+	{EventSubmitFingerprints, SubmitFingerprintsRequest{}},
+}
+
+var ServerEvents = []EventSpec{
+	{EventMatches, MatchesEvent{}},
+	{EventTotalSongs, TotalSongsEvent{}},
+	{EventDownloadStatus, DownloadStatusEvent{}},
+	{EventStreamEnded, StreamEndedEvent{}},
+	{EventRecognitionProgress, RecognitionProgressEvent{}},
+	{EventRecognitionError, RecognitionErrorEvent{}},
+}
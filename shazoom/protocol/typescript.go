@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// WriteTypeScript renders the event payloads, enums and event maps as
+// TypeScript declarations. The output only depends on this package, so it is
+// stable across runs and can be checked in.
+func WriteTypeScript(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "// Code generated by `go run . protocol-types`; DO NOT EDIT.")
+	fmt.Fprintln(bw, "// Source: shazoom/protocol/events.go")
+
+	writeUnion(bw, "ErrorCode", ErrorCodes)
+	writeUnion(bw, "Stage", Stages)
+	writeUnion(bw, "StatusType", StatusTypes)
+	writeUnion(bw, "TrackStatus", TrackStatuses)
+
+	g := &tsGen{seen: map[reflect.Type]bool{}}
+	for _, specs := range [][]EventSpec{ClientEvents, ServerEvents} {
+		for _, spec := range specs {
+			g.collect(reflect.TypeOf(spec.Payload))
+		}
+	}
+	for _, t := range g.order {
+		writeInterface(bw, t)
+	}
+
+	writeEventMap(bw, "ClientEvents", ClientEvents)
+	writeEventMap(bw, "ServerEvents", ServerEvents)
+
+	return bw.Flush()
+}
+
+func writeUnion[T ~string](w io.Writer, name string, values []T) {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("'%s'", v)
+	}
+	fmt.Fprintf(w, "\nexport type %s = %s;\n", name, strings.Join(quoted, " | "))
+}
+
+type tsGen struct {
+	seen  map[reflect.Type]bool
+	order []reflect.Type
+}
+
+// collect records t and every struct reachable from its fields, each once.
+func (g *tsGen) collect(t reflect.Type) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || g.seen[t] {
+		return
+	}
+	g.seen[t] = true
+	g.order = append(g.order, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		g.collect(t.Field(i).Type)
+	}
+}
+
+func writeInterface(w io.Writer, t reflect.Type) {
+	fmt.Fprintf(w, "\nexport interface %s {\n", t.Name())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		optional := ""
+		if strings.Contains(opts, "omitempty") || field.Type.Kind() == reflect.Pointer {
+			optional = "?"
+		}
+		fmt.Fprintf(w, "  %s%s: %s;\n", name, optional, tsType(field.Type))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func tsType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return tsType(t.Elem())
+	case reflect.Slice:
+		return tsType(t.Elem()) + "[]"
+	case reflect.Struct:
+		return t.Name()
+	case reflect.String:
+		if t.PkgPath() != "" {
+			return t.Name()
+		}
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	default:
+		return "unknown"
+	}
+}
+
+func writeEventMap(w io.Writer, name string, specs []EventSpec) {
+	fmt.Fprintf(w, "\nexport interface %s {\n", name)
+	for _, spec := range specs {
+		fmt.Fprintf(w, "  %s: %s;\n", spec.Name, reflect.TypeOf(spec.Payload).Name())
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/slog"
@@ -11,11 +13,15 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"shazoom/capture"
 	"shazoom/core"
 	"shazoom/db"
 	"shazoom/fileformat"
+	"shazoom/jobs"
+	"shazoom/metadata"
+	"shazoom/monitor"
+	"shazoom/protocol"
 	"shazoom/utils"
-	"strconv"
 	"strings"
 	"time"
 
@@ -34,27 +40,10 @@ const SONGS_DIR = "/tmp/songs"
 
 var yellow = color.New(color.FgYellow)
 
-func find(filePath string) {
-	wavFilePath, err := fileformat.ConvertToWAV(filePath)
+func find(filePath string, dbClient db.DBClient) {
+	matches, searchDuration, err := recognizeFile(context.Background(), filePath, dbClient)
 	if err != nil {
-		yellow.Println("Error converting to WAV:", err)
-		return
-	}
-
-	fingerprint, err := core.GenerateFingerprints(wavFilePath, utils.GenerateUniqueID())
-	if err != nil {
-		yellow.Println("Error generating fingerprints:", err)
-		return
-	}
-
-	sampleFingerprint := make(map[int64]uint32)
-	for address, couple := range fingerprint {
-		sampleFingerprint[address] = couple.AnchorTime
-	}
-
-	matches, searchDuration, err := core.FindMatchesUsingFingerPrints(sampleFingerprint)
-	if err != nil {
-		yellow.Println("Error finding matches:", err)
+		yellow.Println(err)
 		return
 	}
 
@@ -79,8 +68,124 @@ func find(filePath string) {
 		best.SongTitle, best.SongArtist, best.Score)
 }
 
+// recognizeFile fingerprints any ffmpeg-decodable file and matches it against dbClient.
+func recognizeFile(ctx context.Context, filePath string, dbClient db.DBClient) ([]core.Match, time.Duration, error) {
+	fingerprint, err := core.FingerprintFile(ctx, filePath, utils.GenerateUniqueID())
+	if err != nil {
+		return nil, 0, fmt.Errorf("error generating fingerprints: %w", err)
+	}
+
+	sampleFingerprint := make(map[int64]uint32)
+	for address, couple := range fingerprint {
+		sampleFingerprint[address] = couple.AnchorTime
+	}
+
+	matches, searchDuration, err := core.FindMatchesUsingFingerPrints(sampleFingerprint, dbClient)
+	if err != nil {
+		return nil, searchDuration, fmt.Errorf("error finding matches: %w", err)
+	}
+
+	return matches, searchDuration, nil
+}
+
+// listen recognises what device is recording, printing the best guess after
+// every rescore and stopping as soon as a match is confident.
+func listen(ctx context.Context, device string, opts core.StreamOptions, dbClient db.DBClient) error {
+	src, err := capture.Open(device)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
 
-func download(spotifyURL string, dbClient db.DBClient) (int, error) {
+	rec, err := core.NewStreamRecognizer(src.SampleRate(), dbClient, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Listening on %s (%d Hz), press Ctrl+C to stop...\n", device, src.SampleRate())
+	result, err := capture.Listen(ctx, src, rec, func(result core.StreamResult) {
+		if result.Done || len(result.Matches) == 0 {
+			return
+		}
+		best := result.Matches[0]
+		fmt.Printf("  %5.1fs  %s by %s (%.2f)\n", result.Audio.Seconds(), best.SongTitle, best.SongArtist, best.Score)
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.Confident {
+		best := result.Matches[0]
+		fmt.Printf("\nMatch after %.1fs: %s by %s (%.2f)\n", result.Audio.Seconds(), best.SongTitle, best.SongArtist, best.Score)
+		return nil
+	}
+	if len(result.Matches) == 0 {
+		fmt.Printf("\nNo Matches Found :( after %.1fs\n", result.Audio.Seconds())
+		return nil
+	}
+	fmt.Printf("\nNo confident match after %.1fs. Best guesses:\n", result.Audio.Seconds())
+	for _, match := range result.Matches[:min(5, len(result.Matches))] {
+		fmt.Printf("  - %s by %s (%.2f)\n", match.SongTitle, match.SongArtist, match.Score)
+	}
+	return nil
+}
+
+// openPlayLog opens the play log: backend itself when it can store plays,
+// and otherwise PLAY_LOG_FILE, data/plays.ndjson by default. backend may be
+// nil.
+func openPlayLog(backend db.DBClient) (db.PlayLog, error) {
+	return db.OpenPlayLog(backend, utils.GetEnv("PLAY_LOG_FILE", utils.DataPath("plays.ndjson")))
+}
+
+// newMonitor returns a monitor matching against dbClient and logging plays
+// in the play log of backend.
+func newMonitor(backend, dbClient db.DBClient, opts monitor.Options) (*monitor.Monitor, error) {
+	plays, err := openPlayLog(backend)
+	if err != nil {
+		return nil, err
+	}
+	return monitor.New(dbClient, plays, opts), nil
+}
+
+// monitorSources logs the songs played on sources until they end or ctx is
+// cancelled, printing every play as it starts.
+func monitorSources(ctx context.Context, sources []string, opts monitor.Options, backend, dbClient db.DBClient) error {
+	opts.OnPlay = func(play db.Play) {
+		fmt.Printf("%s  %-30s %s by %s (%.2f)\n", play.StartedAt.Format(time.DateTime), play.Source, play.Title, play.Artist, play.Score)
+	}
+	mon, err := newMonitor(backend, dbClient, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Monitoring %d source(s), press Ctrl+C to stop...\n", len(sources))
+	return mon.RunAll(ctx, sources)
+}
+
+// printPlays prints the play log, latest first.
+func printPlays(filter db.PlayFilter, backend db.DBClient) error {
+	playLog, err := openPlayLog(backend)
+	if err != nil {
+		return err
+	}
+	plays, err := playLog.ListPlays(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(plays) == 0 {
+		fmt.Println("No plays logged")
+		return nil
+	}
+	for _, play := range plays {
+		fmt.Printf("%s  %6s  %-30s %s by %s (%d detections, %.2f)\n",
+			play.StartedAt.Local().Format(time.DateTime), play.EndedAt.Sub(play.StartedAt).Round(time.Second),
+			play.Source, play.Title, play.Artist, play.Detections, play.Score)
+	}
+	return nil
+}
+
+func download(url string, dbClient db.DBClient) (*spotify.DownloadReport, error) {
     if err := utils.CreateFolder(SONGS_DIR); err != nil {
         err = xerrors.New(err)
         logger := utils.GetLogger()
@@ -88,37 +193,54 @@ func download(spotifyURL string, dbClient db.DBClient) (int, error) {
             "failed to create songs directory",
             slog.Any("error", err),
         )
-        return 0, err
+        return nil, err
     }
 
-    var count int
-    var err error
-
-    switch {
-    case strings.Contains(spotifyURL, "album"):
-        count, err = spotify.DlAlbum(spotifyURL, SONGS_DIR, dbClient)
-    case strings.Contains(spotifyURL, "playlist"):
-        count, err = spotify.DlPlaylist(spotifyURL, SONGS_DIR, dbClient)
-    case strings.Contains(spotifyURL, "track"):
-        count, err = spotify.DlSingleTrack(spotifyURL, SONGS_DIR, dbClient)
-    default:
-        return 0, fmt.Errorf("unsupported Spotify URL format: %s", spotifyURL)
+    ctx := context.Background()
+    tracks, err := metadata.Tracks(ctx, url)
+    if err != nil {
+        return nil, xerrors.New(err)
     }
 
+    report, err := spotify.DownloadTracks(ctx, metadata.ToSpotify(tracks), SONGS_DIR, dbClient, nil)
+    if report != nil {
+        report.Source = url
+    }
     if err != nil {
-        return count, xerrors.New(err)
+        return report, xerrors.New(err)
     }
 
-    return count, nil
+    return report, nil
 }
 
-func serve(protocol, port string, dbClient db.DBClient) { 
-    protocol = strings.ToLower(protocol)
+func serve(proto, port string, dbClient db.DBClient, plays db.PlayLog, mon *monitor.Monitor, sources []string) { 
+    proto = strings.ToLower(proto)
 
     allowOrigin := func(r *http.Request) bool {
         return true 
     }
 
+    ctx, stop := context.WithCancel(context.Background())
+    defer stop()
+
+    // downloads run in the background and need a writable database
+    var downloads *jobs.Manager
+    if dbClient != nil {
+        store := jobs.NewFileStore(utils.GetEnv("JOBS_FILE", utils.DataPath("jobs.json")))
+        manager, err := jobs.NewManager(store, jobs.SpotifyDownloader{SavePath: SONGS_DIR, DB: dbClient},
+            jobs.ManagerOptions{ReportDir: utils.GetEnv("JOBS_REPORT_DIR")})
+        if err != nil {
+            log.Printf("Download jobs disabled: %v", err)
+        } else {
+            downloads = manager
+            go downloads.Run(ctx)
+        }
+    }
+
+    if mon != nil {
+        go mon.RunAll(ctx, sources)
+    }
+
    server := socketio.NewServer(&engineio.Options{
     Transports: []transport.Transport{
 		&polling.Transport{
@@ -138,16 +260,34 @@ func serve(protocol, port string, dbClient db.DBClient) {
         return nil
     })
     
-    server.OnEvent("/", "totalSongs", func(s socketio.Conn) {
-        handleTotalSongs(s, dbClient)
+    server.OnEvent("/", protocol.EventTotalSongs, func(s socketio.Conn, data string) {
+        handleTotalSongs(s, data, dbClient)
+    })
+
+    sockets := newSocketContexts(ctx)
+    server.OnEvent("/", protocol.EventNewDownload, func(s socketio.Conn, data string) {
+        handleSongDownload(sockets.get(s.ID()), s, data, downloads)
     })
 
-    server.OnEvent("/", "newDownload", func(s socketio.Conn, url string) {
-        handleSongDownload(s, url, dbClient)
+    server.OnEvent("/", protocol.EventNewRecording, func(s socketio.Conn, data string) {
+        handleNewRecording(s, data, dbClient)
     })
 
-    server.OnEvent("/", "newRecording", func(s socketio.Conn, data string) {
-        handleNewRecording(s, data)
+    server.OnEvent("/", protocol.EventStartStream, func(s socketio.Conn, data string) {
+        handleStartStream(s, data, dbClient)
+    })
+
+    server.OnEvent("/", protocol.EventStreamChunk, func(s socketio.Conn, data string) {
+        handleStreamChunk(s, data)
+    })
+
+    server.OnEvent("/", protocol.EventStopStream, func(s socketio.Conn, data string) {
+        handleStopStream(s, data)
+    })
+
+    submissions, proxies := submissionLimiter(), trustedProxies()
+    server.OnEvent("/", protocol.EventSubmitFingerprints, func(s socketio.Conn, data string) {
+        handleSubmitFingerprints(s, data, dbClient, submissions, proxies)
     })
 
     // ------------------------------------------
@@ -158,6 +298,7 @@ func serve(protocol, port string, dbClient db.DBClient) {
 
     server.OnDisconnect("/", func(c socketio.Conn, reason string) {
         log.Printf("Socket disconnected (%v): %v", c.ID(), reason)
+        sockets.disconnected(c.ID())
     })
 
     go func() {
@@ -167,12 +308,15 @@ func serve(protocol, port string, dbClient db.DBClient) {
     }()
     defer server.Close()
 
-    serveHTTP(server, protocol == "https", port)
+    serveHTTP(server, dbClient, downloads, plays, mon, proto == "https", port)
 }
 
-func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port string) {
+func serveHTTP(socketServer *socketio.Server, dbClient db.DBClient, downloads *jobs.Manager, plays db.PlayLog, mon *monitor.Monitor, serveHTTPS bool, port string) {
 	mux := http.NewServeMux()
 	mux.Handle("/socket.io/", socketServer)
+	registerAPI(mux, dbClient, downloads)
+	registerJobsAPI(mux, downloads)
+	registerMonitorAPI(mux, plays, mon)
 	mux.Handle("/", http.FileServer(http.Dir("static")))
 
 	corsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -312,30 +456,24 @@ func processFilesConCurrently(filePaths []string, force bool, dbClient db.DBClie
 
 
 func saveSong(filePath string, force bool, dbClient db.DBClient) error {
-	meta, err := fileformat.GetMetadata(filePath)
+	// untagged files fall back to "Artist - Title" file names
+	tags, err := fileformat.ReadTagsOrFilename(filePath)
 	if err != nil {
 		return err
 	}
 
-	duration, _ := strconv.ParseFloat(meta.Format.Duration, 64)
-
-	tags := meta.Format.Tags
 	track := &spotify.Track{
-		Album:    tags["album"],
-		Artist:   tags["artist"],
-		Title:    tags["title"],
-		Duration: int(math.Round(duration)),
-	}
-
-	if track.Title == "" {
-		track.Title = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+		Album:    tags.Album,
+		Artist:   tags.Artist,
+		Title:    tags.Title,
+		Duration: int(math.Round(tags.Duration)),
 	}
 
 	if track.Artist == "" {
 		return fmt.Errorf("missing artist metadata")
 	}
 
-	ytID, err := spotify.GetYoutubeId(*track)
+	ytID, err := spotify.GetYoutubeId(context.Background(), *track)
 	if err != nil && !force {
 		return err
 	}
@@ -344,7 +482,123 @@ func saveSong(filePath string, force bool, dbClient db.DBClient) error {
 		return err
 	}
 
-	src := filepath.Join(filepath.Dir(filePath), track.Title+".wav")
-	dst := filepath.Join(SONGS_DIR, track.Title+".wav")
-	return utils.MoveFile(src, dst)
+	return utils.MoveFile(filePath, filepath.Join(SONGS_DIR, filepath.Base(filePath)))
+}
+
+func exportArchive(path string, dbClient db.DBClient) (db.ArchiveStats, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return db.ArchiveStats{}, err
+	}
+	defer f.Close()
+
+	stats, err := db.ExportArchive(f, dbClient, core.FingerprintConfigVersion)
+	if err != nil {
+		_ = os.Remove(path)
+		return stats, err
+	}
+
+	return stats, f.Close()
+}
+
+// importArchive keeps its resume log next to the archive as <archive>.progress.
+func importArchive(path string, batchSize int, dbClient db.DBClient) (db.ArchiveImportStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return db.ArchiveImportStats{}, err
+	}
+	defer f.Close()
+
+	return db.ImportArchive(f, dbClient, db.ArchiveImportOptions{
+		FingerprintVersion: core.FingerprintConfigVersion,
+		ProgressPath:       path + ".progress",
+		BatchSize:          batchSize,
+	})
+}
+
+// logCacheStats periodically reports fingerprint cache effectiveness.
+func logCacheStats(cache *db.CachedClient, every time.Duration) {
+	logger := utils.GetLogger()
+	for range time.Tick(every) {
+		stats := cache.Stats()
+		logger.Info("fingerprint cache",
+			slog.Uint64("hits", stats.Hits),
+			slog.Uint64("misses", stats.Misses),
+			slog.Uint64("evictions", stats.Evictions),
+			slog.Int("entries", stats.Entries),
+			slog.Int64("bytes", stats.Bytes),
+			slog.Float64("hitRate", stats.HitRate()),
+		)
+	}
+}
+
+// jobsCommand lists or changes download jobs through the API of a running server.
+func jobsCommand(serverURL, action, jobID string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimRight(serverURL, "/") + "/api/jobs"
+
+	var resp *http.Response
+	var err error
+	switch action {
+	case "list":
+		resp, err = client.Get(base)
+	case "show":
+		resp, err = client.Get(base + "/" + jobID)
+	case "add":
+		body, _ := json.Marshal(map[string]string{"url": jobID})
+		resp, err = client.Post(base, "application/json", bytes.NewReader(body))
+	case "cancel", "retry":
+		resp, err = client.Post(base+"/"+jobID+"/"+action, "application/json", nil)
+	default:
+		return fmt.Errorf("unknown jobs action %q", action)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot reach server at %s: %w", serverURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apiErr apiErrorBody
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error.Message == "" {
+			return fmt.Errorf("server returned %s", resp.Status)
+		}
+		return fmt.Errorf("%s: %s", apiErr.Error.Code, apiErr.Error.Message)
+	}
+
+	if action == "list" {
+		var list apiJobsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			return fmt.Errorf("invalid server response: %w", err)
+		}
+		if len(list.Jobs) == 0 {
+			fmt.Println("No download jobs.")
+			return nil
+		}
+		fmt.Printf("%-14s %-10s %-8s %-20s %s\n", "ID", "STATUS", "SAVED", "UPDATED", "URL")
+		for _, job := range list.Jobs {
+			fmt.Printf("%-14s %-10s %-8s %-20s %s\n", job.ID, job.Status,
+				fmt.Sprintf("%d/%d", job.Saved, len(job.Tracks)),
+				job.UpdatedAt.Local().Format("2006-01-02 15:04:05"), job.URL)
+		}
+		return nil
+	}
+
+	var job jobs.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return fmt.Errorf("invalid server response: %w", err)
+	}
+	fmt.Printf("Job %s: %s (%d/%d saved)\n", job.ID, job.Status, job.Saved, len(job.Tracks))
+	if job.Error != "" {
+		fmt.Printf("  error: %s\n", job.Error)
+	}
+	if action == "show" {
+		for i, track := range job.Tracks {
+			line := fmt.Sprintf("  %3d. %-14s '%s' by '%s'", i+1, track.Status, track.Title, track.Artist)
+			if track.Code != "" {
+				line += " - " + string(track.Code)
+			}
+			fmt.Println(line)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,424 @@
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"shazoom/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const apiBaseURL = "https://api.spotify.com/v1"
+
+// ClientOptions configures a Client. Zero URLs, timeouts, rates and backoffs
+// take the value from DefaultClientOptions.
+type ClientOptions struct {
+	BaseURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+
+	// TokenCache keeps the access token between requests; nil keeps it in
+	// memory only. A token is refreshed once it is within RefreshBefore of
+	// expiring, while it can still be used by requests already in flight.
+	TokenCache    TokenCache
+	RefreshBefore time.Duration
+
+	// Timeout bounds a single HTTP attempt, not the retries around it.
+	Timeout time.Duration
+
+	// RequestsPerSecond and Burst size the token bucket every request,
+	// including token requests, has to take a token from.
+	RequestsPerSecond float64
+	Burst             int
+
+	// MaxRetries is how often a request is retried after a 429, a 5xx or a
+	// network error. The wait doubles from MinBackoff up to MaxBackoff unless
+	// the server sent a Retry-After.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	HTTPClient *http.Client
+}
+
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		BaseURL:           apiBaseURL,
+		TokenURL:          tokenURL,
+		RefreshBefore:     5 * time.Minute,
+		Timeout:           15 * time.Second,
+		RequestsPerSecond: 5,
+		Burst:             5,
+		MaxRetries:        5,
+		MinBackoff:        500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+	}
+}
+
+// Client talks to the Spotify Web API. It is safe for concurrent use.
+type Client struct {
+	opts    ClientOptions
+	http    *http.Client
+	limiter *utils.TokenBucket
+
+	mu     sync.Mutex
+	token  Token
+	flight *tokenFlight
+}
+
+// tokenFlight is a token request shared by every caller that needs a new
+// token while it runs.
+type tokenFlight struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+func NewClient(opts ClientOptions) *Client {
+	def := DefaultClientOptions()
+	if opts.BaseURL == "" {
+		opts.BaseURL = def.BaseURL
+	}
+	if opts.TokenURL == "" {
+		opts.TokenURL = def.TokenURL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = def.Timeout
+	}
+	if opts.RequestsPerSecond <= 0 {
+		opts.RequestsPerSecond = def.RequestsPerSecond
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = def.Burst
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = def.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.TokenCache == nil {
+		opts.TokenCache = NewMemoryTokenCache()
+	}
+	if opts.RefreshBefore < 0 {
+		opts.RefreshBefore = 0
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	return &Client{
+		opts:    opts,
+		http:    httpClient,
+		limiter: utils.NewTokenBucket(opts.RequestsPerSecond, opts.Burst),
+	}
+}
+
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// Default returns the client used by the package-level functions, configured
+// from SPOTIFY_CLIENT_ID, SPOTIFY_CLIENT_SECRET and TokenCacheFromEnv.
+func Default() *Client {
+	defaultClientOnce.Do(func() {
+		opts := DefaultClientOptions()
+		opts.ClientID = utils.GetEnv("SPOTIFY_CLIENT_ID", "")
+		opts.ClientSecret = utils.GetEnv("SPOTIFY_CLIENT_SECRET", "")
+
+		cache, err := TokenCacheFromEnv()
+		if err != nil {
+			utils.GetLogger().Error("falling back to an in-memory token cache", "error", err)
+			cache = NewMemoryTokenCache()
+		}
+		opts.TokenCache = cache
+
+		defaultClient = NewClient(opts)
+	})
+	return defaultClient
+}
+
+// StatusError is returned for a response that is not 200 after all retries.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("spotify returned status %d: %s", e.StatusCode, firstLine(e.Body))
+}
+
+// get fetches path (relative to BaseURL, or absolute) and returns the body of
+// a 200 response.
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	endpoint := path
+	if u, err := url.Parse(path); err != nil || !u.IsAbs() {
+		endpoint = c.opts.BaseURL + path
+	}
+
+	refreshed := false
+	for {
+		bearer, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get access token: %w", err)
+		}
+
+		status, body, err := c.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+bearer)
+			return req, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// the cached token may have been revoked early; fetch a new one once
+		if status == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			c.invalidateToken(bearer)
+			continue
+		}
+		if status != http.StatusOK {
+			return nil, &StatusError{StatusCode: status, Body: string(body)}
+		}
+		return body, nil
+	}
+}
+
+// do sends the request built by newReq, waiting for the rate limiter before
+// every attempt and retrying 429s, 5xx responses and network errors.
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error)) (int, []byte, error) {
+	logger := utils.GetLogger()
+
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return 0, nil, err
+		}
+
+		req, err := newReq()
+		if err != nil {
+			return 0, nil, fmt.Errorf("error on making the request: %w", err)
+		}
+
+		status, body, retryAfter, err := c.attempt(ctx, req)
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+
+		retryable := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retryable {
+			return status, body, nil
+		}
+		if attempt >= c.opts.MaxRetries {
+			if err != nil {
+				return 0, nil, fmt.Errorf("error on getting response: %w", err)
+			}
+			return status, body, nil
+		}
+
+		wait := retryAfter
+		if wait <= 0 {
+			wait = c.backoff(attempt)
+		}
+		logger.Warn("retrying spotify request",
+			"url", req.URL.String(), "status", status, "error", err,
+			"attempt", attempt+1, "wait", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, req *http.Request) (int, []byte, time.Duration, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	resp, err := c.http.Do(req.WithContext(attemptCtx))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("error on reading response: %w", err)
+	}
+
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		if retryAfter > c.opts.MaxBackoff {
+			retryAfter = c.opts.MaxBackoff
+		}
+	}
+	return resp.StatusCode, body, retryAfter, nil
+}
+
+// backoff doubles from MinBackoff for every attempt, with up to 20% jitter so
+// parallel downloads do not retry in lockstep.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.opts.MinBackoff << attempt
+	if wait <= 0 || wait > c.opts.MaxBackoff {
+		wait = c.opts.MaxBackoff
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/5+1))
+}
+
+// parseRetryAfter accepts both forms of the header: seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// accessToken returns a token that is valid for at least RefreshBefore, or
+// one that is still valid while a refresh is running. Concurrent callers
+// share a single token request.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	current := c.token
+	if current.Valid(c.opts.RefreshBefore) {
+		c.mu.Unlock()
+		return current.AccessToken, nil
+	}
+
+	flight := c.flight
+	if flight == nil {
+		flight = &tokenFlight{done: make(chan struct{})}
+		c.flight = flight
+		go c.refreshToken(context.WithoutCancel(ctx), flight)
+	}
+	c.mu.Unlock()
+
+	// the old token still works: let this request use it while refreshing
+	if current.Valid(0) {
+		return current.AccessToken, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-flight.done:
+		if flight.err != nil {
+			return "", flight.err
+		}
+		return flight.token.AccessToken, nil
+	}
+}
+
+// refreshToken fetches a new token for flight, unless the cache holds one
+// that is fresh enough: another process may have refreshed it already, or
+// this one may just have started. The cache is only read here, outside c.mu
+// and once per refresh, as loading it can mean disk I/O and key derivation.
+func (c *Client) refreshToken(ctx context.Context, flight *tokenFlight) {
+	cached, err := c.opts.TokenCache.Load()
+	fromCache := err == nil && cached.Valid(c.opts.RefreshBefore)
+	if fromCache {
+		flight.token = cached
+	} else {
+		flight.token, flight.err = c.requestToken(ctx)
+	}
+
+	c.mu.Lock()
+	if flight.err == nil {
+		c.token = flight.token
+	}
+	c.flight = nil
+	c.mu.Unlock()
+
+	if flight.err != nil {
+		utils.GetLogger().Error("failed to refresh spotify token", "error", flight.err)
+	} else if !fromCache {
+		if err := c.opts.TokenCache.Save(flight.token); err != nil {
+			utils.GetLogger().Warn("failed to cache spotify token", "error", err)
+		}
+	}
+	close(flight.done)
+}
+
+func (c *Client) requestToken(ctx context.Context) (Token, error) {
+	if c.opts.ClientID == "" || c.opts.ClientSecret == "" {
+		return Token{}, fmt.Errorf("SPOTIFY_CLIENT_ID or SPOTIFY_CLIENT_SECRET environment variables not set")
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_id", c.opts.ClientID)
+	data.Set("client_secret", c.opts.ClientSecret)
+
+	status, body, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.opts.TokenURL, bytes.NewBufferString(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	if status != http.StatusOK {
+		return Token{}, errors.New("token request failed (check SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET): " + string(body))
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		AccessToken: tr.AccessToken,
+		ExpiresAt:   time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// invalidateToken drops a token the API rejected, unless it was already
+// replaced by a newer one. The cache is cleared outside the lock, as it may
+// touch the disk.
+func (c *Client) invalidateToken(rejected string) {
+	c.mu.Lock()
+	if c.token.AccessToken != rejected {
+		c.mu.Unlock()
+		return
+	}
+	c.token = Token{}
+	cache := c.opts.TokenCache
+	c.mu.Unlock()
+
+	if err := cache.Clear(); err != nil {
+		utils.GetLogger().Warn("failed to clear spotify token cache", "error", err)
+	}
+}
@@ -2,71 +2,106 @@ package spotify
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"path/filepath"
 	"runtime"
 	"shazoom/core"
 	"shazoom/db"
+	"shazoom/fileformat"
 	"shazoom/utils"
-	"strings"
 	"sync"
 	"time"
-	"os/exec"
-	"os"
+
 	"github.com/mdobak/go-xerrors"
 )
 
 const DELETE_SONG_FILE = false
 
-func DlSingleTrack(url, savePath string, dbClient db.DBClient) (int, error) {
-	logger := utils.GetLogger()
-	logger.Info("Getting track info", slog.String("url", url))
-
-	trackInfo, err := TrackInfo(url)
-	if err != nil {
-		return 0, err
-	}
-
-	logger.Info("Now downloading track")
-	return dlTrack([]Track{*trackInfo}, savePath, dbClient)
-}
-
-func DlPlaylist(url, savePath string, dbClient db.DBClient) (int, error) {
-	logger := utils.GetLogger()
-	tracks, err := PlaylistInfo(url)
-	if err != nil {
-		return 0, err
-	}
+// TrackStatus is the stage a track of a download has reached.
+type TrackStatus string
+
+const (
+	TrackQueued         TrackStatus = "queued"
+	TrackSearching      TrackStatus = "searching"
+	TrackDownloading    TrackStatus = "downloading"
+	TrackFingerprinting TrackStatus = "fingerprinting"
+	TrackDone           TrackStatus = "done"
+	TrackSkipped        TrackStatus = "skipped"
+	TrackFailed         TrackStatus = "failed"
+)
 
-	time.Sleep(time.Second)
-	logger.Info("Now downloading playlist")
-	return dlTrack(tracks, savePath, dbClient)
+// TrackUpdate reports that the track at Index of a download moved to Status.
+// Code and Reason explain skipped and failed tracks. Source and SourceID are
+// set once a source matched the track; YouTubeID too if that was YouTube.
+type TrackUpdate struct {
+	Index     int
+	Track     Track
+	Status    TrackStatus
+	Code      FailureCode
+	Reason    string
+	Source    string
+	SourceID  string
+	YouTubeID string
 }
 
-func DlAlbum(url, savePath string, dbClient db.DBClient) (int, error) {
-	logger := utils.GetLogger()
-	tracks, err := AlbumInfo(url)
+// DownloadTracks is DownloadTracksFrom with the DefaultSources.
+func DownloadTracks(ctx context.Context, tracks []Track, path string, dbClient db.DBClient, onUpdate func(TrackUpdate)) (*DownloadReport, error) {
+	sources, err := DefaultSources()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	time.Sleep(time.Second)
-	logger.Info("Now downloading album")
-	return dlTrack(tracks, savePath, dbClient)
+	return DownloadTracksFrom(ctx, sources, tracks, path, dbClient, onUpdate)
 }
 
-func dlTrack(tracks []Track, path string, dbClient db.DBClient) (int, error) {
+// DownloadTracksFrom downloads, fingerprints and saves tracks concurrently
+// and reports the outcome of each. Every track comes from the first of
+// sources that finds it. onUpdate, if set, is called from the worker
+// goroutines every time a track changes stage. Cancelling ctx fails every
+// track that has not finished its current stage yet.
+func DownloadTracksFrom(ctx context.Context, sources []AudioSource, tracks []Track, path string, dbClient db.DBClient, onUpdate func(TrackUpdate)) (*DownloadReport, error) {
 	logger := utils.GetLogger()
 	var wg sync.WaitGroup
-	results := make(chan int, len(tracks))
 	numCPUs := runtime.NumCPU()
 	semaphore := make(chan struct{}, numCPUs)
-	ctx := context.Background()
 
-	for _, t := range tracks {
+	report := newDownloadReport(tracks)
+	var reportMu sync.Mutex
+	started := make([]time.Time, len(tracks))
+
+	update := func(u TrackUpdate) {
+		reportMu.Lock()
+		result := &report.Tracks[u.Index]
+		result.Status = u.Status
+		result.Code = u.Code
+		result.Reason = u.Reason
+		if u.Source != "" {
+			result.Source, result.SourceID = u.Source, u.SourceID
+		}
+		if u.YouTubeID != "" {
+			result.YouTubeID = u.YouTubeID
+		}
+		switch u.Status {
+		case TrackSearching:
+			started[u.Index] = time.Now()
+		case TrackDone, TrackSkipped, TrackFailed:
+			if !started[u.Index].IsZero() {
+				result.DurationMs = time.Since(started[u.Index]).Milliseconds()
+			}
+		}
+		reportMu.Unlock()
+
+		if onUpdate != nil {
+			onUpdate(u)
+		}
+	}
+
+	for i, t := range tracks {
+		update(TrackUpdate{Index: i, Track: t, Status: TrackQueued})
+
 		wg.Add(1)
-		go func(track Track) {
+		go func(index int, track Track) {
 			defer wg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
@@ -79,6 +114,23 @@ func dlTrack(tracks []Track, path string, dbClient db.DBClient) (int, error) {
 				Title:    track.Title,
 			}
 
+			fail := func(status TrackStatus, code FailureCode, reason string) {
+				update(TrackUpdate{Index: index, Track: track, Status: status, Code: code, Reason: reason})
+			}
+			cancelled := func() bool {
+				if ctx.Err() != nil {
+					fail(TrackFailed, CodeCancelled, ctx.Err().Error())
+					return true
+				}
+				return false
+			}
+
+			if cancelled() {
+				return
+			}
+
+			update(TrackUpdate{Index: index, Track: track, Status: TrackSearching})
+
 			keyExists, err := SongKeyExists(
 				utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist),
 				dbClient,
@@ -86,110 +138,134 @@ func dlTrack(tracks []Track, path string, dbClient db.DBClient) (int, error) {
 			if err != nil {
 				logger.ErrorContext(ctx, "error checking song existence",
 					slog.Any("error", xerrors.New(err)))
+				fail(TrackFailed, CodeDBLookupFailed, err.Error())
 				return
 			}
 			if keyExists {
 				logger.Info(fmt.Sprintf("'%s' by '%s' already exists.",
 					trackCopy.Title, trackCopy.Artist))
+				fail(TrackSkipped, CodeAlreadyExists, "song is already in the database")
 				return
 			}
 
-			ytID, err := getYTID(trackCopy, dbClient)
-			if err != nil || ytID == "" {
+			source, sourceID, err := findAudio(ctx, sources, *trackCopy, dbClient)
+			if err != nil {
 				logger.ErrorContext(ctx, "Download failed",
 					slog.Any("error", xerrors.New(err)))
+				switch {
+				case errors.Is(err, errDuplicateYTID):
+					fail(TrackSkipped, CodeDuplicateYTID, err.Error())
+				case errors.Is(err, errDuplicateSource):
+					fail(TrackSkipped, CodeDuplicateSource, err.Error())
+				case errors.Is(err, errNoYouTubeID):
+					fail(TrackFailed, CodeNoYouTubeID, err.Error())
+				case errors.Is(err, ErrNoMatch):
+					fail(TrackFailed, CodeNoMatch, err.Error())
+				case errors.Is(err, errSourceDBLookup):
+					fail(TrackFailed, CodeDBLookupFailed, err.Error())
+				default:
+					fail(TrackFailed, CodeSourceFailed, err.Error())
+				}
+				return
+			}
+			if cancelled() {
 				return
 			}
 
-			ytURL := fmt.Sprintf("https://www.youtube.com/watch?v=%s", ytID)
+			found := TrackUpdate{Index: index, Track: track, Source: source.Name(), SourceID: sourceID}
+			if source.Name() == db.SourceYouTube {
+				found.YouTubeID = sourceID
+			}
+			stage := func(status TrackStatus) {
+				found.Status = status
+				update(found)
+			}
+
+			stage(TrackDownloading)
 
 			trackCopy.Title, trackCopy.Artist =
 				correctFilename(trackCopy.Title, trackCopy.Artist)
 			fileName := fmt.Sprintf("%s - %s", trackCopy.Title, trackCopy.Artist)
 			filePath := filepath.Join(path, fileName)
 
-			downloadedPath, err := downloadYTaudio(ytURL, filePath)
+			downloadedPath, err := source.Download(ctx, sourceID, filePath)
 			if err != nil {
-				logger.ErrorContext(ctx, "yt-dlp failed",
+				logger.ErrorContext(ctx, source.Name()+" download failed",
 					slog.Any("error", xerrors.New(err)))
+				if errors.Is(err, ErrLoginRequired) {
+					fail(TrackFailed, CodeLoginRequired, err.Error())
+				} else {
+					fail(TrackFailed, CodeDownloadFailed, err.Error())
+				}
+				return
+			}
+			if cancelled() {
 				return
 			}
 
-			if err := ProcessAndSaveSong(
-				downloadedPath, trackCopy.Title, trackCopy.Artist, ytID, dbClient,
+			stage(TrackFingerprinting)
+
+			if err := ProcessAndSaveSongFromSource(
+				downloadedPath, trackCopy.Title, trackCopy.Artist, source.Name(), sourceID, dbClient,
 			); err != nil {
 				logger.ErrorContext(ctx, "DB save failed",
 					slog.Any("error", xerrors.New(err)))
+				fail(TrackFailed, CodeSaveFailed, err.Error())
 				return
 			}
 
-			wavFilePath := filepath.Join(path, fileName+".wav")
-			_ = addTags(wavFilePath, *trackCopy)
+			_ = addTags(downloadedPath, *trackCopy)
 			if DELETE_SONG_FILE {
-				utils.DeleteFile(wavFilePath)
+				utils.DeleteFile(downloadedPath)
 			}
 
 			logger.Info(fmt.Sprintf("'%s' by '%s' was downloaded",
 				track.Title, track.Artist))
-			results <- 1
-		}(t)
+			stage(TrackDone)
+		}(i, t)
 	}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	totalTracks := 0
-	for range results {
-		totalTracks++
-	}
-	return totalTracks, nil
+	wg.Wait()
+	report.finish()
+	return report, ctx.Err()
 }
 
-
 func addTags(file string, track Track) error {
 	logger := utils.GetLogger()
-	
-	// Create a temporary file name to avoid editing in-place
-	tempFile := strings.TrimSuffix(file, ".wav") + "_tagged.wav"
-
-	// FFmpeg command to add metadata tags
-	// -i: input file
-	// -c:copy: copy the audio stream without re-encoding
-	// -metadata: sets the specific key=value pairs
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", file, 
-		"-c", "copy",
-		"-metadata", fmt.Sprintf("title=%s", track.Title),
-		"-metadata", fmt.Sprintf("artist=%s", track.Artist),
-		"-metadata", fmt.Sprintf("album_artist=%s", track.Artist),
-		"-metadata", fmt.Sprintf("album=%s", track.Album),
-		"-y", // overwrite output file if it exists
-		tempFile, 
-	)
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error("Failed to add tags via ffmpeg", slog.Any("error", err), slog.String("output", string(out)))
-		return fmt.Errorf("failed to add tags: %v", err)
-	}
 
-	// Replace the original file with the tagged version
-	if err := os.Rename(tempFile, file); err != nil {
-		logger.Error("Failed to rename tagged file", slog.Any("error", err))
-		return fmt.Errorf("failed to rename file: %v", err)
+	err := fileformat.WriteTags(file, fileformat.Tags{
+		Title:       track.Title,
+		Artist:      track.Artist,
+		Album:       track.Album,
+		AlbumArtist: track.Artist,
+	})
+	if errors.Is(err, fileformat.ErrTagsUnsupported) {
+		logger.Debug("Not tagging file", slog.String("file", file), slog.Any("error", err))
+		return nil
+	}
+	if err != nil {
+		logger.Error("Failed to add tags", slog.Any("error", err))
+		return fmt.Errorf("failed to add tags: %w", err)
 	}
 
 	return nil
 }
 
 func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string, dbClient db.DBClient) error {
+	source := ""
+	if ytID != "" {
+		source = db.SourceYouTube
+	}
+	return ProcessAndSaveSongFromSource(songFilePath, songTitle, songArtist, source, ytID, dbClient)
+}
+
+// ProcessAndSaveSongFromSource fingerprints the audio at songFilePath and
+// saves it as a song that came from source under sourceID.
+func ProcessAndSaveSongFromSource(songFilePath, songTitle, songArtist, source, sourceID string, dbClient db.DBClient) error {
 	logger := utils.GetLogger()
 
 	// Register the song
-	songID, err := dbClient.RegisterSong(songTitle, songArtist, ytID)
+	songID, err := dbClient.RegisterSongFromSource(songTitle, songArtist, source, sourceID)
 	if err != nil {
 		return err
 	}
@@ -210,32 +286,43 @@ func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string, dbClie
 	return nil
 }
 
-func getYTID(trackCopy *Track, dbClient db.DBClient) (string, error) {
-    var ytID string
-    var err error
- 
-    ytID, err = getYoutubeIdWithAPI(*trackCopy)
-    
-    if err != nil || ytID == "" {
-        fmt.Printf("DEBUG: API search failed or no results, falling back to scraper for: %s\n", trackCopy.Title)
-        ytID, err = GetYoutubeId(*trackCopy)
-    }
-
-    if err != nil {
-        return "", fmt.Errorf("all search methods failed: %v", err)
-    }
-    if ytID == "" {
-        return "", fmt.Errorf("could not find a YouTube ID for: %s", trackCopy.Title)
-    }
-
-    ytidExists, err := YtIDExists(ytID, dbClient)
-    if err != nil {
-        return "", fmt.Errorf("error checking DB for ytID: %v", err)
-    }
-
-    if ytidExists {
-        return "", fmt.Errorf("youTube ID (%s) already exists in DB", ytID)
-    }
-
-    return ytID, nil
-}
\ No newline at end of file
+var (
+	errNoYouTubeID     = errors.New("could not find a YouTube ID")
+	errDuplicateYTID   = errors.New("youTube ID already exists in DB")
+	errDuplicateSource = errors.New("audio from this source already exists in DB")
+	errSourceDBLookup  = errors.New("error checking DB")
+)
+
+// findAudio asks each source in turn for the track and returns the first
+// match. A match that is already in the database is an error rather than a
+// reason to try the next source, since the track has been indexed.
+func findAudio(ctx context.Context, sources []AudioSource, track Track, dbClient db.DBClient) (AudioSource, string, error) {
+	var errs []error
+	for _, source := range sources {
+		id, err := source.Search(ctx, track)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		_, exists, err := dbClient.GetSongBySource(source.Name(), id)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w for %s %s: %w", errSourceDBLookup, source.Name(), id, err)
+		}
+		if exists {
+			if source.Name() == db.SourceYouTube {
+				return nil, "", fmt.Errorf("%w: %s", errDuplicateYTID, id)
+			}
+			return nil, "", fmt.Errorf("%w: %s %s", errDuplicateSource, source.Name(), id)
+		}
+		return source, id, nil
+	}
+
+	if len(errs) == 1 {
+		return nil, "", errs[0]
+	}
+	return nil, "", fmt.Errorf("%w: %w", ErrNoMatch, errors.Join(errs...))
+}
@@ -0,0 +1,228 @@
+package spotify
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"shazoom/utils"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Candidate is a video that may hold the audio of a track.
+type Candidate struct {
+	ID      string
+	Title   string
+	Channel string
+	// Duration is in seconds, zero when unknown.
+	Duration int
+	Live     bool
+}
+
+// ScoredCandidate is a Candidate with the score RankCandidates gave it and
+// the signals that made it up, for logging.
+type ScoredCandidate struct {
+	Candidate
+	Score   float64
+	Reasons []string
+}
+
+// RankOptions tunes RankCandidates. Zero values take the defaults.
+type RankOptions struct {
+	// DurationTolerance is how far off the track's duration a candidate may
+	// be and still get the full duration score; default 5 seconds.
+	DurationTolerance int
+	// MaxDurationDelta rejects candidates further off than this; default 30
+	// seconds. The score falls linearly from the tolerance to here.
+	MaxDurationDelta int
+	// PenaltyWords map words that mark other versions of a track to what
+	// they cost. A word in the track's own title costs nothing.
+	PenaltyWords map[string]float64
+	// MinScore rejects candidates scoring below it; default 20.
+	MinScore float64
+	// TopN candidates are logged; default 5.
+	TopN int
+}
+
+// DefaultPenaltyWords are the versions of a track that should not be indexed
+// as the original.
+var DefaultPenaltyWords = map[string]float64{
+	"live":         30,
+	"cover":        40,
+	"remix":        30,
+	"slowed":       40,
+	"reverb":       30,
+	"sped up":      40,
+	"nightcore":    40,
+	"8d":           30,
+	"karaoke":      40,
+	"instrumental": 30,
+	"acoustic":     20,
+	"loop":         30,
+	"hour":         30,
+	"reaction":     40,
+	"tutorial":     40,
+	"lyrics":       5,
+	"lyric":        5,
+}
+
+const (
+	durationWeight = 40
+	titleWeight    = 25
+	artistWeight   = 10
+	topicBonus     = 20
+	officialBonus  = 10
+)
+
+func (o RankOptions) withDefaults() RankOptions {
+	if o.DurationTolerance <= 0 {
+		o.DurationTolerance = durationMatchThreshold
+	}
+	if o.MaxDurationDelta <= o.DurationTolerance {
+		o.MaxDurationDelta = max(30, o.DurationTolerance)
+	}
+	if o.PenaltyWords == nil {
+		o.PenaltyWords = DefaultPenaltyWords
+	}
+	if o.MinScore == 0 {
+		o.MinScore = 20
+	}
+	if o.TopN <= 0 {
+		o.TopN = 5
+	}
+	return o
+}
+
+// RankCandidates scores every candidate against track and returns the ones
+// that pass, best first. Live streams and candidates whose duration is too
+// far off the track's are dropped.
+func RankCandidates(track Track, candidates []Candidate, opts RankOptions) []ScoredCandidate {
+	opts = opts.withDefaults()
+
+	titleTokens := tokenize(track.Title)
+	artistTokens := tokenize(track.Artist)
+	trackWords := " " + strings.Join(titleTokens, " ") + " "
+
+	penaltyWords := make([]string, 0, len(opts.PenaltyWords))
+	for word := range opts.PenaltyWords {
+		penaltyWords = append(penaltyWords, word)
+	}
+	sort.Strings(penaltyWords)
+
+	var ranked []ScoredCandidate
+	for _, c := range candidates {
+		sc := ScoredCandidate{Candidate: c}
+		add := func(points float64, reason string) {
+			sc.Score += points
+			sc.Reasons = append(sc.Reasons, fmt.Sprintf("%s %+.0f", reason, points))
+		}
+
+		if c.Live {
+			continue
+		}
+
+		if track.Duration > 0 && c.Duration > 0 {
+			delta := c.Duration - track.Duration
+			if delta < 0 {
+				delta = -delta
+			}
+			if delta > opts.MaxDurationDelta {
+				continue
+			}
+			points := float64(durationWeight)
+			if delta > opts.DurationTolerance {
+				over := float64(delta-opts.DurationTolerance) / float64(opts.MaxDurationDelta-opts.DurationTolerance)
+				points *= 1 - over
+			}
+			add(points, fmt.Sprintf("duration %+ds", c.Duration-track.Duration))
+		}
+
+		candidateTokens := tokenize(c.Title)
+		add(titleWeight*coverage(titleTokens, candidateTokens), "title")
+		if coverage(artistTokens, candidateTokens) == 1 || coverage(artistTokens, tokenize(c.Channel)) == 1 {
+			add(artistWeight, "artist")
+		}
+
+		channel := strings.ToLower(c.Channel)
+		switch {
+		case strings.HasSuffix(channel, " - topic"):
+			add(topicBonus, "topic channel")
+		case strings.HasSuffix(channel, "vevo") || strings.Contains(channel, "official") ||
+			normalizeTag(c.Channel) == normalizeTag(track.Artist):
+			add(officialBonus, "official channel")
+		}
+
+		candidateWords := " " + strings.Join(candidateTokens, " ") + " "
+		for _, word := range penaltyWords {
+			w := " " + strings.Join(tokenize(word), " ") + " "
+			if strings.Contains(candidateWords, w) && !strings.Contains(trackWords, w) {
+				add(-opts.PenaltyWords[word], word)
+			}
+		}
+
+		if sc.Score >= opts.MinScore {
+			ranked = append(ranked, sc)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	return ranked
+}
+
+// BestCandidate ranks candidates and logs the top ones. ok is false when
+// none of them passes.
+func BestCandidate(track Track, candidates []Candidate, opts RankOptions) (ScoredCandidate, bool) {
+	opts = opts.withDefaults()
+	ranked := RankCandidates(track, candidates, opts)
+
+	logger := utils.GetLogger()
+	for i, sc := range ranked[:min(len(ranked), opts.TopN)] {
+		logger.Info("YouTube candidate",
+			slog.String("track", fmt.Sprintf("%s - %s", track.Artist, track.Title)),
+			slog.Int("rank", i+1),
+			slog.String("id", sc.ID),
+			slog.String("title", sc.Title),
+			slog.String("channel", sc.Channel),
+			slog.Float64("score", math.Round(sc.Score*10)/10),
+			slog.String("signals", strings.Join(sc.Reasons, ", ")))
+	}
+	if len(ranked) < len(candidates) {
+		logger.Info("YouTube candidates rejected",
+			slog.String("track", fmt.Sprintf("%s - %s", track.Artist, track.Title)),
+			slog.Int("rejected", len(candidates)-len(ranked)),
+			slog.Int("candidates", len(candidates)))
+	}
+
+	if len(ranked) == 0 {
+		return ScoredCandidate{}, false
+	}
+	return ranked[0], true
+}
+
+// tokenize lower-cases s and splits it into words of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// coverage is the fraction of want that appears in have.
+func coverage(want, have []string) float64 {
+	if len(want) == 0 {
+		return 0
+	}
+	seen := make(map[string]bool, len(have))
+	for _, t := range have {
+		seen[t] = true
+	}
+	found := 0
+	for _, t := range want {
+		if seen[t] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(want))
+}
@@ -0,0 +1,139 @@
+package spotify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// FailureCode says why a track was skipped or failed.
+type FailureCode string
+
+const (
+	CodeAlreadyExists   FailureCode = "already_exists"
+	CodeDuplicateYTID   FailureCode = "duplicate_youtube_id"
+	CodeNoYouTubeID     FailureCode = "no_youtube_id"
+	CodeNoMatch         FailureCode = "no_match"
+	CodeSourceFailed    FailureCode = "source_failed"
+	CodeDuplicateSource FailureCode = "duplicate_source"
+	CodeLoginRequired   FailureCode = "login_required"
+	CodeDownloadFailed  FailureCode = "download_failed"
+	CodeSaveFailed      FailureCode = "save_failed"
+	CodeDBLookupFailed  FailureCode = "db_lookup_failed"
+	CodeCancelled       FailureCode = "cancelled"
+)
+
+// TrackResult is the outcome of one track of a download.
+type TrackResult struct {
+	Index      int         `json:"index"`
+	Title      string      `json:"title"`
+	Artist     string      `json:"artist"`
+	Album      string      `json:"album,omitempty"`
+	Status     TrackStatus `json:"status"`
+	Code       FailureCode `json:"code,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	Source     string      `json:"source,omitempty"`
+	SourceID   string      `json:"sourceId,omitempty"`
+	YouTubeID  string      `json:"youtubeId,omitempty"`
+	DurationMs int64       `json:"durationMs"`
+}
+
+// DownloadReport lists the outcome of every track of a download, in the order
+// the tracks were requested.
+type DownloadReport struct {
+	Source     string        `json:"source,omitempty"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Saved      int           `json:"saved"`
+	Skipped    int           `json:"skipped"`
+	Failed     int           `json:"failed"`
+	Tracks     []TrackResult `json:"tracks"`
+}
+
+func newDownloadReport(tracks []Track) *DownloadReport {
+	report := &DownloadReport{
+		StartedAt: time.Now().UTC(),
+		Tracks:    make([]TrackResult, len(tracks)),
+	}
+	for i, t := range tracks {
+		report.Tracks[i] = TrackResult{
+			Index:  i,
+			Title:  t.Title,
+			Artist: t.Artist,
+			Album:  t.Album,
+			Status: TrackQueued,
+		}
+	}
+	return report
+}
+
+// finish tallies the final statuses once every track is done.
+func (r *DownloadReport) finish() {
+	r.FinishedAt = time.Now().UTC()
+	r.Saved, r.Skipped, r.Failed = 0, 0, 0
+	for _, t := range r.Tracks {
+		switch t.Status {
+		case TrackDone:
+			r.Saved++
+		case TrackSkipped:
+			r.Skipped++
+		default:
+			r.Failed++
+		}
+	}
+}
+
+// WriteJSON saves the report for auditing, replacing any file at path.
+func (r *DownloadReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create report directory: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// PrintTable writes one row per track followed by the totals.
+func (r *DownloadReport) PrintTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tSTATUS\tTITLE\tARTIST\tDETAIL")
+	for _, t := range r.Tracks {
+		detail := t.YouTubeID
+		if detail == "" && t.Source != "" {
+			detail = t.Source + ": " + t.SourceID
+		}
+		if t.Code != "" {
+			detail = string(t.Code)
+			if t.Reason != "" {
+				detail += ": " + firstLine(t.Reason)
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.Index+1, t.Status, t.Title, t.Artist, detail)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d saved, %d skipped, %d failed (%s)\n",
+		r.Saved, r.Skipped, r.Failed, r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	if len(line) > 80 {
+		line = line[:77] + "..."
+	}
+	return line
+}
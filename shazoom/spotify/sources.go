@@ -0,0 +1,411 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/fileformat"
+	"shazoom/utils"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// AudioSource finds and fetches the audio of a track. The identifier Search
+// returns is what Download takes, and is recorded on the saved song together
+// with Name so the same audio is not indexed twice.
+type AudioSource interface {
+	Name() string
+	Search(ctx context.Context, track Track) (string, error)
+	// Download saves the audio of id at destBase, a path without extension,
+	// and returns the path of the file it wrote.
+	Download(ctx context.Context, id, destBase string) (string, error)
+}
+
+// ErrNoMatch is returned by Search when a source has nothing for a track.
+var ErrNoMatch = errors.New("no matching audio found")
+
+var (
+	defaultSources     []AudioSource
+	defaultSourcesErr  error
+	defaultSourcesOnce sync.Once
+)
+
+// DefaultSources returns the sources named in AUDIO_SOURCES, in the order
+// they are tried. Without it, tracks only come from YouTube. The sources are
+// built on the first call and shared by every download after it, so that the
+// local library is only scanned once.
+//
+//	AUDIO_SOURCES=local,youtube  sources to try, comma separated
+//	LOCAL_LIBRARY_DIR            root of the library for "local"
+//	AUDIO_HTTP_URL_TEMPLATE      URL for "http", with {title}, {artist} and
+//	                             {album} placeholders
+func DefaultSources() ([]AudioSource, error) {
+	defaultSourcesOnce.Do(func() {
+		defaultSources, defaultSourcesErr = sourcesFromEnv()
+	})
+	return defaultSources, defaultSourcesErr
+}
+
+func sourcesFromEnv() ([]AudioSource, error) {
+	var sources []AudioSource
+	for _, name := range strings.Split(utils.GetEnv("AUDIO_SOURCES", db.SourceYouTube), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case db.SourceYouTube:
+			sources = append(sources, YouTubeSource{})
+		case db.SourceLocal:
+			root := utils.GetEnv("LOCAL_LIBRARY_DIR")
+			if root == "" {
+				return nil, errors.New("the local audio source needs LOCAL_LIBRARY_DIR")
+			}
+			sources = append(sources, NewLocalLibrarySource(root))
+		case db.SourceHTTP:
+			template := utils.GetEnv("AUDIO_HTTP_URL_TEMPLATE")
+			if template == "" {
+				return nil, errors.New("the http audio source needs AUDIO_HTTP_URL_TEMPLATE")
+			}
+			sources = append(sources, &HTTPSource{URLTemplate: template})
+		default:
+			return nil, fmt.Errorf("unknown audio source %q", name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("AUDIO_SOURCES names no audio source")
+	}
+	return sources, nil
+}
+
+// YouTubeSource searches YouTube through the Data API, falling back to
+// scraping the results page, and downloads with yt-dlp.
+type YouTubeSource struct{}
+
+func (YouTubeSource) Name() string {
+	return db.SourceYouTube
+}
+
+func (YouTubeSource) Search(ctx context.Context, track Track) (string, error) {
+	ytID, err := getYoutubeIdWithAPI(ctx, track)
+	if err != nil || ytID == "" {
+		utils.GetLogger().DebugContext(ctx, "YouTube API search found nothing, scraping the results page",
+			slog.String("title", track.Title), slog.Any("error", err))
+		ytID, err = GetYoutubeId(ctx, track)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("%w: all search methods failed: %v", errNoYouTubeID, err)
+	}
+	if ytID == "" {
+		return "", fmt.Errorf("%w for: %s", errNoYouTubeID, track.Title)
+	}
+	return ytID, nil
+}
+
+func (YouTubeSource) Download(ctx context.Context, id, destBase string) (string, error) {
+	return downloadYTaudio(fmt.Sprintf("https://www.youtube.com/watch?v=%s", id), destBase)
+}
+
+var libraryExtensions = map[string]bool{
+	".wav": true, ".mp3": true, ".flac": true, ".ogg": true, ".oga": true,
+	".opus": true, ".m4a": true, ".aac": true, ".webm": true,
+}
+
+type libraryEntry struct {
+	id            string
+	title, artist string
+}
+
+// LocalLibrarySource finds tracks in a directory tree of audio files by their
+// title and artist tags. Files without tags are read as "Artist - Title". The
+// tree is scanned on the first search, and again on the next one if that
+// search was cancelled mid-scan; identifiers are slash-separated paths
+// relative to Root.
+type LocalLibrarySource struct {
+	Root string
+	// ReadTags returns the title and artist of a file; nil reads them with
+	// fileformat.ReadTags.
+	ReadTags func(path string) (title, artist string, err error)
+
+	scanMu  sync.Mutex
+	scanned bool
+	entries []libraryEntry
+	scanErr error
+}
+
+func NewLocalLibrarySource(root string) *LocalLibrarySource {
+	return &LocalLibrarySource{Root: root}
+}
+
+func (s *LocalLibrarySource) Name() string {
+	return db.SourceLocal
+}
+
+func (s *LocalLibrarySource) Search(ctx context.Context, track Track) (string, error) {
+	if err := s.ensureScanned(ctx); err != nil {
+		return "", err
+	}
+
+	title := normalizeTag(track.Title)
+	artists := track.Artists
+	if len(artists) == 0 {
+		artists = []string{track.Artist}
+	}
+
+	for _, e := range s.entries {
+		if normalizeTag(e.title) != title {
+			continue
+		}
+		for _, artist := range artists {
+			if normalizeTag(e.artist) == normalizeTag(artist) {
+				return e.id, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w in %s for '%s' by '%s'", ErrNoMatch, s.Root, track.Title, track.Artist)
+}
+
+// ensureScanned scans the library unless an earlier search did. The outcome
+// of a scan is kept, unless ctx ended it: that is the caller's error, not the
+// library's.
+func (s *LocalLibrarySource) ensureScanned(ctx context.Context) error {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	if s.scanned {
+		return s.scanErr
+	}
+
+	s.entries = nil
+	err := s.scan(ctx)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	s.scanned, s.scanErr = true, err
+	return err
+}
+
+func (s *LocalLibrarySource) scan(ctx context.Context) error {
+	logger := utils.GetLogger()
+	readTags := s.ReadTags
+	if readTags == nil {
+		readTags = probeTags
+	}
+
+	err := filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || !libraryExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		entry := libraryEntry{id: filepath.ToSlash(rel)}
+
+		entry.title, entry.artist, err = readTags(p)
+		if err != nil {
+			logger.Debug("could not read tags, using the file name",
+				slog.String("path", p), slog.Any("error", err))
+		}
+		if entry.title == "" || entry.artist == "" {
+			entry.artist, entry.title = parseLibraryFilename(p)
+		}
+		if entry.title != "" {
+			s.entries = append(s.entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan library %s: %w", s.Root, err)
+	}
+	return nil
+}
+
+// Download copies the library file, leaving the original untouched.
+func (s *LocalLibrarySource) Download(ctx context.Context, id, destBase string) (string, error) {
+	if !fs.ValidPath(id) {
+		return "", fmt.Errorf("invalid library path %q", id)
+	}
+	src := filepath.Join(s.Root, filepath.FromSlash(id))
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	dest := destBase + strings.ToLower(filepath.Ext(src))
+	if err := writeFile(dest, in); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// parseLibraryFilename reads "Artist - Title.ext"; a name without the
+// separator is taken as the title alone.
+func parseLibraryFilename(p string) (artist, title string) {
+	tags := fileformat.TagsFromFilename(p)
+	return tags.Artist, tags.Title
+}
+
+func probeTags(p string) (string, string, error) {
+	tags, err := fileformat.ReadTags(p)
+	if err != nil {
+		return "", "", err
+	}
+	return tags.Title, tags.Artist, nil
+}
+
+// normalizeTag drops case, punctuation and spacing so that tags and file
+// names compare equal to the metadata of a track.
+func normalizeTag(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// HTTPSource fetches audio from direct URLs built from URLTemplate, e.g.
+// "https://music.example.com/{artist}/{title}.mp3". A track matches when the
+// server answers a HEAD request for its URL with 200, or, from servers that
+// do not allow HEAD, a GET of its first byte; the URL is the identifier.
+type HTTPSource struct {
+	URLTemplate string
+	Client      *http.Client
+}
+
+func (s *HTTPSource) Name() string {
+	return db.SourceHTTP
+}
+
+func (s *HTTPSource) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &http.Client{Timeout: 5 * time.Minute}
+}
+
+func (s *HTTPSource) Search(ctx context.Context, track Track) (string, error) {
+	url := strings.NewReplacer(
+		"{title}", neturl.PathEscape(track.Title),
+		"{artist}", neturl.PathEscape(track.Artist),
+		"{album}", neturl.PathEscape(track.Album),
+	).Replace(s.URLTemplate)
+
+	method := http.MethodHead
+	status, err := s.probe(ctx, method, url)
+	if status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+		method = http.MethodGet
+		status, err = s.probe(ctx, method, url)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case status == http.StatusOK || status == http.StatusPartialContent:
+		return url, nil
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return "", fmt.Errorf("%w at %s", ErrNoMatch, url)
+	default:
+		return "", fmt.Errorf("%s %s returned status %d", method, url, status)
+	}
+}
+
+// probe requests url without downloading it: a GET only asks for the first
+// byte, and its body is not read.
+func (s *HTTPSource) probe(ctx context.Context, method, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s failed: %w", method, url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (s *HTTPSource) Download(ctx context.Context, id, destBase string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GET %s failed: %w", id, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s returned status %d", id, resp.StatusCode)
+	}
+
+	dest := destBase + httpAudioExt(id, resp.Header.Get("Content-Type"))
+	if err := writeFile(dest, resp.Body); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// httpAudioExt picks the extension of a download from its URL, or from its
+// content type when the URL has none.
+func httpAudioExt(rawURL, contentType string) string {
+	if u, err := neturl.Parse(rawURL); err == nil {
+		if ext := strings.ToLower(path.Ext(u.Path)); libraryExtensions[ext] {
+			return ext
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "audio/wav", "audio/x-wav", "audio/wave":
+			return ".wav"
+		case "audio/mpeg":
+			return ".mp3"
+		case "audio/flac", "audio/x-flac":
+			return ".flac"
+		case "audio/ogg":
+			return ".ogg"
+		case "audio/mp4", "audio/x-m4a":
+			return ".m4a"
+		}
+	}
+	return ".audio"
+}
+
+// writeFile copies r to dest, removing what was written if the copy fails.
+func writeFile(dest string, r io.Reader) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	return out.Close()
+}
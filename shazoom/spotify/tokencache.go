@@ -0,0 +1,294 @@
+package spotify
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shazoom/utils"
+	"sync"
+	"time"
+)
+
+// Token is a Spotify access token and the moment it stops being accepted.
+type Token struct {
+	AccessToken string    `json:"token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Valid reports whether the token is still usable at least margin from now.
+func (t Token) Valid(margin time.Duration) bool {
+	return t.AccessToken != "" && time.Now().Add(margin).Before(t.ExpiresAt)
+}
+
+// ErrNoToken is returned by a TokenCache that holds no token.
+var ErrNoToken = errors.New("no cached token")
+
+// TokenCache stores the access token between requests and, for the file
+// based caches, between runs and across processes.
+type TokenCache interface {
+	Load() (Token, error)
+	Save(Token) error
+	Clear() error
+}
+
+// MemoryTokenCache keeps the token for the lifetime of the process.
+type MemoryTokenCache struct {
+	mu    sync.Mutex
+	token Token
+}
+
+func NewMemoryTokenCache() *MemoryTokenCache {
+	return &MemoryTokenCache{}
+}
+
+func (c *MemoryTokenCache) Load() (Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token.AccessToken == "" {
+		return Token{}, ErrNoToken
+	}
+	return c.token, nil
+}
+
+func (c *MemoryTokenCache) Save(token Token) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	return nil
+}
+
+func (c *MemoryTokenCache) Clear() error {
+	return c.Save(Token{})
+}
+
+// FileTokenCache stores the token as JSON readable by the owner only. Writes
+// go through a temp file and a rename, so a concurrent reader in another
+// process sees either the old or the new token, never a torn file.
+type FileTokenCache struct {
+	Path string
+}
+
+func NewFileTokenCache(path string) *FileTokenCache {
+	return &FileTokenCache{Path: path}
+}
+
+func (c *FileTokenCache) Load() (Token, error) {
+	data, err := readTokenFile(c.Path)
+	if err != nil {
+		return Token{}, err
+	}
+
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return Token{}, fmt.Errorf("invalid token cache %s: %w", c.Path, err)
+	}
+	return token, nil
+}
+
+func (c *FileTokenCache) Save(token Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeTokenFile(c.Path, data)
+}
+
+func (c *FileTokenCache) Clear() error {
+	return removeTokenFile(c.Path)
+}
+
+// EncryptedFileTokenCache is a FileTokenCache whose contents are sealed with
+// AES-256-GCM under a key derived from a passphrase, for machines where the
+// cache directory is shared or backed up.
+type EncryptedFileTokenCache struct {
+	Path       string
+	passphrase []byte
+
+	// the key is derived once per salt, which is kept across saves
+	mu   sync.Mutex
+	salt []byte
+	aead cipher.AEAD
+}
+
+const (
+	encryptedTokenMagic = "SZTK1"
+	tokenKeySaltSize    = 16
+	tokenKeyIterations  = 100_000
+)
+
+func NewEncryptedFileTokenCache(path, passphrase string) (*EncryptedFileTokenCache, error) {
+	if passphrase == "" {
+		return nil, errors.New("encrypted token cache needs a passphrase")
+	}
+	return &EncryptedFileTokenCache{Path: path, passphrase: []byte(passphrase)}, nil
+}
+
+func (c *EncryptedFileTokenCache) Load() (Token, error) {
+	data, err := readTokenFile(c.Path)
+	if err != nil {
+		return Token{}, err
+	}
+
+	header := len(encryptedTokenMagic) + tokenKeySaltSize
+	if len(data) < header || !bytes.HasPrefix(data, []byte(encryptedTokenMagic)) {
+		return Token{}, fmt.Errorf("invalid token cache %s: not an encrypted token file", c.Path)
+	}
+	salt := data[len(encryptedTokenMagic):header]
+
+	gcm, err := c.cipher(salt)
+	if err != nil {
+		return Token{}, err
+	}
+	sealed := data[header:]
+	if len(sealed) < gcm.NonceSize() {
+		return Token{}, fmt.Errorf("invalid token cache %s: truncated", c.Path)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(encryptedTokenMagic))
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to decrypt token cache %s (wrong passphrase?): %w", c.Path, err)
+	}
+
+	var token Token
+	if err := json.Unmarshal(plain, &token); err != nil {
+		return Token{}, fmt.Errorf("invalid token cache %s: %w", c.Path, err)
+	}
+	return token, nil
+}
+
+func (c *EncryptedFileTokenCache) Save(token Token) error {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	salt := c.salt
+	c.mu.Unlock()
+	if salt == nil {
+		salt = make([]byte, tokenKeySaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+	gcm, err := c.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := append([]byte(encryptedTokenMagic), salt...)
+	data = append(data, nonce...)
+	data = gcm.Seal(data, nonce, plain, []byte(encryptedTokenMagic))
+	return writeTokenFile(c.Path, data)
+}
+
+func (c *EncryptedFileTokenCache) Clear() error {
+	return removeTokenFile(c.Path)
+}
+
+// cipher returns the AEAD keyed from the passphrase and salt, deriving the
+// key only when the salt differs from the last one.
+func (c *EncryptedFileTokenCache) cipher(salt []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aead != nil && bytes.Equal(salt, c.salt) {
+		return c.aead, nil
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(c.passphrase), salt, tokenKeyIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.salt, c.aead = bytes.Clone(salt), gcm
+	return gcm, nil
+}
+
+func readTokenFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	return data, err
+}
+
+func writeTokenFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create token cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp already uses 0600, but be explicit about it
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func removeTokenFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// DefaultTokenCachePath is spotify/token.json in the user's cache directory,
+// falling back to the temp directory when there is none.
+func DefaultTokenCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "shazoom", "spotify", "token.json")
+}
+
+// TokenCacheFromEnv picks the cache from SPOTIFY_TOKEN_CACHE: "memory",
+// "file" (the default) or "encrypted", which needs SPOTIFY_TOKEN_KEY. The
+// file caches live at SPOTIFY_TOKEN_CACHE_PATH or DefaultTokenCachePath.
+func TokenCacheFromEnv() (TokenCache, error) {
+	path := utils.GetEnv("SPOTIFY_TOKEN_CACHE_PATH", DefaultTokenCachePath())
+
+	switch kind := utils.GetEnv("SPOTIFY_TOKEN_CACHE", "file"); kind {
+	case "memory":
+		return NewMemoryTokenCache(), nil
+	case "file":
+		return NewFileTokenCache(path), nil
+	case "encrypted":
+		return NewEncryptedFileTokenCache(path, utils.GetEnv("SPOTIFY_TOKEN_KEY", ""))
+	default:
+		return nil, fmt.Errorf("unknown SPOTIFY_TOKEN_CACHE %q (want memory, file or encrypted)", kind)
+	}
+}
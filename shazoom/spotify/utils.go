@@ -1,14 +1,15 @@
 package spotify
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"shazoom/db"
+	"shazoom/fileformat"
 	"strings"
 )
 
@@ -73,37 +74,48 @@ func correctFilename(title, artist string) (string, string) {
 	return title, artist
 }
 
+// convertStereoToMono decodes the audio file at stereoFilePath with the
+// codec registry, falling back to ffmpeg for formats it has no codec for,
+// and returns it as a mono 16-bit WAV file.
 func convertStereoToMono(stereoFilePath string) ([]byte, error) {
-	fileExt := filepath.Ext(stereoFilePath)
-	monoFilePath := strings.TrimSuffix(stereoFilePath, fileExt) + "_mono" + fileExt
-	defer os.Remove(monoFilePath)
-
-	// Check the number of channels in the stereo audio
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
-	output, err := cmd.CombinedOutput()
+	stream, err := fileformat.DecodeFile(context.Background(), stereoFilePath, fileformat.DecodeOptions{Channels: 1})
 	if err != nil {
-		return nil, fmt.Errorf("error getting number of channels: %v, %v", err, string(output))
+		return nil, fmt.Errorf("error decoding audio: %w", err)
 	}
-	channels := strings.TrimSpace(string(output))
+	defer stream.Close()
 
-	audioBytes, err := ioutil.ReadFile(stereoFilePath)
+	monoFilePath := strings.TrimSuffix(stereoFilePath, filepath.Ext(stereoFilePath)) + "_mono.wav"
+	f, err := os.Create(monoFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("error reading stereo file: %v", err)
+		return nil, fmt.Errorf("error creating mono file: %w", err)
 	}
+	defer os.Remove(monoFilePath)
+	defer f.Close()
 
-	if channels != "1" {
-		// Convert stereo to mono and downsample by 44100/2
-		cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
-		// cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", "-ar", "22050", monoFilePath)
-		if err := cmd.Run(); err != nil {
-			return nil, fmt.Errorf("error converting stereo to mono: %v", err)
+	w, err := fileformat.NewWavWriter(f, fileformat.PCMFormat(stream.SampleRate, 1, 16))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]float64, 16384)
+	for {
+		n, err := stream.ReadFrames(buf)
+		if _, werr := w.WriteFrames(buf[:n]); werr != nil {
+			return nil, fmt.Errorf("error writing mono file: %w", werr)
+		}
+		if err == io.EOF {
+			break
 		}
-
-		audioBytes, err = ioutil.ReadFile(monoFilePath)
 		if err != nil {
-			return nil, fmt.Errorf("error reading mono file: %v", err)
+			return nil, fmt.Errorf("error decoding audio: %w", err)
 		}
 	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error writing mono file: %w", err)
+	}
 
+	audioBytes, err := os.ReadFile(monoFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mono file: %v", err)
+	}
 	return audioBytes, nil
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"log/slog"
@@ -22,7 +23,7 @@ import (
 	"google.golang.org/api/youtube/v3"
 )
 
-func getYoutubeIdWithAPI(spTrack Track) (string, error) {
+func getYoutubeIdWithAPI(ctx context.Context, spTrack Track) (string, error) {
 	_ = godotenv.Load()
 
 	developerKey := os.Getenv("YT_KEY")
@@ -30,30 +31,90 @@ func getYoutubeIdWithAPI(spTrack Track) (string, error) {
 		return "", errors.New("YT_KEY environment variable not set")
 	}
 
-	service, err := youtube.NewService(context.TODO(), option.WithAPIKey(developerKey))
+	service, err := youtube.NewService(ctx, option.WithAPIKey(developerKey))
 	if err != nil {
 		log.Printf("Error creating new YouTube client: %v", err)
 		return "", err
 	}
 
 	query := fmt.Sprintf("'%s' %s %s", spTrack.Title, spTrack.Artist, spTrack.Album)
-	call := service.Search.List([]string{"id"}).
+	call := service.Search.List([]string{"id", "snippet"}).
 		Q(query).
 		VideoCategoryId("10").
 		Type("video").
-		MaxResults(5)
+		MaxResults(10)
 
-	resp, err := call.Do()
+	resp, err := call.Context(ctx).Do()
 	if err != nil {
 		log.Printf("Error making search API call: %v", err)
 		return "", err
 	}
+
+	var candidates []Candidate
+	var ids []string
 	for _, item := range resp.Items {
 		if item.Id.Kind == "youtube#video" && item.Id.VideoId != "" {
-			return item.Id.VideoId, nil
+			c := Candidate{ID: item.Id.VideoId}
+			if item.Snippet != nil {
+				c.Title = html.UnescapeString(item.Snippet.Title)
+				c.Channel = item.Snippet.ChannelTitle
+				c.Live = item.Snippet.LiveBroadcastContent == "live" || item.Snippet.LiveBroadcastContent == "upcoming"
+			}
+			candidates = append(candidates, c)
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	// search results carry no duration; one videos.list call fetches them all
+	videos, err := service.Videos.List([]string{"contentDetails"}).Id(ids...).Do()
+	if err != nil {
+		log.Printf("Error fetching video durations: %v", err)
+	} else {
+		durations := make(map[string]int, len(videos.Items))
+		for _, v := range videos.Items {
+			if v.ContentDetails != nil {
+				durations[v.Id] = parseISODuration(v.ContentDetails.Duration)
+			}
+		}
+		for i := range candidates {
+			candidates[i].Duration = durations[candidates[i].ID]
+		}
+	}
+
+	best, ok := BestCandidate(spTrack, candidates, RankOptions{})
+	if !ok {
+		return "", nil
+	}
+	return best.ID, nil
+}
+
+// parseISODuration reads the PT#H#M#S durations of the Data API.
+func parseISODuration(d string) int {
+	rest, ok := strings.CutPrefix(d, "PT")
+	if !ok {
+		return 0
+	}
+
+	total := 0
+	for _, unit := range []struct {
+		suffix  string
+		seconds int
+	}{{"H", 3600}, {"M", 60}, {"S", 1}} {
+		value, after, found := strings.Cut(rest, unit.suffix)
+		if !found {
+			continue
 		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0
+		}
+		total += n * unit.seconds
+		rest = after
 	}
-	return "", nil
+	return total
 }
 
 var httpClient = &http.Client{}
@@ -84,11 +145,10 @@ func convertStringDurationToSeconds(durationStr string) int {
 	return 0
 }
 
-func GetYoutubeId(track Track) (string, error) {
-	songDurationInSeconds := track.Duration
+func GetYoutubeId(ctx context.Context, track Track) (string, error) {
 	searchQuery := fmt.Sprintf("'%s' %s", track.Title, track.Artist)
 
-	searchResults, err := ytSearch(searchQuery, 10)
+	searchResults, err := ytSearch(ctx, searchQuery, 10)
 	if err != nil {
 		return "", err
 	}
@@ -96,17 +156,24 @@ func GetYoutubeId(track Track) (string, error) {
 		return "", fmt.Errorf("no songs found for %s", searchQuery)
 	}
 
+	candidates := make([]Candidate, 0, len(searchResults))
 	for _, result := range searchResults {
-		allowedDurationRangeStart := songDurationInSeconds - durationMatchThreshold
-		allowedDurationRangeEnd := songDurationInSeconds + durationMatchThreshold
-		resultSongDuration := convertStringDurationToSeconds(result.Duration)
-		if resultSongDuration >= allowedDurationRangeStart && resultSongDuration <= allowedDurationRangeEnd {
-			fmt.Printf("INFO: Found song with id '%s'\n", result.ID)
-			return result.ID, nil
-		}
+		candidates = append(candidates, Candidate{
+			ID:       result.ID,
+			Title:    result.Title,
+			Channel:  result.Uploader,
+			Duration: convertStringDurationToSeconds(result.Duration),
+			Live:     result.Live,
+		})
 	}
 
-	return "", fmt.Errorf("could not settle on a song from search result for: %s", searchQuery)
+	best, ok := BestCandidate(track, candidates, RankOptions{})
+	if !ok {
+		return "", fmt.Errorf("could not settle on a song from search result for: %s", searchQuery)
+	}
+
+	fmt.Printf("INFO: Found song with id '%s'\n", best.ID)
+	return best.ID, nil
 }
 
 func getContent(data []byte, index int) []byte {
@@ -115,9 +182,9 @@ func getContent(data []byte, index int) []byte {
 	return contents
 }
 
-func ytSearch(searchTerm string, limit int) (results []*SearchResult, err error) {
+func ytSearch(ctx context.Context, searchTerm string, limit int) (results []*SearchResult, err error) {
 	ytSearchUrl := fmt.Sprintf("https://www.youtube.com/results?search_query=%s", url.QueryEscape(searchTerm))
-	req, err := http.NewRequest("GET", ytSearchUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", ytSearchUrl, nil)
 	if err != nil {
 		return nil, errors.New("cannot create youtube request")
 	}
@@ -189,6 +256,9 @@ func ytSearch(searchTerm string, limit int) (results []*SearchResult, err error)
 }
 
 // downloadYTaudio downloads audio from a YouTube video using yt-dlp.
+// ErrLoginRequired is returned for videos YouTube only serves to signed-in users.
+var ErrLoginRequired = errors.New("video requires a YouTube login")
+
 func downloadYTaudio(videoURL, outputFilePath string) (string, error) {
 	logger := utils.GetLogger()
 
@@ -243,7 +313,7 @@ func downloadYTaudio(videoURL, outputFilePath string) (string, error) {
 		   strings.Contains(string(output), "Sign in to confirm you're not a bot") {
 			logger.Warn("Skipping login-protected YouTube video",
 				slog.String("output", string(output)))
-			return "", nil
+			return "", ErrLoginRequired
 		}
 		logger.Error("yt-dlp command failed",
 			slog.String("output", string(output)),
@@ -1,13 +1,20 @@
 package core_test
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"shazoom/db"
 	"shazoom/fileformat"
 	"shazoom/models"
+	"shazoom/utils"
+	"slices"
+	"sort"
+	"sync"
 	"testing"
 )
 
@@ -75,25 +82,240 @@ func TestProcessRecording(t *testing.T, recData models.RecordData, wavBytes []by
 }
 
 func LoadRealAudio(t *testing.T) ([]float64, int, float64) {
-	if err := os.MkdirAll("tmp", 0755); err != nil {
-		t.Fatalf("Failed to create tmp directory: %v", err)
-	}
-	defer os.RemoveAll("tmp")
-
 	path := GetTestPath("testdata/sample3.mp3")
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		t.Fatalf("Test file does not exist: %s", path)
 	}
 
-	wavPath, err := fileformat.ConvertToWAV(path)
+	// decode in-process to 16-bit mono PCM, as a client would record it
+	stream, err := fileformat.DecodeFile(context.Background(), path, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	defer stream.Close()
+
+	decoded, err := stream.ReadAll()
 	if err != nil {
-		t.Fatalf("Failed to convert to WAV: %v", err)
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	pcm := make([]byte, 2*len(decoded))
+	for i, s := range decoded {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(s*(1<<15))))
 	}
 
-	recData, wavBytes := MakeRecordTestData(t, wavPath)
+	recData := models.RecordData{
+		Audio:      base64.StdEncoding.EncodeToString(pcm),
+		Duration:   float64(len(decoded)) / float64(stream.SampleRate),
+		Channels:   1,
+		SampleRate: stream.SampleRate,
+		SampleSize: 16,
+	}
 
-	samples, SampleRate, Duration := TestProcessRecording(t, recData, wavBytes)
+	samples, SampleRate, Duration := TestProcessRecording(t, recData, pcm)
 
 	return samples, SampleRate, Duration
 }
+
+// MemoryDB is an in-memory db.DBClient for tests that should not need postgres.
+type MemoryDB struct {
+	mu           sync.Mutex
+	nextID       uint32
+	songs        map[uint32]db.Song
+	fingerprints map[int64][]models.Couple
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		songs:        make(map[uint32]db.Song),
+		fingerprints: make(map[int64][]models.Couple),
+	}
+}
+
+func (m *MemoryDB) Close() error { return nil }
+
+func (m *MemoryDB) StoreFingerprints(fingerprints map[int64]models.Couple) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for address, couple := range fingerprints {
+		if slices.Contains(m.fingerprints[address], couple) {
+			// mirrors ON CONFLICT DO NOTHING on the postgres primary key
+			continue
+		}
+		m.fingerprints[address] = append(m.fingerprints[address], couple)
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetCouples(addresses []int64) (map[int64][]models.Couple, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	couples := make(map[int64][]models.Couple)
+	for _, address := range addresses {
+		if c, ok := m.fingerprints[address]; ok {
+			couples[address] = append([]models.Couple(nil), c...)
+		}
+	}
+	return couples, nil
+}
+
+func (m *MemoryDB) TotalSongs() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.songs), nil
+}
+
+func (m *MemoryDB) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+	if ytID == "" {
+		return m.RegisterSongFromSource(songTitle, songArtist, "", "")
+	}
+	return m.RegisterSongFromSource(songTitle, songArtist, db.SourceYouTube, ytID)
+}
+
+func (m *MemoryDB) RegisterSongFromSource(songTitle, songArtist, source, sourceID string) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := utils.GenerateSongKey(songTitle, songArtist)
+	for _, song := range m.songs {
+		if utils.GenerateSongKey(song.Title, song.Artist) == key {
+			return 0, fmt.Errorf("song already exists: %s", key)
+		}
+	}
+	m.nextID++
+	song := db.Song{ID: m.nextID, Title: songTitle, Artist: songArtist, Source: source, SourceID: sourceID}
+	if source == db.SourceYouTube {
+		song.YouTubeID = sourceID
+	}
+	m.songs[m.nextID] = song
+	return m.nextID, nil
+}
+
+func (m *MemoryDB) GetSong(filterKey string, value interface{}) (db.Song, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, song := range m.songs {
+		var match bool
+		switch filterKey {
+		case "id":
+			match = value == song.ID
+		case "ytID":
+			match = value == song.YouTubeID
+		case "key":
+			match = value == utils.GenerateSongKey(song.Title, song.Artist)
+		default:
+			return db.Song{}, false, fmt.Errorf("invalid filter key")
+		}
+		if match {
+			return song, true, nil
+		}
+	}
+	return db.Song{}, false, nil
+}
+
+func (m *MemoryDB) GetSongByID(songID uint32) (db.Song, bool, error) { return m.GetSong("id", songID) }
+func (m *MemoryDB) GetSongsByIDs(songIDs []uint32) (map[uint32]db.Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	songs := make(map[uint32]db.Song, len(songIDs))
+	for _, id := range songIDs {
+		if song, ok := m.songs[id]; ok {
+			songs[id] = song
+		}
+	}
+	return songs, nil
+}
+
+func (m *MemoryDB) GetSongByYTID(ytID string) (db.Song, bool, error) { return m.GetSong("ytID", ytID) }
+func (m *MemoryDB) GetSongByKey(key string) (db.Song, bool, error)   { return m.GetSong("key", key) }
+
+func (m *MemoryDB) GetSongBySource(source, sourceID string) (db.Song, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, song := range m.songs {
+		if song.Source == source && song.SourceID == sourceID {
+			return song, true, nil
+		}
+	}
+	return db.Song{}, false, nil
+}
+
+func (m *MemoryDB) DeleteSongByID(songID uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.songs, songID)
+	for address, couples := range m.fingerprints {
+		kept := couples[:0]
+		for _, c := range couples {
+			if c.SongId != songID {
+				kept = append(kept, c)
+			}
+		}
+		m.fingerprints[address] = kept
+	}
+	return nil
+}
+
+func (m *MemoryDB) DeleteCollection(collectionName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch collectionName {
+	case "songs":
+		m.songs = make(map[uint32]db.Song)
+	case "fingerprints":
+		m.fingerprints = make(map[int64][]models.Couple)
+	default:
+		return fmt.Errorf("unauthorized table drop")
+	}
+	return nil
+}
+
+func (m *MemoryDB) ListSongs(afterID uint32, limit int) ([]db.Song, error) {
+	var songs []db.Song
+	err := m.IterateSongs(func(song db.Song) error {
+		if song.ID > afterID && len(songs) < limit {
+			songs = append(songs, song)
+		}
+		return nil
+	})
+	return songs, err
+}
+
+func (m *MemoryDB) IterateSongs(fn func(song db.Song) error) error {
+	m.mu.Lock()
+	songs := make([]db.Song, 0, len(m.songs))
+	for _, song := range m.songs {
+		songs = append(songs, song)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(songs, func(i, j int) bool { return songs[i].ID < songs[j].ID })
+	for _, song := range songs {
+		if err := fn(song); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) IterateFingerprints(fn func(address int64, couple models.Couple) error) error {
+	m.mu.Lock()
+	addresses := make([]int64, 0, len(m.fingerprints))
+	for address := range m.fingerprints {
+		addresses = append(addresses, address)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	for _, address := range addresses {
+		m.mu.Lock()
+		couples := append([]models.Couple(nil), m.fingerprints[address]...)
+		m.mu.Unlock()
+		for _, couple := range couples {
+			if err := fn(address, couple); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
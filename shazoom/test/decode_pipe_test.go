@@ -0,0 +1,178 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"shazoom/core"
+	"shazoom/fileformat"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// s16le encodes samples as ffmpeg's raw s16le output.
+func s16le(samples []float64) []byte {
+	b := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(int16(s*(1<<15))))
+	}
+	return b
+}
+
+// fakeFFmpeg puts an ffmpeg on PATH that runs script instead.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FINGERPRINT_STEREO", "false")
+}
+
+// pcmFFmpeg is a fake ffmpeg that checks it was asked for raw PCM on stdout
+// and writes the file in FAKE_FFMPEG_PCM there.
+const pcmFFmpeg = `case "$*" in *"-f s16le"*" -") ;; *) echo "unexpected arguments: $*" >&2; exit 2;; esac
+case "$*" in *pipe:0*) cat > /dev/null;; esac
+exec cat "$FAKE_FFMPEG_PCM"
+`
+
+func TestPCMReader(t *testing.T) {
+	frames := testFrames(1000, 2)
+	var samples []float64
+	for _, f := range frames {
+		samples = append(samples, f...)
+	}
+	// a trailing partial frame is dropped
+	data := append(s16le(samples), 0x01, 0x02, 0x03)
+
+	s := fileformat.NewPCMReader(iotest.OneByteReader(bytes.NewReader(data)), 44100, 2)
+	got, err := s.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(samples) {
+		t.Fatalf("read %d samples, want %d", len(got), len(samples))
+	}
+	for i := range got {
+		if d := got[i] - samples[i]; d > 1.0/30000 || d < -1.0/30000 {
+			t.Fatalf("sample %d: got %v, want %v", i, got[i], samples[i])
+		}
+	}
+	if n, err := s.ReadFrames(make([]float64, 8)); n != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF at the end, got %d frames and %v", n, err)
+	}
+}
+
+func TestFingerprintPCMMatchesStreaming(t *testing.T) {
+	song := syntheticSong(3*44100+5, 1, 9)
+	mono := make([]float64, len(song))
+	for i, frame := range song {
+		mono[i] = frame[0]
+	}
+	pcm := s16le(mono)
+
+	// the length of a PCM stream is not known, so its frames are timed by
+	// the hop size, as by a StreamFingerprinter over the same samples
+	quantised, _ := fileformat.NewPCMReader(bytes.NewReader(pcm), 44100, 1).ReadAll()
+	want := hopTimedFingerprints(t, [][]float64{quantised}, 44100, 5)
+
+	got, err := core.FingerprintPCM(fileformat.NewPCMReader(bytes.NewReader(pcm), 44100, 1), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("pipeline produced %d fingerprints, want %d", len(got), len(want))
+	}
+}
+
+func TestFingerprintFileLeavesNoFiles(t *testing.T) {
+	song := syntheticSong(2*44100, 1, 3)
+	mono := make([]float64, len(song))
+	for i, frame := range song {
+		mono[i] = frame[0]
+	}
+	pcm := s16le(mono)
+
+	pcmPath := filepath.Join(t.TempDir(), "decoded.raw")
+	if err := os.WriteFile(pcmPath, pcm, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeFFmpeg(t, pcmFFmpeg)
+	t.Setenv("FAKE_FFMPEG_PCM", pcmPath)
+
+	library := t.TempDir()
+	songPath := filepath.Join(library, "song.mp3")
+	if err := os.WriteFile(songPath, []byte("not decoded by the fake"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := core.FingerprintFile(context.Background(), songPath, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := core.FingerprintPCM(fileformat.NewPCMReader(bytes.NewReader(pcm), 44100, 1), 11)
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d fingerprints, want %d", len(got), len(want))
+	}
+
+	entries, _ := os.ReadDir(library)
+	if len(entries) != 1 {
+		t.Fatalf("decoding left files behind: %v", entries)
+	}
+
+	// recordings are PCM, which needs no ffmpeg
+	stream, err := fileformat.DecodeRecording(context.Background(), pcm, 44100, 1, 16, fileformat.DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	samples, err := stream.ReadAll()
+	if err != nil || len(samples) != len(mono) || stream.Decoder != "wav" {
+		t.Fatalf("%s decoded %d samples of %d: %v", stream.Decoder, len(samples), len(mono), err)
+	}
+}
+
+func TestDecodeFileErrors(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "song.mp3")
+	if err := os.WriteFile(input, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ffmpeg fails", func(t *testing.T) {
+		fakeFFmpeg(t, "echo 'Invalid data found when processing input' >&2\nexit 1\n")
+		_, err := core.FingerprintFile(context.Background(), input, 1)
+		if !errors.Is(err, fileformat.ErrDecodeFailed) || !strings.Contains(err.Error(), "Invalid data") {
+			t.Fatalf("expected ErrDecodeFailed with ffmpeg's message, got %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		fakeFFmpeg(t, "exec sleep 30\n")
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := core.FingerprintFile(ctx, input, 1)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("cancelling did not stop ffmpeg")
+		}
+	})
+
+	t.Run("ffmpeg missing", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		if _, err := core.FingerprintFile(context.Background(), input, 1); !errors.Is(err, fileformat.ErrNoCodec) {
+			t.Fatalf("expected ErrNoCodec without ffmpeg, got %v", err)
+		}
+	})
+}
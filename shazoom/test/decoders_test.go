@@ -0,0 +1,510 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"shazoom/core"
+	"shazoom/fileformat"
+	"testing"
+)
+
+// flacBitWriter writes big-endian bit fields, as FLAC frames are laid out.
+type flacBitWriter struct {
+	buf []byte
+	cur uint64
+	n   uint
+}
+
+func (w *flacBitWriter) write(v uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | v>>uint(i)&1
+		w.n++
+		if w.n == 8 {
+			w.buf = append(w.buf, byte(w.cur))
+			w.cur, w.n = 0, 0
+		}
+	}
+}
+
+func (w *flacBitWriter) signed(v int64, n uint) { w.write(uint64(v)&(1<<n-1), n) }
+
+func (w *flacBitWriter) rice(v int64, k uint) {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	for q := u >> k; q > 0; q-- {
+		w.write(0, 1)
+	}
+	w.write(1, 1)
+	w.write(u, k)
+}
+
+func (w *flacBitWriter) align() {
+	for w.n != 0 {
+		w.write(0, 1)
+	}
+}
+
+func flacCRC8(b []byte) byte {
+	var crc byte
+	for _, c := range b {
+		crc ^= c
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func flacCRC16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacSubframe encodes one channel with the given kind: "constant",
+// "verbatim", "fixed2" or "lpc2".
+func flacSubframe(w *flacBitWriter, samples []int64, bps uint, kind string) {
+	order := 0
+	var residual []int64
+	switch kind {
+	case "constant":
+		w.write(0, 8)
+		w.signed(samples[0], bps)
+		return
+	case "verbatim":
+		w.write(1<<1, 8)
+		for _, s := range samples {
+			w.signed(s, bps)
+		}
+		return
+	case "fixed2":
+		order = 2
+		w.write((8+2)<<1, 8)
+		for i := 0; i < order; i++ {
+			w.signed(samples[i], bps)
+		}
+		for i := order; i < len(samples); i++ {
+			residual = append(residual, samples[i]-(2*samples[i-1]-samples[i-2]))
+		}
+	case "lpc2":
+		order = 2
+		w.write((32+1)<<1, 8)
+		for i := 0; i < order; i++ {
+			w.signed(samples[i], bps)
+		}
+		coefs, shift := []int64{14000, -6500}, int64(13)
+		w.write(15-1, 4)
+		w.signed(shift, 5)
+		for _, c := range coefs {
+			w.signed(c, 15)
+		}
+		for i := order; i < len(samples); i++ {
+			sum := coefs[0]*samples[i-1] + coefs[1]*samples[i-2]
+			residual = append(residual, samples[i]-sum>>shift)
+		}
+	}
+
+	// two partitions: a Rice-coded one and an escaped one of raw values
+	w.write(0, 2)
+	w.write(1, 4)
+	half := len(samples)/2 - order
+	w.write(12, 4)
+	for _, r := range residual[:half] {
+		w.rice(r, 12)
+	}
+	w.write(0xF, 4)
+	w.write(uint64(bps+2), 5)
+	for _, r := range residual[half:] {
+		w.signed(r, bps+2)
+	}
+}
+
+// flacFile encodes 16-bit channels as a FLAC stream with frames of
+// blockSize samples, behind an ID3v2 tag and with a padding block after
+// STREAMINFO.
+func flacFile(channels [][]int64, rate, blockSize int, assignment int, kinds []string) []byte {
+	var out bytes.Buffer
+	out.WriteString("ID3\x04\x00\x00\x00\x00\x00\x05hello")
+	out.WriteString("fLaC")
+
+	info := make([]byte, 34)
+	total := len(channels[0])
+	binary.BigEndian.PutUint64(info[10:], uint64(rate)<<44|uint64(len(channels)-1)<<41|uint64(16-1)<<36|uint64(total))
+	out.Write([]byte{0x00, 0, 0, 34})
+	out.Write(info)
+	out.Write([]byte{0x81, 0, 0, 6})
+	out.Write(make([]byte, 6))
+
+	for frame, start := 0, 0; start < total; frame, start = frame+1, start+blockSize {
+		end := min(start+blockSize, total)
+		w := &flacBitWriter{}
+		w.write(0xFFF8, 16)
+		w.write(7, 4) // 16-bit block size at the end of the header
+		w.write(0, 4) // sample rate from STREAMINFO
+		w.write(uint64(assignment), 4)
+		w.write(4, 3) // 16 bits per sample
+		w.write(0, 1)
+		w.write(uint64(frame), 8)
+		w.write(uint64(end-start-1), 16)
+		w.write(uint64(flacCRC8(w.buf)), 8)
+
+		block := make([][]int64, len(channels))
+		for c := range channels {
+			block[c] = channels[c][start:end]
+		}
+		bps := []uint{16, 16}
+		switch assignment {
+		case 8: // left, side
+			side := make([]int64, end-start)
+			for i := range side {
+				side[i] = block[0][i] - block[1][i]
+			}
+			block[1], bps[1] = side, 17
+		case 10: // mid, side
+			mid, side := make([]int64, end-start), make([]int64, end-start)
+			for i := range side {
+				mid[i], side[i] = (block[0][i]+block[1][i])>>1, block[0][i]-block[1][i]
+			}
+			block[0], block[1], bps[1] = mid, side, 17
+		}
+
+		for c := range block {
+			flacSubframe(w, block[c], bps[min(c, 1)], kinds[(frame+c)%len(kinds)])
+		}
+		w.align()
+		w.write(uint64(flacCRC16(w.buf)), 16)
+		out.Write(w.buf)
+	}
+	return out.Bytes()
+}
+
+func readAll(t *testing.T, s *fileformat.PCMStream) []float64 {
+	t.Helper()
+	samples, err := s.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+// TestFlacRFCExample decodes example 1 of RFC 9639, a single stereo frame
+// of verbatim subframes with wasted bits.
+func TestFlacRFCExample(t *testing.T) {
+	data := []byte{
+		'f', 'L', 'a', 'C', 0x80, 0x00, 0x00, 0x22, 0x10, 0x00, 0x10, 0x00,
+		0x00, 0x00, 0x0f, 0x00, 0x00, 0x0f, 0x0a, 0xc4, 0x42, 0xf0, 0x00, 0x00,
+		0x00, 0x01, 0x3e, 0x84, 0xb4, 0x18, 0x07, 0xdc, 0x69, 0x03, 0x07, 0x58,
+		0x6a, 0x3d, 0xad, 0x1a, 0x2e, 0x0f, 0xff, 0xf8, 0x69, 0x18, 0x00, 0x00,
+		0xbf, 0x03, 0x58, 0xfd, 0x03, 0x12, 0x8b, 0xaa, 0x9a,
+	}
+	r, err := fileformat.NewFlacReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SampleRate != 44100 || r.Channels != 2 || r.BitsPerSample != 16 || r.TotalFrames != 1 {
+		t.Fatalf("unexpected STREAMINFO %+v", r)
+	}
+
+	frame := make([]float64, 2)
+	if n, err := r.ReadFrames(frame); n != 1 || err != nil {
+		t.Fatalf("read %d frames: %v", n, err)
+	}
+	if frame[0] != 25588.0/32768 || frame[1] != 10416.0/32768 {
+		t.Fatalf("got %v, want [25588 10416]/32768", frame)
+	}
+}
+
+func TestFlacDecoding(t *testing.T) {
+	const n = 2500
+	left, right := make([]int64, n), make([]int64, n)
+	for i := range left {
+		left[i] = int64(12000*math.Sin(float64(i)*0.03) + 3000*math.Sin(float64(i)*0.31))
+		right[i] = int64(9000*math.Sin(float64(i)*0.05+1) - 2000*math.Cos(float64(i)*0.17))
+	}
+	kinds := []string{"verbatim", "fixed2", "lpc2"}
+
+	for _, assignment := range []int{1, 8, 10} {
+		data := flacFile([][]int64{left, right}, 44100, 1000, assignment, kinds)
+		path := filepath.Join(t.TempDir(), "song.flac")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := fileformat.DecodeFile(context.Background(), path, fileformat.DecodeOptions{Channels: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readAll(t, s)
+		s.Close()
+		if s.Decoder != "flac" {
+			t.Fatalf("decoded by %q", s.Decoder)
+		}
+		if len(got) != 2*n {
+			t.Fatalf("assignment %d: got %d samples, want %d", assignment, len(got), 2*n)
+		}
+		for i := 0; i < n; i++ {
+			if got[2*i] != float64(left[i])/32768 || got[2*i+1] != float64(right[i])/32768 {
+				t.Fatalf("assignment %d, frame %d: got %v %v, want %d %d", assignment, i,
+					got[2*i]*32768, got[2*i+1]*32768, left[i], right[i])
+			}
+		}
+	}
+
+	silence := make([]int64, 300)
+	for i := range silence {
+		silence[i] = -7
+	}
+	data := flacFile([][]int64{silence}, 8000, 300, 0, []string{"constant"})
+	r, err := fileformat.NewFlacReader(bytes.NewReader(data[15:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]float64, 1000)
+	if n, err := r.ReadFrames(buf); n != 300 || err != nil || buf[299] != -7.0/32768 {
+		t.Fatalf("constant subframe: read %d frames (%v), last %v", n, err, buf[299]*32768)
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-3] ^= 0x40
+	r, _ = fileformat.NewFlacReader(bytes.NewReader(corrupt[15:]))
+	if _, err := r.ReadFrames(buf); err == nil {
+		t.Fatal("expected a CRC error for a corrupted frame")
+	}
+}
+
+func TestDecodeVorbis(t *testing.T) {
+	s, err := fileformat.DecodeFile(context.Background(), GetTestPath("testdata/tone.ogg"), fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	samples := readAll(t, s)
+	if s.Decoder != "vorbis" || len(samples) != 44100 {
+		t.Fatalf("%s decoded %d samples, want 44100 from vorbis", s.Decoder, len(samples))
+	}
+	var energy float64
+	for _, x := range samples {
+		energy += x * x
+	}
+	if energy == 0 {
+		t.Fatal("decoded silence")
+	}
+}
+
+func TestDecodeMP3(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	path := GetTestPath("testdata/sample3.mp3")
+
+	s, err := fileformat.DecodeFile(context.Background(), path, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	samples := readAll(t, s)
+	tags, err := fileformat.ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// within a few frames of the length worked out from the headers
+	duration := float64(len(samples)) / float64(s.SampleRate)
+	if s.Decoder != "mp3" || math.Abs(duration-tags.Duration) > 0.2 {
+		t.Fatalf("%s decoded %.2fs, want %.2fs from mp3", s.Decoder, duration, tags.Duration)
+	}
+	var energy float64
+	for _, x := range samples {
+		energy += x * x
+	}
+	if energy == 0 {
+		t.Fatal("decoded silence")
+	}
+}
+
+func TestDecodeResamples(t *testing.T) {
+	const from, freq = 48000, 1000.0
+	frames := make([][]float64, from)
+	for i := range frames {
+		s := 0.5 * math.Sin(2*math.Pi*freq*float64(i)/from)
+		frames[i] = []float64{s, 0}
+	}
+	fixture := wavFixture{format: 1, channels: 2, bits: 16, rate: from}
+
+	s, err := fileformat.DecodeReader(context.Background(), bytes.NewReader(fixture.build(frames)), fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, s)
+	if s.Decoder != "wav" || s.SampleRate != 44100 || len(got) != 44100 {
+		t.Fatalf("%s produced %d samples at %d Hz", s.Decoder, len(got), s.SampleRate)
+	}
+
+	// the mono mix is a quarter amplitude sine; away from the edges it
+	// must survive resampling
+	for i := 100; i < len(got)-100; i++ {
+		want := 0.25 * math.Sin(2*math.Pi*freq*float64(i)/44100)
+		if math.Abs(got[i]-want) > 2e-3 {
+			t.Fatalf("sample %d: got %v, want %v", i, got[i], want)
+		}
+	}
+}
+
+func TestDecodeKnowsLength(t *testing.T) {
+	for _, rate := range []int{44100, 48000, 22050, 96000} {
+		for _, n := range []int{1, 1234, 12345} {
+			frames := make([][]float64, n)
+			for i := range frames {
+				frames[i] = []float64{0, 0}
+			}
+			fixture := wavFixture{format: 1, channels: 2, bits: 16, rate: rate}
+			s, err := fileformat.DecodeReader(context.Background(), bytes.NewReader(fixture.build(frames)), fileformat.DecodeOptions{Channels: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readAll(t, s)
+			if s.Frames != int64(len(got)) {
+				t.Fatalf("%d frames at %d Hz: stream said %d frames, decoded %d", n, rate, s.Frames, len(got))
+			}
+		}
+	}
+
+	fixture := wavFixture{format: 1, channels: 1, bits: 16, rate: 48000, streaming: true}
+	s, err := fileformat.DecodeReader(context.Background(), bytes.NewReader(fixture.build([][]float64{{0}, {0}})), fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Frames != -1 {
+		t.Fatalf("a WAV file without sizes has %d frames", s.Frames)
+	}
+}
+
+func TestFingerprintWithoutFFmpeg(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("FINGERPRINT_STEREO", "false")
+	dir := t.TempDir()
+
+	song := syntheticSong(2*44100, 1, 21)
+	mono := make([]int64, len(song))
+	wavFrames := make([][]float64, len(song))
+	for i, frame := range song {
+		mono[i] = int64(frame[0] * 32767)
+		wavFrames[i] = []float64{float64(mono[i]) / 32768}
+	}
+
+	wavData := wavFixture{format: 1, channels: 1, bits: 16, rate: 44100}.build(wavFrames)
+	// both headers give the length, so decoding gives the fingerprints of
+	// the batch path
+	want, err := core.FingerprintWav(bytes.NewReader(wavData), 4)
+	if err != nil || len(want) == 0 {
+		t.Fatalf("no reference fingerprints: %v", err)
+	}
+
+	files := map[string][]byte{
+		"song.wav":  wavData,
+		"song.flac": flacFile([][]int64{mono}, 44100, 4096, 0, []string{"lpc2", "fixed2"}),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := core.GenerateFingerprints(path, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %d fingerprints, want %d", name, len(got), len(want))
+		}
+	}
+}
+
+// formatDecoder is a codec for streams starting with "FMT!", followed by
+// their channel count and sample rate as little-endian uint32s. It decodes
+// silence and records the largest read it was asked for.
+type formatDecoder struct {
+	rate, channels int
+	left           int
+	largestRead    int
+}
+
+func (d *formatDecoder) Format() (int, int) { return d.rate, d.channels }
+
+func (d *formatDecoder) ReadFrames(dst []float64) (int, error) {
+	d.largestRead = max(d.largestRead, len(dst))
+	n := min(len(dst)/d.channels, d.left)
+	clear(dst[:n*d.channels])
+	d.left -= n
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+var lastFormatDecoder *formatDecoder
+
+func init() {
+	fileformat.RegisterCodec(fileformat.Codec{
+		Name:  "format-test",
+		Sniff: func(h []byte) bool { return bytes.HasPrefix(h, []byte("FMT!")) },
+		Open: func(r io.Reader) (fileformat.FrameDecoder, error) {
+			var h struct{ Magic, Channels, Rate uint32 }
+			if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+				return nil, err
+			}
+			lastFormatDecoder = &formatDecoder{rate: int(h.Rate), channels: int(h.Channels), left: 100000}
+			return lastFormatDecoder, nil
+		},
+	})
+}
+
+func formatStream(channels, rate uint32) io.Reader {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{binary.LittleEndian.Uint32([]byte("FMT!")), channels, rate})
+	return &b
+}
+
+func TestDecodeRejectsImplausibleFormats(t *testing.T) {
+	ctx := context.Background()
+	for _, f := range []struct{ channels, rate uint32 }{
+		{65535, 44100},
+		{2, 4000000000},
+		// a kernel for this ratio would be too large
+		{2, 768000},
+		{1, 0},
+	} {
+		if _, err := fileformat.DecodeReader(ctx, formatStream(f.channels, f.rate), fileformat.DecodeOptions{SampleRate: 8000, Channels: 1}); !errors.Is(err, fileformat.ErrUnsupportedFormat) {
+			t.Errorf("%d channels at %d Hz: expected ErrUnsupportedFormat, got %v", f.channels, f.rate, err)
+		}
+	}
+
+	// reads are bounded however much is asked for at once
+	s, err := fileformat.DecodeReader(ctx, formatStream(8, 44100), fileformat.DecodeOptions{SampleRate: 44100, Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.ReadFrames(make([]float64, 1<<20)); n == 0 || err != nil {
+		t.Fatalf("read %d frames: %v", n, err)
+	}
+	if lastFormatDecoder.largestRead > 8*4096 {
+		t.Errorf("the decoder was asked for %d samples at once", lastFormatDecoder.largestRead)
+	}
+}
@@ -0,0 +1,241 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"shazoom/jobs"
+	"shazoom/spotify"
+	"testing"
+	"time"
+)
+
+// fakeDownloader resolves every URL to the same tracks and walks each of them
+// through the download stages. Tracks titled "fail" fail while downloading;
+// when block is set, Download waits for the context to be cancelled.
+type fakeDownloader struct {
+	tracks []spotify.Track
+	block  bool
+}
+
+func (d *fakeDownloader) Resolve(ctx context.Context, url string) ([]spotify.Track, error) {
+	if url == "bad" {
+		return nil, errors.New("no such playlist")
+	}
+	return d.tracks, nil
+}
+
+func (d *fakeDownloader) Download(ctx context.Context, tracks []spotify.Track, onUpdate func(spotify.TrackUpdate)) (*spotify.DownloadReport, error) {
+	if d.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	report := &spotify.DownloadReport{}
+	for i, track := range tracks {
+		for _, status := range []spotify.TrackStatus{spotify.TrackSearching, spotify.TrackDownloading} {
+			onUpdate(spotify.TrackUpdate{Index: i, Track: track, Status: status})
+		}
+		if track.Title == "fail" {
+			onUpdate(spotify.TrackUpdate{Index: i, Track: track, Status: spotify.TrackFailed,
+				Code: spotify.CodeDownloadFailed, Reason: "yt-dlp failed"})
+			report.Failed++
+			continue
+		}
+		onUpdate(spotify.TrackUpdate{Index: i, Track: track, Status: spotify.TrackDone, YouTubeID: "yt" + track.Title})
+		report.Saved++
+	}
+	return report, nil
+}
+
+func waitForJob(t *testing.T, m *jobs.Manager, id string, want jobs.Status) jobs.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == want {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := m.Get(id)
+	t.Fatalf("job %s stayed %s, want %s", id, job.Status, want)
+	return job
+}
+
+func TestDownloadJobRunsAndPersists(t *testing.T) {
+	store := jobs.NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	dl := &fakeDownloader{tracks: []spotify.Track{{Title: "one", Artist: "A"}, {Title: "fail", Artist: "B"}}}
+
+	m, err := jobs.NewManager(store, dl, jobs.ManagerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, unsubscribe := m.Subscribe("")
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	queued, err := m.Enqueue("https://open.spotify.com/playlist/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJob(t, m, queued.ID, jobs.StatusDone)
+	if job.Saved != 1 || job.Failed != 1 || job.Attempts != 1 {
+		t.Errorf("expected 1 saved and 1 failed on attempt 1, got %d/%d on attempt %d", job.Saved, job.Failed, job.Attempts)
+	}
+	if job.Tracks[0].Status != spotify.TrackDone || job.Tracks[0].YouTubeID != "ytone" {
+		t.Errorf("unexpected first track %+v", job.Tracks[0])
+	}
+	if job.Tracks[1].Status != spotify.TrackFailed || job.Tracks[1].Code != spotify.CodeDownloadFailed {
+		t.Errorf("unexpected second track %+v", job.Tracks[1])
+	}
+
+	trackEvents := 0
+	for len(events) > 0 {
+		if e := <-events; e.TrackIndex >= 0 {
+			trackEvents++
+		}
+	}
+	if trackEvents != 6 {
+		t.Errorf("expected 6 track events, got %d", trackEvents)
+	}
+
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Status != jobs.StatusDone || len(saved[0].Tracks) != 2 {
+		t.Errorf("store does not hold the finished job: %+v", saved)
+	}
+}
+
+func TestDownloadJobRequeuedAfterRestart(t *testing.T) {
+	store := jobs.NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	err := store.Save([]jobs.Job{
+		{ID: "a", URL: "u", Status: jobs.StatusRunning, CreatedAt: time.Now()},
+		{ID: "b", URL: "u", Status: jobs.StatusDone, CreatedAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := jobs.NewManager(store, &fakeDownloader{tracks: []spotify.Track{{Title: "one"}}}, jobs.ManagerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := m.Get("a"); job.Status != jobs.StatusQueued {
+		t.Fatalf("interrupted job should be queued again, got %s", job.Status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	waitForJob(t, m, "a", jobs.StatusDone)
+	if job, _ := m.Get("b"); job.Attempts != 0 {
+		t.Errorf("finished job must not run again")
+	}
+}
+
+func TestDownloadJobCancelAndRetry(t *testing.T) {
+	store := jobs.NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	dl := &fakeDownloader{tracks: []spotify.Track{{Title: "one"}}, block: true}
+
+	m, err := jobs.NewManager(store, dl, jobs.ManagerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling before any worker runs drops it from the queue
+	queued, _ := m.Enqueue("first")
+	if job, err := m.Cancel(queued.ID); err != nil || job.Status != jobs.StatusCancelled {
+		t.Fatalf("cancel queued: %v %+v", err, job)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	running, _ := m.Enqueue("second")
+	waitForJob(t, m, running.ID, jobs.StatusRunning)
+	if _, err := m.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, m, running.ID, jobs.StatusCancelled)
+
+	if _, err := m.Cancel(running.ID); !errors.Is(err, jobs.ErrFinished) {
+		t.Errorf("expected ErrFinished, got %v", err)
+	}
+
+	dl.block = false
+	if _, err := m.Retry(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, m, running.ID, jobs.StatusDone)
+	if job.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", job.Attempts)
+	}
+
+	if _, err := m.Retry(running.ID); !errors.Is(err, jobs.ErrNotRetryable) {
+		t.Errorf("expected ErrNotRetryable, got %v", err)
+	}
+
+	failed, _ := m.Enqueue("bad")
+	job = waitForJob(t, m, failed.ID, jobs.StatusFailed)
+	if job.Error != "no such playlist" {
+		t.Errorf("unexpected error %q", job.Error)
+	}
+}
+
+func TestDownloadJobsPruneOldFinishedJobs(t *testing.T) {
+	store := jobs.NewFileStore(filepath.Join(t.TempDir(), "jobs.json"))
+	now := time.Now()
+	err := store.Save([]jobs.Job{
+		{ID: "old", URL: "u", Status: jobs.StatusDone, CreatedAt: now, UpdatedAt: now.Add(-3 * time.Hour)},
+		{ID: "older", URL: "u", Status: jobs.StatusFailed, CreatedAt: now, UpdatedAt: now.Add(-4 * time.Hour)},
+		{ID: "recent", URL: "u", Status: jobs.StatusCancelled, CreatedAt: now, UpdatedAt: now.Add(-time.Hour)},
+		{ID: "waiting", URL: "u", Status: jobs.StatusQueued, CreatedAt: now, UpdatedAt: now.Add(-5 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := jobs.NewManager(store, &fakeDownloader{tracks: []spotify.Track{{Title: "one"}}}, jobs.ManagerOptions{KeepFinished: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("older"); err != jobs.ErrNotFound {
+		t.Fatalf("the oldest finished job was kept: %v", err)
+	}
+	for _, id := range []string{"old", "recent", "waiting"} {
+		if _, err := m.Get(id); err != nil {
+			t.Fatalf("job %s: %v", id, err)
+		}
+	}
+
+	// finishing the queued job pushes out the next oldest
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	waitForJob(t, m, "waiting", jobs.StatusDone)
+
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, job := range saved {
+		ids = append(ids, job.ID)
+	}
+	if len(saved) != 2 || saved[0].ID == "old" || saved[1].ID == "old" {
+		t.Fatalf("store holds %v", ids)
+	}
+}
@@ -0,0 +1,110 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"shazoom/jobs"
+	"shazoom/spotify"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleReport() *spotify.DownloadReport {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return &spotify.DownloadReport{
+		Source:     "https://open.spotify.com/playlist/x",
+		StartedAt:  start,
+		FinishedAt: start.Add(42 * time.Second),
+		Saved:      1,
+		Skipped:    1,
+		Failed:     1,
+		Tracks: []spotify.TrackResult{
+			{Index: 0, Title: "One", Artist: "A", Status: spotify.TrackDone, YouTubeID: "abc"},
+			{Index: 1, Title: "Two", Artist: "B", Status: spotify.TrackSkipped, Code: spotify.CodeAlreadyExists},
+			{Index: 2, Title: "Three", Artist: "C", Status: spotify.TrackFailed, Code: spotify.CodeLoginRequired,
+				Reason: "sign in to confirm your age\nfull yt-dlp output"},
+		},
+	}
+}
+
+func TestDownloadReportPrintTable(t *testing.T) {
+	var buf bytes.Buffer
+	sampleReport().PrintTable(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		"abc",
+		"already_exists",
+		"login_required: sign in to confirm your age",
+		"1 saved, 1 skipped, 1 failed (42s)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("table is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "full yt-dlp output") {
+		t.Errorf("table should only show the first line of a reason:\n%s", out)
+	}
+}
+
+func TestDownloadReportWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports", "import.json")
+	if err := sampleReport().WriteJSON(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got spotify.DownloadReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Tracks) != 3 || got.Tracks[1].Code != spotify.CodeAlreadyExists || got.Source == "" {
+		t.Errorf("report did not round-trip: %+v", got)
+	}
+}
+
+func TestDownloadJobWritesReport(t *testing.T) {
+	dir := t.TempDir()
+	store := jobs.NewFileStore(filepath.Join(dir, "jobs.json"))
+	dl := &fakeDownloader{tracks: []spotify.Track{{Title: "one"}}}
+
+	m, err := jobs.NewManager(store, dl, jobs.ManagerOptions{ReportDir: filepath.Join(dir, "reports")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	queued, _ := m.Enqueue("https://open.spotify.com/track/x")
+	waitForJob(t, m, queued.ID, jobs.StatusDone)
+
+	// the report is written just after the job is marked done
+	path := filepath.Join(dir, "reports", queued.ID+".json")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var report spotify.DownloadReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Source != queued.URL || report.Saved != 1 {
+				t.Errorf("unexpected job report %+v", report)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job report was not written: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/spotify"
+	"testing"
+)
+
+func writeLibraryFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalLibrarySource(t *testing.T) {
+	root := t.TempDir()
+	writeLibraryFile(t, root, "Daft Punk/Discovery/Daft Punk - One More Time.flac", "one more time")
+	writeLibraryFile(t, root, "misc/track01.mp3", "tagged")
+	writeLibraryFile(t, root, "misc/notes.txt", "not audio")
+
+	src := spotify.NewLocalLibrarySource(root)
+	src.ReadTags = func(path string) (string, string, error) {
+		if filepath.Base(path) == "track01.mp3" {
+			return "Get Lucky", "Daft Punk", nil
+		}
+		return "", "", errors.New("no tags")
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		track spotify.Track
+		want  string
+	}{
+		// untagged, matched by its file name regardless of case and punctuation
+		{spotify.Track{Title: "One more time!", Artist: "DAFT PUNK"}, "Daft Punk/Discovery/Daft Punk - One More Time.flac"},
+		// tagged, matched on a featured artist
+		{spotify.Track{Title: "Get Lucky", Artist: "Pharrell Williams", Artists: []string{"Pharrell Williams", "Daft Punk"}}, "misc/track01.mp3"},
+	}
+	for _, tt := range tests {
+		id, err := src.Search(ctx, tt.track)
+		if err != nil {
+			t.Errorf("%s: %v", tt.track.Title, err)
+			continue
+		}
+		if id != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.track.Title, id, tt.want)
+		}
+	}
+
+	if _, err := src.Search(ctx, spotify.Track{Title: "notes", Artist: ""}); !errors.Is(err, spotify.ErrNoMatch) {
+		t.Errorf("expected ErrNoMatch for a non-audio file, got %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "One More Time - Daft Punk")
+	path, err := src.Download(ctx, tests[0].want, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); path != dest+".flac" || string(data) != "one more time" {
+		t.Errorf("downloaded %s with %q", path, data)
+	}
+
+	if _, err := src.Download(ctx, "../outside.wav", dest); err == nil {
+		t.Error("expected paths outside the library to be refused")
+	}
+}
+
+func TestLocalLibrarySourceRescansAfterCancellation(t *testing.T) {
+	root := t.TempDir()
+	writeLibraryFile(t, root, "Daft Punk - Voyager.mp3", "voyager")
+	src := spotify.NewLocalLibrarySource(root)
+	track := spotify.Track{Title: "Voyager", Artist: "Daft Punk"}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := src.Search(cancelled, track); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled scan to fail, got %v", err)
+	}
+
+	id, err := src.Search(context.Background(), track)
+	if err != nil || id != "Daft Punk - Voyager.mp3" {
+		t.Fatalf("after a cancelled scan: got %q, %v", id, err)
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Daft Punk/Digital Love.mp3" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodGet {
+			w.Write([]byte("mp3 data"))
+		}
+	}))
+	defer server.Close()
+
+	src := &spotify.HTTPSource{URLTemplate: server.URL + "/{artist}/{title}.mp3"}
+	ctx := context.Background()
+
+	id, err := src.Search(ctx, spotify.Track{Title: "Digital Love", Artist: "Daft Punk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != server.URL+"/Daft%20Punk/Digital%20Love.mp3" {
+		t.Errorf("unexpected id %q", id)
+	}
+
+	dest := filepath.Join(t.TempDir(), "Digital Love - Daft Punk")
+	path, err := src.Download(ctx, id, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); path != dest+".mp3" || string(data) != "mp3 data" {
+		t.Errorf("downloaded %s with %q", path, data)
+	}
+
+	if _, err := src.Search(ctx, spotify.Track{Title: "Missing", Artist: "Daft Punk"}); !errors.Is(err, spotify.ErrNoMatch) {
+		t.Errorf("expected ErrNoMatch, got %v", err)
+	}
+}
+
+func TestHTTPSourceWithoutHead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path != "/Digital Love.mp3":
+			http.NotFound(w, r)
+		case r.Header.Get("Range") != "bytes=0-0":
+			t.Errorf("probe asked for range %q", r.Header.Get("Range"))
+		default:
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("m"))
+		}
+	}))
+	defer server.Close()
+
+	src := &spotify.HTTPSource{URLTemplate: server.URL + "/{title}.mp3"}
+	ctx := context.Background()
+
+	if id, err := src.Search(ctx, spotify.Track{Title: "Digital Love"}); err != nil || id != server.URL+"/Digital%20Love.mp3" {
+		t.Errorf("got %q, %v", id, err)
+	}
+	if _, err := src.Search(ctx, spotify.Track{Title: "Missing"}); !errors.Is(err, spotify.ErrNoMatch) {
+		t.Errorf("expected ErrNoMatch, got %v", err)
+	}
+}
+
+func TestDownloadTracksFromSources(t *testing.T) {
+	root := t.TempDir()
+	writeLibraryFile(t, root, "Daft Punk - Aerodynamic.wav", "aerodynamic")
+
+	memDB := NewMemoryDB()
+	// indexed before under another title, but from the same library file
+	if _, err := memDB.RegisterSongFromSource("Aerodynamic (Remastered)", "Daft Punk", db.SourceLocal, "Daft Punk - Aerodynamic.wav"); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := []spotify.Track{
+		{Title: "Aerodynamic", Artist: "Daft Punk"},
+		{Title: "Veridis Quo", Artist: "Daft Punk"},
+	}
+	sources := []spotify.AudioSource{
+		spotify.NewLocalLibrarySource(root),
+		&spotify.HTTPSource{URLTemplate: "http://127.0.0.1:1/{title}", Client: &http.Client{}},
+	}
+
+	report, err := spotify.DownloadTracksFrom(context.Background(), sources, tracks, t.TempDir(), memDB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := report.Tracks[0]; got.Status != spotify.TrackSkipped || got.Code != spotify.CodeDuplicateSource {
+		t.Errorf("expected the library duplicate to be skipped, got %+v", got)
+	}
+	// no source has the second track: the library has no match and the HTTP
+	// server is unreachable
+	if got := report.Tracks[1]; got.Status != spotify.TrackFailed || got.Source != "" {
+		t.Errorf("expected the second track to fail, got %+v", got)
+	}
+	if report.Skipped != 1 || report.Failed != 1 {
+		t.Errorf("unexpected totals %+v", report)
+	}
+
+	// a source that cannot be reached is not a database failure
+	report, err = spotify.DownloadTracksFrom(context.Background(), sources[1:], tracks[1:], t.TempDir(), memDB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Tracks[0]; got.Status != spotify.TrackFailed || got.Code != spotify.CodeSourceFailed {
+		t.Errorf("expected a source failure, got %+v", got)
+	}
+}
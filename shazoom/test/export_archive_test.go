@@ -0,0 +1,172 @@
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/models"
+	"testing"
+)
+
+// flakyDB fails StoreFingerprints once after a set number of successful calls.
+type flakyDB struct {
+	*MemoryDB
+	failAfter int
+	calls     int
+}
+
+func (f *flakyDB) StoreFingerprints(fingerprints map[int64]models.Couple) error {
+	f.calls++
+	if f.calls == f.failAfter+1 {
+		return errors.New("connection reset")
+	}
+	return f.MemoryDB.StoreFingerprints(fingerprints)
+}
+
+func seedCatalogue(t *testing.T, songs int) *MemoryDB {
+	t.Helper()
+	src := NewMemoryDB()
+	for i := 0; i < songs; i++ {
+		songID, err := src.RegisterSong("Song "+string(rune('A'+i)), "Band", "")
+		if err != nil {
+			t.Fatalf("RegisterSong failed: %v", err)
+		}
+		fingerprints := make(map[int64]models.Couple)
+		for j := 0; j < 200; j++ {
+			fingerprints[int64(j*7+i)] = models.Couple{AnchorTime: uint32(j * 100), SongId: songID}
+		}
+		_ = src.StoreFingerprints(fingerprints)
+	}
+	return src
+}
+
+func countFingerprints(t *testing.T, client db.DBClient) int {
+	t.Helper()
+	n := 0
+	_ = client.IterateFingerprints(func(int64, models.Couple) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+func TestArchiveRoundTripSkipsExistingSongs(t *testing.T) {
+	src := seedCatalogue(t, 5)
+
+	var archive bytes.Buffer
+	stats, err := db.ExportArchive(&archive, src, 1)
+	if err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+	if stats.Songs != 5 || stats.Fingerprints != 1000 {
+		t.Fatalf("unexpected export stats %+v", stats)
+	}
+
+	dst := NewMemoryDB()
+	if _, err := dst.RegisterSong("Song C", "Band", ""); err != nil {
+		t.Fatalf("RegisterSong failed: %v", err)
+	}
+
+	imported, err := db.ImportArchive(bytes.NewReader(archive.Bytes()), dst, db.ArchiveImportOptions{FingerprintVersion: 1})
+	if err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+	if imported.SongsImported != 4 || imported.SongsSkipped != 1 || imported.Fingerprints != 800 {
+		t.Fatalf("unexpected import stats %+v", imported)
+	}
+	if n := countFingerprints(t, dst); n != 800 {
+		t.Fatalf("expected 800 stored fingerprints, got %d", n)
+	}
+
+	_, err = db.ImportArchive(bytes.NewReader(archive.Bytes()), NewMemoryDB(), db.ArchiveImportOptions{FingerprintVersion: 2})
+	if err == nil {
+		t.Fatal("expected a fingerprint version mismatch error")
+	}
+}
+
+func TestArchiveImportResumes(t *testing.T) {
+	src := seedCatalogue(t, 5)
+
+	var archive bytes.Buffer
+	if _, err := db.ExportArchive(&archive, src, 1); err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+
+	progressPath := filepath.Join(t.TempDir(), "import.progress")
+	opts := db.ArchiveImportOptions{FingerprintVersion: 1, ProgressPath: progressPath, BatchSize: 50}
+
+	dst := &flakyDB{MemoryDB: NewMemoryDB(), failAfter: 3}
+	if _, err := db.ImportArchive(bytes.NewReader(archive.Bytes()), dst, opts); err == nil {
+		t.Fatal("expected the first import to fail")
+	}
+	if _, err := os.Stat(progressPath); err != nil {
+		t.Fatalf("expected a progress file after failure: %v", err)
+	}
+
+	stats, err := db.ImportArchive(bytes.NewReader(archive.Bytes()), dst, opts)
+	if err != nil {
+		t.Fatalf("resumed import failed: %v", err)
+	}
+	if !stats.Resumed || stats.SongsImported != 0 {
+		t.Fatalf("unexpected resume stats %+v", stats)
+	}
+
+	total, _ := dst.TotalSongs()
+	if total != 5 {
+		t.Fatalf("expected 5 songs, got %d", total)
+	}
+	if n := countFingerprints(t, dst); n != 1000 {
+		t.Fatalf("expected 1000 stored fingerprints, got %d", n)
+	}
+	if _, err := os.Stat(progressPath); !os.IsNotExist(err) {
+		t.Fatal("expected the progress file to be removed after completion")
+	}
+}
+
+// crashingRegisterDB registers a song and then fails, as a process killed
+// before it could record the new ID would.
+type crashingRegisterDB struct {
+	*MemoryDB
+	crashOn int
+	calls   int
+}
+
+func (c *crashingRegisterDB) RegisterSongFromSource(title, artist, source, sourceID string) (uint32, error) {
+	c.calls++
+	id, err := c.MemoryDB.RegisterSongFromSource(title, artist, source, sourceID)
+	if err == nil && c.calls == c.crashOn {
+		return 0, errors.New("killed")
+	}
+	return id, err
+}
+
+func TestArchiveImportAdoptsSongRegisteredBeforeCrash(t *testing.T) {
+	src := seedCatalogue(t, 5)
+
+	var archive bytes.Buffer
+	if _, err := db.ExportArchive(&archive, src, 1); err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+
+	opts := db.ArchiveImportOptions{FingerprintVersion: 1, ProgressPath: filepath.Join(t.TempDir(), "import.progress")}
+	dst := &crashingRegisterDB{MemoryDB: NewMemoryDB(), crashOn: 3}
+	if _, err := db.ImportArchive(bytes.NewReader(archive.Bytes()), dst, opts); err == nil {
+		t.Fatal("expected the first import to fail")
+	}
+
+	stats, err := db.ImportArchive(bytes.NewReader(archive.Bytes()), dst, opts)
+	if err != nil {
+		t.Fatalf("resumed import failed: %v", err)
+	}
+	if stats.SongsSkipped != 0 || stats.SongsImported != 3 {
+		t.Fatalf("unexpected resume stats %+v", stats)
+	}
+	if total, _ := dst.TotalSongs(); total != 5 {
+		t.Fatalf("expected 5 songs, got %d", total)
+	}
+	if n := countFingerprints(t, dst); n != 1000 {
+		t.Fatalf("expected 1000 stored fingerprints, got %d", n)
+	}
+}
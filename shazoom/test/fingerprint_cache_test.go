@@ -0,0 +1,84 @@
+package core_test
+
+import (
+	"shazoom/db"
+	"shazoom/models"
+	"testing"
+	"time"
+)
+
+// countingDB records how many addresses reach the wrapped backend.
+type countingDB struct {
+	*MemoryDB
+	lookups int
+}
+
+func (c *countingDB) GetCouples(addresses []int64) (map[int64][]models.Couple, error) {
+	c.lookups += len(addresses)
+	return c.MemoryDB.GetCouples(addresses)
+}
+
+func TestCachedClientHitsAndInvalidation(t *testing.T) {
+	backend := &countingDB{MemoryDB: NewMemoryDB()}
+	_ = backend.StoreFingerprints(map[int64]models.Couple{1: {AnchorTime: 10, SongId: 7}})
+
+	cache := db.NewCachedClient(backend, db.CacheOptions{MaxBytes: 1 << 20})
+
+	for i := 0; i < 3; i++ {
+		couples, err := cache.GetCouples([]int64{1, 2})
+		if err != nil {
+			t.Fatalf("GetCouples failed: %v", err)
+		}
+		if len(couples[1]) != 1 || len(couples[2]) != 0 {
+			t.Fatalf("unexpected couples %v", couples)
+		}
+	}
+
+	if backend.lookups != 2 {
+		t.Fatalf("expected 2 backend lookups, got %d", backend.lookups)
+	}
+	stats := cache.Stats()
+	if stats.Hits != 4 || stats.Misses != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// a write to a cached address must be visible on the next read
+	_ = cache.StoreFingerprints(map[int64]models.Couple{2: {AnchorTime: 20, SongId: 8}})
+	couples, _ := cache.GetCouples([]int64{2})
+	if len(couples[2]) != 1 {
+		t.Fatalf("stale cache entry after StoreFingerprints: %v", couples)
+	}
+
+	_ = cache.DeleteSongByID(7)
+	before := backend.lookups
+	_, _ = cache.GetCouples([]int64{1})
+	if backend.lookups != before+1 {
+		t.Fatal("expected DeleteSongByID to invalidate entries referencing the song")
+	}
+}
+
+func TestCachedClientBudgetAndTTL(t *testing.T) {
+	backend := &countingDB{MemoryDB: NewMemoryDB()}
+
+	// room for roughly ten empty entries
+	cache := db.NewCachedClient(backend, db.CacheOptions{MaxBytes: 1000})
+	addresses := make([]int64, 100)
+	for i := range addresses {
+		addresses[i] = int64(i)
+	}
+	_, _ = cache.GetCouples(addresses)
+
+	stats := cache.Stats()
+	if stats.Bytes > 1000 || stats.Evictions == 0 {
+		t.Fatalf("cache exceeded its budget: %+v", stats)
+	}
+
+	ttl := db.NewCachedClient(backend, db.CacheOptions{MaxBytes: 1 << 20, TTL: 10 * time.Millisecond})
+	_, _ = ttl.GetCouples([]int64{1})
+	time.Sleep(20 * time.Millisecond)
+	before := backend.lookups
+	_, _ = ttl.GetCouples([]int64{1})
+	if backend.lookups != before+1 {
+		t.Fatal("expected an expired entry to be fetched again")
+	}
+}
@@ -0,0 +1,185 @@
+package core_test
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"shazoom/core"
+	"shazoom/fileformat"
+	"shazoom/models"
+	"shazoom/utils"
+	"testing"
+)
+
+// syntheticSong is a few seconds of tones over noise, varying over time so
+// that every frame has peaks.
+func syntheticSong(frames, channels int, seed int64) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	song := make([][]float64, frames)
+	for i := range song {
+		song[i] = make([]float64, channels)
+		t := float64(i) / 44100
+		for c := range song[i] {
+			freq := 220 * math.Pow(2, float64((i/11025+c)%24)/12)
+			song[i][c] = 0.5*math.Sin(2*math.Pi*freq*t) +
+				0.2*math.Sin(2*math.Pi*(freq*2.5)*t) +
+				0.1*(rng.Float64()*2-1)
+		}
+	}
+	return song
+}
+
+// batchFingerprints is the pre-streaming GenerateFingerprints over a WAV file.
+func batchFingerprints(t *testing.T, path string, songID uint32) map[int64]models.Couple {
+	t.Helper()
+	info, err := fileformat.ReadWavInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := make(map[int64]models.Couple)
+	channels := [][]float64{info.LeftChannelSamples}
+	if info.Channels == 2 {
+		channels = append(channels, info.RightChannelSamples)
+	}
+	for _, samples := range channels {
+		spectro, err := core.Spectrogram(samples, info.SampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peaks := core.ExtractPeaks(spectro, info.Duration, info.SampleRate)
+		utils.ExtendMap(fingerprints, core.Fingerprint(peaks, songID))
+	}
+	return fingerprints
+}
+
+// hopTimedFingerprints fingerprints each channel as a StreamFingerprinter,
+// timing frames by the hop size, and combines them left channel first.
+func hopTimedFingerprints(t *testing.T, channels [][]float64, sampleRate int, songID uint32) map[int64]models.Couple {
+	t.Helper()
+	fingerprints := make(map[int64]models.Couple)
+	for _, samples := range channels {
+		fp, err := core.NewStreamFingerprinter(sampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anchors := make(map[int64]uint32)
+		fp.Write(samples, anchors)
+		for address, anchor := range anchors {
+			fingerprints[address] = models.Couple{AnchorTime: anchor, SongId: songID}
+		}
+	}
+	return fingerprints
+}
+
+func TestFingerprintWavMatchesBatch(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		fixture wavFixture
+		frames  int
+	}{
+		{"mono 16-bit", wavFixture{format: 1, channels: 1, bits: 16, rate: 44100}, 3*44100 + 3},
+		{"stereo 16-bit", wavFixture{format: 1, channels: 2, bits: 16, rate: 44100}, 3*44100 + 1},
+		{"5.1 float downmix", wavFixture{format: fileformat.WaveFormatExtensible, subFormat: 3, channels: 6, bits: 32, rate: 48000}, 2 * 48000},
+		{"shorter than one frame", wavFixture{format: 1, channels: 1, bits: 16, rate: 44100}, 1000},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.fixture.build(syntheticSong(tt.frames, tt.fixture.channels, int64(i)))
+			path := filepath.Join(dir, tt.name+".wav")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			want := batchFingerprints(t, path, 7)
+			got, err := core.FingerprintWav(bytes.NewReader(data), 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.frames > 44100 && len(want) == 0 {
+				t.Fatal("the fixture produced no fingerprints")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("streaming produced %d fingerprints, batch %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// Without a data size in the header, peaks are hashed as they are found and
+// timed by the hop size.
+func TestFingerprintWavStreamedWithoutSizes(t *testing.T) {
+	fixture := wavFixture{format: 1, channels: 2, bits: 16, rate: 44100, streaming: true}
+	data := fixture.build(syntheticSong(2*44100, 2, 5))
+	path := filepath.Join(t.TempDir(), "streamed.wav")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fileformat.ReadWavInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := hopTimedFingerprints(t, [][]float64{info.LeftChannelSamples, info.RightChannelSamples}, 44100, 7)
+	got, err := core.FingerprintWav(bytes.NewReader(data), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		t.Fatal("the fixture produced no fingerprints")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("streaming produced %d fingerprints, want %d", len(got), len(want))
+	}
+}
+
+func TestFingerprintPipelineChunking(t *testing.T) {
+	song := syntheticSong(4*44100+17, 1, 42)
+	samples := make([]float64, len(song))
+	for i, frame := range song {
+		samples[i] = frame[0]
+	}
+
+	batch, err := core.GenerateFingerprintsFromSamples(samples, 44100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, total := range []int64{int64(len(samples)), -1} {
+		want := batch
+		if total < 0 {
+			want = hopTimedFingerprints(t, [][]float64{samples}, 44100, 3)
+		}
+		p, err := core.NewFingerprintPipeline(44100, total, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// chunks of every size, down to single samples
+		rng := rand.New(rand.NewSource(total))
+		for rest := samples; len(rest) > 0; {
+			n := min(len(rest), 1+rng.Intn(5000))
+			p.Push(rest[:n])
+			rest = rest[n:]
+		}
+
+		got, err := p.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("total %d: pipeline produced %d fingerprints, want %d", total, len(got), len(want))
+		}
+	}
+
+	p, _ := core.NewFingerprintPipeline(44100, int64(len(samples)), 3)
+	p.Push(samples[:1000])
+	if _, err := p.Finish(); err == nil {
+		t.Fatal("expected an error when fewer samples than announced are pushed")
+	}
+}
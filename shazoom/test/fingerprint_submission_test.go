@@ -0,0 +1,208 @@
+package core_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"shazoom/core"
+	"shazoom/fileformat"
+	"shazoom/utils"
+	"testing"
+	"time"
+)
+
+// clientPCM converts samples the way floatTo16BitPCM in the web client does.
+func clientPCM(samples []float64) []byte {
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		s = max(-1, min(1, s))
+		if s < 0 {
+			s *= 0x8000
+		} else {
+			s *= 0x7FFF
+		}
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(s)))
+	}
+	return pcm
+}
+
+func TestFingerprintSubmissionMatchesUpload(t *testing.T) {
+	song := syntheticSong(5*48000, 1, 7)
+	samples := make([]float64, len(song))
+	for i, frame := range song {
+		samples[i] = frame[0]
+	}
+
+	submission, err := core.FingerprintSubmission(samples, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submission.Config != core.CurrentFingerprintConfig() {
+		t.Fatalf("config %+v", submission.Config)
+	}
+
+	// what handleNewRecording computes for the same recording uploaded
+	stream, err := fileformat.DecodeRecording(context.Background(), clientPCM(samples), 48000, 1, 16, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	uploaded, err := core.FingerprintPCM(stream, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sample, err := submission.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submission.Hashes) != len(uploaded) || len(sample) != len(uploaded) {
+		t.Fatalf("%d hashes submitted, %d computed from the upload", len(submission.Hashes), len(uploaded))
+	}
+	for address, couple := range uploaded {
+		if anchor, ok := sample[address]; !ok || anchor != couple.AnchorTime {
+			t.Fatalf("address %d: submitted anchor %d, want %d", address, anchor, couple.AnchorTime)
+		}
+	}
+	for i := 1; i < len(submission.Hashes); i++ {
+		if submission.Hashes[i].AnchorTime < submission.Hashes[i-1].AnchorTime {
+			t.Fatal("hashes are not in time order")
+		}
+	}
+
+	memDB := NewMemoryDB()
+	songID, _ := memDB.RegisterSong("Synthetic", "Test", "")
+	catalogue, err := core.GenerateFingerprintsFromSamples(samples, 48000, songID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memDB.StoreFingerprints(catalogue)
+	matches, _, err := core.FindMatchesUsingFingerPrints(sample, memDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongId != songID {
+		t.Fatalf("matched %+v", matches)
+	}
+}
+
+func TestSubmissionSample(t *testing.T) {
+	config := core.CurrentFingerprintConfig()
+
+	sample, err := core.Submission{Config: config, Hashes: []core.Hash{
+		{Address: 42, AnchorTime: 900},
+		{Address: 42, AnchorTime: 100},
+		{Address: 1<<32 - 1, AnchorTime: 0},
+	}}.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sample) != 2 || sample[42] != 900 {
+		t.Fatalf("sample %v", sample)
+	}
+
+	old := config
+	old.Version--
+	if _, err := (core.Submission{Config: old, Hashes: []core.Hash{{Address: 1}}}).Sample(); !errors.Is(err, core.ErrConfigMismatch) {
+		t.Fatalf("old version: got %v", err)
+	}
+	rate := config
+	rate.SampleRate = 48000
+	if _, err := (core.Submission{Config: rate, Hashes: []core.Hash{{Address: 1}}}).Sample(); !errors.Is(err, core.ErrConfigMismatch) {
+		t.Fatalf("other sample rate: got %v", err)
+	}
+
+	tooLate := uint32(core.MaxSubmittedDuration.Milliseconds()) + 1
+	for name, hashes := range map[string][]core.Hash{
+		"none":             nil,
+		"too many":         make([]core.Hash, core.MaxSubmittedHashes+1),
+		"negative address": {{Address: -1}},
+		"wide address":     {{Address: 1 << 32}},
+		"late anchor":      {{Address: 1, AnchorTime: tooLate}},
+	} {
+		if _, err := (core.Submission{Config: config, Hashes: hashes}).Sample(); !errors.Is(err, core.ErrInvalidHashes) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := utils.NewRateLimiter(0.001, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.Allow("10.0.0.1"); got != want {
+			t.Fatalf("request %d: allowed %v", i, got)
+		}
+	}
+	if !limiter.Allow("10.0.0.2") {
+		t.Fatal("another client was limited")
+	}
+
+	fast := utils.NewRateLimiter(1000, 1)
+	fast.Allow("client")
+	if fast.Allow("client") {
+		t.Fatal("burst exceeded")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !fast.Allow("client") {
+		t.Fatal("bucket did not refill")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := utils.NewTokenBucket(200, 1)
+	ctx := context.Background()
+	start := time.Now()
+	for range 3 {
+		if err := bucket.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first token is there, the other two are 5ms apart
+	if elapsed := time.Since(start); elapsed < 9*time.Millisecond {
+		t.Fatalf("3 tokens in %v", elapsed)
+	}
+
+	slow := utils.NewTokenBucket(0.001, 1)
+	slow.Allow()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := slow.Wait(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := utils.ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		// not a proxy: what it says is ignored
+		{"203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"192.168.1.1:5000", "198.51.100.1", "198.51.100.1"},
+		// a client's own entry ahead of the proxies cannot spoof its address
+		{"10.1.2.3:5000", "1.2.3.4, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"10.1.2.3:5000", "", "10.1.2.3"},
+		{"10.1.2.3:5000", "garbage", "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:5000", "198.51.100.1", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.forwarded != "" {
+			header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := proxies.ClientIP(tt.remote, header); got != tt.want {
+			t.Errorf("%s with %q: got %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+
+	if got := utils.TrustedProxies(nil).ClientIP("10.1.2.3:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}); got != "10.1.2.3" {
+		t.Errorf("no trusted proxies: got %s", got)
+	}
+	if _, err := utils.ParseTrustedProxies("10.0.0.0/40"); err == nil {
+		t.Error("accepted an invalid range")
+	}
+}
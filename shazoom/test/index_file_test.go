@@ -0,0 +1,147 @@
+package core_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"shazoom/db"
+	"shazoom/models"
+	"sort"
+	"testing"
+)
+
+func TestIndexFileRoundTrip(t *testing.T) {
+	src := NewMemoryDB()
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		songID, err := src.RegisterSong(
+			"Title "+string(rune('A'+i)), "Artist", "yt"+string(rune('a'+i)),
+		)
+		if err != nil {
+			t.Fatalf("RegisterSong failed: %v", err)
+		}
+
+		fingerprints := make(map[int64]models.Couple)
+		for j := 0; j < 500; j++ {
+			// a small address space forces shared posting lists across songs
+			address := int64(rng.Intn(3000))
+			fingerprints[address] = models.Couple{AnchorTime: uint32(rng.Intn(300000)), SongId: songID}
+		}
+		if err := src.StoreFingerprints(fingerprints); err != nil {
+			t.Fatalf("StoreFingerprints failed: %v", err)
+		}
+	}
+
+	localID, err := src.RegisterSongFromSource("Local", "Artist", db.SourceLocal, "albums/local.flac")
+	if err != nil {
+		t.Fatalf("RegisterSongFromSource failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "catalogue.idx")
+	if err := db.WriteIndexFile(path, src); err != nil {
+		t.Fatalf("WriteIndexFile failed: %v", err)
+	}
+
+	idx, err := db.OpenIndexClient(path)
+	if err != nil {
+		t.Fatalf("OpenIndexClient failed: %v", err)
+	}
+	defer idx.Close()
+
+	addresses := make([]int64, 0, 3100)
+	for a := int64(-50); a < 3050; a++ {
+		addresses = append(addresses, a)
+	}
+
+	want, _ := src.GetCouples(addresses)
+	got, err := idx.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples failed: %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d addresses, got %d", len(want), len(got))
+	}
+	for address, couples := range want {
+		sortCouples(couples)
+		if !reflect.DeepEqual(couples, got[address]) {
+			t.Fatalf("address %d: expected %v, got %v", address, couples, got[address])
+		}
+	}
+
+	total, _ := idx.TotalSongs()
+	if total != 21 {
+		t.Fatalf("expected 21 songs, got %d", total)
+	}
+
+	song, exists, err := idx.GetSongByKey("Title C___Artist")
+	if err != nil || !exists || song.YouTubeID != "ytc" {
+		t.Fatalf("GetSongByKey returned %+v, %v, %v", song, exists, err)
+	}
+
+	song, exists, err = idx.GetSongBySource(db.SourceLocal, "albums/local.flac")
+	if err != nil || !exists || song.ID != localID || song.YouTubeID != "" {
+		t.Fatalf("GetSongBySource returned %+v, %v, %v", song, exists, err)
+	}
+	song, exists, _ = idx.GetSongBySource(db.SourceYouTube, "ytc")
+	if !exists || song.Title != "Title C" {
+		t.Fatalf("expected the YouTube song to be found by source, got %+v", song)
+	}
+
+	if _, err := idx.RegisterSong("x", "y", "z"); !errors.Is(err, db.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func sortCouples(couples []models.Couple) {
+	sort.Slice(couples, func(i, j int) bool {
+		if couples[i].SongId != couples[j].SongId {
+			return couples[i].SongId < couples[j].SongId
+		}
+		return couples[i].AnchorTime < couples[j].AnchorTime
+	})
+}
+
+func TestIndexFileRejectsCorruptDirectory(t *testing.T) {
+	src := NewMemoryDB()
+	songID, _ := src.RegisterSong("Title", "Artist", "yt")
+	fingerprints := make(map[int64]models.Couple)
+	for address := int64(0); address < 5000; address++ {
+		fingerprints[address] = models.Couple{AnchorTime: uint32(address), SongId: songID}
+	}
+	if err := src.StoreFingerprints(fingerprints); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "catalogue.idx")
+	if err := db.WriteIndexFile(path, src); err != nil {
+		t.Fatalf("WriteIndexFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory closes the file; point its last block past the end
+	corrupt := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(corrupt[len(corrupt)-8:], uint64(len(corrupt))*2)
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := db.OpenIndexClient(path); err == nil {
+		idx.Close()
+		t.Fatal("opened an index whose directory points past the file")
+	}
+
+	if err := os.WriteFile(path, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := db.OpenIndexClient(path); err == nil {
+		idx.Close()
+		t.Fatal("opened a truncated index")
+	}
+}
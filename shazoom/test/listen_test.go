@@ -0,0 +1,84 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"shazoom/capture"
+	"shazoom/core"
+	"shazoom/fileformat"
+	"testing"
+	"time"
+)
+
+func TestListenToFile(t *testing.T) {
+	memDB := newStreamCatalogue(t)
+
+	// 12s of the third song, played into a "microphone"
+	excerpt := synthTrack(3, 40)[5*streamSampleRate : 17*streamSampleRate]
+	path := filepath.Join(t.TempDir(), "room.wav")
+	if err := fileformat.WriteWavFile(path, s16le(excerpt), streamSampleRate, 1, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := capture.OpenFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	rec, err := core.NewStreamRecognizer(src.SampleRate(), memDB, core.DefaultStreamOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := 0
+	result, err := capture.Listen(context.Background(), src, rec, func(core.StreamResult) { updates++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Confident || result.Matches[0].SongTitle != "Third" {
+		t.Fatalf("result %+v", result)
+	}
+	if result.Audio >= 12*time.Second || updates == 0 {
+		t.Fatalf("listened to %v in %d updates, want an early stop", result.Audio, updates)
+	}
+}
+
+func TestFileDeviceIsPaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tone.wav")
+	if err := fileformat.WriteWavFile(path, s16le(synthTrack(1, 1)), streamSampleRate, 1, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second of audio at ten times real time
+	src, err := capture.OpenFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	start := time.Now()
+	rec, _ := core.NewStreamRecognizer(src.SampleRate(), NewMemoryDB(), core.DefaultStreamOptions)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := capture.Listen(ctx, src, rec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("replayed %v of audio in %v", result.Audio, elapsed)
+	}
+	if !result.Done || result.Audio != time.Second {
+		t.Fatalf("result %+v", result)
+	}
+}
+
+func TestOpenDevice(t *testing.T) {
+	if _, err := capture.Open("file:" + filepath.Join(t.TempDir(), "missing.wav")); err == nil {
+		t.Fatal("opened a missing file")
+	}
+	// sound card input needs the portaudio build tag
+	if _, err := capture.Open("default"); !errors.Is(err, capture.ErrNoPortAudio) {
+		t.Fatalf("got %v", err)
+	}
+}
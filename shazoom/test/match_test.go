@@ -1,7 +1,13 @@
+//go:build portaudio
+
+// The tests here record from the microphone, so they only build with the
+// portaudio tag: go test -tags portaudio ./test
+
 package core_test
 
 import (
     "bytes"
+    "context"
     "encoding/binary"
     "fmt"
     "os"
@@ -89,22 +95,16 @@ func TestMatching(t *testing.T) {
         t.Log("Cleanup: Deleted raw_recording.wav")
     }()
 
-    reformatedWavFile, err := fileformat.ReformatWav(rawWavPath, CHANNELS)
+    stream, err := fileformat.DecodeFile(context.Background(), rawWavPath, fileformat.DecodeOptions{Channels: CHANNELS})
     if err != nil {
-        t.Fatalf("Failed to reformat WAV: %v", err)
+        t.Fatalf("Failed to decode WAV: %v", err)
     }
+    defer stream.Close()
 
-    defer func() {
-        os.Remove(reformatedWavFile)
-        t.Log("Cleanup: Deleted reformatted .wav file")
-    }()
-
-    wavInfo, err := fileformat.ReadWavInfo(reformatedWavFile)
+    finalSamples, err := stream.ReadAll()
     if err != nil {
-        t.Fatalf("Failed to read reformatted WAV info: %v", err)
+        t.Fatalf("Failed to read decoded samples: %v", err)
     }
-
-    finalSamples := wavInfo.LeftChannelSamples
     audioDuration := float64(len(finalSamples)) / float64(sampleRate)
 
     matches, matchTime, err := core.FindMatches(finalSamples, audioDuration, sampleRate)
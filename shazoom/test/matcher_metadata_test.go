@@ -0,0 +1,91 @@
+package core_test
+
+import (
+	"shazoom/core"
+	"shazoom/db"
+	"shazoom/models"
+	"testing"
+)
+
+// metadataCountingDB counts song metadata round trips.
+type metadataCountingDB struct {
+	*MemoryDB
+	single, batch, batchIDs int
+}
+
+func (m *metadataCountingDB) GetSongByID(songID uint32) (db.Song, bool, error) {
+	m.single++
+	return m.MemoryDB.GetSongByID(songID)
+}
+
+func (m *metadataCountingDB) GetSongsByIDs(songIDs []uint32) (map[uint32]db.Song, error) {
+	m.batch++
+	m.batchIDs += len(songIDs)
+	return m.MemoryDB.GetSongsByIDs(songIDs)
+}
+
+// noisyCatalogue stores 50 songs; song i shares i+1 time-aligned addresses
+// with the returned sample, so the last song is the best match.
+func noisyCatalogue(t *testing.T) (*metadataCountingDB, map[int64]uint32, uint32) {
+	t.Helper()
+	client := &metadataCountingDB{MemoryDB: NewMemoryDB()}
+	sample := make(map[int64]uint32)
+
+	var best uint32
+	for i := 0; i < 50; i++ {
+		songID, err := client.RegisterSong("Song", string(rune('A'+i)), "")
+		if err != nil {
+			t.Fatalf("RegisterSong failed: %v", err)
+		}
+		fingerprints := make(map[int64]models.Couple)
+		for j := 0; j <= i; j++ {
+			address := int64(i*1000 + j)
+			sample[address] = uint32(j * 100)
+			fingerprints[address] = models.Couple{AnchorTime: uint32(5000 + j*100), SongId: songID}
+		}
+		_ = client.StoreFingerprints(fingerprints)
+		best = songID
+	}
+	return client, sample, best
+}
+
+func TestMatcherResolvesTopCandidatesInOneQuery(t *testing.T) {
+	client, sample, best := noisyCatalogue(t)
+
+	matches, _, err := core.FindMatchesUsingFingerPrints(sample, client)
+	if err != nil {
+		t.Fatalf("FindMatchesUsingFingerPrints failed: %v", err)
+	}
+
+	if len(matches) != core.MaxResolvedCandidates {
+		t.Fatalf("expected %d matches, got %d", core.MaxResolvedCandidates, len(matches))
+	}
+	if matches[0].SongId != best {
+		t.Fatalf("expected song %d first, got %+v", best, matches[0])
+	}
+	for i := 1; i < len(matches); i++ {
+		if matches[i].Score > matches[i-1].Score {
+			t.Fatalf("matches not sorted by score at %d", i)
+		}
+	}
+
+	if client.single != 0 || client.batch != 1 || client.batchIDs != core.MaxResolvedCandidates {
+		t.Fatalf("expected one batched lookup of %d songs, got single=%d batch=%d ids=%d",
+			core.MaxResolvedCandidates, client.single, client.batch, client.batchIDs)
+	}
+}
+
+func TestSongCacheAvoidsRepeatLookups(t *testing.T) {
+	client, sample, _ := noisyCatalogue(t)
+	cache := db.NewSongCache(client, 100)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := core.FindMatchesUsingFingerPrints(sample, cache); err != nil {
+			t.Fatalf("FindMatchesUsingFingerPrints failed: %v", err)
+		}
+	}
+
+	if client.batch != 1 {
+		t.Fatalf("expected metadata to be fetched once, got %d batches", client.batch)
+	}
+}
@@ -0,0 +1,184 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shazoom/metadata"
+	"shazoom/spotify"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtureServer serves the API responses in testdata/metadata/<dir>. They
+// are hand-written in the shape of the services' JSON, trimmed to the fields
+// the providers read; the IDs in them are made up.
+// A request for /a/b?index=n is answered with a_b_n.json, or a_b.json when it
+// has no index. Unknown paths get a 404.
+type fixtureServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	userAgents []string
+}
+
+func newFixtureServer(t *testing.T, dir string) *fixtureServer {
+	root := GetTestPath(filepath.Join("testdata", "metadata", dir))
+	f := &fixtureServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.userAgents = append(f.userAgents, r.UserAgent())
+		f.mu.Unlock()
+
+		name := strings.ReplaceAll(strings.Trim(r.URL.Path, "/"), "/", "_")
+		if index := r.URL.Query().Get("index"); index != "" {
+			name += "_" + index
+		}
+		data, err := os.ReadFile(filepath.Join(root, name+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestDeezerProvider(t *testing.T) {
+	f := newFixtureServer(t, "deezer")
+	deezer := metadata.NewDeezer(metadata.DeezerOptions{BaseURL: f.URL})
+	ctx := context.Background()
+
+	track, err := deezer.TrackInfo(ctx, "https://www.deezer.com/en/track/3135556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metadata.Track{Title: "Harder, Better, Faster, Stronger", Artist: "Daft Punk", Album: "Discovery", Duration: 224}
+	if track.Title != want.Title || track.Artist != want.Artist || track.Album != want.Album || track.Duration != want.Duration {
+		t.Errorf("got %+v, want %+v", track, want)
+	}
+
+	album, err := deezer.AlbumInfo(ctx, "https://www.deezer.com/album/302127")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(album) != 3 || album[2].Title != "Digital Love" || album[2].Album != "Discovery" {
+		t.Errorf("unexpected album tracks %+v", album)
+	}
+
+	// the playlist is split over two pages linked by next
+	playlist, err := deezer.PlaylistInfo(ctx, "https://www.deezer.com/playlist/908622995")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist) != 3 || playlist[1].Album != "Random Access Memories" || playlist[2].Title != "Around the World" {
+		t.Errorf("unexpected playlist tracks %+v", playlist)
+	}
+
+	// Deezer reports missing objects as an error body with status 200
+	if _, err := deezer.TrackInfo(ctx, "https://www.deezer.com/track/1"); err == nil || !strings.Contains(err.Error(), "no data") {
+		t.Errorf("expected the API error, got %v", err)
+	}
+}
+
+func TestMusicBrainzProvider(t *testing.T) {
+	f := newFixtureServer(t, "musicbrainz")
+	mb := metadata.NewMusicBrainz(metadata.MusicBrainzOptions{
+		BaseURL:         f.URL,
+		UserAgent:       "shazoom-test/1.0 (test@example.com)",
+		RequestInterval: time.Millisecond,
+	})
+	ctx := context.Background()
+
+	track, err := mb.TrackInfo(ctx, "https://musicbrainz.org/recording/5b4a9f4e-2c1a-4b7e-9a55-1f2d7c3b8e60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.Title != "Under Pressure" || track.Artist != "Queen" || len(track.Artists) != 2 ||
+		track.Album != "Hot Space" || track.Duration != 248 {
+		t.Errorf("unexpected track %+v", track)
+	}
+
+	album, err := mb.AlbumInfo(ctx, "https://musicbrainz.org/release/0e2f6a3c-7b8d-4c1e-a5f9-6d2b8e4c1a37")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(album) != 2 || album[0].Album != "Greatest Hits II" {
+		t.Fatalf("unexpected release tracks %+v", album)
+	}
+	// a track without a length takes the recording's, and its own credit
+	if album[1].Duration != 248 || len(album[1].Artists) != 2 {
+		t.Errorf("unexpected second track %+v", album[1])
+	}
+
+	if _, err := mb.PlaylistInfo(ctx, "https://musicbrainz.org/playlist/x"); !errors.Is(err, metadata.ErrUnsupportedKind) {
+		t.Errorf("expected ErrUnsupportedKind, got %v", err)
+	}
+
+	var status *metadata.StatusError
+	_, err = mb.TrackInfo(ctx, "https://musicbrainz.org/recording/00000000-0000-0000-0000-000000000000")
+	if !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 StatusError, got %v", err)
+	}
+
+	for _, ua := range f.userAgents {
+		if ua != "shazoom-test/1.0 (test@example.com)" {
+			t.Errorf("request sent with User-Agent %q", ua)
+		}
+	}
+}
+
+func TestMetadataRegistry(t *testing.T) {
+	deezer := newFixtureServer(t, "deezer")
+	registry := metadata.NewRegistry(
+		metadata.NewSpotify(spotify.NewClient(spotify.ClientOptions{})),
+		metadata.NewDeezer(metadata.DeezerOptions{BaseURL: deezer.URL}),
+		metadata.NewMusicBrainz(metadata.MusicBrainzOptions{}),
+	)
+
+	tests := []struct {
+		url      string
+		provider string
+		kind     metadata.Kind
+	}{
+		{"https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC?si=0123456789abcdef", "spotify", metadata.KindTrack},
+		{"https://open.spotify.com/intl-de/album/6dVIqQ8qmQ5GBnJ9shOYGE", "spotify", metadata.KindAlbum},
+		{"https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M", "spotify", metadata.KindPlaylist},
+		{"https://www.deezer.com/fr/album/302127", "deezer", metadata.KindAlbum},
+		{"https://deezer.com/playlist/908622995", "deezer", metadata.KindPlaylist},
+		{"https://musicbrainz.org/release/0e2f6a3c-7b8d-4c1e-a5f9-6d2b8e4c1a37", "musicbrainz", metadata.KindAlbum},
+		{"https://musicbrainz.org/recording/5b4a9f4e-2c1a-4b7e-9a55-1f2d7c3b8e60", "musicbrainz", metadata.KindTrack},
+	}
+	for _, tt := range tests {
+		p, res, err := registry.Lookup(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if p.Name() != tt.provider || res.Kind != tt.kind {
+			t.Errorf("%s: routed to %s %s, want %s %s", tt.url, p.Name(), res.Kind, tt.provider, tt.kind)
+		}
+	}
+
+	// the old substring checks took anything mentioning "track"
+	for _, url := range []string{"https://example.com/track/1", "soundtrack", ""} {
+		if _, _, err := registry.Lookup(url); !errors.Is(err, metadata.ErrUnsupportedURL) {
+			t.Errorf("%q: expected ErrUnsupportedURL, got %v", url, err)
+		}
+	}
+
+	tracks, err := registry.Tracks(context.Background(), "https://www.deezer.com/track/3135556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].Artist != "Daft Punk" {
+		t.Errorf("unexpected tracks %+v", tracks)
+	}
+}
@@ -0,0 +1,237 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shazoom/db"
+	"shazoom/fileformat"
+	"shazoom/monitor"
+	"strings"
+	"testing"
+	"time"
+)
+
+// broadcast writes a WAV of 20s excerpts of the synth songs with the given
+// seeds, played back to back.
+func broadcast(t *testing.T, seeds ...int64) []byte {
+	t.Helper()
+	var pcm []float64
+	for _, seed := range seeds {
+		pcm = append(pcm, synthTrack(seed, 40)[10*streamSampleRate:30*streamSampleRate]...)
+	}
+	path := filepath.Join(t.TempDir(), "broadcast.wav")
+	if err := fileformat.WriteWavFile(path, s16le(pcm), streamSampleRate, 1, 16); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func playTitles(plays []db.Play) []string {
+	titles := make([]string, len(plays))
+	for i, play := range plays {
+		// plays are listed latest first
+		titles[len(plays)-1-i] = play.Title
+	}
+	return titles
+}
+
+func TestMonitorLogsEachPlayOnce(t *testing.T) {
+	memDB := newStreamCatalogue(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "station.wav")
+	if err := os.WriteFile(path, broadcast(t, 1, 2, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plays, err := db.OpenFilePlayLog(filepath.Join(dir, "plays.ndjson"), db.FilePlayLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var started []string
+	mon := monitor.New(memDB, plays, monitor.Options{
+		Gap:    10 * time.Second,
+		OnPlay: func(play db.Play) { started = append(started, play.Title) },
+	})
+	if err := mon.Run(context.Background(), "file:"+path); err != nil {
+		t.Fatal(err)
+	}
+
+	logged, err := plays.ListPlays(db.PlayFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := playTitles(logged)
+	if len(titles) != 3 || titles[0] != "First" || titles[1] != "Second" || titles[2] != "First" {
+		t.Fatalf("logged %v", titles)
+	}
+	if len(started) != 3 {
+		t.Fatalf("OnPlay called for %v", started)
+	}
+	for _, play := range logged {
+		if play.Source != "file:"+path || play.Detections < 2 || !play.EndedAt.After(play.StartedAt) {
+			t.Fatalf("play %+v", play)
+		}
+	}
+	if logged[0].StartedAt.Sub(logged[2].StartedAt) < 30*time.Second {
+		t.Fatalf("plays not timed by the audio: %v to %v", logged[2].StartedAt, logged[0].StartedAt)
+	}
+
+	// the log is read back as it was left, updates included
+	reopened, err := db.OpenFilePlayLog(filepath.Join(dir, "plays.ndjson"), db.FilePlayLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := reopened.ListPlays(db.PlayFilter{Source: "file:" + path, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 2 || again[0].ID != logged[0].ID || again[0].Detections != logged[0].Detections || !again[0].EndedAt.Equal(logged[0].EndedAt) {
+		t.Fatalf("reopened %+v, want %+v", again, logged[:2])
+	}
+
+	statuses := mon.Status()
+	if len(statuses) != 1 || statuses[0].Connected || statuses[0].Listened != time.Minute {
+		t.Fatalf("status %+v", statuses)
+	}
+}
+
+func TestMonitorHTTPStream(t *testing.T) {
+	memDB := newStreamCatalogue(t)
+	audio := broadcast(t, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/wav")
+		_, _ = w.Write(audio)
+	}))
+	defer srv.Close()
+
+	plays, err := db.OpenFilePlayLog(filepath.Join(t.TempDir(), "plays.ndjson"), db.FilePlayLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mon := monitor.New(memDB, plays, monitor.Options{
+		RetryDelay: time.Hour,
+		OnPlay:     func(db.Play) { cancel() },
+	})
+
+	// a stream is reconnected to when it ends, so Run only stops with ctx
+	done := make(chan error, 1)
+	go func() { done <- mon.Run(ctx, srv.URL+"/stream") }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("no play detected on the stream")
+	}
+
+	logged, _ := plays.ListPlays(db.PlayFilter{})
+	if titles := playTitles(logged); len(titles) != 1 || titles[0] != "Third" {
+		t.Fatalf("logged %v", titles)
+	}
+}
+
+func TestMonitorReconnectsIdleStream(t *testing.T) {
+	audio := broadcast(t, 3)
+	connections := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections <- struct{}{}
+		w.Header().Set("Content-Type", "audio/wav")
+		// a second of audio, then nothing while the connection stays open
+		_, _ = w.Write(audio[:44+2*streamSampleRate])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	plays, err := db.OpenFilePlayLog(filepath.Join(t.TempDir(), "plays.ndjson"), db.FilePlayLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mon := monitor.New(NewMemoryDB(), plays, monitor.Options{
+		RetryDelay:  10 * time.Millisecond,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- mon.Run(ctx, srv.URL+"/stream") }()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connections:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d connection(s) to a stalled stream", i)
+		}
+	}
+	if statuses := mon.Status(); len(statuses) != 1 || !strings.Contains(statuses[0].Error, monitor.ErrStreamIdle.Error()) {
+		t.Errorf("status %+v", statuses)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+}
+
+func TestMonitorMissingSource(t *testing.T) {
+	plays, _ := db.OpenFilePlayLog(filepath.Join(t.TempDir(), "plays.ndjson"), db.FilePlayLogOptions{})
+	mon := monitor.New(NewMemoryDB(), plays, monitor.Options{})
+	if err := mon.Run(context.Background(), filepath.Join(t.TempDir(), "missing.mp3")); err == nil {
+		t.Fatal("monitored a missing file")
+	}
+	if statuses := mon.Status(); len(statuses) != 1 || statuses[0].Error == "" {
+		t.Fatalf("status %+v", statuses)
+	}
+}
+
+func TestFilePlayLogCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plays.ndjson")
+	plays, err := db.OpenFilePlayLog(path, db.FilePlayLogOptions{MaxPlays: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		play := db.Play{Source: "radio", Title: fmt.Sprint(i), StartedAt: start.Add(time.Duration(i) * time.Minute)}
+		if err := plays.RecordPlay(&play); err != nil {
+			t.Fatal(err)
+		}
+		play.EndedAt = play.StartedAt.Add(30 * time.Second)
+		if err := plays.UpdatePlay(play); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines >= 6 {
+		t.Fatalf("%d lines for at most 3 plays", lines)
+	}
+
+	reopened, err := db.OpenFilePlayLog(path, db.FilePlayLogOptions{MaxPlays: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _ := reopened.ListPlays(db.PlayFilter{})
+	if len(kept) < 3 || kept[0].Title != "9" || kept[0].EndedAt.IsZero() {
+		t.Fatalf("kept %+v", kept)
+	}
+	// ids go on from the last one recorded
+	play := db.Play{Source: "radio", StartedAt: start.Add(time.Hour)}
+	if err := reopened.RecordPlay(&play); err != nil || play.ID != 11 {
+		t.Fatalf("recorded play %d: %v", play.ID, err)
+	}
+}
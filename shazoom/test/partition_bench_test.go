@@ -0,0 +1,107 @@
+package core_test
+
+import (
+	"database/sql"
+	"fmt"
+	"shazoom/db"
+	"shazoom/utils"
+	"strconv"
+	"testing"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// BenchmarkGetCouples measures GetCouples latency on a synthetic catalogue,
+// with and without hash partitioning. It needs a scratch Postgres database
+// (the fingerprints table is dropped and re-seeded for every case):
+//
+//	BENCH_DB_DSN="host=localhost user=postgres dbname=shazoom_bench sslmode=disable" \
+//	    go test ./test -run '^$' -bench GetCouples -benchtime 20x
+//
+// BENCH_FINGERPRINTS_PER_SONG (default 300) sets how many rows each synthetic
+// song contributes.
+func BenchmarkGetCouples(b *testing.B) {
+	dsn := utils.GetEnv("BENCH_DB_DSN")
+	if dsn == "" {
+		b.Skip("BENCH_DB_DSN not set, skipping postgres benchmark")
+	}
+
+	perSong, err := strconv.Atoi(utils.GetEnv("BENCH_FINGERPRINTS_PER_SONG", "300"))
+	if err != nil {
+		b.Fatalf("invalid BENCH_FINGERPRINTS_PER_SONG: %v", err)
+	}
+
+	raw, err := sql.Open("pgx", dsn)
+	if err != nil {
+		b.Fatalf("failed to open postgres: %v", err)
+	}
+	defer raw.Close()
+
+	for _, songs := range []int{10_000, 100_000} {
+		for _, partitions := range []int{0, 16} {
+			name := fmt.Sprintf("songs=%d/partitions=%d", songs, partitions)
+			b.Run(name, func(b *testing.B) {
+				if _, err := raw.Exec(`DROP TABLE IF EXISTS fingerprints`); err != nil {
+					b.Fatalf("failed to drop fingerprints: %v", err)
+				}
+
+				client, err := db.NewPostgresClientWithOptions(dsn, db.PostgresOptions{Partitions: partitions})
+				if err != nil {
+					b.Fatalf("failed to create client: %v", err)
+				}
+				defer client.Close()
+
+				addresses := seedFingerprints(b, raw, songs, perSong)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := client.GetCouples(addresses); err != nil {
+						b.Fatalf("GetCouples failed: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// seedFingerprints fills the fingerprints table with random rows and returns a
+// sample-sized address list: half taken from the table, half random misses.
+func seedFingerprints(b *testing.B, raw *sql.DB, songs, perSong int) []int64 {
+	b.Helper()
+
+	_, err := raw.Exec(`
+		INSERT INTO fingerprints (address, "anchorTimeMs", "songID")
+		SELECT (random() * 4294967295)::bigint, (random() * 300000)::int, s
+		FROM generate_series(1, $1::int) AS s, generate_series(1, $2::int) AS f
+		ON CONFLICT DO NOTHING
+	`, songs, perSong)
+	if err != nil {
+		b.Fatalf("failed to seed fingerprints: %v", err)
+	}
+
+	if _, err := raw.Exec(`ANALYZE fingerprints`); err != nil {
+		b.Fatalf("failed to analyze fingerprints: %v", err)
+	}
+
+	const sampleSize = 2000
+	rows, err := raw.Query(`SELECT address FROM fingerprints ORDER BY random() LIMIT $1`, sampleSize/2)
+	if err != nil {
+		b.Fatalf("failed to sample addresses: %v", err)
+	}
+	defer rows.Close()
+
+	addresses := make([]int64, 0, sampleSize)
+	for rows.Next() {
+		var address int64
+		if err := rows.Scan(&address); err != nil {
+			b.Fatalf("failed to scan address: %v", err)
+		}
+		addresses = append(addresses, address)
+	}
+
+	for len(addresses) < sampleSize {
+		addresses = append(addresses, int64(utils.GenerateUniqueID()))
+	}
+
+	return addresses
+}
@@ -0,0 +1,48 @@
+package core_test
+
+import (
+	"bytes"
+	"os"
+	"shazoom/protocol"
+	"strings"
+	"testing"
+)
+
+// The client's protocol.ts is generated; it must be regenerated whenever the
+// Go schema changes.
+func TestProtocolTypesUpToDate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := protocol.WriteTypeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	checkedIn, err := os.ReadFile("../../client/protocol.ts")
+	if err != nil {
+		t.Skipf("client sources not available: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), checkedIn) {
+		t.Fatal("client/protocol.ts is stale; run `go run . protocol-types ../client/protocol.ts`")
+	}
+}
+
+func TestProtocolTypesCoverEveryEvent(t *testing.T) {
+	var buf bytes.Buffer
+	if err := protocol.WriteTypeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ts := buf.String()
+
+	for _, want := range []string{
+		"  recognitionError: RecognitionErrorEvent;",
+		"  recognitionProgress: RecognitionProgressEvent;",
+		"  newRecording: NewRecordingRequest;",
+		"'database_unavailable'",
+		"  requestId?: string;",
+		"  error?: ErrorBody;",
+	} {
+		if !strings.Contains(ts, want) {
+			t.Errorf("generated types are missing %q", want)
+		}
+	}
+}
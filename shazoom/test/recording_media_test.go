@@ -0,0 +1,99 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"shazoom/fileformat"
+	"testing"
+)
+
+func TestIsPCMMediaType(t *testing.T) {
+	for mimeType, want := range map[string]bool{
+		"":                       true,
+		"audio/pcm":              true,
+		"audio/L16;rate=44100":   true,
+		"audio/webm;codecs=opus": false,
+		"audio/mp4":              false,
+		"not a type;;":           false,
+	} {
+		if got := fileformat.IsPCMMediaType(mimeType); got != want {
+			t.Errorf("IsPCMMediaType(%q) = %v", mimeType, got)
+		}
+	}
+}
+
+func TestDecodeMedia(t *testing.T) {
+	ogg, err := os.ReadFile(GetTestPath("testdata/tone.ogg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ogg natively", func(t *testing.T) {
+		s, err := fileformat.DecodeMedia(context.Background(), ogg, "audio/ogg; codecs=vorbis", fileformat.DecodeOptions{Channels: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if got := readAll(t, s); s.Decoder != "vorbis" || len(got) != 44100 {
+			t.Fatalf("%s decoded %d samples", s.Decoder, len(got))
+		}
+	})
+
+	t.Run("webm through ffmpeg", func(t *testing.T) {
+		want := testFrames(500, 1)
+		var samples []float64
+		for _, f := range want {
+			samples = append(samples, f...)
+		}
+		pcm := filepath.Join(t.TempDir(), "out.pcm")
+		if err := os.WriteFile(pcm, s16le(samples), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fakeFFmpeg(t, pcmFFmpeg)
+		t.Setenv("FAKE_FFMPEG_PCM", pcm)
+
+		webm := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, "opus in matroska"...)
+		s, err := fileformat.DecodeMedia(context.Background(), webm, "audio/webm;codecs=opus", fileformat.DecodeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if got := readAll(t, s); s.Decoder != "ffmpeg" || len(got) != len(samples) {
+			t.Fatalf("%s decoded %d samples", s.Decoder, len(got))
+		}
+	})
+
+	for _, tt := range []struct{ mimeType, data string }{
+		{"audio/webm", "OggS not webm"},
+		{"audio/mp4", "RIFF\x00\x00\x00\x00WAVE"},
+		{"application/octet-stream", "anything"},
+		{"audio/webm;;", "\x1a\x45\xdf\xa3"},
+	} {
+		_, err := fileformat.DecodeMedia(context.Background(), []byte(tt.data), tt.mimeType, fileformat.DecodeOptions{})
+		if !errors.Is(err, fileformat.ErrUnsupportedMedia) {
+			t.Errorf("%s: got %v", tt.mimeType, err)
+		}
+	}
+}
+
+func TestArchiveMedia(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	data := []byte("\x00\x00\x00\x18ftypM4A audio")
+	path, err := fileformat.ArchiveMedia(data, "audio/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != "recordings" || filepath.Ext(path) != ".m4a" {
+		t.Fatalf("archived as %s", path)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(data) {
+		t.Fatal("archive differs from the upload")
+	}
+
+	if _, err := fileformat.ArchiveMedia(data, "video/mp2t"); !errors.Is(err, fileformat.ErrUnsupportedMedia) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"shazoom/spotify"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	fakeTrackURL    = "https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC"
+	fakePlaylistURL = "https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M"
+	fakeAlbumURL    = "https://open.spotify.com/album/6dVIqQ8qmQ5GBnJ9shOYGE"
+)
+
+// fakeSpotify serves the token, track, playlist and album endpoints. fail
+// lets a test make the next responses of a path fail with a status code.
+type fakeSpotify struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	fail          map[string][]int
+	retryAfter    string
+	playlistTotal int
+
+	tokenDelay     time.Duration
+	tokenExpiresIn int
+	tokenRequests  int32
+	requests       int32
+}
+
+func newFakeSpotify(t *testing.T) *fakeSpotify {
+	f := &fakeSpotify{fail: map[string][]int{}, playlistTotal: 250, tokenExpiresIn: 3600}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.tokenRequests, 1)
+		time.Sleep(f.tokenDelay)
+		if r.FormValue("client_id") != "id" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "tok", "token_type": "Bearer", "expires_in": f.tokenExpiresIn})
+	})
+	mux.HandleFunc("GET /v1/tracks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(fakeTrackJSON("Song", 0))
+	})
+	mux.HandleFunc("GET /v1/playlists/{id}/tracks", func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		var items []any
+		for i := offset; i < offset+limit && i < f.playlistTotal; i++ {
+			items = append(items, map[string]any{"track": fakeTrackJSON("Song", i)})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"items": items, "total": f.playlistTotal})
+	})
+	mux.HandleFunc("GET /v1/albums/{id}/tracks", func(w http.ResponseWriter, r *http.Request) {
+		items := []any{fakeTrackJSON("Intro", 0), fakeTrackJSON("Outro", 1)}
+		json.NewEncoder(w).Encode(map[string]any{"items": items, "total": 2})
+	})
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" && r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		f.mu.Lock()
+		atomic.AddInt32(&f.requests, 1)
+		key := r.URL.Path
+		if offset := r.URL.Query().Get("offset"); offset != "" {
+			key += "?offset=" + offset
+		}
+		var status int
+		if codes := f.fail[key]; len(codes) > 0 {
+			status, f.fail[key] = codes[0], codes[1:]
+		}
+		retryAfter := f.retryAfter
+		f.mu.Unlock()
+
+		if status != 0 {
+			if status == http.StatusTooManyRequests && retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSpotify) failNext(path string, codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[path] = append(f.fail[path], codes...)
+}
+
+func (f *fakeSpotify) client(opts spotify.ClientOptions) *spotify.Client {
+	opts.BaseURL = f.URL + "/v1"
+	opts.TokenURL = f.URL + "/token"
+	opts.ClientID = "id"
+	opts.ClientSecret = "secret"
+	if opts.RequestsPerSecond == 0 {
+		opts.RequestsPerSecond = 1000
+		opts.Burst = 1000
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 10 * time.Millisecond
+	}
+	return spotify.NewClient(opts)
+}
+
+func fakeTrackJSON(title string, n int) map[string]any {
+	return map[string]any{
+		"name":        fmt.Sprintf("%s %d", title, n),
+		"duration_ms": 180000 + n,
+		"artists":     []any{map[string]any{"name": "Artist"}, map[string]any{"name": "Guest"}},
+		"album":       map[string]any{"name": "Album"},
+	}
+}
+
+func TestSpotifyClientTrackInfo(t *testing.T) {
+	f := newFakeSpotify(t)
+	c := f.client(spotify.ClientOptions{MaxRetries: 3})
+
+	for i := 0; i < 3; i++ {
+		track, err := c.TrackInfo(context.Background(), fakeTrackURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if track.Title != "Song 0" || track.Artist != "Artist" || len(track.Artists) != 2 || track.Album != "Album" || track.Duration != 180 {
+			t.Fatalf("unexpected track %+v", track)
+		}
+	}
+
+	if n := atomic.LoadInt32(&f.tokenRequests); n != 1 {
+		t.Errorf("token should be fetched once and reused, got %d requests", n)
+	}
+}
+
+func TestSpotifyClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		codes      []int
+		retryAfter string
+		maxRetries int
+		wantStatus int
+		minElapsed time.Duration
+	}{
+		{name: "recovers from 5xx", codes: []int{500, 502, 503}, maxRetries: 3},
+		{name: "honours Retry-After", codes: []int{429}, retryAfter: "1", maxRetries: 1, minElapsed: time.Second},
+		{name: "gives up after MaxRetries", codes: []int{503, 503, 503}, maxRetries: 2, wantStatus: 503},
+		{name: "does not retry 404", codes: []int{404}, maxRetries: 3, wantStatus: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSpotify(t)
+			f.retryAfter = tt.retryAfter
+			f.failNext("/v1/tracks/4uLU6hMCjMI75M1A2tKUQC", tt.codes...)
+			c := f.client(spotify.ClientOptions{MaxRetries: tt.maxRetries, MaxBackoff: 5 * time.Second})
+
+			start := time.Now()
+			_, err := c.TrackInfo(context.Background(), fakeTrackURL)
+			elapsed := time.Since(start)
+
+			var statusErr *spotify.StatusError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Fatalf("expected success, got %v", err)
+			case tt.wantStatus != 0 && (!errors.As(err, &statusErr) || statusErr.StatusCode != tt.wantStatus):
+				t.Fatalf("expected status %d, got %v", tt.wantStatus, err)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("retried after %s, want at least %s", elapsed, tt.minElapsed)
+			}
+
+			// one token request plus every attempt
+			wantRequests := len(tt.codes) + 1
+			if tt.wantStatus != 0 {
+				wantRequests = min(len(tt.codes), tt.maxRetries+1)
+				if tt.wantStatus == 404 {
+					wantRequests = 1
+				}
+			}
+			if got := int(atomic.LoadInt32(&f.requests)) - 1; got != wantRequests {
+				t.Errorf("expected %d API requests, got %d", wantRequests, got)
+			}
+		})
+	}
+}
+
+func TestSpotifyClientRateLimit(t *testing.T) {
+	f := newFakeSpotify(t)
+	c := f.client(spotify.ClientOptions{RequestsPerSecond: 20, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the token request and 5 track requests share the bucket: 5 waits of 50ms
+	if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+		t.Errorf("6 requests at 20/s finished in %s", elapsed)
+	}
+}
+
+func TestSpotifyClientPaging(t *testing.T) {
+	f := newFakeSpotify(t)
+	c := f.client(spotify.ClientOptions{MaxRetries: 0})
+
+	tracks, err := c.PlaylistInfo(context.Background(), fakePlaylistURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 250 || tracks[249].Title != "Song 249" {
+		t.Fatalf("expected 250 tracks in order, got %d", len(tracks))
+	}
+
+	album, err := c.AlbumInfo(context.Background(), fakeAlbumURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(album) != 2 || album[1].Title != "Outro 1" {
+		t.Errorf("unexpected album tracks %+v", album)
+	}
+
+	// a page that keeps failing stops the listing but can be resumed
+	f.failNext("/v1/playlists/37i9dQZF1DXcBWIGoYBM5M/tracks?offset=200", 500)
+	partial, err := c.PlaylistInfo(context.Background(), fakePlaylistURL)
+	var pageErr *spotify.PageError
+	if !errors.As(err, &pageErr) || pageErr.Offset != 200 || len(partial) != 200 {
+		t.Fatalf("expected a page error at offset 200 with 200 tracks, got %v with %d", err, len(partial))
+	}
+
+	rest, err := c.PlaylistTracksFrom(context.Background(), fakePlaylistURL, pageErr.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 50 || rest[0].Title != "Song 200" {
+		t.Errorf("resume returned %d tracks starting at %+v", len(rest), rest[0])
+	}
+}
+
+func TestSpotifyClientTimeoutAndCancel(t *testing.T) {
+	f := newFakeSpotify(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	c := f.client(spotify.ClientOptions{Timeout: 50 * time.Millisecond, MaxRetries: 1})
+	if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := spotify.ClientOptions{
+		BaseURL: slow.URL, TokenURL: f.URL + "/token", ClientID: "id", ClientSecret: "secret",
+		Timeout: 50 * time.Millisecond, MaxRetries: 1, MinBackoff: time.Millisecond,
+	}
+	start := time.Now()
+	_, err := spotify.NewClient(opts).TrackInfo(context.Background(), fakeTrackURL)
+	if err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("timed out requests took %s", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.TrackInfo(ctx, fakeTrackURL); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
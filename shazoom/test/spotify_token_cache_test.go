@@ -0,0 +1,269 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"shazoom/spotify"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenCaches(t *testing.T) {
+	dir := t.TempDir()
+	encrypted, err := spotify.NewEncryptedFileTokenCache(filepath.Join(dir, "enc", "token"), "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caches := map[string]spotify.TokenCache{
+		"memory":    spotify.NewMemoryTokenCache(),
+		"file":      spotify.NewFileTokenCache(filepath.Join(dir, "plain", "token.json")),
+		"encrypted": encrypted,
+	}
+
+	want := spotify.Token{AccessToken: "secret-token", ExpiresAt: time.Now().Add(time.Hour).Round(time.Second)}
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			if _, err := cache.Load(); !errors.Is(err, spotify.ErrNoToken) {
+				t.Fatalf("empty cache: expected ErrNoToken, got %v", err)
+			}
+			if err := cache.Save(want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := cache.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.AccessToken != want.AccessToken || !got.ExpiresAt.Equal(want.ExpiresAt) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if err := cache.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cache.Load(); !errors.Is(err, spotify.ErrNoToken) {
+				t.Errorf("cleared cache: expected ErrNoToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileTokenCachePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	cache := spotify.NewFileTokenCache(path)
+	if err := cache.Save(spotify.Token{AccessToken: "a", ExpiresAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(spotify.Token{AccessToken: "b", ExpiresAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("token file has mode %o, want 600", mode)
+	}
+
+	// temp files of the atomic rename must not be left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the token file, found %d entries", len(entries))
+	}
+}
+
+func TestEncryptedTokenCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	cache, err := spotify.NewEncryptedFileTokenCache(path, "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(spotify.Token{AccessToken: "plaintext-token", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("plaintext-token")) {
+		t.Error("token is stored in plain text")
+	}
+
+	wrong, _ := spotify.NewEncryptedFileTokenCache(path, "wrong")
+	if _, err := wrong.Load(); err == nil {
+		t.Error("expected the wrong passphrase to fail")
+	}
+
+	if _, err := spotify.NewEncryptedFileTokenCache(path, ""); err == nil {
+		t.Error("expected an empty passphrase to be rejected")
+	}
+}
+
+func TestSpotifyClientSingleFlightRefresh(t *testing.T) {
+	f := newFakeSpotify(t)
+	f.tokenDelay = 50 * time.Millisecond
+	c := f.client(spotify.ClientOptions{})
+
+	var wg sync.WaitGroup
+	var failures int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+				atomic.AddInt32(&failures, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failures != 0 {
+		t.Errorf("%d requests failed", failures)
+	}
+	if n := atomic.LoadInt32(&f.tokenRequests); n != 1 {
+		t.Errorf("parallel requests should share one token refresh, got %d", n)
+	}
+}
+
+func TestSpotifyClientProactiveRefresh(t *testing.T) {
+	f := newFakeSpotify(t)
+	cache := spotify.NewMemoryTokenCache()
+
+	// still valid, but inside the refresh window
+	soon := time.Now().Add(time.Minute)
+	cache.Save(spotify.Token{AccessToken: "tok", ExpiresAt: soon})
+	c := f.client(spotify.ClientOptions{TokenCache: cache, RefreshBefore: 5 * time.Minute})
+
+	if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		token, err := cache.Load()
+		if err == nil && token.ExpiresAt.After(soon) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("token was not refreshed before expiring: %+v", token)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&f.tokenRequests); n != 1 {
+		t.Errorf("expected one refresh, got %d", n)
+	}
+
+	// a fresh token from the cache is used as is
+	c = f.client(spotify.ClientOptions{TokenCache: cache, RefreshBefore: 5 * time.Minute})
+	if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&f.tokenRequests); n != 1 {
+		t.Errorf("cached token should have been reused, got %d refreshes", n)
+	}
+}
+
+// slowTokenCache takes as long to load as a cache that derives its key.
+type slowTokenCache struct {
+	spotify.TokenCache
+	loads int32
+}
+
+func (c *slowTokenCache) Load() (spotify.Token, error) {
+	atomic.AddInt32(&c.loads, 1)
+	time.Sleep(50 * time.Millisecond)
+	return c.TokenCache.Load()
+}
+
+func TestSpotifyClientLoadsCacheOncePerRefresh(t *testing.T) {
+	f := newFakeSpotify(t)
+	f.tokenExpiresIn = 120
+	cache := &slowTokenCache{TokenCache: spotify.NewMemoryTokenCache()}
+	c := f.client(spotify.ClientOptions{TokenCache: cache, RefreshBefore: 5 * time.Minute})
+
+	// every token is inside the refresh window, so each request wants one
+	if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.TrackInfo(context.Background(), fakeTrackURL); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("requests were serialized behind the cache: %v", elapsed)
+	}
+	loads, refreshes := atomic.LoadInt32(&cache.loads), atomic.LoadInt32(&f.tokenRequests)
+	if loads > refreshes+1 {
+		t.Errorf("%d cache loads for %d refreshes", loads, refreshes)
+	}
+}
+
+// stuckClearCache clears the token it wraps, then blocks the first Clear
+// until release is closed.
+type stuckClearCache struct {
+	spotify.TokenCache
+	once    sync.Once
+	cleared chan struct{}
+	release chan struct{}
+}
+
+func (c *stuckClearCache) Clear() error {
+	err := c.TokenCache.Clear()
+	c.once.Do(func() {
+		close(c.cleared)
+		<-c.release
+	})
+	return err
+}
+
+func TestSpotifyClientClearsCacheOutsideLock(t *testing.T) {
+	f := newFakeSpotify(t)
+	cache := &stuckClearCache{TokenCache: spotify.NewMemoryTokenCache(), cleared: make(chan struct{}), release: make(chan struct{})}
+	cache.TokenCache.Save(spotify.Token{AccessToken: "revoked", ExpiresAt: time.Now().Add(time.Hour)})
+	c := f.client(spotify.ClientOptions{TokenCache: cache})
+	defer close(cache.release)
+
+	// the revoked token is rejected and cleared from the cache, where the
+	// first request stays stuck
+	go c.TrackInfo(context.Background(), fakeTrackURL)
+	select {
+	case <-cache.cleared:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rejected token was never cleared")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.TrackInfo(context.Background(), fakeTrackURL)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a request waited for the cache to be cleared")
+	}
+}
@@ -0,0 +1,137 @@
+package core_test
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"shazoom/core"
+	"testing"
+	"time"
+)
+
+const streamSampleRate = 44100
+
+// synthTrack renders a deterministic melody of short chords, distinct per seed.
+func synthTrack(seed int64, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(seconds*streamSampleRate))
+
+	noteLen := streamSampleRate / 8
+	var freqs [3]float64
+	for i := range samples {
+		if i%noteLen == 0 {
+			for j := range freqs {
+				freqs[j] = 100 + rng.Float64()*2400
+			}
+		}
+		t := float64(i) / streamSampleRate
+		for _, f := range freqs {
+			samples[i] += 0.3 * math.Sin(2*math.Pi*f*t)
+		}
+	}
+	return samples
+}
+
+func newStreamCatalogue(t *testing.T) *MemoryDB {
+	t.Helper()
+	memDB := NewMemoryDB()
+
+	for i, title := range []string{"First", "Second", "Third"} {
+		songID, err := memDB.RegisterSong(title, "Synth", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints, err := core.GenerateFingerprintsFromSamples(synthTrack(int64(i+1), 40), streamSampleRate, songID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := memDB.StoreFingerprints(fingerprints); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return memDB
+}
+
+func TestStreamRecognizerStopsEarlyWhenConfident(t *testing.T) {
+	memDB := newStreamCatalogue(t)
+
+	rec, err := core.NewStreamRecognizer(streamSampleRate, memDB, core.DefaultStreamOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 15s starting 12s into the second song, fed in 250ms chunks
+	excerpt := synthTrack(2, 40)[12*streamSampleRate : 27*streamSampleRate]
+	chunk := streamSampleRate / 4
+
+	var final *core.StreamResult
+	updates := 0
+	for start := 0; start < len(excerpt); start += chunk {
+		result, err := rec.Feed(excerpt[start:min(start+chunk, len(excerpt))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil {
+			continue
+		}
+		updates++
+		if result.Done {
+			final = result
+			break
+		}
+	}
+
+	if final == nil {
+		t.Fatal("session never finished")
+	}
+	if !final.Confident {
+		t.Fatalf("expected a confident match, got %+v", final.Matches)
+	}
+	if final.Audio >= 15*time.Second {
+		t.Errorf("expected to stop before the excerpt ended, stopped after %s", final.Audio)
+	}
+	if updates < 1 {
+		t.Errorf("expected at least one rescore, got %d", updates)
+	}
+	if final.Matches[0].SongTitle != "Second" {
+		t.Errorf("expected Second, got %s", final.Matches[0].SongTitle)
+	}
+
+	if _, err := rec.Feed(excerpt[:chunk]); !errors.Is(err, core.ErrStreamDone) {
+		t.Errorf("expected ErrStreamDone after the session ended, got %v", err)
+	}
+}
+
+func TestStreamRecognizerFinishWithoutConfidence(t *testing.T) {
+	memDB := newStreamCatalogue(t)
+
+	opts := core.DefaultStreamOptions
+	opts.MinScore = math.MaxFloat64
+
+	rec, err := core.NewStreamRecognizer(streamSampleRate, memDB, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	excerpt := synthTrack(3, 40)[5*streamSampleRate : 9*streamSampleRate]
+	for start := 0; start < len(excerpt); start += 4096 {
+		result, err := rec.Feed(excerpt[start:min(start+4096, len(excerpt))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != nil && result.Done {
+			t.Fatal("session should not finish on its own")
+		}
+	}
+
+	final, err := rec.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !final.Done || final.Confident {
+		t.Errorf("expected a done, unconfident result, got done=%v confident=%v", final.Done, final.Confident)
+	}
+	if len(final.Matches) == 0 || final.Matches[0].SongTitle != "Third" {
+		t.Errorf("expected Third as best match, got %+v", final.Matches)
+	}
+}
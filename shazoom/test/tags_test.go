@@ -0,0 +1,360 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"shazoom/fileformat"
+	"testing"
+)
+
+// mp3Fixture is an ID3v2.3 tagged stream of MPEG frame headers, with a
+// comment frame the tag writer must keep and an ID3v1 tag at the end.
+func mp3Fixture() []byte {
+	frame := func(id string, data []byte) []byte {
+		b := []byte(id)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+		return append(append(b, 0, 0), data...)
+	}
+	var frames []byte
+	frames = append(frames, frame("TIT2", []byte("\x00Old Title"))...)
+	frames = append(frames, frame("COMM", []byte("\x00engkept comment"))...)
+
+	tag := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(frames))}
+	tag = append(tag, frames...)
+	for range 50 {
+		tag = append(tag, 0xFF, 0xFB, 0x90, 0x64, 1, 2, 3, 4)
+	}
+
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[33:], "V1 Artist")
+	return append(tag, v1...)
+}
+
+// mp4Fixture is a minimal M4A with moov ahead of mdat, its one chunk
+// offset pointing at the media data.
+func mp4Fixture(payload []byte) []byte {
+	box := func(typ string, parts ...[]byte) []byte {
+		size := 8
+		for _, p := range parts {
+			size += len(p)
+		}
+		b := binary.BigEndian.AppendUint32(nil, uint32(size))
+		b = append(b, typ...)
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 2500) // duration
+	ftyp := box("ftyp", []byte("M4A \x00\x00\x00\x00M4A isom"))
+	build := func(offset uint32) []byte {
+		stco := box("stco", []byte{0, 0, 0, 0, 0, 0, 0, 1}, binary.BigEndian.AppendUint32(nil, offset))
+		trak := box("trak", box("mdia", box("minf", box("stbl", stco))))
+		return box("moov", box("mvhd", mvhd), trak)
+	}
+	moov := build(0)
+	moov = build(uint32(len(ftyp) + len(moov) + 8))
+	return append(append(ftyp, moov...), box("mdat", payload)...)
+}
+
+// mp4ChunkData follows the chunk offset of an mp4Fixture file.
+func mp4ChunkData(t *testing.T, data []byte, n int) []byte {
+	t.Helper()
+	i := bytes.Index(data, []byte("stco"))
+	if i < 0 {
+		t.Fatal("no stco box")
+	}
+	offset := binary.BigEndian.Uint32(data[i+12:])
+	return data[offset : int(offset)+n]
+}
+
+func decodeSamples(t *testing.T, path string) []float64 {
+	t.Helper()
+	s, err := fileformat.DecodeFile(context.Background(), path, fileformat.DecodeOptions{Channels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return readAll(t, s)
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	ogg, err := os.ReadFile(GetTestPath("testdata/tone.ogg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wav := wavFixture{
+		format: 1, channels: 1, bits: 16, rate: 8000,
+		before: [][2]string{{"LIST", "INFO" + "ICMT\x05\x00\x00\x00kept\x00\x00"}},
+	}
+	tone := make([]int64, 4000)
+	for i := range tone {
+		tone[i] = int64(8000 * math.Sin(float64(i)*0.07))
+	}
+	audio := []byte("media data that must not move")
+
+	tests := []struct {
+		name     string
+		file     []byte
+		duration float64
+		decodes  bool
+		// RIFF INFO has no album artist field
+		albumArtist bool
+	}{
+		{"song.wav", wav.build(testFrames(4000, 1)), 0.5, true, false},
+		{"song.flac", flacFile([][]int64{tone}, 8000, 1000, 0, []string{"fixed2"}), 0.5, true, true},
+		{"song.ogg", ogg, 1, true, true},
+		{"song.mp3", mp3Fixture(), 0, false, true},
+		{"song.m4a", mp4Fixture(audio), 2.5, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.name)
+			if err := os.WriteFile(path, tt.file, 0640); err != nil {
+				t.Fatal(err)
+			}
+			var before []float64
+			if tt.decodes {
+				before = decodeSamples(t, path)
+			}
+
+			want := fileformat.Tags{Title: "Ünïcode Title", Artist: "Some Artist", Album: "Some Album", AlbumArtist: "Some Artist"}
+			if err := fileformat.WriteTags(path, want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := fileformat.ReadTags(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got.Duration-tt.duration) > 1e-3 {
+				t.Errorf("duration %v, want %v", got.Duration, tt.duration)
+			}
+			got.Duration = 0
+			if !tt.albumArtist {
+				want.AlbumArtist = ""
+			}
+			if got != want {
+				t.Fatalf("read back %+v, want %+v", got, want)
+			}
+
+			// empty fields leave the ones already there
+			if err := fileformat.WriteTags(path, fileformat.Tags{Album: "Other Album"}); err != nil {
+				t.Fatal(err)
+			}
+			got, _ = fileformat.ReadTags(path)
+			if got.Title != want.Title || got.Artist != want.Artist || got.Album != "Other Album" {
+				t.Fatalf("after partial write: %+v", got)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+				t.Errorf("mode changed to %v", info.Mode())
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+				t.Errorf("left %d files behind", len(entries))
+			}
+
+			switch tt.name {
+			case "song.wav":
+				if !bytes.Contains(data, []byte("ICMT\x05\x00\x00\x00kept")) {
+					t.Error("other INFO field lost")
+				}
+			case "song.mp3":
+				if !bytes.Contains(data, []byte("COMM")) || !bytes.HasSuffix(data, tt.file[len(tt.file)-128-400:]) {
+					t.Error("comment frame or audio lost")
+				}
+			case "song.m4a":
+				if !bytes.Equal(mp4ChunkData(t, data, len(audio)), audio) {
+					t.Error("chunk offset does not point at the media data")
+				}
+			}
+			if tt.decodes {
+				after := decodeSamples(t, path)
+				if len(after) != len(before) {
+					t.Fatalf("decoded %d samples, was %d", len(after), len(before))
+				}
+				for i := range after {
+					if after[i] != before[i] {
+						t.Fatalf("sample %d changed", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadTagsVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	// ID3v2.2 with a UTF-16 title, and ID3v1 filling in the artist
+	v22 := []byte("ID3\x02\x00\x00\x00\x00\x00\x13TT2\x00\x00\x0d\x01\xff\xfeT\x00i\x00t\x00l\x00e\x00")
+	v22 = append(v22, 0xFF, 0xFB, 0x90, 0x64)
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[33:], "V1 Artist")
+	path := filepath.Join(dir, "old.mp3")
+	if err := os.WriteFile(path, append(v22, v1...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := fileformat.ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Title" || got.Artist != "V1 Artist" {
+		t.Fatalf("read %+v", got)
+	}
+
+	// rewriting a v2.2 tag upgrades it and keeps its title
+	if err := fileformat.WriteTags(path, fileformat.Tags{Artist: "New Artist"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if data[3] != 4 {
+		t.Fatalf("rewritten as ID3v2.%d", data[3])
+	}
+	got, _ = fileformat.ReadTags(path)
+	if got.Title != "Title" || got.Artist != "New Artist" {
+		t.Fatalf("after rewrite: %+v", got)
+	}
+}
+
+// mpegStream is n MPEG-1 layer III frames of 128 kbps at 48 kHz, 384 bytes
+// and 24ms each, with first written into the body of the first frame.
+func mpegStream(n int, first []byte) []byte {
+	frames := make([]byte, 384*n)
+	for i := 0; i < n; i++ {
+		copy(frames[384*i:], []byte{0xFF, 0xFB, 0x94, 0x64})
+	}
+	copy(frames[4:], first)
+	return frames
+}
+
+func TestReadTagsMPEGDuration(t *testing.T) {
+	xing := make([]byte, 32+12)
+	copy(xing[32:], "Xing\x00\x00\x00\x01")
+	binary.BigEndian.PutUint32(xing[40:], 1000)
+	vbri := make([]byte, 32+18)
+	copy(vbri[32:], "VBRI")
+	binary.BigEndian.PutUint32(vbri[32+14:], 500)
+	// TLEN says 99s, but the frames are what is played
+	tlen := []byte("ID3\x03\x00\x00\x00\x00\x00\x10TLEN\x00\x00\x00\x06\x00\x00\x0099000")
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+
+	tests := []struct {
+		name string
+		file []byte
+		want float64
+	}{
+		{"cbr", mpegStream(100, nil), 2.4},
+		{"tagged", append(append(tlen, mpegStream(100, nil)...), v1...), 2.4},
+		{"xing", mpegStream(10, xing), 24},
+		{"vbri", mpegStream(10, vbri), 12},
+		// a single frame header is not trusted to be one
+		{"tlen only", append(tlen, 0xFF, 0xFB, 0x94, 0x64), 99},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name+".mp3")
+		if err := os.WriteFile(path, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fileformat.ReadTags(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if math.Abs(got.Duration-tt.want) > 1e-9 {
+			t.Errorf("%s: duration %v, want %v", tt.name, got.Duration, tt.want)
+		}
+	}
+
+	// a VBR file from an encoder, within a frame of the sum of its frames
+	got, err := fileformat.ReadTags(GetTestPath("testdata/sample1.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(got.Duration-92.08) > 0.05 {
+		t.Errorf("sample1.mp3: duration %v", got.Duration)
+	}
+}
+
+func TestTagsFromFilename(t *testing.T) {
+	dir := t.TempDir()
+	wav := wavFixture{format: 1, channels: 1, bits: 16, rate: 8000}.build(testFrames(800, 1))
+
+	untagged := filepath.Join(dir, "Some Artist - Some Song.wav")
+	if err := os.WriteFile(untagged, wav, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileformat.ReadTagsOrFilename(untagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Artist != "Some Artist" || got.Title != "Some Song" || got.Duration != 0.1 {
+		t.Fatalf("read %+v", got)
+	}
+
+	if got := fileformat.TagsFromFilename("/music/Just A Title.mp3"); got.Title != "Just A Title" || got.Artist != "" {
+		t.Fatalf("read %+v", got)
+	}
+
+	// tags in the file win over the name
+	if err := fileformat.WriteTags(untagged, fileformat.Tags{Title: "Tagged"}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = fileformat.ReadTagsOrFilename(untagged)
+	if got.Title != "Tagged" || got.Artist != "Some Artist" {
+		t.Fatalf("read %+v", got)
+	}
+
+	// a corrupt tag is no reason to refuse the file
+	corrupt := filepath.Join(dir, "Other Artist - Other Song.mp3")
+	if err := os.WriteFile(corrupt, []byte("ID3\x03\x00\x00\x00\x00\x10\x00TIT2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileformat.ReadTags(corrupt); !errors.Is(err, fileformat.ErrInvalidTags) {
+		t.Fatalf("expected ErrInvalidTags, got %v", err)
+	}
+	got, err = fileformat.ReadTagsOrFilename(corrupt)
+	if err != nil || got.Artist != "Other Artist" || got.Title != "Other Song" {
+		t.Fatalf("read %+v, %v", got, err)
+	}
+	if _, err := fileformat.ReadTagsOrFilename(filepath.Join(dir, "Missing - Song.mp3")); err == nil {
+		t.Fatal("read tags of a missing file")
+	}
+}
+
+func TestWriteTagsUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"streamed.wav": wavFixture{format: 1, channels: 1, bits: 16, rate: 8000, streaming: true}.build(testFrames(100, 1)),
+		"rf64.wav":     wavFixture{format: 1, channels: 1, bits: 16, rate: 8000, rf64: true}.build(testFrames(100, 1)),
+		"notes.txt":    []byte("not audio"),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := fileformat.WriteTags(path, fileformat.Tags{Title: "x"})
+		if !errors.Is(err, fileformat.ErrTagsUnsupported) {
+			t.Errorf("%s: got %v", name, err)
+		}
+		if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+			t.Errorf("%s was modified", name)
+		}
+	}
+}
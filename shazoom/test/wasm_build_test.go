@@ -0,0 +1,25 @@
+package core_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestWasmBuilds keeps the packages the browser build links free of
+// anything that does not compile for js/wasm.
+func TestWasmBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the wasm module")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+
+	cmd := exec.Command(goTool, "build", "-o", os.DevNull, "shazoom/wasm")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("GOOS=js GOARCH=wasm go build ./wasm: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,303 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"shazoom/fileformat"
+	"testing"
+)
+
+// wavFixture builds a synthetic WAV file in memory.
+type wavFixture struct {
+	format     uint16 // format code, or WaveFormatExtensible
+	subFormat  uint16 // for extensible files
+	channels   int
+	bits       int
+	rate       int
+	before     [][2]string // chunks written between fmt and data
+	rf64       bool
+	streaming  bool // data size left at zero, as by an encoder writing to a pipe
+	truncateBy int  // bytes cut from the end of the file
+}
+
+func (f wavFixture) encode(sample float64) []byte {
+	b := make([]byte, f.bits/8)
+	code := f.format
+	if code == fileformat.WaveFormatExtensible {
+		code = f.subFormat
+	}
+	switch {
+	case code == fileformat.WaveFormatIEEEFloat && f.bits == 32:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(sample)))
+	case code == fileformat.WaveFormatIEEEFloat && f.bits == 64:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(sample))
+	case f.bits == 8:
+		b[0] = byte(int(math.Round(sample*128)) + 128)
+	default:
+		v := int64(math.Round(sample * float64(int64(1)<<(f.bits-1))))
+		for i := range b {
+			b[i] = byte(v >> (8 * i))
+		}
+	}
+	return b
+}
+
+// build encodes frames, each a sample per channel.
+func (f wavFixture) build(frames [][]float64) []byte {
+	var data bytes.Buffer
+	for _, frame := range frames {
+		for _, s := range frame {
+			data.Write(f.encode(s))
+		}
+	}
+
+	var fmtChunk bytes.Buffer
+	le := func(v any) { binary.Write(&fmtChunk, binary.LittleEndian, v) }
+	blockAlign := f.channels * f.bits / 8
+	le(f.format)
+	le(uint16(f.channels))
+	le(uint32(f.rate))
+	le(uint32(f.rate * blockAlign))
+	le(uint16(blockAlign))
+	le(uint16(f.bits))
+	if f.format == fileformat.WaveFormatExtensible {
+		le(uint16(22))
+		le(uint16(f.bits))
+		le(uint32(0x3F)) // 5.1
+		le(f.subFormat)
+		fmtChunk.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71})
+	}
+
+	var body bytes.Buffer
+	chunk := func(id string, size uint32, payload []byte) {
+		body.WriteString(id)
+		binary.Write(&body, binary.LittleEndian, size)
+		body.Write(payload)
+		if len(payload)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	if f.rf64 {
+		ds64 := make([]byte, 28)
+		binary.LittleEndian.PutUint64(ds64[0:], uint64(4+36+fmtChunk.Len()+8+data.Len()))
+		binary.LittleEndian.PutUint64(ds64[8:], uint64(data.Len()))
+		binary.LittleEndian.PutUint64(ds64[16:], uint64(len(frames)))
+		chunk("ds64", uint32(len(ds64)), ds64)
+	}
+	chunk("fmt ", uint32(fmtChunk.Len()), fmtChunk.Bytes())
+	for _, c := range f.before {
+		chunk(c[0], uint32(len(c[1])), []byte(c[1]))
+	}
+	dataSize := uint32(data.Len())
+	if f.rf64 {
+		dataSize = 0xFFFFFFFF
+	} else if f.streaming {
+		dataSize = 0
+	}
+	chunk("data", dataSize, data.Bytes())
+
+	var out bytes.Buffer
+	riffSize := uint32(4 + body.Len())
+	if f.rf64 {
+		out.WriteString("RF64")
+		riffSize = 0xFFFFFFFF
+	} else {
+		out.WriteString("RIFF")
+	}
+	binary.Write(&out, binary.LittleEndian, riffSize)
+	out.WriteString("WAVE")
+	out.Write(body.Bytes())
+
+	return out.Bytes()[:out.Len()-f.truncateBy]
+}
+
+func testFrames(n, channels int) [][]float64 {
+	frames := make([][]float64, n)
+	for i := range frames {
+		frames[i] = make([]float64, channels)
+		for c := range frames[i] {
+			frames[i][c] = 0.9 * math.Sin(float64(i)*0.05+float64(c))
+		}
+	}
+	return frames
+}
+
+func TestWavReaderFormats(t *testing.T) {
+	list := [2]string{"LIST", "INFOISFT\x07\x00\x00\x00shazoom\x00"}
+	tests := []struct {
+		name      string
+		fixture   wavFixture
+		frames    int
+		wantRead  int
+		tolerance float64
+	}{
+		{"8-bit", wavFixture{format: 1, channels: 1, bits: 8, rate: 8000}, 300, 300, 1.0 / 100},
+		{"16-bit with LIST, fact and bext", wavFixture{format: 1, channels: 2, bits: 16, rate: 44100,
+			before: [][2]string{list, {"fact", "\x2c\x01\x00\x00"}, {"bext", "odd"}}}, 300, 300, 1.0 / 30000},
+		{"24-bit", wavFixture{format: 1, channels: 2, bits: 24, rate: 48000}, 300, 300, 1e-6},
+		{"32-bit", wavFixture{format: 1, channels: 1, bits: 32, rate: 96000}, 300, 300, 1e-9},
+		{"32-bit float", wavFixture{format: 3, channels: 2, bits: 32, rate: 44100}, 300, 300, 1e-7},
+		{"64-bit float extensible 5.1", wavFixture{format: fileformat.WaveFormatExtensible, subFormat: 3,
+			channels: 6, bits: 64, rate: 48000}, 300, 300, 0},
+		{"24-bit extensible", wavFixture{format: fileformat.WaveFormatExtensible, subFormat: 1,
+			channels: 6, bits: 24, rate: 48000}, 300, 300, 1e-6},
+		{"RF64", wavFixture{format: 1, channels: 2, bits: 16, rate: 44100, rf64: true}, 300, 300, 1.0 / 30000},
+		{"streamed without sizes", wavFixture{format: 1, channels: 2, bits: 16, rate: 44100, streaming: true}, 300, 300, 1.0 / 30000},
+		{"truncated mid-frame", wavFixture{format: 1, channels: 2, bits: 24, rate: 44100, truncateBy: 4}, 300, 299, 1e-6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := testFrames(tt.frames, tt.fixture.channels)
+			r, err := fileformat.NewWavReader(bytes.NewReader(tt.fixture.build(frames)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Channels != tt.fixture.channels || r.SampleRate != tt.fixture.rate || r.BitsPerSample != tt.fixture.bits {
+				t.Fatalf("unexpected format %+v", r.WavFormat)
+			}
+
+			// read in uneven pieces to cross buffer boundaries
+			var got []float64
+			buf := make([]float64, 7*r.Channels)
+			for {
+				n, err := r.ReadFrames(buf)
+				got = append(got, buf[:n*r.Channels]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(got) != tt.wantRead*r.Channels {
+				t.Fatalf("read %d frames, want %d", len(got)/r.Channels, tt.wantRead)
+			}
+			for i, s := range got {
+				want := frames[i/r.Channels][i%r.Channels]
+				if math.Abs(s-want) > tt.tolerance+1e-12 {
+					t.Fatalf("sample %d: got %v, want %v", i, s, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWavReaderDownmix(t *testing.T) {
+	fixture := wavFixture{format: fileformat.WaveFormatExtensible, subFormat: 3, channels: 6, bits: 32, rate: 48000}
+	frames := testFrames(1000, 6)
+
+	r, err := fileformat.NewWavReader(bytes.NewReader(fixture.build(frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Frames() != 1000 || r.ChannelMask != 0x3F {
+		t.Fatalf("unexpected header: %d frames, mask %#x", r.Frames(), r.ChannelMask)
+	}
+
+	mono := make([]float64, 1000)
+	n, err := r.ReadMono(mono)
+	if err != nil || n != 1000 {
+		t.Fatalf("ReadMono read %d frames: %v", n, err)
+	}
+	for i, frame := range frames {
+		var sum float64
+		for _, s := range frame {
+			sum += s
+		}
+		if math.Abs(mono[i]-sum/6) > 1e-6 {
+			t.Fatalf("frame %d: got %v, want %v", i, mono[i], sum/6)
+		}
+	}
+	if _, err := r.ReadMono(mono); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestWavReaderRejects(t *testing.T) {
+	adpcm := wavFixture{format: 2, channels: 1, bits: 4, rate: 8000}.build(nil)
+	if _, err := fileformat.NewWavReader(bytes.NewReader(adpcm)); !errors.Is(err, fileformat.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for ADPCM, got %v", err)
+	}
+	if _, err := fileformat.NewWavReader(bytes.NewReader([]byte("ID3\x04 not a wav file"))); !errors.Is(err, fileformat.ErrNotWav) {
+		t.Errorf("expected ErrNotWav, got %v", err)
+	}
+	wide := wavFixture{format: 1, channels: 65535, bits: 8, rate: 8000}.build(nil)
+	if _, err := fileformat.NewWavReader(bytes.NewReader(wide)); err == nil {
+		t.Error("expected 65535 channels to be refused")
+	}
+}
+
+func TestReadWavInfoIgnoresClaimedSize(t *testing.T) {
+	fixture := wavFixture{format: 1, channels: 2, bits: 16, rate: 44100}
+	data := fixture.build(testFrames(100, 2))
+	// a few hundred bytes claiming 4 GB of samples
+	sizeAt := bytes.Index(data, []byte("data")) + 4
+	binary.LittleEndian.PutUint32(data[sizeAt:], 0xFFFFFFF0)
+	path := filepath.Join(t.TempDir(), "claims.wav")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	info, err := fileformat.ReadWavInfo(path)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.LeftChannelSamples) != 100 {
+		t.Errorf("got %d samples, want 100", len(info.LeftChannelSamples))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("allocated %d bytes for 100 frames", allocated)
+	}
+}
+
+func TestReadWavInfo(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name         string
+		fixture      wavFixture
+		wantChannels int
+	}{
+		{"stereo 24-bit", wavFixture{format: 1, channels: 2, bits: 24, rate: 44100,
+			before: [][2]string{{"LIST", "INFOINAM\x04\x00\x00\x00Song"}}}, 2},
+		{"5.1 float", wavFixture{format: fileformat.WaveFormatExtensible, subFormat: 3, channels: 6, bits: 32, rate: 48000}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := testFrames(44100, tt.fixture.channels)
+			path := filepath.Join(dir, tt.name+".wav")
+			if err := os.WriteFile(path, tt.fixture.build(frames), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := fileformat.ReadWavInfo(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Channels != tt.wantChannels || info.SampleRate != tt.fixture.rate {
+				t.Fatalf("got %d channels at %d Hz", info.Channels, info.SampleRate)
+			}
+			if len(info.LeftChannelSamples) != len(frames) {
+				t.Fatalf("got %d samples, want %d", len(info.LeftChannelSamples), len(frames))
+			}
+			if want := float64(len(frames)) / float64(tt.fixture.rate); math.Abs(info.Duration-want) > 1e-9 {
+				t.Errorf("duration %v, want %v", info.Duration, want)
+			}
+			if tt.wantChannels == 2 && math.Abs(info.RightChannelSamples[100]-frames[100][1]) > 1e-6 {
+				t.Errorf("right channel sample %v, want %v", info.RightChannelSamples[100], frames[100][1])
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package core_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"shazoom/fileformat"
+	"testing"
+)
+
+func TestWavWriterRoundTrip(t *testing.T) {
+	formats := []struct {
+		name   string
+		format fileformat.WavFormat
+		tol    float64
+	}{
+		{"pcm8", fileformat.PCMFormat(8000, 1, 8), 1.0 / 128},
+		{"pcm16", fileformat.PCMFormat(44100, 2, 16), 1.0 / (1 << 15)},
+		{"pcm24", fileformat.PCMFormat(48000, 2, 24), 1.0 / (1 << 23)},
+		{"pcm32", fileformat.PCMFormat(48000, 1, 32), 1.0 / (1 << 31)},
+		{"float32", fileformat.FloatFormat(44100, 2, 32), 1e-7},
+		{"float64", fileformat.FloatFormat(96000, 6, 64), 0},
+	}
+
+	for _, tt := range formats {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := tt.format.Channels
+			frames := testFrames(1001, ch)
+			var samples []float64
+			for _, f := range frames {
+				samples = append(samples, f...)
+			}
+
+			path := filepath.Join(t.TempDir(), "out.wav")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := fileformat.NewWavWriter(f, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// written in uneven pieces, as a stream would be
+			for start := 0; start < len(frames); start += 300 {
+				end := min(start+300, len(frames))
+				if n, err := w.WriteFrames(samples[start*ch : end*ch]); err != nil || n != end-start {
+					t.Fatalf("wrote %d frames: %v", n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data)%2 != 0 || int(binary.LittleEndian.Uint32(data[4:8])) != len(data)-8 {
+				t.Fatalf("RIFF size %d for a %d byte file", binary.LittleEndian.Uint32(data[4:8]), len(data))
+			}
+
+			in, _ := os.Open(path)
+			defer in.Close()
+			r, err := fileformat.NewWavReader(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Frames() != int64(len(frames)) || r.SampleRate != tt.format.SampleRate || r.Channels != ch ||
+				r.BitsPerSample != tt.format.BitsPerSample || r.AudioFormat != tt.format.AudioFormat {
+				t.Fatalf("read back %+v with %d frames", r.WavFormat, r.Frames())
+			}
+
+			got := make([]float64, len(samples)+ch)
+			n, err := r.ReadFrames(got)
+			if err != nil || n != len(frames) {
+				t.Fatalf("read %d frames: %v", n, err)
+			}
+			for i := range samples {
+				if math.Abs(got[i]-samples[i]) > tt.tol {
+					t.Fatalf("sample %d: got %v, want %v", i, got[i], samples[i])
+				}
+			}
+			if _, err := r.ReadFrames(got); err != io.EOF {
+				t.Fatalf("got %v after the last frame", err)
+			}
+		})
+	}
+}
+
+func TestWavWriterClips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.wav")
+	f, _ := os.Create(path)
+	defer f.Close()
+	w, err := fileformat.NewWavWriter(f, fileformat.PCMFormat(8000, 1, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteFrames([]float64{1, -1, 2, -2})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fileformat.ReadWavInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{32767.0 / 32768, -1, 32767.0 / 32768, -1}
+	for i, s := range info.LeftChannelSamples {
+		if s != want[i] {
+			t.Fatalf("sample %d: got %v, want %v", i, s, want[i])
+		}
+	}
+}
+
+func TestWavWriterRejects(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, format := range []fileformat.WavFormat{
+		fileformat.PCMFormat(0, 1, 16),
+		fileformat.PCMFormat(44100, 0, 16),
+		fileformat.PCMFormat(44100, fileformat.MaxChannels+1, 16),
+		fileformat.PCMFormat(44100, 1, 12),
+		fileformat.FloatFormat(44100, 1, 16),
+	} {
+		f, _ := os.Create(filepath.Join(dir, "bad.wav"))
+		if _, err := fileformat.NewWavWriter(f, format); err == nil {
+			t.Errorf("%+v accepted", format)
+		}
+		f.Close()
+	}
+
+	// a partial frame is caught on close
+	f, _ := os.Create(filepath.Join(dir, "partial.wav"))
+	defer f.Close()
+	w, err := fileformat.NewWavWriter(f, fileformat.PCMFormat(44100, 2, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte{1, 2, 3})
+	if err := w.Close(); !errors.Is(err, fileformat.ErrInvalidPCM) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestWriteWavFileValidatesFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.wav")
+
+	// 3 bytes are not whole frames of 16-bit mono
+	if err := fileformat.WriteWavFile(path, []byte{1, 2, 3}, 44100, 1, 16); !errors.Is(err, fileformat.ErrInvalidPCM) {
+		t.Fatalf("got %v", err)
+	}
+	if err := fileformat.WriteWavFile(path, []byte{1, 2}, 44100, 0, 16); err == nil {
+		t.Fatal("zero channels accepted")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("file created for invalid arguments")
+	}
+
+	_, err := fileformat.DecodeRecording(context.Background(), []byte{1, 2, 3, 4, 5, 6}, 44100, 2, 16, fileformat.DecodeOptions{})
+	if !errors.Is(err, fileformat.ErrInvalidPCM) {
+		t.Fatalf("DecodeRecording: got %v", err)
+	}
+	// one 65535-channel frame is refused before anything is sized from it
+	_, err = fileformat.DecodeRecording(context.Background(), make([]byte, 65535), 44100, 65535, 8, fileformat.DecodeOptions{})
+	if !errors.Is(err, fileformat.ErrUnsupportedFormat) {
+		t.Fatalf("DecodeRecording of 65535 channels: got %v", err)
+	}
+
+	t.Chdir(t.TempDir())
+	if _, err := fileformat.ArchiveRecording([]byte{1}, 44100, 1, 16); !errors.Is(err, fileformat.ErrInvalidPCM) {
+		t.Fatalf("ArchiveRecording: got %v", err)
+	}
+	if _, err := os.Stat("recordings"); !os.IsNotExist(err) {
+		t.Fatal("recordings folder created for an invalid recording")
+	}
+
+	pcm := s16le([]float64{0.5, -0.5, 0.25, -0.25})
+	archived, err := fileformat.ArchiveRecording(pcm, 44100, 2, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fileformat.ReadWavInfo(archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channels != 2 || len(info.LeftChannelSamples) != 2 || info.RightChannelSamples[1] != -0.25 {
+		t.Fatalf("archived %+v", info)
+	}
+}
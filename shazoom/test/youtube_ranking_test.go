@@ -0,0 +1,135 @@
+package core_test
+
+import (
+	"shazoom/spotify"
+	"strconv"
+	"testing"
+)
+
+func TestRankCandidates(t *testing.T) {
+	getLucky := spotify.Track{Title: "Get Lucky", Artist: "Daft Punk", Duration: 248}
+
+	tests := []struct {
+		name       string
+		track      spotify.Track
+		candidates []spotify.Candidate
+		want       string // best ID, "" when every candidate is rejected
+	}{
+		{
+			name:  "studio version over live",
+			track: getLucky,
+			candidates: []spotify.Candidate{
+				{ID: "live", Title: "Daft Punk - Get Lucky (Live at the Grammys)", Channel: "Grammys", Duration: 250},
+				{ID: "studio", Title: "Daft Punk - Get Lucky (Official Audio)", Channel: "Daft Punk", Duration: 248},
+			},
+			want: "studio",
+		},
+		{
+			name:  "topic channel over a lyric video",
+			track: getLucky,
+			candidates: []spotify.Candidate{
+				{ID: "lyrics", Title: "Daft Punk - Get Lucky (Lyrics)", Channel: "Lyric Vibes", Duration: 249},
+				{ID: "topic", Title: "Get Lucky", Channel: "Daft Punk - Topic", Duration: 248},
+			},
+			want: "topic",
+		},
+		{
+			name:  "hour-long loop rejected on duration",
+			track: getLucky,
+			candidates: []spotify.Candidate{
+				{ID: "loop", Title: "Daft Punk - Get Lucky", Channel: "Loops", Duration: 3600},
+				{ID: "radio", Title: "Daft Punk - Get Lucky (Radio Edit)", Channel: "Daft Punk", Duration: 250},
+			},
+			want: "radio",
+		},
+		{
+			name:  "penalty words",
+			track: getLucky,
+			candidates: []spotify.Candidate{
+				{ID: "slowed", Title: "Get Lucky (slowed + reverb)", Channel: "Daft Punk - Topic", Duration: 255},
+				{ID: "cover", Title: "Get Lucky - Daft Punk cover", Channel: "Pentatonix", Duration: 248},
+				{ID: "remix", Title: "Daft Punk - Get Lucky (Remix)", Channel: "Daft Punk", Duration: 248},
+				{ID: "plain", Title: "Daft Punk - Get Lucky", Channel: "Music Uploads", Duration: 252},
+			},
+			want: "plain",
+		},
+		{
+			name:  "penalty word in the track title",
+			track: spotify.Track{Title: "Get Lucky (Remix)", Artist: "Daft Punk", Duration: 300},
+			candidates: []spotify.Candidate{
+				{ID: "original", Title: "Daft Punk - Get Lucky", Channel: "Daft Punk", Duration: 248},
+				{ID: "remix", Title: "Daft Punk - Get Lucky (Remix)", Channel: "Daft Punk", Duration: 301},
+			},
+			want: "remix",
+		},
+		{
+			name:  "title similarity picks the right song",
+			track: spotify.Track{Title: "Instant Crush", Artist: "Daft Punk", Duration: 337},
+			candidates: []spotify.Candidate{
+				{ID: "other", Title: "Daft Punk - Lose Yourself to Dance", Channel: "Daft Punk", Duration: 353},
+				{ID: "crush", Title: "Daft Punk - Instant Crush ft. Julian Casablancas", Channel: "Daft Punk", Duration: 338},
+			},
+			want: "crush",
+		},
+		{
+			name:  "unknown durations rank on the other signals",
+			track: spotify.Track{Title: "Get Lucky", Artist: "Daft Punk"},
+			candidates: []spotify.Candidate{
+				{ID: "unrelated", Title: "Pharrell Williams - Happy", Channel: "Pharrell Williams"},
+				{ID: "match", Title: "Daft Punk - Get Lucky", Channel: "Daft Punk"},
+			},
+			want: "match",
+		},
+		{
+			name:  "live streams and off-duration videos only",
+			track: getLucky,
+			candidates: []spotify.Candidate{
+				{ID: "stream", Title: "Daft Punk - Get Lucky", Channel: "Daft Punk", Live: true},
+				{ID: "extended", Title: "Daft Punk - Get Lucky (Extended)", Channel: "Daft Punk", Duration: 369},
+			},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			best, ok := spotify.BestCandidate(tt.track, tt.candidates, spotify.RankOptions{})
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected no candidate, got %s (%.1f: %v)", best.ID, best.Score, best.Reasons)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s, every candidate was rejected", tt.want)
+			}
+			if best.ID != tt.want {
+				t.Errorf("picked %s (%.1f: %v), want %s", best.ID, best.Score, best.Reasons, tt.want)
+				for _, sc := range spotify.RankCandidates(tt.track, tt.candidates, spotify.RankOptions{}) {
+					t.Logf("  %s %.1f %v", sc.ID, sc.Score, sc.Reasons)
+				}
+			}
+		})
+	}
+}
+
+func TestRankCandidatesDurationFalloff(t *testing.T) {
+	track := spotify.Track{Title: "Song", Artist: "Band", Duration: 200}
+	opts := spotify.RankOptions{DurationTolerance: 2, MaxDurationDelta: 12, MinScore: -100}
+
+	var candidates []spotify.Candidate
+	for _, d := range []int{200, 202, 207, 212, 213} {
+		candidates = append(candidates, spotify.Candidate{ID: strconv.Itoa(d), Title: "Song", Channel: "Band", Duration: d})
+	}
+
+	ranked := spotify.RankCandidates(track, candidates, opts)
+	if len(ranked) != 4 {
+		t.Fatalf("expected the candidate 13s off to be dropped, got %d candidates", len(ranked))
+	}
+	if ranked[0].Score != ranked[1].Score {
+		t.Errorf("candidates within the tolerance should score the same: %v", ranked)
+	}
+	if !(ranked[1].Score > ranked[2].Score && ranked[2].Score > ranked[3].Score) {
+		t.Errorf("score should fall with the duration delta: %v", ranked)
+	}
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the reverse proxies whose X-Forwarded-For header is
+// believed, as addresses and CIDR ranges.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies reads a comma-separated list of IP addresses and CIDR
+// ranges, such as "10.0.0.0/8, ::1". An empty list trusts no one.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address a request came from. That is the peer at
+// remoteAddr, unless it is a trusted proxy: then X-Forwarded-For is followed
+// back from its last entry, each one added by the proxy before it, to the
+// first address that is not a trusted proxy. Entries a client wrote itself,
+// ahead of that one, are never looked at.
+func (p TrustedProxies) ClientIP(remoteAddr string, header http.Header) string {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !p.trusts(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(header.Values("X-Forwarded-For"), ","), ",")
+	client := peer.Unmap().String()
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !p.trusts(addr) {
+			break
+		}
+	}
+	return client
+}
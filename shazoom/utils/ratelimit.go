@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket refilled at rate tokens per second, holding
+// at most burst tokens. It starts full.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket allowing rate requests per second on
+// average, and bursts of up to burst requests.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucket(rate, burst, time.Now())
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token if there is one, and otherwise says how long until
+// there will be.
+func (b *TokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Allow takes a token and reports whether there was one. It never blocks.
+func (b *TokenBucket) Allow() bool {
+	ok, _ := b.take(time.Now())
+	return ok
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		ok, delay := b.take(time.Now())
+		if ok {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// idleSince reports whether the bucket has not been used for d.
+func (b *TokenBucket) idleSince(now time.Time, d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last) >= d
+}
+
+// RateLimiter keeps a token bucket per key, such as a client address, each
+// refilled at rate tokens per second and holding at most burst tokens. Keys
+// whose buckets have refilled completely are forgotten.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+	swept   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second per key
+// on average, and bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*TokenBucket{},
+		swept:   time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket and reports whether there was one.
+// It never blocks.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[key] = b
+	}
+	ok, _ = b.take(now)
+	return ok
+}
+
+// sweep drops full buckets, at most once per refill period, so that the map
+// does not grow with every client ever seen.
+func (l *RateLimiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < full {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.idleSince(now, full) {
+			delete(l.buckets, key)
+		}
+	}
+}
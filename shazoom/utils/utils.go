@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 	"math/rand"
+	"path/filepath"
 )
 
 func GenerateUniqueID() uint32 {
@@ -14,6 +15,12 @@ func GenerateUniqueID() uint32 {
 	return rand.Uint32();
 }
 
+// DataPath returns the path of name in the directory the server keeps its
+// state in: DATA_DIR, or "data" under the working directory.
+func DataPath(name string) string {
+	return filepath.Join(GetEnv("DATA_DIR", "data"), name)
+}
+
 func GetEnv(key string, fallback ...string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
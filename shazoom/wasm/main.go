@@ -0,0 +1,78 @@
+//go:build js && wasm
+
+// Command wasm exposes the fingerprinting of the core package to browsers,
+// so that a client can submit hashes with submitFingerprints instead of
+// uploading its recording. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o ../client/public/shazoom.wasm ./wasm
+//
+// and load it with the wasm_exec.js of the same Go release. It defines
+//
+//	shazoomFingerprint(samples: Float32Array, sampleRate: number)
+//
+// which returns {config, hashes} as sent in a SubmitFingerprintsRequest, or
+// {error} if the samples cannot be fingerprinted.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"shazoom/core"
+	"shazoom/protocol"
+	"syscall/js"
+)
+
+func main() {
+	js.Global().Set("shazoomFingerprint", js.FuncOf(fingerprint))
+	select {}
+}
+
+func fingerprint(_ js.Value, args []js.Value) any {
+	if len(args) != 2 || !args[0].InstanceOf(js.Global().Get("Float32Array")) || args[1].Type() != js.TypeNumber {
+		return failure("expected a Float32Array and a sample rate")
+	}
+
+	submission, err := core.FingerprintSubmission(float32Samples(args[0]), args[1].Int())
+	if err != nil {
+		return failure(err.Error())
+	}
+
+	req := protocol.SubmitFingerprintsRequest{
+		Config: protocol.FingerprintConfig{
+			Version:        submission.Config.Version,
+			SampleRate:     submission.Config.SampleRate,
+			WindowSize:     submission.Config.WindowSize,
+			HopSize:        submission.Config.HopSize,
+			TargetZoneSize: submission.Config.TargetZoneSize,
+		},
+		Hashes: make([]protocol.FingerprintHash, len(submission.Hashes)),
+	}
+	for i, h := range submission.Hashes {
+		req.Hashes[i] = protocol.FingerprintHash{Address: h.Address, AnchorTime: h.AnchorTime}
+	}
+
+	// the JSON form is the one the server decodes, field names included
+	out, err := json.Marshal(req)
+	if err != nil {
+		return failure(err.Error())
+	}
+	return js.Global().Get("JSON").Call("parse", string(out))
+}
+
+// float32Samples copies a Float32Array out of the JavaScript heap.
+func float32Samples(array js.Value) []float64 {
+	view := js.Global().Get("Uint8Array").New(array.Get("buffer"), array.Get("byteOffset"), array.Get("byteLength"))
+	raw := make([]byte, view.Length())
+	js.CopyBytesToGo(raw, view)
+
+	samples := make([]float64, len(raw)/4)
+	for i := range samples {
+		samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:])))
+	}
+	return samples
+}
+
+func failure(message string) map[string]any {
+	return map[string]any{"error": message}
+}
@@ -4,12 +4,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"shazoom/db"
 	"shazoom/core"
+	"shazoom/jobs"
+	"shazoom/metadata"
+	"shazoom/protocol"
 	"shazoom/spotify"
 	"shazoom/utils"
 	"shazoom/fileformat"
@@ -17,156 +23,353 @@ import (
 	socketio "github.com/googollee/go-socket.io"
 )
 
+const dbUnavailableMessage = "The server is running without a database connection."
 
+// decodeRequest unmarshals a JSON request payload into req. Payloads that are
+// not JSON objects are handed to legacy, for clients that still send bare
+// values; a nil legacy rejects them.
+func decodeRequest(data string, req any, legacy func(string)) error {
+	trimmed := strings.TrimSpace(data)
+	if strings.HasPrefix(trimmed, "{") {
+		return json.Unmarshal([]byte(trimmed), req)
+	}
+	if legacy == nil {
+		return errors.New("expected a JSON object")
+	}
+	legacy(trimmed)
+	return nil
+}
+
+func emitDownloadError(socket socketio.Conn, requestID string, code protocol.ErrorCode, message string) {
+	socket.Emit(protocol.EventDownloadStatus, protocol.DownloadStatusEvent{
+		RequestID: requestID,
+		Type:      protocol.StatusError,
+		Message:   message,
+		Error:     &protocol.ErrorBody{Code: code, Message: message},
+	})
+}
 
-func emitStatus(socket socketio.Conn, statusType, message string) {
-	socket.Emit("downloadStatus", map[string]any{
-		"type":    statusType,
-		"message": message,
+func emitProgress(socket socketio.Conn, requestID string, stage protocol.Stage) {
+	socket.Emit(protocol.EventRecognitionProgress, protocol.RecognitionProgressEvent{
+		RequestID: requestID,
+		Stage:     stage,
 	})
 }
 
+func emitRecognitionError(socket socketio.Conn, requestID string, code protocol.ErrorCode, message string) {
+	socket.Emit(protocol.EventRecognitionError, protocol.RecognitionErrorEvent{
+		RequestID: requestID,
+		Code:      code,
+		Message:   message,
+	})
+}
+
+func emitMatches(socket socketio.Conn, requestID string, matches []core.Match, final bool) {
+	if len(matches) > 10 {
+		matches = matches[:10]
+	}
+
+	payload := make([]protocol.Match, 0, len(matches))
+	for _, m := range matches {
+		payload = append(payload, protocol.Match{
+			SongID:      m.SongId,
+			SongTitle:   m.SongTitle,
+			SongArtist:  m.SongArtist,
+			YouTubeID:   m.YoutubeID,
+			TimestampMs: m.Timestamp,
+			Score:       m.Score,
+		})
+	}
+
+	socket.Emit(protocol.EventMatches, protocol.MatchesEvent{
+		RequestID: requestID,
+		Matches:   payload,
+		Final:     final,
+	})
+}
 
-func handleTotalSongs(socket socketio.Conn, dbClient db.DBClient) {
+func handleTotalSongs(socket socketio.Conn, data string, dbClient db.DBClient) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
 
+	var req protocol.TotalSongsRequest
+	_ = decodeRequest(data, &req, func(string) {})
+
+	if dbClient == nil {
+		socket.Emit(protocol.EventTotalSongs, protocol.TotalSongsEvent{
+			RequestID: req.RequestID,
+			Error:     &protocol.ErrorBody{Code: protocol.ErrDatabaseUnavailable, Message: dbUnavailableMessage},
+		})
+		return
+	}
 
 	totalSongs, err := dbClient.TotalSongs()
 	if err != nil {
 		logger.ErrorContext(ctx, "failed to get total songs", slog.Any("error", err))
+		socket.Emit(protocol.EventTotalSongs, protocol.TotalSongsEvent{
+			RequestID: req.RequestID,
+			Error:     &protocol.ErrorBody{Code: protocol.ErrInternal, Message: "Failed to count songs."},
+		})
 		return
 	}
 
-	socket.Emit("totalSongs", totalSongs)
+	socket.Emit(protocol.EventTotalSongs, protocol.TotalSongsEvent{
+		RequestID: req.RequestID,
+		Total:     totalSongs,
+	})
 }
 
-func handleSongDownload(socket socketio.Conn, spotifyURL string, dbClient db.DBClient) {
-	logger := utils.GetLogger()
-	ctx := context.Background()
+// handleSongDownload queues a download job and forwards its progress to the
+// socket. The job keeps running if the socket goes away.
+func handleSongDownload(ctx context.Context, socket socketio.Conn, data string, downloads *jobs.Manager) {
+	var req protocol.NewDownloadRequest
+	if err := decodeRequest(data, &req, func(url string) { req.URL = url }); err != nil {
+		emitDownloadError(socket, "", protocol.ErrInvalidPayload, "Invalid download request.")
+		return
+	}
+	id := req.RequestID
 
-	switch {
-	case strings.Contains(spotifyURL, "album"):
-		tracks, err := spotify.AlbumInfo(spotifyURL)
-		if err != nil {
-			emitStatus(socket, "error", err.Error())
-			return
-		}
+	if downloads == nil {
+		emitDownloadError(socket, id, protocol.ErrDatabaseUnavailable, dbUnavailableMessage)
+		return
+	}
 
-		emitStatus(socket, "info",
-			fmt.Sprintf("%d songs found in album.", len(tracks)),
-		)
+	if _, _, err := metadata.Default().Lookup(req.URL); err != nil {
+		emitDownloadError(socket, id, protocol.ErrInvalidPayload, "Unsupported URL. Use a Spotify, Deezer or MusicBrainz link.")
+		return
+	}
 
-		count, err := spotify.DlAlbum(spotifyURL, SONGS_DIR, dbClient)
-		if err != nil {
-			logger.ErrorContext(ctx, "album download failed", slog.Any("error", err))
-			emitStatus(socket, "error", "Failed to download album.")
-			return
-		}
+	job, err := downloads.Enqueue(req.URL)
+	if err != nil {
+		emitDownloadError(socket, id, protocol.ErrInvalidPayload, err.Error())
+		return
+	}
+	events, unsubscribe := downloads.Subscribe(job.ID)
 
-		emitStatus(socket, "success",
-			fmt.Sprintf("%d songs downloaded from album.", count),
-		)
+	socket.Emit(protocol.EventDownloadStatus, protocol.DownloadStatusEvent{
+		RequestID: id,
+		JobID:     job.ID,
+		Type:      protocol.StatusInfo,
+		Message:   "Download queued.",
+	})
 
-	case strings.Contains(spotifyURL, "playlist"):
-		tracks, err := spotify.PlaylistInfo(spotifyURL)
-		if err != nil {
-			emitStatus(socket, "error", err.Error())
-			return
+	go func() {
+		defer unsubscribe()
+
+		// events are dropped when the channel is full, the finishing one
+		// included, so the job is also polled until it is over
+		poll := time.NewTicker(downloadPollInterval)
+		defer poll.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if status, ok := jobStatusEvent(id, event); ok {
+					socket.Emit(protocol.EventDownloadStatus, status)
+				}
+				if event.TrackIndex < 0 && event.Job.Status.Finished() {
+					return
+				}
+			case <-poll.C:
+				current, err := downloads.Get(job.ID)
+				if err != nil {
+					return
+				}
+				if current.Status.Finished() {
+					if status, ok := jobStatusEvent(id, jobs.Event{Job: current, TrackIndex: -1}); ok {
+						socket.Emit(protocol.EventDownloadStatus, status)
+					}
+					return
+				}
+			}
 		}
+	}()
+}
 
-		emitStatus(socket, "info",
-			fmt.Sprintf("%d songs found in playlist.", len(tracks)),
-		)
+// downloadPollInterval is how often a download followed over a socket is
+// checked for having finished without its event getting through.
+const downloadPollInterval = 10 * time.Second
 
-		count, err := spotify.DlPlaylist(spotifyURL, SONGS_DIR, dbClient)
-		if err != nil {
-			logger.ErrorContext(ctx, "playlist download failed", slog.Any("error", err))
-			emitStatus(socket, "error", "Failed to download playlist.")
-			return
-		}
+// socketContexts hands out a context per socket, cancelled when it
+// disconnects, for the work a socket leaves running in the background.
+type socketContexts struct {
+	parent context.Context
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	ctxs    map[string]context.Context
+}
+
+func newSocketContexts(parent context.Context) *socketContexts {
+	return &socketContexts{
+		parent:  parent,
+		cancels: make(map[string]context.CancelFunc),
+		ctxs:    make(map[string]context.Context),
+	}
+}
 
-		emitStatus(socket, "success",
-			fmt.Sprintf("%d songs downloaded from playlist.", count),
-		)
+func (s *socketContexts) get(socketID string) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	case strings.Contains(spotifyURL, "track"):
-		track, err := spotify.TrackInfo(spotifyURL)
-		if err != nil {
-			emitStatus(socket, "error", err.Error())
-			return
-		}
+	if ctx, ok := s.ctxs[socketID]; ok {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(s.parent)
+	s.ctxs[socketID] = ctx
+	s.cancels[socketID] = cancel
+	return ctx
+}
+
+func (s *socketContexts) disconnected(socketID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.cancels[socketID]; ok {
+		cancel()
+		delete(s.cancels, socketID)
+		delete(s.ctxs, socketID)
+	}
+}
 
-		key := utils.GenerateSongKey(track.Title, track.Artist)
-		existing, exists, err := dbClient.GetSongByKey(key)
-		if err == nil && exists {
-			emitStatus(socket, "error",
-				fmt.Sprintf("'%s' by '%s' already exists (YouTube ID: %s)",
-					existing.Title, existing.Artist, existing.YouTubeID),
-			)
-			return
+// jobStatusEvent turns a job event into the downloadStatus sent to clients.
+func jobStatusEvent(requestID string, event jobs.Event) (protocol.DownloadStatusEvent, bool) {
+	job := event.Job
+	status := protocol.DownloadStatusEvent{RequestID: requestID, JobID: job.ID, Type: protocol.StatusInfo}
+
+	if event.TrackIndex >= 0 {
+		track := job.Tracks[event.TrackIndex]
+		status.Track = downloadTrack(event.TrackIndex, track)
+		status.Message = fmt.Sprintf("'%s' by '%s': %s", track.Title, track.Artist, track.Status)
+		if track.Reason != "" {
+			status.Message += " (" + track.Reason + ")"
 		}
+		if track.Status == spotify.TrackFailed {
+			status.Type = protocol.StatusError
+		}
+		return status, true
+	}
 
-		count, err := spotify.DlSingleTrack(spotifyURL, SONGS_DIR, dbClient)
-		if err != nil || count != 1 {
-			emitStatus(socket, "error", "Track download failed.")
-			return
+	switch job.Status {
+	case jobs.StatusRunning:
+		if len(job.Tracks) == 0 {
+			return status, false
 		}
+		status.Message = fmt.Sprintf("%d songs found.", len(job.Tracks))
+	case jobs.StatusDone:
+		status.Type = protocol.StatusSuccess
+		status.Message = fmt.Sprintf("%d of %d songs downloaded.", job.Saved, len(job.Tracks))
+	case jobs.StatusFailed:
+		status.Type = protocol.StatusError
+		status.Message = fmt.Sprintf("Download failed: %s", job.Error)
+	case jobs.StatusCancelled:
+		status.Type = protocol.StatusError
+		status.Message = "Download cancelled."
+	default:
+		return status, false
+	}
 
-		emitStatus(socket, "success",
-			fmt.Sprintf("'%s' by '%s' downloaded.", track.Title, track.Artist),
-		)
+	if len(job.Tracks) > 0 {
+		report := &protocol.DownloadReport{Saved: job.Saved, Skipped: job.Skipped, Failed: job.Failed}
+		for i, track := range job.Tracks {
+			report.Tracks = append(report.Tracks, *downloadTrack(i, track))
+		}
+		status.Report = report
+	}
+	return status, true
+}
 
-	default:
-		emitStatus(socket, "error", "Invalid Spotify URL.")
+func downloadTrack(index int, track jobs.Track) *protocol.DownloadTrack {
+	return &protocol.DownloadTrack{
+		Index:  index,
+		Title:  track.Title,
+		Artist: track.Artist,
+		Status: protocol.TrackStatus(track.Status),
+		Code:   string(track.Code),
+		Reason: track.Reason,
 	}
 }
 
-func handleNewRecording(socket socketio.Conn, recordData string) {
+func handleNewRecording(socket socketio.Conn, recordData string, dbClient db.DBClient) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
 
-	var rec struct {
-		Audio      string `json:"audio"`
-		SampleRate int    `json:"sampleRate"`
-		Channels   int    `json:"channels"`
+	var rec protocol.NewRecordingRequest
+	if err := decodeRequest(recordData, &rec, nil); err != nil {
+		logger.ErrorContext(ctx, "invalid recording payload", slog.Any("error", err))
+		emitRecognitionError(socket, "", protocol.ErrInvalidPayload, "Invalid recording payload.")
+		return
 	}
+	id := rec.RequestID
 
-	if err := json.Unmarshal([]byte(recordData), &rec); err != nil {
-		logger.ErrorContext(ctx, "invalid recording payload", slog.Any("error", err))
+	if dbClient == nil {
+		emitRecognitionError(socket, id, protocol.ErrDatabaseUnavailable, dbUnavailableMessage)
 		return
 	}
 
+	emitProgress(socket, id, protocol.StageReceived)
+	emitProgress(socket, id, protocol.StageDecoding)
+
 	audioBytes, err := base64.StdEncoding.DecodeString(rec.Audio)
 	if err != nil {
 		logger.ErrorContext(ctx, "failed to decode base64 audio", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrDecodeFailed, "Recording is not valid base64.")
 		return
 	}
 
-	if err := utils.CreateFolder("recordings"); err != nil {
-		logger.ErrorContext(ctx, "failed to create recordings dir", slog.Any("error", err))
+	pcm := fileformat.IsPCMMediaType(rec.MimeType)
+	bitsPerSample := rec.SampleSize
+	if bitsPerSample == 0 {
+		bitsPerSample = 16
+	}
+
+	var stream *fileformat.PCMStream
+	if pcm {
+		stream, err = fileformat.DecodeRecording(ctx, audioBytes, rec.SampleRate, rec.Channels, bitsPerSample, fileformat.DecodeOptions{})
+	} else {
+		stream, err = fileformat.DecodeMedia(ctx, audioBytes, rec.MimeType, fileformat.DecodeOptions{})
+	}
+	if errors.Is(err, fileformat.ErrInvalidPCM) {
+		logger.ErrorContext(ctx, "malformed recording", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrInvalidPayload, "Recording is not whole PCM frames.")
+		return
+	}
+	if errors.Is(err, fileformat.ErrUnsupportedMedia) {
+		logger.ErrorContext(ctx, "unsupported recording type", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrInvalidPayload, "Recording type is not supported.")
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to start decoding", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrDecodeFailed, "Recording could not be decoded.")
 		return
 	}
+	defer stream.Close()
+
+	if archiveRecordings() {
+		if pcm {
+			_, err = fileformat.ArchiveRecording(audioBytes, rec.SampleRate, rec.Channels, bitsPerSample)
+		} else {
+			_, err = fileformat.ArchiveMedia(audioBytes, rec.MimeType)
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to archive recording", slog.Any("error", err))
+		}
+	}
 
-	filePath := fmt.Sprintf(
-		"recordings/%d.wav",
-		time.Now().UnixNano(),
-	)
+	emitProgress(socket, id, protocol.StageFingerprinting)
 
-	if err := fileformat.WriteWavFile(
-		filePath,
-		audioBytes,
-		rec.SampleRate,
-		rec.Channels,
-		16,
-	); err != nil {
-		logger.ErrorContext(ctx, "failed to write wav", slog.Any("error", err))
+	fingerprint, err := core.FingerprintPCM(stream, utils.GenerateUniqueID())
+	if errors.Is(err, fileformat.ErrDecodeFailed) {
+		logger.ErrorContext(ctx, "failed to decode recording", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrDecodeFailed, "Recording could not be decoded.")
 		return
 	}
-
-	fingerprint, err := core.GenerateFingerprints(filePath, utils.GenerateUniqueID())
 	if err != nil {
 		logger.ErrorContext(ctx, "fingerprint generation failed", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrFingerprintFailed, "Failed to fingerprint the recording.")
 		return
 	}
 
@@ -175,17 +378,285 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		sampleFingerprint[addr] = couple.AnchorTime
 	}
 
-	matches, _, err := core.FindMatchesUsingFingerPrints(sampleFingerprint)
+	emitProgress(socket, id, protocol.StageMatching)
+
+	matches, _, err := core.FindMatchesUsingFingerPrints(sampleFingerprint, dbClient)
 	if err != nil {
 		logger.ErrorContext(ctx, "matching failed", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrMatchFailed, "Failed to search the catalogue.")
 		return
 	}
 
-	if len(matches) > 10 {
-		matches = matches[:10]
+	emitMatches(socket, id, matches, true)
+	emitProgress(socket, id, protocol.StageDone)
+}
+
+// handleSubmitFingerprints matches hashes the client computed itself, so
+// that no audio leaves its device. Submissions are rate limited per client
+// address since, unlike recordings, they cost the client next to nothing.
+func handleSubmitFingerprints(socket socketio.Conn, data string, dbClient db.DBClient, limiter *utils.RateLimiter, proxies utils.TrustedProxies) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	var req protocol.SubmitFingerprintsRequest
+	if err := decodeRequest(data, &req, nil); err != nil {
+		logger.ErrorContext(ctx, "invalid fingerprint submission", slog.Any("error", err))
+		emitRecognitionError(socket, "", protocol.ErrInvalidPayload, "Invalid fingerprint submission.")
+		return
+	}
+	id := req.RequestID
+
+	if !limiter.Allow(clientAddress(socket, proxies)) {
+		emitRecognitionError(socket, id, protocol.ErrRateLimited, "Too many submissions; try again shortly.")
+		return
+	}
+
+	if dbClient == nil {
+		emitRecognitionError(socket, id, protocol.ErrDatabaseUnavailable, dbUnavailableMessage)
+		return
+	}
+
+	emitProgress(socket, id, protocol.StageReceived)
+
+	submission := core.Submission{
+		Config: core.FingerprintConfig{
+			Version:        req.Config.Version,
+			SampleRate:     req.Config.SampleRate,
+			WindowSize:     req.Config.WindowSize,
+			HopSize:        req.Config.HopSize,
+			TargetZoneSize: req.Config.TargetZoneSize,
+		},
+		Hashes: make([]core.Hash, len(req.Hashes)),
+	}
+	for i, h := range req.Hashes {
+		submission.Hashes[i] = core.Hash{Address: h.Address, AnchorTime: h.AnchorTime}
+	}
+
+	sample, err := submission.Sample()
+	if errors.Is(err, core.ErrConfigMismatch) {
+		emitRecognitionError(socket, id, protocol.ErrConfigMismatch,
+			fmt.Sprintf("Fingerprints must be computed with configuration version %d.", core.FingerprintConfigVersion))
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "rejected fingerprint submission", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrInvalidPayload, "Invalid fingerprint hashes.")
+		return
+	}
+
+	emitProgress(socket, id, protocol.StageMatching)
+
+	matches, _, err := core.FindMatchesUsingFingerPrints(sample, dbClient)
+	if err != nil {
+		logger.ErrorContext(ctx, "matching failed", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrMatchFailed, "Failed to search the catalogue.")
+		return
+	}
+
+	emitMatches(socket, id, matches, true)
+	emitProgress(socket, id, protocol.StageDone)
+}
+
+// clientAddress is the host a socket connected from, without its port, or
+// the client a trusted proxy forwarded it for.
+func clientAddress(socket socketio.Conn, proxies utils.TrustedProxies) string {
+	return proxies.ClientIP(socket.RemoteAddr().String(), socket.RemoteHeader())
+}
+
+// trustedProxies reads TRUSTED_PROXIES, the comma-separated addresses and
+// CIDR ranges of the reverse proxies whose X-Forwarded-For header is
+// believed. By default none are, and clients are told apart by the address
+// they connect from.
+func trustedProxies() utils.TrustedProxies {
+	proxies, err := utils.ParseTrustedProxies(utils.GetEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		utils.GetLogger().Error("ignoring TRUSTED_PROXIES", slog.Any("error", err))
+		return nil
+	}
+	return proxies
+}
+
+// submissionLimiter allows FINGERPRINT_SUBMISSIONS_PER_MINUTE submissions
+// per client address (30 by default), in bursts of up to 10.
+func submissionLimiter() *utils.RateLimiter {
+	perMinute, err := strconv.ParseFloat(utils.GetEnv("FINGERPRINT_SUBMISSIONS_PER_MINUTE", "30"), 64)
+	if err != nil || perMinute <= 0 {
+		perMinute = 30
+	}
+	return utils.NewRateLimiter(perMinute/60, 10)
+}
+
+// archiveRecordings reports whether ARCHIVE_RECORDINGS asks for recordings
+// to be kept under recordings/; by default nothing is written to disk.
+func archiveRecordings() bool {
+	archive, _ := strconv.ParseBool(utils.GetEnv("ARCHIVE_RECORDINGS", "false"))
+	return archive
+}
+
+// streamSession is the per-socket state of a streaming recognition, kept in
+// the socket context between startStream and the end of the session.
+type streamSession struct {
+	mu         sync.Mutex
+	requestID  string
+	recognizer *core.StreamRecognizer
+	channels   int
+}
+
+func handleStartStream(socket socketio.Conn, streamData string, dbClient db.DBClient) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	var req protocol.StartStreamRequest
+	if err := decodeRequest(streamData, &req, nil); err != nil {
+		logger.ErrorContext(ctx, "invalid stream payload", slog.Any("error", err))
+		emitRecognitionError(socket, "", protocol.ErrInvalidPayload, "Invalid stream request.")
+		return
+	}
+	if req.Channels < 1 {
+		req.Channels = 1
+	}
+
+	if dbClient == nil {
+		emitRecognitionError(socket, req.RequestID, protocol.ErrDatabaseUnavailable, dbUnavailableMessage)
+		return
+	}
+
+	recognizer, err := core.NewStreamRecognizer(req.SampleRate, dbClient, core.DefaultStreamOptions)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to start stream", slog.Any("error", err))
+		emitRecognitionError(socket, req.RequestID, protocol.ErrInvalidPayload, err.Error())
+		return
+	}
+
+	socket.SetContext(&streamSession{requestID: req.RequestID, recognizer: recognizer, channels: req.Channels})
+	emitProgress(socket, req.RequestID, protocol.StageReceived)
+}
+
+// activeStream returns the socket's stream session, or reports an error to
+// the client when there is none or requestID names a different stream.
+func activeStream(socket socketio.Conn, requestID string) (*streamSession, bool) {
+	session, ok := socket.Context().(*streamSession)
+	if !ok {
+		emitRecognitionError(socket, requestID, protocol.ErrNoActiveStream, "No stream is active; send startStream first.")
+		return nil, false
+	}
+	if requestID != "" && requestID != session.requestID {
+		emitRecognitionError(socket, requestID, protocol.ErrNoActiveStream,
+			fmt.Sprintf("Stream %q is not active.", requestID))
+		return nil, false
 	}
+	return session, true
+}
+
+// handleStreamChunk feeds one chunk of 16-bit PCM into the socket's session
+// and emits provisional matches after every rescore.
+func handleStreamChunk(socket socketio.Conn, data string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	var req protocol.StreamChunkRequest
+	if err := decodeRequest(data, &req, func(audio string) { req.Audio = audio }); err != nil {
+		emitRecognitionError(socket, "", protocol.ErrInvalidPayload, "Invalid stream chunk.")
+		return
+	}
+
+	session, ok := activeStream(socket, req.RequestID)
+	if !ok {
+		return
+	}
+	id := session.requestID
+
+	pcm, err := base64.StdEncoding.DecodeString(req.Audio)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to decode base64 chunk", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrDecodeFailed, "Chunk is not valid base64.")
+		return
+	}
+	samples, err := fileformat.WavBytesToSample(pcm)
+	if err != nil {
+		logger.ErrorContext(ctx, "invalid PCM chunk", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrDecodeFailed, "Chunk is not 16-bit PCM.")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	result, err := session.recognizer.Feed(downmix(samples, session.channels))
+	if err != nil {
+		logger.ErrorContext(ctx, "stream matching failed", slog.Any("error", err))
+		emitRecognitionError(socket, id, protocol.ErrMatchFailed, "Failed to search the catalogue.")
+		socket.SetContext("")
+		return
+	}
+	if result != nil {
+		emitStreamResult(socket, id, *result, "maxDuration")
+	}
+}
 
-	socket.Emit("matches", matches)
+func handleStopStream(socket socketio.Conn, data string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	var req protocol.StopStreamRequest
+	_ = decodeRequest(data, &req, func(string) {})
+
+	session, ok := activeStream(socket, req.RequestID)
+	if !ok {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	result, err := session.recognizer.Finish()
+	if err != nil {
+		logger.ErrorContext(ctx, "stream matching failed", slog.Any("error", err))
+		emitRecognitionError(socket, session.requestID, protocol.ErrMatchFailed, "Failed to search the catalogue.")
+		socket.SetContext("")
+		return
+	}
+	emitStreamResult(socket, session.requestID, result, "stopped")
+}
+
+// emitStreamResult sends the current matches and, once the session is done,
+// a streamEnded event telling the client it can stop recording.
+func emitStreamResult(socket socketio.Conn, requestID string, result core.StreamResult, doneReason string) {
+	if len(result.Matches) > 0 || result.Done {
+		emitMatches(socket, requestID, result.Matches, result.Done)
+	}
+
+	if !result.Done {
+		return
+	}
+
+	reason := doneReason
+	if result.Confident {
+		reason = "confident"
+	}
+	socket.Emit(protocol.EventStreamEnded, protocol.StreamEndedEvent{
+		RequestID:  requestID,
+		Reason:     reason,
+		Confident:  result.Confident,
+		DurationMs: result.Audio.Milliseconds(),
+	})
+	emitProgress(socket, requestID, protocol.StageDone)
+	socket.SetContext("")
 }
 
+// downmix averages interleaved channels into a mono signal.
+func downmix(samples []float64, channels int) []float64 {
+	if channels <= 1 {
+		return samples
+	}
 
+	mono := make([]float64, len(samples)/channels)
+	for i := range mono {
+		var sum float64
+		for c := 0; c < channels; c++ {
+			sum += samples[i*channels+c]
+		}
+		mono[i] = sum / float64(channels)
+	}
+	return mono
+}